@@ -0,0 +1,21 @@
+//go:build !windows
+
+// Command clip-autofs is an autofs program map mounting archives on first access, see clip autofs --help.
+// Install it as /etc/auto.clip, next to mount.clip.
+package main
+
+import (
+	"os"
+
+	"github.com/NilayYadav/clip/pkg/commands"
+)
+
+func main() {
+	rootCmd := commands.AutofsCmd
+	commands.Setup(rootCmd)
+
+	if err := rootCmd.Execute(); err != nil {
+		commands.PrintError(err)
+		os.Exit(1)
+	}
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"fmt"
 	"os"
 	"os/signal"
 
@@ -14,12 +13,26 @@ func main() {
 	rootCmd := &cobra.Command{
 		Use:   "clip",
 		Short: "A tool to create, extract, and mount clip archives",
+		Long: "A tool to create, extract, and mount clip archives.\n\n" +
+			"Flags can also be set with CLIP_<COMMAND>_<FLAG> and CLIP_<FLAG> environment variables, like CLIP_MOUNT_DISK_CACHE_DIR or " +
+			"CLIP_DISK_CACHE_DIR, and in a config file, see --config. The command line wins over the environment, which wins over the config file.",
 	}
 
 	rootCmd.AddCommand(commands.CreateCmd)
 	rootCmd.AddCommand(commands.ExtractCmd)
 	rootCmd.AddCommand(commands.StoreCmd)
 	rootCmd.AddCommand(commands.MountCmd)
+	rootCmd.AddCommand(commands.ProfileCmd)
+	rootCmd.AddCommand(commands.ServeCmd)
+	rootCmd.AddCommand(commands.RepackCmd)
+	rootCmd.AddCommand(commands.SubsetCmd)
+	rootCmd.AddCommand(commands.SyncCmd)
+	rootCmd.AddCommand(commands.LinkCmd)
+	rootCmd.AddCommand(commands.ExportCmd)
+	rootCmd.AddCommand(commands.GrepCmd)
+	rootCmd.AddCommand(commands.LsCmd)
+	addPlatformCommands(rootCmd)
+	commands.Setup(rootCmd)
 
 	// Setup signal catching
 	sigs := make(chan os.Signal, 1)
@@ -35,7 +48,7 @@ func main() {
 	// If an error occurs, it will appear here.
 	if err := rootCmd.Execute(); err != nil {
 		log.StopSpinner()
-		log.Fail(fmt.Sprintf("Failed to execute command: %v", err))
+		commands.PrintError(err)
 		os.Exit(1)
 	}
 }
@@ -0,0 +1,24 @@
+//go:build !windows
+
+// Command mount.clip is the mount(8) helper for clip archives, installed as /sbin/mount.clip so they can
+// be listed in /etc/fstab and mounted by systemd, see clip mount.clip --help. With x-systemd.automount
+// they are mounted on first access:
+//
+//	s3://images/app.rclip  /mnt/app  clip  ro,noauto,x-systemd.automount,cache=/var/cache/clip  0 0
+package main
+
+import (
+	"os"
+
+	"github.com/NilayYadav/clip/pkg/commands"
+)
+
+func main() {
+	rootCmd := commands.MountHelperCmd
+	commands.Setup(rootCmd)
+
+	if err := rootCmd.Execute(); err != nil {
+		commands.PrintError(err)
+		os.Exit(commands.ExitCode(err))
+	}
+}
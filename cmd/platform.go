@@ -0,0 +1,17 @@
+//go:build !windows
+
+package main
+
+import (
+	"github.com/NilayYadav/clip/pkg/commands"
+	"github.com/spf13/cobra"
+)
+
+// addPlatformCommands adds the commands that need Linux mounts, like the daemon and clip ctl
+func addPlatformCommands(rootCmd *cobra.Command) {
+	rootCmd.AddCommand(commands.DaemonCmd)
+	rootCmd.AddCommand(commands.BenchCmd)
+	rootCmd.AddCommand(commands.CtlCmd)
+	rootCmd.AddCommand(commands.SidecarCmd)
+	rootCmd.AddCommand(commands.AutofsCmd)
+}
@@ -0,0 +1,8 @@
+package main
+
+import (
+	"github.com/spf13/cobra"
+)
+
+// addPlatformCommands adds nothing on Windows, where mounts go through WinFSP
+func addPlatformCommands(rootCmd *cobra.Command) {}
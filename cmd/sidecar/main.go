@@ -0,0 +1,36 @@
+//go:build !windows
+
+// Command clip-sidecar mounts archives for the containers of a Kubernetes pod, see clip sidecar --help.
+// A native sidecar mounting an archive from S3 for the app container of a pod:
+//
+//	initContainers:
+//	  - name: clip
+//	    image: clip-sidecar
+//	    restartPolicy: Always
+//	    args: [--root=/clip, --archive=s3://images/app.rclip=app, --warm=app/bin]
+//	    securityContext: {privileged: true}
+//	    startupProbe: {httpGet: {path: /readyz, port: 8080}, periodSeconds: 1, failureThreshold: 600}
+//	    volumeMounts: [{name: clip, mountPath: /clip, mountPropagation: Bidirectional}]
+//	containers:
+//	  - name: app
+//	    volumeMounts: [{name: clip, mountPath: /clip, mountPropagation: HostToContainer}]
+//	volumes:
+//	  - {name: clip, emptyDir: {}}
+package main
+
+import (
+	"os"
+
+	"github.com/NilayYadav/clip/pkg/commands"
+)
+
+func main() {
+	rootCmd := commands.SidecarCmd
+	rootCmd.Use = "clip-sidecar"
+	commands.Setup(rootCmd)
+
+	if err := rootCmd.Execute(); err != nil {
+		commands.PrintError(err)
+		os.Exit(1)
+	}
+}
@@ -1,29 +1,33 @@
 package archive
 
 import (
+	"archive/zip"
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/cipher"
 	"crypto/sha256"
 	"encoding/binary"
 	"encoding/gob"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"hash/crc64"
 	"io"
-	"io/fs"
 	"os"
 	"path"
 	"path/filepath"
 	"strings"
 	"syscall"
+	"time"
 
-	"github.com/hanwen/go-fuse/v2/fuse"
 	log "github.com/okteto/okteto/pkg/log"
-	"golang.org/x/sys/unix"
 
 	common "github.com/NilayYadav/clip/pkg/common"
+	"github.com/NilayYadav/clip/pkg/storage"
 
 	"github.com/karrick/godirwalk"
+	"github.com/klauspost/compress/zstd"
 	"github.com/tidwall/btree"
 )
 
@@ -41,9 +45,42 @@ type ClipArchiverOptions struct {
 	SourcePath  string
 	OutputFile  string
 	OutputPath  string
+
+	PrefetchPaths []string // Paths or glob patterns of files to prefetch on mount
+	PrefetchAuto  bool     // Also prefetch files known to be read on startup, e.g. the python modules imported by site
+
+	ManifestPath string // Create the archive from the files a manifest lists instead of SourcePath, see ReadManifest
+	ZipPath      string // Create the archive from the entries of a zip file instead of SourcePath
+	SquashFSPath string // Create the archive from the tree of a SquashFS image instead of SourcePath
+	TarPath      string // Create the archive from a tar, gzipped or not, or standard input for -, instead of SourcePath
+
+	Rootfs bool              // Import TarPath as a container root filesystem, like docker export writes, see createFromTar
+	Labels map[string]string // Stored in the archive's attributes, see ImageConfig
+
+	Rewrites []PathRewrite // Path prefixes to move when extracting
+
+	PreserveSetuid bool // Keep setuid, setgid and sticky bits when extracting, they are cleared otherwise
+	AllowDevices   bool // Create device nodes when extracting, they are skipped otherwise
+
+	Reproducible    bool  // Make the archive depend only on the content, names and modes of the source files
+	SourceDateEpoch int64 // Timestamp of every file in reproducible archives
+
+	EncryptPaths  []string // Glob patterns of files to encrypt, see matchPathPattern
+	EncryptionKey []byte   // Key to encrypt files with, or to decrypt them when extracting
+
+	CheckpointPath string // Save progress here while creating, and resume from it if an earlier run was interrupted
+	SkipHashing    bool   // Don't hash file content, so files aren't deduplicated or kept in content caches when mounted
+	SearchIndex    bool   // Index the trigrams of text files, so content searches read only the files that may match
+	ContentTypes   bool   // Sniff the MIME type of each file, see contentType
+
+	sources    map[string]string // Source file of each node, set when creating from a manifest
+	checkpoint *createCheckpoint
+
+	open func(node *common.ClipNode) (io.ReadCloser, error) // Opens the content of each node, set when importing an archive
 }
 
 type ClipArchiver struct {
+	Limits ArchiveLimits // Enforced when reading archives
 }
 
 func NewClipArchiver() *ClipArchiver {
@@ -57,7 +94,9 @@ func (ca *ClipArchiver) newIndex() *btree.BTree {
 	return btree.New(compare)
 }
 
-// InodeGenerator generates unique inodes for each ClipNode
+// InodeGenerator generates unique inodes for each ClipNode. Inodes are assigned while walking the
+// source in sorted order, so the same tree always gets the same inodes and they're stored in the
+// index, which keeps (dev, ino) identity stable across remounts.
 type InodeGenerator struct {
 	current uint64
 }
@@ -72,157 +111,307 @@ func (ca *ClipArchiver) populateIndex(index *btree.BTree, sourcePath string) err
 	root := &common.ClipNode{
 		Path:     "/",
 		NodeType: common.DirNode,
-		Attr: fuse.Attr{
+		Attr: common.Attr{
 			Mode: uint32(os.ModeDir | 0755),
 		},
 	}
 	index.Set(root)
 
-	inodeGen := &InodeGenerator{current: 0}
-	inodeMap := make(map[string]uint64)
+	inodes := newInodeAssigner()
 
 	err := godirwalk.Walk(sourcePath, &godirwalk.Options{
 		Callback: func(path string, de *godirwalk.Dirent) error {
-			var target string = ""
-			var nodeType common.ClipNodeType
-
-			if de.IsDir() {
-				nodeType = common.DirNode
-			} else if de.IsSymlink() {
-				_target, err := os.Readlink(path)
-				if err != nil {
-					return fmt.Errorf("error reading symlink target %s: %v", path, err)
-				}
-				target = _target
-				nodeType = common.SymLinkNode
-			} else {
-				nodeType = common.FileNode
-			}
-
-			var stat unix.Stat_t
-			var err error
-			if nodeType == common.SymLinkNode {
-				err = unix.Lstat(path, &stat)
-			} else {
-				err = unix.Stat(path, &stat)
-			}
+			pathWithPrefix := filepath.Join("/", strings.TrimPrefix(path, sourcePath))
+			node, err := ca.sourceNode(path, pathWithPrefix, inodes)
 			if err != nil {
 				return err
 			}
+			index.Set(node)
 
-			var contentHash = ""
-			if nodeType == common.FileNode {
-				fileContent, err := os.ReadFile(path)
-				if err != nil {
-					return fmt.Errorf("failed to read file contents for hashing: %w", err)
-				}
+			return nil
+		},
+		Unsorted: false, // Inodes depend on the walk order
+	})
 
-				hash := sha256.Sum256(fileContent)
-				contentHash = hex.EncodeToString(hash[:])
-			}
+	return err
+}
 
-			// Determine the file mode and type
-			mode := uint32(stat.Mode & 0777) // preserve permission bits only
-			switch stat.Mode & unix.S_IFMT {
-			case unix.S_IFDIR:
-				mode |= syscall.S_IFDIR
-			case unix.S_IFLNK:
-				mode |= syscall.S_IFLNK
-			case unix.S_IFREG:
-				mode |= syscall.S_IFREG
-			default:
-				// Handle other types if needed
-				mode |= syscall.S_IFREG
-			}
-			// Assign a unique inode
-			var inode uint64
-			if existingInode, exists := inodeMap[path]; exists {
-				inode = existingInode
-			} else {
-				inode = inodeGen.Next()
-				inodeMap[path] = inode
-			}
+// inodeAssigner hands out archive inodes for source files, so hard links share an inode
+type inodeAssigner struct {
+	gen      *InodeGenerator
+	inodeMap map[[2]uint64]uint64 // Keyed by source (dev, ino)
+}
 
-			attr := fuse.Attr{
-				Ino:       inode,
-				Size:      uint64(stat.Size),
-				Blocks:    uint64(stat.Blocks),
-				Atime:     uint64(stat.Atim.Sec),
-				Atimensec: uint32(stat.Atim.Nsec),
-				Mtime:     uint64(stat.Mtim.Sec),
-				Mtimensec: uint32(stat.Mtim.Nsec),
-				Ctime:     uint64(stat.Ctim.Sec),
-				Ctimensec: uint32(stat.Ctim.Nsec),
-				Mode:      mode,
-				Nlink:     uint32(stat.Nlink),
-				Owner: fuse.Owner{
-					Uid: stat.Uid,
-					Gid: stat.Gid,
-				},
-			}
+func newInodeAssigner() *inodeAssigner {
+	return &inodeAssigner{gen: &InodeGenerator{current: 0}, inodeMap: make(map[[2]uint64]uint64)}
+}
 
-			pathWithPrefix := filepath.Join("/", strings.TrimPrefix(path, sourcePath))
-			index.Set(&common.ClipNode{Path: pathWithPrefix, NodeType: nodeType, Attr: attr, Target: target, ContentHash: contentHash})
+// sourceNode creates the node for the source file at path, stored at archivePath in the archive
+func (ca *ClipArchiver) sourceNode(path string, archivePath string, inodes *inodeAssigner) (*common.ClipNode, error) {
+	stat, err := lstat(path)
+	if err != nil {
+		return nil, err
+	}
 
-			return nil
+	var target string = ""
+	var nodeType common.ClipNodeType
+
+	switch stat.mode & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		nodeType = common.DirNode
+	case syscall.S_IFLNK:
+		_target, err := os.Readlink(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading symlink target %s: %v", path, err)
+		}
+		target = _target
+		nodeType = common.SymLinkNode
+	case syscall.S_IFCHR, syscall.S_IFBLK, syscall.S_IFIFO, syscall.S_IFSOCK:
+		// Don't try to read device nodes, fifos or sockets, only their mode and rdev are archived
+		nodeType = common.SpecialNode
+	default:
+		nodeType = common.FileNode
+	}
+
+	// Determine the file mode and type
+	mode := stat.mode & 0777 // preserve permission bits only
+	switch stat.mode & syscall.S_IFMT {
+	case syscall.S_IFDIR, syscall.S_IFLNK, syscall.S_IFREG, syscall.S_IFCHR, syscall.S_IFBLK, syscall.S_IFIFO, syscall.S_IFSOCK:
+		mode |= stat.mode & syscall.S_IFMT
+	default:
+		// Handle other types if needed
+		mode |= syscall.S_IFREG
+	}
+	// Assign a unique inode
+	var inode uint64
+	sourceIno := [2]uint64{stat.dev, stat.ino}
+	if existingInode, exists := inodes.inodeMap[sourceIno]; exists && nodeType != common.DirNode {
+		inode = existingInode
+	} else {
+		inode = inodes.gen.Next()
+		inodes.inodeMap[sourceIno] = inode
+	}
+
+	attr := common.Attr{
+		Ino:       inode,
+		Size:      stat.size,
+		Blocks:    stat.blocks,
+		Atime:     uint64(stat.atime.Unix()),
+		Atimensec: uint32(stat.atime.Nanosecond()),
+		Mtime:     uint64(stat.mtime.Unix()),
+		Mtimensec: uint32(stat.mtime.Nanosecond()),
+		Ctime:     uint64(stat.ctime.Unix()),
+		Ctimensec: uint32(stat.ctime.Nanosecond()),
+		Mode:      mode,
+		Nlink:     stat.nlink,
+		Rdev:      stat.rdev,
+		Owner: common.Owner{
+			Uid: stat.uid,
+			Gid: stat.gid,
 		},
-		Unsorted: false,
-	})
+	}
+
+	return &common.ClipNode{Path: archivePath, NodeType: nodeType, Attr: attr, Target: target}, nil
+}
+
+// sourceFile returns the file the content of node is read from
+func sourceFile(node *common.ClipNode, opts ClipArchiverOptions) string {
+	if source, exists := opts.sources[node.Path]; exists {
+		return source
+	}
+	return path.Join(opts.SourcePath, node.Path)
+}
+
+// openSource opens the content of node
+func openSource(node *common.ClipNode, opts ClipArchiverOptions) (io.ReadCloser, error) {
+	if opts.open != nil {
+		return opts.open(node)
+	}
+	return os.Open(sourceFile(node, opts))
+}
+
+// hashContent sets the content hash of every file in the index. With opts.SkipHashing only files
+// encrypted in a reproducible archive are hashed, their IVs are derived from the hash.
+func (ca *ClipArchiver) hashContent(index *btree.BTree, opts ClipArchiverOptions) error {
+	var err error
+	index.Ascend(index.Min(), func(a interface{}) bool {
+		node := a.(*common.ClipNode)
+		if node.NodeType != common.FileNode {
+			return true
+		}
+		if opts.SkipHashing && !(opts.Reproducible && encryptedPath(opts, node.Path)) {
+			return true
+		}
+
+		var f io.ReadCloser
+		if f, err = openSource(node, opts); err != nil {
+			err = fmt.Errorf("failed to read file contents for hashing: %w", err)
+			return false
+		}
+		defer f.Close()
 
+		hash := sha256.New()
+		if _, err = io.Copy(hash, f); err != nil {
+			err = fmt.Errorf("failed to read file contents for hashing: %w", err)
+			return false
+		}
+		node.ContentHash = hex.EncodeToString(hash.Sum(nil))
+		return true
+	})
 	return err
 }
 
 func (ca *ClipArchiver) Create(opts ClipArchiverOptions) error {
-	outFile, err := os.Create(opts.OutputFile)
+	flags := os.O_RDWR | os.O_CREATE | os.O_TRUNC
+	if opts.CheckpointPath != "" && (opts.ZipPath != "" || opts.SquashFSPath != "" || opts.TarPath != "") {
+		return fmt.Errorf("imported archives can't be resumed")
+	}
+	if opts.CheckpointPath != "" {
+		// Keep the data written by an interrupted run until the checkpoint has been checked
+		flags &^= os.O_TRUNC
+
+		var err error
+		if opts.checkpoint, err = ca.loadCheckpoint(opts); err != nil {
+			return err
+		}
+	}
+
+	outFile, err := os.OpenFile(opts.OutputFile, flags, 0666)
 	if err != nil {
 		return err
 	}
 	defer outFile.Close()
 
+	if opts.TarPath != "" {
+		return ca.createFromTar(outFile, opts)
+	}
+	if opts.Rootfs {
+		return fmt.Errorf("root filesystems can only be imported from a tar")
+	}
+
 	// Create a new index for the archive
 	index := ca.newIndex()
 
-	err = ca.populateIndex(index, opts.SourcePath)
-	if err != nil {
+	if opts.ManifestPath != "" {
+		entries, err := ReadManifest(opts.ManifestPath)
+		if err != nil {
+			return err
+		}
+		if opts.sources, err = ca.populateIndexFromManifest(index, entries); err != nil {
+			return err
+		}
+	} else if opts.ZipPath != "" {
+		zr, err := zip.OpenReader(opts.ZipPath)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		if err := ca.populateIndexFromZip(index, &zr.Reader, &opts); err != nil {
+			return err
+		}
+	} else if opts.SquashFSPath != "" {
+		image, err := os.Open(opts.SquashFSPath)
+		if err != nil {
+			return err
+		}
+		defer image.Close()
+		if err := ca.populateIndexFromSquashFS(index, image, &opts); err != nil {
+			return err
+		}
+	} else if err := ca.populateIndex(index, opts.SourcePath); err != nil {
 		return err
 	}
 
-	// Prepare and write placeholder for the header
-	var storageType [12]byte
-	copy(storageType[:], []byte(""))
-	header := common.ClipArchiveHeader{
-		ClipFileFormatVersion: common.ClipFileFormatVersion,
-		IndexLength:           0,
-		StorageInfoLength:     0,
-		StorageInfoPos:        0,
-		StorageInfoType:       storageType,
+	if err := ca.hashContent(index, opts); err != nil {
+		return err
 	}
-	copy(header.StartBytes[:], common.ClipFileStartBytes)
 
-	headerPos, err := outFile.Seek(0, io.SeekCurrent) // Get current position
-	if err != nil {
-		return err
+	if opts.checkpoint != nil {
+		opts.checkpoint.prepare(index)
 	}
 
-	// Write placeholder bytes for the header
-	if _, err := outFile.Write(make([]byte, common.ClipHeaderLength)); err != nil {
+	if opts.Reproducible {
+		ca.normalizeAttrs(index, opts.SourceDateEpoch)
+	}
+
+	if err := ca.markEncrypted(index, opts); err != nil {
 		return err
 	}
 
+	if opts.ContentTypes {
+		if err := ca.detectContentTypes(index, opts); err != nil {
+			return err
+		}
+	}
+
+	attributes := common.ClipArchiveAttributes{
+		PrefetchPaths: ca.prefetchPaths(index, opts),
+		Labels:        opts.Labels,
+	}
+	if len(opts.EncryptPaths) > 0 {
+		attributes.EncryptionKeyID = common.EncryptionKeyID(opts.EncryptionKey)
+	}
+	if opts.SearchIndex {
+		if attributes.SearchIndex, err = ca.buildSearchIndex(index, opts); err != nil {
+			return err
+		}
+	}
+
+	var initialOffset int64
+	if opts.checkpoint != nil {
+		if initialOffset, err = opts.checkpoint.resume(index, outFile); err != nil {
+			return err
+		}
+	}
+
+	if initialOffset == 0 {
+		if err := outFile.Truncate(0); err != nil {
+			return err
+		}
+
+		// Write placeholder bytes for the header
+		if _, err := outFile.Write(make([]byte, common.ClipHeaderLength)); err != nil {
+			return err
+		}
+		initialOffset = int64(common.ClipHeaderLength)
+	}
+
 	// Write data blocks
-	var initialOffset int64 = int64(common.ClipHeaderLength)
 	err = ca.writeBlocks(index, opts.SourcePath, outFile, initialOffset, opts)
 	if err != nil {
 		return err
 	}
 
+	if err := ca.writeIndexAndHeader(outFile, index, attributes); err != nil {
+		return err
+	}
+
+	if opts.checkpoint != nil {
+		os.Remove(opts.CheckpointPath)
+	}
+	return nil
+}
+
+// writeIndexAndHeader finishes a local archive whose data blocks have been written after a placeholder header
+func (ca *ClipArchiver) writeIndexAndHeader(outFile *os.File, index *btree.BTree, attributes common.ClipArchiveAttributes) error {
+	var storageType [11]byte
+	copy(storageType[:], []byte(""))
+	header := common.ClipArchiveHeader{
+		ClipFileFormatVersion: common.ClipFileFormatVersion,
+		IndexLength:           0,
+		StorageInfoLength:     0,
+		StorageInfoPos:        0,
+		StorageInfoType:       storageType,
+	}
+	copy(header.StartBytes[:], common.ClipFileStartBytes)
+
 	// Write the actual index data
 	indexPos, err := outFile.Seek(0, io.SeekCurrent) // Get current position
 	if err != nil {
 		return err
 	}
 
-	indexBytes, err := ca.EncodeIndex(index)
+	indexBytes, err := ca.encodeIndexSection(index, attributes, &header)
 	if err != nil {
 		return err
 	}
@@ -240,7 +429,7 @@ func (ca *ClipArchiver) Create(opts ClipArchiverOptions) error {
 		return err
 	}
 
-	_, err = outFile.Seek(headerPos, os.SEEK_SET) // Go back to header position
+	_, err = outFile.Seek(0, os.SEEK_SET) // Go back to header position
 	if err != nil {
 		return err
 	}
@@ -260,7 +449,7 @@ func (ca *ClipArchiver) CreateRemoteArchive(storageInfo common.ClipStorageInfo,
 	defer outFile.Close()
 
 	// Prepare and write placeholder for the header
-	var storageType [12]byte
+	var storageType [11]byte
 	copy(storageType[:], []byte(storageInfo.Type()))
 
 	header := common.ClipArchiveHeader{
@@ -288,7 +477,7 @@ func (ca *ClipArchiver) CreateRemoteArchive(storageInfo common.ClipStorageInfo,
 		return err
 	}
 
-	indexBytes, err := ca.EncodeIndex(metadata.Index)
+	indexBytes, err := ca.encodeIndexSection(metadata.Index, metadata.Attributes, &header)
 	if err != nil {
 		return err
 	}
@@ -348,16 +537,109 @@ func (ca *ClipArchiver) CreateRemoteArchive(storageInfo common.ClipStorageInfo,
 	return nil
 }
 
+// UpdateAttributes replaces the attributes of an existing archive in place. The index section is
+// rewritten, along with the storage info that follows it in rclips.
+func (ca *ClipArchiver) UpdateAttributes(archivePath string, attributes common.ClipArchiveAttributes) error {
+	metadata, err := ca.ExtractMetadata(archivePath)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(archivePath, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	header := metadata.Header
+
+	var storageInfoBytes []byte
+	if header.StorageInfoLength > 0 {
+		storageInfoBytes = make([]byte, header.StorageInfoLength)
+		if _, err := f.ReadAt(storageInfoBytes, header.StorageInfoPos); err != nil {
+			return fmt.Errorf("error reading storage info: %v", err)
+		}
+	}
+
+	indexBytes, err := ca.encodeIndexSection(metadata.Index, attributes, &header)
+	if err != nil {
+		return err
+	}
+
+	if err := f.Truncate(header.IndexPos); err != nil {
+		return err
+	}
+
+	if _, err := f.WriteAt(indexBytes, header.IndexPos); err != nil {
+		return err
+	}
+	header.IndexLength = int64(len(indexBytes))
+
+	if storageInfoBytes != nil {
+		header.StorageInfoPos = header.IndexPos + header.IndexLength
+		if _, err := f.WriteAt(storageInfoBytes, header.StorageInfoPos); err != nil {
+			return err
+		}
+	}
+
+	headerBytes, err := ca.EncodeHeader(&header)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.WriteAt(headerBytes, 0)
+	return err
+}
+
 func (ca *ClipArchiver) ExtractMetadata(archivePath string) (*common.ClipArchiveMetadata, error) {
 	file, err := os.Open(archivePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, common.NewError(err.Error(), err, common.ErrNotFound)
+	}
 	if err != nil {
 		return nil, err
 	}
 	defer file.Close()
 
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	return ca.readMetadata(file, info.Size())
+}
+
+// ExtractRemoteMetadata reads the header and index of an archive held in remote storage at info,
+// without downloading its data. The metadata gets info as its storage info, as if read from an rclip.
+func (ca *ClipArchiver) ExtractRemoteMetadata(ctx context.Context, remote storage.RemoteArchive, info common.ClipStorageInfo) (*common.ClipArchiveMetadata, error) {
+	r := &remoteReaderAt{ctx: ctx, remote: remote}
+
+	headerBytes := make([]byte, common.ClipHeaderLength)
+	if _, err := r.ReadAt(headerBytes, 0); err != nil {
+		return nil, common.ErrFileHeaderMismatch
+	}
+	header, err := ca.DecodeHeader(headerBytes)
+	if err != nil {
+		return nil, common.ErrFileHeaderMismatch
+	}
+	if header.StorageInfoLength > 0 {
+		return nil, fmt.Errorf("remote archive is an RCLIP, use the archive it points at")
+	}
+
+	// The size of the object isn't known, but archives end with their index
+	metadata, err := ca.readMetadata(r, header.IndexPos+header.IndexLength)
+	if err != nil {
+		return nil, err
+	}
+	metadata.StorageInfo = info
+	return metadata, nil
+}
+
+// readMetadata decodes the header, index and storage info of an archive of size bytes
+func (ca *ClipArchiver) readMetadata(file io.ReaderAt, size int64) (*common.ClipArchiveMetadata, error) {
 	// Read and decode the header
 	headerBytes := make([]byte, common.ClipHeaderLength)
-	if _, err := io.ReadFull(file, headerBytes); err != nil {
+	if _, err := file.ReadAt(headerBytes, 0); err != nil {
 		return nil, common.ErrFileHeaderMismatch
 	}
 
@@ -367,29 +649,30 @@ func (ca *ClipArchiver) ExtractMetadata(archivePath string) (*common.ClipArchive
 		return nil, common.ErrFileHeaderMismatch
 	}
 
-	// Verify the header
-	if !bytes.Equal(header.StartBytes[:], common.ClipFileStartBytes) || header.ClipFileFormatVersion != common.ClipFileFormatVersion {
-		return nil, common.ErrFileHeaderMismatch
+	if err := CheckHeader(header); err != nil {
+		return nil, err
 	}
 
-	// Seek to the correct position for the index
-	_, err = file.Seek(header.IndexPos, 0)
-	if err != nil {
-		return nil, fmt.Errorf("error seeking to index: %v", err)
+	if err := ca.checkSection("index", header.IndexPos, header.IndexLength, size); err != nil {
+		return nil, err
+	}
+	if err := ca.checkSection("storage info", header.StorageInfoPos, header.StorageInfoLength, size); err != nil {
+		return nil, err
 	}
 
 	// Read and decode the index
 	indexBytes := make([]byte, header.IndexLength)
-	if _, err := io.ReadFull(file, indexBytes); err != nil {
+	if _, err := file.ReadAt(indexBytes, header.IndexPos); err != nil {
 		return nil, fmt.Errorf("error reading index: %v", err)
 	}
 
-	indexReader := bytes.NewReader(indexBytes)
-	indexDec := gob.NewDecoder(indexReader)
+	nodes, attributes, err := ca.decodeIndexSection(header, indexBytes)
+	if err != nil {
+		return nil, err
+	}
 
-	var nodes []*common.ClipNode
-	if err := indexDec.Decode(&nodes); err != nil {
-		return nil, fmt.Errorf("error decoding index: %v", err)
+	if err := ca.checkNodes(nodes); err != nil {
+		return nil, err
 	}
 
 	index := ca.newIndex()
@@ -400,13 +683,8 @@ func (ca *ClipArchiver) ExtractMetadata(archivePath string) (*common.ClipArchive
 	var storageInfo common.ClipStorageInfo
 	if header.StorageInfoLength > 0 {
 		// Read and decode the storage info
-		_, err = file.Seek(header.StorageInfoPos, 0)
-		if err != nil {
-			return nil, fmt.Errorf("error seeking to storage info: %v", err)
-		}
-
 		storageBytes := make([]byte, header.StorageInfoLength)
-		if _, err := io.ReadFull(file, storageBytes); err != nil {
+		if _, err := file.ReadAt(storageBytes, header.StorageInfoPos); err != nil {
 			return nil, fmt.Errorf("error reading storage info: %v", err)
 		}
 
@@ -415,18 +693,17 @@ func (ca *ClipArchiver) ExtractMetadata(archivePath string) (*common.ClipArchive
 
 		var wrapper common.StorageInfoWrapper
 		if err := storageDec.Decode(&wrapper); err != nil {
-			return nil, fmt.Errorf("error decoding storage info: %v", err)
+			return nil, fmt.Errorf("%w: error decoding storage info: %v", common.ErrCorruptArchive, err)
 		}
 
-		switch wrapper.Type {
-		case "s3":
-			var s3Info common.S3StorageInfo
-			if err := gob.NewDecoder(bytes.NewReader(wrapper.Data)).Decode(&s3Info); err != nil {
-				return nil, fmt.Errorf("error decoding s3 storage info: %v", err)
-			}
-			storageInfo = s3Info
-		default:
-			return nil, fmt.Errorf("unsupported storage info type: %s", wrapper.Type)
+		backend, err := storage.GetBackend(wrapper.Type)
+		if err != nil {
+			return nil, err
+		}
+
+		storageInfo, err = backend.DecodeStorageInfo(wrapper.Data)
+		if err != nil {
+			return nil, err
 		}
 	}
 
@@ -434,58 +711,41 @@ func (ca *ClipArchiver) ExtractMetadata(archivePath string) (*common.ClipArchive
 		Index:       index,
 		Header:      *header,
 		StorageInfo: storageInfo,
+		Attributes:  attributes,
 	}, nil
 }
 
-func (ca *ClipArchiver) Extract(opts ClipArchiverOptions) error {
-	file, err := os.Open(opts.ArchivePath)
+func (ca *ClipArchiver) Extract(opts ClipArchiverOptions) (*ExtractStats, error) {
+	metadata, err := ca.ExtractMetadata(opts.ArchivePath)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer file.Close()
-	os.MkdirAll(opts.OutputPath, 0755)
 
-	// Read and decode the header
-	headerBytes := make([]byte, common.ClipHeaderLength)
-	if _, err := io.ReadFull(file, headerBytes); err != nil {
-		return common.ErrFileHeaderMismatch
+	if err := CheckEncryptionKey(metadata.Attributes, opts.EncryptionKey); err != nil {
+		return nil, err
 	}
 
-	// Decode the header
-	header, err := ca.DecodeHeader(headerBytes)
-	if err != nil {
-		return common.ErrFileHeaderMismatch
+	if err := ca.RewritePaths(metadata, opts.Rewrites); err != nil {
+		return nil, err
 	}
+	index := metadata.Index
 
-	// Verify the header
-	if !bytes.Equal(header.StartBytes[:], common.ClipFileStartBytes) || header.ClipFileFormatVersion != common.ClipFileFormatVersion {
-		return common.ErrFileHeaderMismatch
+	if err := ca.checkExtractSize(index); err != nil {
+		return nil, err
 	}
 
-	// Seek to the correct position for the index
-	_, err = file.Seek(header.IndexPos, 0)
+	file, err := os.Open(opts.ArchivePath)
 	if err != nil {
-		return fmt.Errorf("error seeking to index: %v", err)
+		return nil, err
 	}
+	defer file.Close()
+	os.MkdirAll(opts.OutputPath, 0755)
 
-	// Read and decode the index
-	indexBytes := make([]byte, header.IndexLength)
-	if _, err := io.ReadFull(file, indexBytes); err != nil {
-		return fmt.Errorf("error reading index: %v", err)
+	if err := ca.checkExtractPaths(index); err != nil {
+		return nil, err
 	}
 
-	indexReader := bytes.NewReader(indexBytes)
-	indexDec := gob.NewDecoder(indexReader)
-
-	var nodes []*common.ClipNode
-	if err := indexDec.Decode(&nodes); err != nil {
-		return fmt.Errorf("error decoding index: %v", err)
-	}
-
-	index := ca.newIndex()
-	for _, node := range nodes {
-		index.Set(node)
-	}
+	stats := &ExtractStats{}
 
 	// Iterate over the index and extract every node
 	index.Ascend(index.Min(), func(a interface{}) bool {
@@ -495,43 +755,36 @@ func (ca *ClipArchiver) Extract(opts ClipArchiverOptions) error {
 			log.Spinner(fmt.Sprintf("Extracting... %s", node.Path))
 		}
 
-		if node.NodeType == common.FileNode {
-			// Seek to the position of the file in the archive
-			_, err := file.Seek(node.DataPos, 0)
-			if err != nil {
-				log.Printf("error seeking to file %s: %v", node.Path, err)
-				return false
-			}
+		err = ca.extractNode(file, node, opts, stats)
+		return err == nil
+	})
+	if err != nil {
+		return nil, err
+	}
 
-			// Open the output file
-			outFile, err := os.Create(path.Join(opts.OutputPath, node.Path))
-			if err != nil {
-				if opts.Verbose {
-					log.Printf("error creating file %s: %v", node.Path, err)
-				}
-				return false
-			}
-			defer outFile.Close()
+	// Restore modes and timestamps once everything is written, children first since creating
+	// entries in a directory changes its mtime and a read-only directory can't be written to
+	index.Descend(index.Max(), func(a interface{}) bool {
+		node := a.(*common.ClipNode)
+		outputPath := filepath.Join(opts.OutputPath, node.Path)
 
-			// Copy the data from the archive to the output file
-			_, err = io.CopyN(outFile, file, node.DataLen)
-			if err != nil {
-				if opts.Verbose {
-					log.Printf("error extracting file %s: %v", node.Path, err)
-				}
-				return false
+		if node.IsDir() && node.Path != "/" {
+			if err := chmod(outputPath, extractMode(node, opts)); err != nil && opts.Verbose {
+				log.Printf("error setting mode of %s: %v", node.Path, err)
 			}
+		}
 
-		} else if node.NodeType == common.DirNode {
-			os.MkdirAll(path.Join(opts.OutputPath, node.Path), fs.FileMode(node.Attr.Mode))
-		} else if node.NodeType == common.SymLinkNode {
-			os.Symlink(node.Target, path.Join(opts.OutputPath, node.Path))
+		atime := time.Unix(int64(node.Attr.Atime), int64(node.Attr.Atimensec))
+		mtime := time.Unix(int64(node.Attr.Mtime), int64(node.Attr.Mtimensec))
+		err := lchtimes(outputPath, atime, mtime)
+		if err != nil && opts.Verbose {
+			log.Printf("error setting times of %s: %v", node.Path, err)
 		}
 
 		return true
 	})
 
-	return nil
+	return stats, nil
 }
 
 func (ca *ClipArchiver) writeBlocks(index *btree.BTree, sourcePath string, outFile *os.File, offset int64, opts ClipArchiverOptions) error {
@@ -575,20 +828,52 @@ func (ca *ClipArchiver) writeBlocks(index *btree.BTree, sourcePath string, outFi
 		return true
 	})
 
+	// Files with the same content share the block written for the first of them
+	written := make(map[string]*common.ClipNode)
+	index.Ascend(index.Min(), func(a interface{}) bool {
+		if node := a.(*common.ClipNode); opts.checkpoint.restored(node) && node.ContentHash != "" {
+			written[node.ContentHash] = node
+		}
+		return true
+	})
+	shared := func(node *common.ClipNode) bool {
+		first, exists := written[node.ContentHash]
+		if !exists || node.ContentHash == "" {
+			return false
+		}
+		node.DataPos, node.DataLen = first.DataPos, first.DataLen
+		return true
+	}
+
+	// Blocks already written before a resumed run was interrupted are kept
+	pending := func(node *common.ClipNode) bool {
+		return node.NodeType == common.FileNode && !opts.checkpoint.restored(node) && !shared(node)
+	}
+
 	// Process priority nodes first
 	for _, node := range priorityNodes {
-		if node.NodeType == common.FileNode {
-			if !ca.processNode(node, writer, sourcePath, &pos, opts) {
-				return fmt.Errorf("error processing priority node %s", node.Path)
+		if pending(node) {
+			if !ca.processNode(node, writer, &pos, opts) {
+				return ca.failBlocks(writer, outFile, opts, fmt.Errorf("error processing priority node %s", node.Path))
+			}
+			written[node.ContentHash] = node
+			opts.checkpoint.record(node)
+			if err := opts.checkpoint.maybeSave(writer, outFile); err != nil {
+				return err
 			}
 		}
 	}
 
 	// Process other nodes
 	for _, node := range otherNodes {
-		if node.NodeType == common.FileNode {
-			if !ca.processNode(node, writer, sourcePath, &pos, opts) {
-				return fmt.Errorf("error processing other node %s", node.Path)
+		if pending(node) {
+			if !ca.processNode(node, writer, &pos, opts) {
+				return ca.failBlocks(writer, outFile, opts, fmt.Errorf("error processing other node %s", node.Path))
+			}
+			written[node.ContentHash] = node
+			opts.checkpoint.record(node)
+			if err := opts.checkpoint.maybeSave(writer, outFile); err != nil {
+				return err
 			}
 		}
 	}
@@ -596,12 +881,23 @@ func (ca *ClipArchiver) writeBlocks(index *btree.BTree, sourcePath string, outFi
 	return nil
 }
 
-func (ca *ClipArchiver) processNode(node *common.ClipNode, writer *bufio.Writer, sourcePath string, pos *int64, opts ClipArchiverOptions) bool {
+// failBlocks saves the checkpoint, if any, before giving up on writing blocks so a later run
+// resumes from the last file written
+func (ca *ClipArchiver) failBlocks(writer *bufio.Writer, outFile *os.File, opts ClipArchiverOptions, err error) error {
+	if opts.checkpoint != nil {
+		if saveErr := opts.checkpoint.save(writer, outFile); saveErr != nil {
+			log.Printf("%v", saveErr)
+		}
+	}
+	return err
+}
+
+func (ca *ClipArchiver) processNode(node *common.ClipNode, writer *bufio.Writer, pos *int64, opts ClipArchiverOptions) bool {
 	if opts.Verbose {
 		log.Spinner(fmt.Sprintf("Archiving... %s", node.Path))
 	}
 
-	f, err := os.Open(path.Join(sourcePath, node.Path))
+	f, err := openSource(node, opts)
 	if err != nil {
 		log.Printf("error opening source file %s: %v", node.Path, err)
 		return false
@@ -627,7 +923,17 @@ func (ca *ClipArchiver) processNode(node *common.ClipNode, writer *bufio.Writer,
 	node.DataPos = *pos
 
 	// Create a multi-writer that writes to both the checksum and the writer
-	multi := io.MultiWriter(hash, writer)
+	var multi io.Writer = io.MultiWriter(hash, writer)
+
+	// The checksum covers the data as stored, so encrypted files are checked without the key
+	if node.IsEncrypted() {
+		stream, err := common.NewContentCipher(opts.EncryptionKey, node.IV, 0)
+		if err != nil {
+			log.Printf("error encrypting file %s: %v", node.Path, err)
+			return false
+		}
+		multi = &cipher.StreamWriter{S: stream, W: multi}
+	}
 
 	// Use io.Copy to simultaneously write the file to the output and update the checksum
 	copied, err := io.Copy(multi, f)
@@ -673,7 +979,21 @@ func (ca *ClipArchiver) DecodeHeader(headerBytes []byte) (*common.ClipArchiveHea
 	return header, nil
 }
 
-func (ca *ClipArchiver) EncodeIndex(index *btree.BTree) ([]byte, error) {
+// CheckHeader makes sure a decoded header is the header of an archive this version of clip reads
+func CheckHeader(header *common.ClipArchiveHeader) error {
+	if !bytes.Equal(header.StartBytes[:], common.ClipFileStartBytes) {
+		return common.ErrFileHeaderMismatch
+	}
+	if header.ClipFileFormatVersion < common.ClipFileFormatVersionMin || header.ClipFileFormatVersion > common.ClipFileFormatVersion {
+		return fmt.Errorf("%w %d, expected %d to %d", common.ErrUnsupportedVersion, header.ClipFileFormatVersion, common.ClipFileFormatVersionMin, common.ClipFileFormatVersion)
+	}
+	if unknown := header.Flags &^ common.ClipHeaderKnownFlags; unknown != 0 {
+		return fmt.Errorf("%w %d, with unknown flags %#x", common.ErrUnsupportedVersion, header.ClipFileFormatVersion, unknown)
+	}
+	return nil
+}
+
+func (ca *ClipArchiver) EncodeIndex(index *btree.BTree, attributes common.ClipArchiveAttributes) ([]byte, error) {
 	var nodes []*common.ClipNode
 	index.Ascend(index.Min(), func(a interface{}) bool {
 		nodes = append(nodes, a.(*common.ClipNode))
@@ -686,5 +1006,64 @@ func (ca *ClipArchiver) EncodeIndex(index *btree.BTree) ([]byte, error) {
 		return nil, err
 	}
 
+	if err := enc.Encode(attributes); err != nil {
+		return nil, err
+	}
+
 	return buf.Bytes(), nil
 }
+
+// encodeIndexSection encodes the index as it's written to archives, compressed, and flags the header accordingly
+func (ca *ClipArchiver) encodeIndexSection(index *btree.BTree, attributes common.ClipArchiveAttributes, header *common.ClipArchiveHeader) ([]byte, error) {
+	indexBytes, err := ca.EncodeIndex(index, attributes)
+	if err != nil {
+		return nil, err
+	}
+
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		return nil, err
+	}
+	defer enc.Close()
+
+	// Older clip reads the version, not the flags
+	header.ClipFileFormatVersion = common.ClipFileFormatVersion
+	header.Flags |= common.ClipHeaderFlagCompressedIndex
+	return enc.EncodeAll(indexBytes, nil), nil
+}
+
+// decodeIndexSection decodes the nodes and attributes of an index section, compressed or not
+func (ca *ClipArchiver) decodeIndexSection(header *common.ClipArchiveHeader, indexBytes []byte) ([]*common.ClipNode, common.ClipArchiveAttributes, error) {
+	var attributes common.ClipArchiveAttributes
+
+	if header.Flags&common.ClipHeaderFlagCompressedIndex != 0 {
+		var decOpts []zstd.DOption
+		if ca.Limits.MaxMetadataSize > 0 {
+			decOpts = append(decOpts, zstd.WithDecoderMaxMemory(uint64(ca.Limits.MaxMetadataSize)))
+		}
+		dec, err := zstd.NewReader(nil, decOpts...)
+		if err != nil {
+			return nil, attributes, err
+		}
+		defer dec.Close()
+
+		indexBytes, err = dec.DecodeAll(indexBytes, nil)
+		if err != nil {
+			return nil, attributes, fmt.Errorf("error decompressing index: %v", err)
+		}
+	}
+
+	indexDec := gob.NewDecoder(bytes.NewReader(indexBytes))
+
+	var nodes []*common.ClipNode
+	if err := indexDec.Decode(&nodes); err != nil {
+		return nil, attributes, fmt.Errorf("%w: error decoding index: %v", common.ErrCorruptArchive, err)
+	}
+
+	// Archives created before attributes existed end right after the nodes
+	if err := indexDec.Decode(&attributes); err != nil && err != io.EOF {
+		return nil, attributes, fmt.Errorf("%w: error decoding archive attributes: %v", common.ErrCorruptArchive, err)
+	}
+
+	return nodes, attributes, nil
+}
@@ -0,0 +1,238 @@
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/crc64"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	common "github.com/NilayYadav/clip/pkg/common"
+	log "github.com/okteto/okteto/pkg/log"
+	"github.com/tidwall/btree"
+)
+
+// How often the progress of a resumable Create is saved
+const checkpointInterval = time.Second * 10
+
+// Checkpoints are JSON rather than gob: gob numbers types in the order a process first encodes
+// them, so a gob checkpoint would change the encoding of the index of reproducible archives.
+
+// createCheckpoint records the data blocks a Create has written, so an interrupted run can keep
+// them instead of starting over. Only blocks known to be on disk are recorded: the output is synced
+// before every save.
+type createCheckpoint struct {
+	SourcePath      string
+	ManifestPath    string
+	EncryptionKeyID []byte
+	Blocks          map[string]checkpointBlock // Keyed by archive path
+
+	path         string
+	fingerprints map[string]string // Of each source file, see prepare
+	lastSaved    time.Time
+}
+
+type checkpointBlock struct {
+	DataPos     int64
+	DataLen     int64
+	Fingerprint string
+	IV          []byte
+}
+
+// loadCheckpoint reads the checkpoint of an earlier run at opts.CheckpointPath. A missing checkpoint,
+// or one made for another source, gives an empty checkpoint.
+func (ca *ClipArchiver) loadCheckpoint(opts ClipArchiverOptions) (*createCheckpoint, error) {
+	cp := &createCheckpoint{
+		SourcePath:   opts.SourcePath,
+		ManifestPath: opts.ManifestPath,
+		Blocks:       make(map[string]checkpointBlock),
+		path:         opts.CheckpointPath,
+		lastSaved:    time.Now(),
+	}
+	if len(opts.EncryptPaths) > 0 {
+		cp.EncryptionKeyID = common.EncryptionKeyID(opts.EncryptionKey)
+	}
+
+	data, err := os.ReadFile(opts.CheckpointPath)
+	if os.IsNotExist(err) {
+		return cp, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var saved createCheckpoint
+	if err := json.Unmarshal(data, &saved); err != nil {
+		log.Printf("Ignoring unreadable checkpoint %s: %v", opts.CheckpointPath, err)
+		return cp, nil
+	}
+	if saved.SourcePath != cp.SourcePath || saved.ManifestPath != cp.ManifestPath || !bytes.Equal(saved.EncryptionKeyID, cp.EncryptionKeyID) {
+		log.Printf("Ignoring checkpoint %s, it was made for another source or key", opts.CheckpointPath)
+		return cp, nil
+	}
+
+	cp.Blocks = saved.Blocks
+	return cp, nil
+}
+
+// prepare fingerprints every file in the index, by its content hash or, if it wasn't hashed, its size
+// and modification time. It must run before the index is marked for encryption, which clears the
+// hashes of encrypted files, and before the times of reproducible archives are normalized.
+func (cp *createCheckpoint) prepare(index *btree.BTree) {
+	cp.fingerprints = make(map[string]string)
+	index.Ascend(index.Min(), func(a interface{}) bool {
+		node := a.(*common.ClipNode)
+		if node.NodeType != common.FileNode {
+			return true
+		}
+		if node.ContentHash != "" {
+			cp.fingerprints[node.Path] = node.ContentHash
+		} else {
+			cp.fingerprints[node.Path] = fmt.Sprintf("%d:%d.%09d", node.Attr.Size, node.Attr.Mtime, node.Attr.Mtimensec)
+		}
+		return true
+	})
+}
+
+// resume checks the blocks of the checkpoint against the output file and points the nodes whose
+// source is unchanged at them. Blocks are kept up to the first one missing or failing its checksum,
+// the output is truncated after it and the position to write the next block at is returned, 0 if
+// nothing could be kept.
+func (cp *createCheckpoint) resume(index *btree.BTree, outFile *os.File) (int64, error) {
+	paths := make([]string, 0, len(cp.Blocks))
+	for p := range cp.Blocks {
+		paths = append(paths, p)
+	}
+	sort.Slice(paths, func(i, j int) bool { return cp.Blocks[paths[i]].DataPos < cp.Blocks[paths[j]].DataPos })
+
+	info, err := outFile.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	kept := make(map[string]checkpointBlock)
+	pos := int64(common.ClipHeaderLength)
+	table := crc64.MakeTable(crc64.ISO)
+	for _, p := range paths {
+		block := cp.Blocks[p]
+		if block.DataPos != pos+1 || block.DataPos+block.DataLen+ChecksumLength > info.Size() {
+			break
+		}
+		if !validBlock(outFile, block.DataPos, block.DataLen, table) {
+			log.Printf("Checkpointed data of %s is damaged, archiving again from there", p)
+			break
+		}
+		kept[p] = block
+		pos = block.DataPos + block.DataLen + ChecksumLength
+	}
+
+	// Blocks of files that changed since stay in the output, unreferenced
+	restored := 0
+	for p, block := range kept {
+		item := index.Get(&common.ClipNode{Path: p})
+		if item == nil {
+			continue
+		}
+		node := item.(*common.ClipNode)
+		if node.NodeType != common.FileNode || cp.fingerprints[p] != block.Fingerprint || int64(node.Attr.Size) != block.DataLen || node.IsEncrypted() != (block.IV != nil) {
+			continue
+		}
+		node.DataPos, node.DataLen = block.DataPos, block.DataLen
+		node.IV = block.IV
+		restored++
+	}
+
+	cp.Blocks = kept
+	if len(kept) == 0 {
+		return 0, nil
+	}
+
+	if err := outFile.Truncate(pos); err != nil {
+		return 0, err
+	}
+	if _, err := outFile.Seek(pos, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	log.Printf("Resuming from checkpoint, %d files already archived", restored)
+	return pos, nil
+}
+
+// validBlock checks the type and checksum of the file block with data at dataPos
+func validBlock(f *os.File, dataPos int64, dataLen int64, table *crc64.Table) bool {
+	blockType := make([]byte, 1)
+	if _, err := f.ReadAt(blockType, dataPos-1); err != nil || common.BlockType(blockType[0]) != common.BlockTypeFile {
+		return false
+	}
+
+	hash := crc64.New(table)
+	if _, err := io.Copy(hash, io.NewSectionReader(f, dataPos, dataLen)); err != nil {
+		return false
+	}
+
+	checksum := make([]byte, ChecksumLength)
+	if _, err := f.ReadAt(checksum, dataPos+dataLen); err != nil {
+		return false
+	}
+	return bytes.Equal(checksum, hash.Sum(nil))
+}
+
+// restored reports whether a node was pointed at a checkpointed block by resume
+func (cp *createCheckpoint) restored(node *common.ClipNode) bool {
+	if cp == nil {
+		return false
+	}
+	block, exists := cp.Blocks[node.Path]
+	return exists && node.DataPos == block.DataPos && node.DataLen == block.DataLen
+}
+
+// record adds the block just written for node
+func (cp *createCheckpoint) record(node *common.ClipNode) {
+	if cp == nil {
+		return
+	}
+	cp.Blocks[node.Path] = checkpointBlock{
+		DataPos:     node.DataPos,
+		DataLen:     node.DataLen,
+		Fingerprint: cp.fingerprints[node.Path],
+		IV:          node.IV,
+	}
+}
+
+// maybeSave saves the checkpoint if the last save is older than checkpointInterval
+func (cp *createCheckpoint) maybeSave(writer *bufio.Writer, outFile *os.File) error {
+	if cp == nil || time.Since(cp.lastSaved) < checkpointInterval {
+		return nil
+	}
+	return cp.save(writer, outFile)
+}
+
+// save flushes and syncs the output, then atomically replaces the checkpoint file
+func (cp *createCheckpoint) save(writer *bufio.Writer, outFile *os.File) error {
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	if err := outFile.Sync(); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := cp.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to save checkpoint: %v", err)
+	}
+	if err := os.Rename(tmpPath, cp.path); err != nil {
+		return fmt.Errorf("failed to save checkpoint: %v", err)
+	}
+
+	cp.lastSaved = time.Now()
+	return nil
+}
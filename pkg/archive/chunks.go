@@ -0,0 +1,94 @@
+package archive
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Size of the chunks listed in a chunk manifest unless another is picked
+const DefaultChunkSize = 4 * 1024 * 1024
+
+// ChunkManifest lists an archive cut in fixed size byte ranges, for edge caches and download
+// accelerators to fetch and check the pieces of an archive on their own. A chunk is fetched from
+// its URL with a Range request for its offset and length.
+type ChunkManifest struct {
+	URL       string          `json:"url,omitempty"`
+	Size      int64           `json:"size"`
+	Digest    string          `json:"sha256"` // Of the whole archive, see Digest
+	ChunkSize int64           `json:"chunk_size"`
+	Chunks    []ManifestChunk `json:"chunks"`
+}
+
+type ManifestChunk struct {
+	Offset int64  `json:"offset"`
+	Length int64  `json:"length"`
+	Digest string `json:"sha256"`
+	URL    string `json:"url,omitempty"`
+	Range  string `json:"range"` // HTTP Range header value fetching the chunk
+}
+
+// NewChunkManifest cuts the archive at archivePath in chunks of chunkSize bytes, DefaultChunkSize if
+// it's 0, and hashes them. url is where the archive is served from, it can be left empty.
+func NewChunkManifest(archivePath string, chunkSize int64, url string) (*ChunkManifest, error) {
+	if chunkSize == 0 {
+		chunkSize = DefaultChunkSize
+	}
+	if chunkSize < 0 {
+		return nil, fmt.Errorf("invalid chunk size %d", chunkSize)
+	}
+
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	manifest := &ChunkManifest{URL: url, ChunkSize: chunkSize}
+	whole := sha256.New()
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := io.ReadFull(f, buf)
+		if n > 0 {
+			sum := sha256.Sum256(buf[:n])
+			whole.Write(buf[:n])
+			manifest.Chunks = append(manifest.Chunks, ManifestChunk{
+				Offset: manifest.Size,
+				Length: int64(n),
+				Digest: hex.EncodeToString(sum[:]),
+				URL:    url,
+				Range:  fmt.Sprintf("bytes=%d-%d", manifest.Size, manifest.Size+int64(n)-1),
+			})
+			manifest.Size += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	manifest.Digest = hex.EncodeToString(whole.Sum(nil))
+	return manifest, nil
+}
+
+// WriteChunkManifest writes the chunk manifest of an archive to manifestPath, see NewChunkManifest
+func WriteChunkManifest(archivePath string, manifestPath string, chunkSize int64, url string) error {
+	manifest, err := NewChunkManifest(archivePath, chunkSize, url)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(manifestPath, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write chunk manifest: %v", err)
+	}
+	return nil
+}
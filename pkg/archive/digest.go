@@ -0,0 +1,119 @@
+package archive
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+
+	common "github.com/NilayYadav/clip/pkg/common"
+	"github.com/NilayYadav/clip/pkg/storage"
+)
+
+// Size of the ranges an uploaded archive is read back in to check its digest
+const verifyReadSize = 8 * 1024 * 1024
+
+// Digest returns the hex encoded sha256 of a whole archive file. Content addressed archives are
+// named after it, see ContentAddressedName.
+func Digest(archivePath string) (string, error) {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// ContentAddressedName returns the file name or object key of the archive with digest
+func ContentAddressedName(digest string) string {
+	return digest + ".clip"
+}
+
+// VerifyStored checks the archive stored at info, at every replica if it's mirrored, against the
+// local archive with digest
+func VerifyStored(ctx context.Context, info common.ClipStorageInfo, archivePath string, digest string, opts storage.UploadOpts) error {
+	replicas, err := storage.Replicas(info)
+	if err != nil {
+		return err
+	}
+
+	for i, replica := range replicas {
+		if err := verifyReplica(ctx, replica, archivePath, digest, opts); err != nil {
+			if len(replicas) > 1 {
+				return fmt.Errorf("replica %d (%s): %v", i+1, replica.Type(), err)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// verifyReplica checks a single stored archive. Backends that can vouch for the upload themselves
+// are asked first, otherwise the stored archive is read back and hashed.
+func verifyReplica(ctx context.Context, info common.ClipStorageInfo, archivePath string, digest string, opts storage.UploadOpts) error {
+	backend, err := storage.GetBackend(info.Type())
+	if err != nil {
+		return err
+	}
+
+	if verifier, ok := backend.(storage.UploadVerifier); ok {
+		verified, err := verifier.VerifyUpload(ctx, info, archivePath, opts)
+		if err != nil {
+			return err
+		}
+		if verified {
+			return nil
+		}
+	}
+
+	fi, err := os.Stat(archivePath)
+	if err != nil {
+		return err
+	}
+
+	remote, err := backend.Open(ctx, info, storage.ClipStorageOpts{Credentials: opts.Credentials})
+	if err != nil {
+		return err
+	}
+	defer remote.Close()
+
+	remoteDigest, err := readDigest(ctx, remote, fi.Size())
+	if err != nil {
+		return fmt.Errorf("failed to read back stored archive: %v", err)
+	}
+	if remoteDigest != digest {
+		return fmt.Errorf("%w: stored archive doesn't match %s, digest is %s, expected %s", common.ErrChecksumMismatch, archivePath, remoteDigest, digest)
+	}
+	return nil
+}
+
+// readDigest hashes the first size bytes of a remote archive
+func readDigest(ctx context.Context, remote storage.RemoteArchive, size int64) (string, error) {
+	hash := sha256.New()
+	buf := make([]byte, verifyReadSize)
+	for off := int64(0); off < size; {
+		chunk := buf
+		if left := size - off; left < int64(len(chunk)) {
+			chunk = chunk[:left]
+		}
+
+		n, err := remote.ReadRange(ctx, chunk, off)
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		if n < len(chunk) {
+			return "", fmt.Errorf("archive is shorter than %d bytes", size)
+		}
+
+		hash.Write(chunk)
+		off += int64(n)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
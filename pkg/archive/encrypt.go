@@ -0,0 +1,108 @@
+package archive
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"path"
+	"strings"
+
+	common "github.com/NilayYadav/clip/pkg/common"
+	log "github.com/okteto/okteto/pkg/log"
+	"github.com/tidwall/btree"
+)
+
+// matchPathPattern reports whether an archive path matches a pattern selecting files to encrypt or keep.
+// Patterns with a / match the whole path, relative to the archive root, and may end in /** to take
+// in a whole directory. Other patterns match the file name, like *.pem.
+func matchPathPattern(pattern string, p string) bool {
+	if !strings.Contains(pattern, "/") {
+		ok, _ := path.Match(pattern, path.Base(p))
+		return ok
+	}
+	pattern = path.Join("/", pattern)
+
+	if dir, ok := strings.CutSuffix(pattern, "/**"); ok {
+		if dir == "" {
+			return true
+		}
+		if matched, _ := path.Match(dir, p); matched {
+			return true
+		}
+		// Match the directory against each ancestor of the path
+		for parent := path.Dir(p); parent != "/"; parent = path.Dir(parent) {
+			if matched, _ := path.Match(dir, parent); matched {
+				return true
+			}
+		}
+		return false
+	}
+
+	ok, _ := path.Match(pattern, p)
+	return ok
+}
+
+// encryptedPath reports whether the file at p is one opts.EncryptPaths selects
+func encryptedPath(opts ClipArchiverOptions, p string) bool {
+	for _, pattern := range opts.EncryptPaths {
+		if matchPathPattern(pattern, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// markEncrypted gives every file matching opts.EncryptPaths its own random IV, its data is then
+// encrypted as it's written. Encrypted files get no content hash: the hash of their content would
+// tell what it is, and they are kept out of content caches and dedup.
+func (ca *ClipArchiver) markEncrypted(index *btree.BTree, opts ClipArchiverOptions) error {
+	if len(opts.EncryptPaths) == 0 {
+		return nil
+	}
+	if len(opts.EncryptionKey) != common.EncryptionKeyLength {
+		return fmt.Errorf("encrypting files needs a %d byte key", common.EncryptionKeyLength)
+	}
+
+	var err error
+	encrypted := 0
+	index.Ascend(index.Min(), func(a interface{}) bool {
+		node := a.(*common.ClipNode)
+		if node.NodeType != common.FileNode {
+			return true
+		}
+
+		if encryptedPath(opts, node.Path) {
+			if opts.Reproducible {
+				node.IV = reproducibleIV(opts.EncryptionKey, node)
+			} else {
+				node.IV = make([]byte, 16)
+				if _, err = rand.Read(node.IV); err != nil {
+					return false
+				}
+			}
+			node.ContentHash = ""
+			encrypted++
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	if opts.Verbose {
+		log.Printf("Encrypting %d files\n", encrypted)
+	}
+	return nil
+}
+
+// CheckEncryptionKey makes sure a key given to read an archive is the one its files were encrypted
+// with. Archives can be read without a key, just not their encrypted files.
+func CheckEncryptionKey(attributes common.ClipArchiveAttributes, key []byte) error {
+	if key == nil || len(attributes.EncryptionKeyID) == 0 {
+		return nil
+	}
+	if !bytes.Equal(attributes.EncryptionKeyID, common.EncryptionKeyID(key)) {
+		return fmt.Errorf("archive was encrypted with a different key")
+	}
+	return nil
+}
@@ -0,0 +1,408 @@
+package archive
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"syscall"
+
+	common "github.com/NilayYadav/clip/pkg/common"
+	log "github.com/okteto/okteto/pkg/log"
+)
+
+// EROFS images, uncompressed. The image starts with the data of the files, followed by the inodes
+// and then the blocks of large directories and symlinks. The last partial block of a file, directory
+// or symlink is stored right after its inode when it fits in the inode's block.
+const (
+	erofsMagic       = 0xe0f5e1e2
+	erofsSuperOffset = 1024
+	erofsBlockBits   = 12
+	erofsBlockSize   = 1 << erofsBlockBits
+	erofsInodeSize   = 64 // Extended inodes, for 32 bit ids and 64 bit sizes
+	erofsSlotSize    = 32 // Inodes are numbered by their position in slots of this size
+	erofsDirentSize  = 12
+
+	erofsFlatPlain  = 0
+	erofsFlatInline = 2
+)
+
+// Directory entry file types
+const (
+	erofsFileType = iota + 1
+	erofsDirType
+	erofsCharDevType
+	erofsBlockDevType
+	erofsFifoType
+	erofsSocketType
+	erofsSymlinkType
+)
+
+type erofsInode struct {
+	node    *common.ClipNode
+	size    int64
+	blocks  int64 // Of data outside the inode, the last one padded if it isn't inlined
+	tail    int64 // Bytes of data inlined after the inode
+	blkaddr uint32
+	pos     int64
+	nid     uint64
+	nlink   uint32
+	dir     [][]erofsDirent // Blocks of the directory listing
+}
+
+type erofsDirent struct {
+	name  string
+	inode *erofsInode
+	kind  uint8
+}
+
+// erofsLayout splits size bytes of data in whole blocks and a tail inlined after the inode, unless
+// the tail can't fit in a block with the inode
+func erofsLayout(inode *erofsInode, size int64) {
+	inode.size = size
+	inode.blocks, inode.tail = size/erofsBlockSize, size%erofsBlockSize
+	if inode.tail > erofsBlockSize-erofsInodeSize {
+		inode.blocks, inode.tail = inode.blocks+1, 0
+	}
+}
+
+// erofsHash is an entry of the map accompanying an EROFS image, placing the content of a file in the
+// image for content caches
+type erofsHash struct {
+	Path    string `json:"path"`
+	Digest  string `json:"sha256"` // ContentHash of the file
+	Size    int64  `json:"size"`
+	NID     uint64 `json:"nid"`
+	BlkAddr uint32 `json:"blkaddr,omitempty"` // First block of the file, unset if it's all inlined
+}
+
+// exportEROFS writes the archive as an EROFS image, which kernels mount natively. The ContentHash of
+// every file, and where its data is in the image, goes to opts.HashMapPath.
+func (ca *ClipArchiver) exportEROFS(metadata *common.ClipArchiveMetadata, inFile *os.File, outFile *os.File, opts ExportOptions) (*ExportStats, error) {
+	root := metadata.Get("/")
+	if root == nil {
+		return nil, fmt.Errorf("archive has no root directory")
+	}
+
+	outBuf := bufio.NewWriterSize(outFile, 512*1024)
+	out := &countingWriter{w: outBuf}
+	stats := &ExportStats{}
+
+	// The superblock is written last, in the first block
+	if err := erofsPad(out, erofsBlockSize); err != nil {
+		return nil, err
+	}
+
+	// File data first, shared by hard links and files with the same content
+	var inodes []*erofsInode
+	byPath := make(map[string]*erofsInode)
+	links := make(map[uint64]*erofsInode)
+	shared := make(map[string]*erofsInode) // Keyed by content hash
+	children := make(map[string][]*common.ClipNode)
+	var err error
+	metadata.Index.Ascend(metadata.Index.Min(), func(a interface{}) bool {
+		node := a.(*common.ClipNode)
+		if node.NodeType == common.FileNode && node.IsEncrypted() && opts.EncryptionKey == nil {
+			log.Printf("skipping encrypted file %s, no key given", node.Path)
+			stats.Skipped++
+			return true
+		}
+		if node.Path != "/" {
+			children[path.Dir(node.Path)] = append(children[path.Dir(node.Path)], node)
+		}
+		stats.Entries++
+
+		if node.NodeType == common.FileNode {
+			if inode, linked := links[node.Attr.Ino]; linked {
+				inode.nlink++
+				byPath[node.Path] = inode
+				return true
+			}
+		}
+		inode := &erofsInode{node: node, nlink: 1}
+		inodes = append(inodes, inode)
+		byPath[node.Path] = inode
+
+		switch node.NodeType {
+		case common.FileNode:
+			links[node.Attr.Ino] = inode
+			erofsLayout(inode, node.DataLen)
+			if first, exists := shared[node.ContentHash]; exists && node.ContentHash != "" {
+				inode.blkaddr = first.blkaddr
+				return true
+			}
+			shared[node.ContentHash] = inode
+			err = erofsWriteData(out, inode, inFile, opts)
+		case common.SymLinkNode:
+			erofsLayout(inode, int64(len(node.Target)))
+		}
+		return err == nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Directory listings, sorted by name with . and .., in blocks entries don't straddle
+	for _, inode := range inodes {
+		if !inode.node.IsDir() {
+			continue
+		}
+		parent := byPath[path.Dir(inode.node.Path)]
+		entries := []erofsDirent{{name: ".", inode: inode, kind: erofsDirType}, {name: "..", inode: parent, kind: erofsDirType}}
+		for _, child := range children[inode.node.Path] {
+			entries = append(entries, erofsDirent{name: path.Base(child.Path), inode: byPath[child.Path], kind: erofsKind(child)})
+			if child.IsDir() {
+				inode.nlink++
+			}
+		}
+		inode.nlink++ // For .
+		sort.Slice(entries, func(i, j int) bool { return entries[i].name < entries[j].name })
+
+		var size, used int64
+		var block []erofsDirent
+		for _, e := range entries {
+			if need := int64(erofsDirentSize + len(e.name)); used+need > erofsBlockSize {
+				inode.dir = append(inode.dir, block)
+				size += erofsBlockSize
+				block, used = nil, 0
+			}
+			block = append(block, e)
+			used += int64(erofsDirentSize + len(e.name))
+		}
+		inode.dir = append(inode.dir, block)
+		erofsLayout(inode, size+used)
+	}
+
+	// Inodes follow the data, the root first since its number must fit in 16 bits. Every inode is
+	// kept in one block with its tail.
+	metaStart := out.n
+	pos := metaStart
+	for _, inode := range inodes {
+		if need := int64(erofsInodeSize) + inode.tail; pos%erofsBlockSize+need > erofsBlockSize {
+			pos += erofsBlockSize - pos%erofsBlockSize
+		}
+		inode.pos = pos
+		inode.nid = uint64(pos-metaStart) / erofsSlotSize
+		pos += erofsInodeSize + inode.tail
+		pos += (erofsSlotSize - pos%erofsSlotSize) % erofsSlotSize
+	}
+
+	// Then the blocks of directories and symlinks
+	blkaddr := uint32((pos + erofsBlockSize - 1) / erofsBlockSize)
+	for _, inode := range inodes {
+		if inode.node.NodeType != common.FileNode && inode.blocks > 0 {
+			inode.blkaddr = blkaddr
+			blkaddr += uint32(inode.blocks)
+		}
+	}
+
+	for _, inode := range inodes {
+		if err := erofsPad(out, inode.pos-out.n); err != nil {
+			return nil, err
+		}
+		if _, err := out.Write(erofsInodeBytes(inode)); err != nil {
+			return nil, err
+		}
+		if err := erofsWriteTail(out, inode, inFile, opts); err != nil {
+			return nil, err
+		}
+	}
+	if err := erofsPad(out, (erofsBlockSize-out.n%erofsBlockSize)%erofsBlockSize); err != nil {
+		return nil, err
+	}
+	for _, inode := range inodes {
+		if inode.node.NodeType == common.FileNode || inode.blocks == 0 {
+			continue
+		}
+		var data []byte
+		if inode.node.IsDir() {
+			for _, block := range inode.dir[:inode.blocks] {
+				data = append(data, erofsDirBlock(block)...)
+				data = append(data, make([]byte, (erofsBlockSize-int64(len(data))%erofsBlockSize)%erofsBlockSize)...)
+			}
+		} else {
+			data = []byte(inode.node.Target)
+		}
+		data = append(data, make([]byte, inode.blocks*erofsBlockSize-int64(len(data)))...)
+		if _, err := out.Write(data); err != nil {
+			return nil, err
+		}
+	}
+	if err := outBuf.Flush(); err != nil {
+		return nil, err
+	}
+
+	sb := make([]byte, 0, 128)
+	sb = binary.LittleEndian.AppendUint32(sb, erofsMagic)
+	sb = binary.LittleEndian.AppendUint32(sb, 0) // No checksum
+	sb = binary.LittleEndian.AppendUint32(sb, 0) // Compatible features
+	sb = append(sb, erofsBlockBits, 0)
+	sb = binary.LittleEndian.AppendUint16(sb, uint16(inodes[0].nid))
+	sb = binary.LittleEndian.AppendUint64(sb, uint64(len(inodes)))
+	sb = binary.LittleEndian.AppendUint64(sb, root.Attr.Mtime)
+	sb = binary.LittleEndian.AppendUint32(sb, root.Attr.Mtimensec)
+	sb = binary.LittleEndian.AppendUint32(sb, uint32(out.n/erofsBlockSize))
+	sb = binary.LittleEndian.AppendUint32(sb, uint32(metaStart/erofsBlockSize))
+	sb = binary.LittleEndian.AppendUint32(sb, 0) // No shared xattrs
+	sb = append(sb, make([]byte, 128-len(sb))...)
+	if _, err := outFile.WriteAt(sb, erofsSuperOffset); err != nil {
+		return nil, err
+	}
+
+	if err := erofsWriteHashMap(opts.HashMapPath, byPath); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+func erofsKind(node *common.ClipNode) uint8 {
+	switch node.NodeType {
+	case common.FileNode:
+		return erofsFileType
+	case common.DirNode:
+		return erofsDirType
+	case common.SymLinkNode:
+		return erofsSymlinkType
+	}
+	switch node.Attr.Mode & syscall.S_IFMT {
+	case syscall.S_IFCHR:
+		return erofsCharDevType
+	case syscall.S_IFBLK:
+		return erofsBlockDevType
+	case syscall.S_IFIFO:
+		return erofsFifoType
+	}
+	return erofsSocketType
+}
+
+// erofsWriteData writes the blocks of a file that aren't inlined, at the current block
+func erofsWriteData(out *countingWriter, inode *erofsInode, inFile *os.File, opts ExportOptions) error {
+	if inode.blocks == 0 {
+		return nil
+	}
+	inode.blkaddr = uint32(out.n / erofsBlockSize)
+
+	data, err := nodeData(inFile, inode.node, opts.EncryptionKey, 0)
+	if err != nil {
+		return err
+	}
+	if opts.Verbose {
+		log.Spinner(fmt.Sprintf("Exporting... %s", inode.node.Path))
+	}
+
+	n := inode.blocks * erofsBlockSize
+	if n > inode.size {
+		n = inode.size
+	}
+	if _, err := io.CopyN(out, data, n); err != nil {
+		return fmt.Errorf("error exporting %s: %v", inode.node.Path, err)
+	}
+	return erofsPad(out, (erofsBlockSize-out.n%erofsBlockSize)%erofsBlockSize)
+}
+
+// erofsWriteTail writes the data inlined after an inode
+func erofsWriteTail(out *countingWriter, inode *erofsInode, inFile *os.File, opts ExportOptions) error {
+	if inode.tail == 0 {
+		return nil
+	}
+
+	switch inode.node.NodeType {
+	case common.FileNode:
+		data, err := nodeData(inFile, inode.node, opts.EncryptionKey, inode.blocks*erofsBlockSize)
+		if err != nil {
+			return err
+		}
+		if _, err := io.CopyN(out, data, inode.tail); err != nil {
+			return fmt.Errorf("error exporting %s: %v", inode.node.Path, err)
+		}
+		return nil
+	case common.DirNode:
+		_, err := out.Write(erofsDirBlock(inode.dir[len(inode.dir)-1]))
+		return err
+	}
+	_, err := out.Write([]byte(inode.node.Target))
+	return err
+}
+
+func erofsInodeBytes(inode *erofsInode) []byte {
+	node := inode.node
+	layout := uint16(erofsFlatPlain)
+	if inode.tail > 0 {
+		layout = erofsFlatInline
+	}
+
+	// Block address of the data, or device number
+	addr := inode.blkaddr
+	if node.NodeType == common.SpecialNode {
+		addr = node.Attr.Rdev
+	}
+
+	b := binary.LittleEndian.AppendUint16(nil, 1|layout<<1) // Extended
+	b = binary.LittleEndian.AppendUint16(b, 0)              // No xattrs
+	b = binary.LittleEndian.AppendUint16(b, uint16(node.Attr.Mode&(syscall.S_IFMT|07777)))
+	b = binary.LittleEndian.AppendUint16(b, 0)
+	b = binary.LittleEndian.AppendUint64(b, uint64(inode.size))
+	b = binary.LittleEndian.AppendUint32(b, addr)
+	b = binary.LittleEndian.AppendUint32(b, uint32(inode.nid))
+	b = binary.LittleEndian.AppendUint32(b, node.Attr.Owner.Uid)
+	b = binary.LittleEndian.AppendUint32(b, node.Attr.Owner.Gid)
+	b = binary.LittleEndian.AppendUint64(b, node.Attr.Mtime)
+	b = binary.LittleEndian.AppendUint32(b, node.Attr.Mtimensec)
+	b = binary.LittleEndian.AppendUint32(b, inode.nlink)
+	return append(b, make([]byte, 16)...)
+}
+
+// erofsDirBlock returns a block of a directory listing: the entries, then their names, unpadded
+func erofsDirBlock(entries []erofsDirent) []byte {
+	nameOff := len(entries) * erofsDirentSize
+	var b, names []byte
+	for _, e := range entries {
+		b = binary.LittleEndian.AppendUint64(b, e.inode.nid)
+		b = binary.LittleEndian.AppendUint16(b, uint16(nameOff+len(names)))
+		b = append(b, e.kind, 0)
+		names = append(names, e.name...)
+	}
+	return append(b, names...)
+}
+
+func erofsPad(out io.Writer, n int64) error {
+	if n <= 0 {
+		return nil
+	}
+	_, err := out.Write(make([]byte, n))
+	return err
+}
+
+// erofsWriteHashMap writes the content hash of every hashed file in an image, with where it is
+func erofsWriteHashMap(name string, byPath map[string]*erofsInode) error {
+	if name == "" {
+		return nil
+	}
+
+	var hashes []erofsHash
+	for p, inode := range byPath {
+		node := inode.node
+		if node.NodeType != common.FileNode || node.ContentHash == "" {
+			continue
+		}
+		hash := erofsHash{Path: p, Digest: node.ContentHash, Size: inode.size, NID: inode.nid}
+		if inode.blocks > 0 {
+			hash.BlkAddr = inode.blkaddr
+		}
+		hashes = append(hashes, hash)
+	}
+	sort.Slice(hashes, func(i, j int) bool { return hashes[i].Path < hashes[j].Path })
+
+	data, err := json.MarshalIndent(hashes, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(name, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write hash map: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,341 @@
+package archive
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	common "github.com/NilayYadav/clip/pkg/common"
+	log "github.com/okteto/okteto/pkg/log"
+)
+
+// eStargz is a tar.gz whose entries, and the chunks of large files, are each compressed in their own
+// gzip member. A table of contents at the end gives the offset of every member, so a file can be
+// read without decompressing the layer. See the estargz package of stargz-snapshotter.
+const (
+	estargzTOCName          = "stargz.index.json"
+	estargzPrefetchLandmark = ".prefetch.landmark"
+	estargzNoPrefetch       = ".no.prefetch.landmark"
+	estargzLandmarkContents = 0xf
+)
+
+type estargzTOC struct {
+	Version int             `json:"version"`
+	Entries []*estargzEntry `json:"entries"`
+}
+
+type estargzEntry struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Size        int64  `json:"size,omitempty"`
+	ModTime     string `json:"modtime,omitempty"`
+	LinkName    string `json:"linkName,omitempty"`
+	Mode        int64  `json:"mode,omitempty"`
+	UID         int    `json:"uid,omitempty"`
+	GID         int    `json:"gid,omitempty"`
+	DevMajor    int    `json:"devMajor,omitempty"`
+	DevMinor    int    `json:"devMinor,omitempty"`
+	Digest      string `json:"digest,omitempty"`
+	Offset      int64  `json:"offset,omitempty"`
+	ChunkOffset int64  `json:"chunkOffset,omitempty"`
+	ChunkSize   int64  `json:"chunkSize,omitempty"`
+	ChunkDigest string `json:"chunkDigest,omitempty"`
+}
+
+// estargzWriter writes the tar stream of an export, opening a gzip member whenever it's written to
+// without one
+type estargzWriter struct {
+	out       *countingWriter
+	gz        *gzip.Writer
+	tw        *tar.Writer
+	toc       estargzTOC
+	chunkSize int64
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+func (w *estargzWriter) Write(p []byte) (int, error) {
+	if w.gz == nil {
+		w.gz = gzip.NewWriter(w.out)
+	}
+	return w.gz.Write(p)
+}
+
+// closeGz ends the current gzip member, the next write starts another
+func (w *estargzWriter) closeGz() error {
+	if w.gz == nil {
+		return nil
+	}
+	err := w.gz.Close()
+	w.gz = nil
+	return err
+}
+
+// exportEStargz writes the archive as an eStargz layer. Files the archive prefetches come first,
+// followed by the prefetch landmark, so stargz-snapshotter prefetches them too.
+func (ca *ClipArchiver) exportEStargz(metadata *common.ClipArchiveMetadata, inFile *os.File, outFile *os.File, opts ExportOptions) (*ExportStats, error) {
+	out := bufio.NewWriterSize(outFile, 512*1024)
+	w := &estargzWriter{out: &countingWriter{w: out}, toc: estargzTOC{Version: 1}, chunkSize: opts.ChunkSize}
+	w.tw = tar.NewWriter(w)
+	stats := &ExportStats{}
+
+	written := make(map[string]bool)
+	links := make(map[uint64]string) // First path of each hard linked inode
+	var err error
+	export := func(node *common.ClipNode) bool {
+		if node.Path == "/" || written[node.Path] {
+			return true
+		}
+		written[node.Path] = true
+
+		var exported bool
+		if exported, err = w.writeNode(node, inFile, links, opts); err != nil {
+			return false
+		}
+		if exported {
+			stats.Entries++
+		} else {
+			stats.Skipped++
+		}
+		return true
+	}
+
+	landmark := estargzNoPrefetch
+	for _, p := range metadata.Attributes.PrefetchPaths {
+		item := metadata.Get(p)
+		if item == nil {
+			continue
+		}
+		// Parents first, so extracting the layer gives them their modes
+		var parents []string
+		for parent := path.Dir(p); parent != "/"; parent = path.Dir(parent) {
+			parents = append([]string{parent}, parents...)
+		}
+		for _, parent := range parents {
+			if node := metadata.Get(parent); node != nil && !export(node) {
+				return nil, err
+			}
+		}
+		if !export(item) {
+			return nil, err
+		}
+		landmark = estargzPrefetchLandmark
+	}
+
+	if err := w.writeLandmark(landmark); err != nil {
+		return nil, err
+	}
+
+	metadata.Index.Ascend(metadata.Index.Min(), func(a interface{}) bool {
+		return export(a.(*common.ClipNode))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	digest, err := w.writeTOC()
+	if err != nil {
+		return nil, err
+	}
+	stats.TOCDigest = digest
+	return stats, out.Flush()
+}
+
+// writeNode writes an entry of the archive, reporting whether the format could hold it
+func (w *estargzWriter) writeNode(node *common.ClipNode, inFile *os.File, links map[uint64]string, opts ExportOptions) (bool, error) {
+	name := strings.TrimPrefix(node.Path, "/")
+	modTime := time.Unix(int64(node.Attr.Mtime), int64(node.Attr.Mtimensec)).UTC()
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    int64(node.Attr.Mode & 07777),
+		Uid:     int(node.Attr.Owner.Uid),
+		Gid:     int(node.Attr.Owner.Gid),
+		ModTime: modTime,
+		Format:  tar.FormatPAX,
+	}
+	entry := &estargzEntry{
+		Name:    name,
+		Mode:    hdr.Mode,
+		UID:     hdr.Uid,
+		GID:     hdr.Gid,
+		ModTime: modTime.Format(time.RFC3339),
+	}
+
+	switch node.NodeType {
+	case common.DirNode:
+		hdr.Typeflag, hdr.Name = tar.TypeDir, name+"/"
+		entry.Type = "dir"
+
+	case common.SymLinkNode:
+		hdr.Typeflag, hdr.Linkname = tar.TypeSymlink, node.Target
+		entry.Type, entry.LinkName = "symlink", node.Target
+
+	case common.SpecialNode:
+		switch node.Attr.Mode & syscall.S_IFMT {
+		case syscall.S_IFCHR:
+			hdr.Typeflag, entry.Type = tar.TypeChar, "char"
+		case syscall.S_IFBLK:
+			hdr.Typeflag, entry.Type = tar.TypeBlock, "block"
+		case syscall.S_IFIFO:
+			hdr.Typeflag, entry.Type = tar.TypeFifo, "fifo"
+		default:
+			if opts.Verbose {
+				log.Printf("skipping %s, sockets can't be exported", node.Path)
+			}
+			return false, nil
+		}
+		hdr.Devmajor, hdr.Devminor = int64(devMajor(node.Attr.Rdev)), int64(devMinor(node.Attr.Rdev))
+		entry.DevMajor, entry.DevMinor = int(hdr.Devmajor), int(hdr.Devminor)
+
+	case common.FileNode:
+		if node.IsEncrypted() && opts.EncryptionKey == nil {
+			log.Printf("skipping encrypted file %s, no key given", node.Path)
+			return false, nil
+		}
+		if first, linked := links[node.Attr.Ino]; linked {
+			hdr.Typeflag, hdr.Linkname = tar.TypeLink, first
+			entry.Type, entry.LinkName = "hardlink", first
+			break
+		}
+		if node.Attr.Nlink > 1 {
+			links[node.Attr.Ino] = name
+		}
+
+		data, err := nodeData(inFile, node, opts.EncryptionKey, 0)
+		if err != nil {
+			return false, err
+		}
+		hdr.Typeflag, hdr.Size = tar.TypeReg, node.DataLen
+		entry.Type, entry.Size = "reg", node.DataLen
+		return true, w.writeFile(hdr, entry, data)
+	}
+
+	if err := w.tw.WriteHeader(hdr); err != nil {
+		return false, fmt.Errorf("error exporting %s: %v", node.Path, err)
+	}
+	w.toc.Entries = append(w.toc.Entries, entry)
+	return true, nil
+}
+
+// writeFile writes a regular file, every chunk of its content starting a gzip member
+func (w *estargzWriter) writeFile(hdr *tar.Header, entry *estargzEntry, data io.Reader) error {
+	if err := w.tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("error exporting %s: %v", hdr.Name, err)
+	}
+	if hdr.Size == 0 {
+		w.toc.Entries = append(w.toc.Entries, entry)
+		return nil
+	}
+
+	first := entry
+	whole := sha256.New()
+	for written := int64(0); written < hdr.Size; {
+		if err := w.closeGz(); err != nil {
+			return err
+		}
+
+		n := w.chunkSize
+		if left := hdr.Size - written; left <= n {
+			n = left
+		} else {
+			entry.ChunkSize = n // Left out for the last chunk, which runs to the end of the file
+		}
+		entry.Offset = w.out.n
+		entry.ChunkOffset = written
+
+		chunk := sha256.New()
+		if _, err := io.CopyN(w.tw, io.TeeReader(data, io.MultiWriter(whole, chunk)), n); err != nil {
+			return fmt.Errorf("error exporting %s: %v", hdr.Name, err)
+		}
+		entry.ChunkDigest = "sha256:" + hex.EncodeToString(chunk.Sum(nil))
+		w.toc.Entries = append(w.toc.Entries, entry)
+
+		written += n
+		entry = &estargzEntry{Name: first.Name, Type: "chunk"}
+	}
+	first.Digest = "sha256:" + hex.EncodeToString(whole.Sum(nil))
+	return nil
+}
+
+// writeLandmark writes the entry telling stargz-snapshotter where the files to prefetch end, or that
+// there are none
+func (w *estargzWriter) writeLandmark(name string) error {
+	hdr := &tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0444, Size: 1, Format: tar.FormatPAX}
+	entry := &estargzEntry{Name: name, Type: "reg", Size: 1, Mode: 0444}
+	return w.writeFile(hdr, entry, bytes.NewReader([]byte{estargzLandmarkContents}))
+}
+
+// writeTOC ends the layer with its table of contents, in a tar of its own, and the footer pointing
+// at it. It returns the digest of the table of contents.
+func (w *estargzWriter) writeTOC() (string, error) {
+	if err := w.tw.Flush(); err != nil {
+		return "", err
+	}
+	if err := w.closeGz(); err != nil {
+		return "", err
+	}
+
+	tocJSON, err := json.MarshalIndent(w.toc, "", "\t")
+	if err != nil {
+		return "", err
+	}
+
+	tocOff := w.out.n
+	tw := tar.NewWriter(w)
+	if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: estargzTOCName, Mode: 0444, Size: int64(len(tocJSON))}); err != nil {
+		return "", err
+	}
+	if _, err := tw.Write(tocJSON); err != nil {
+		return "", err
+	}
+	if err := tw.Close(); err != nil {
+		return "", err
+	}
+	if err := w.closeGz(); err != nil {
+		return "", err
+	}
+
+	if _, err := w.out.Write(estargzFooter(tocOff)); err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(tocJSON)
+	return "sha256:" + hex.EncodeToString(sum[:]), nil
+}
+
+// estargzFooter returns the empty gzip member ending a layer, whose extra field holds the offset of
+// the table of contents. Readers expect exactly 51 bytes, so it's built by hand around a stored empty
+// block rather than left to the compressor.
+func estargzFooter(tocOff int64) []byte {
+	subfield := fmt.Sprintf("%016xSTARGZ", tocOff)
+	extra := []byte{'S', 'G', 0, 0}
+	binary.LittleEndian.PutUint16(extra[2:], uint16(len(subfield)))
+	extra = append(extra, subfield...)
+
+	footer := []byte{0x1f, 0x8b, 8, 1 << 2, 0, 0, 0, 0, 0, 0xff} // Magic, deflate, FEXTRA, no mtime
+	footer = binary.LittleEndian.AppendUint16(footer, uint16(len(extra)))
+	footer = append(footer, extra...)
+	footer = append(footer, 1, 0, 0, 0xff, 0xff) // Final stored block, empty
+	return append(footer, make([]byte, 8)...)    // CRC-32 and size of no data
+}
@@ -0,0 +1,112 @@
+package archive
+
+import (
+	"crypto/cipher"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	common "github.com/NilayYadav/clip/pkg/common"
+)
+
+// Formats an archive can be exported to
+const (
+	ExportEStargz  = "estargz"
+	ExportSquashFS = "squashfs"
+	ExportEROFS    = "erofs"
+)
+
+type ExportOptions struct {
+	InputFile     string
+	OutputFile    string
+	Format        string
+	ChunkSize     int64  // Files are cut in chunks of this size in eStargz layers, defaults to DefaultChunkSize
+	EncryptionKey []byte // Encrypted files are skipped without it
+	Verbose       bool
+	HashMapPath   string // Of the content hash map of EROFS images, defaults to the image path with a .hashes.json extension
+}
+
+// ExportStats describes what an export wrote
+type ExportStats struct {
+	Entries    int
+	Skipped    int // Encrypted files without a key, and entries the format can't hold
+	OutputSize int64
+	TOCDigest  string // Of the eStargz table of contents, layers are annotated with it
+}
+
+// Export converts a local archive into an image of another format, for tools which can't read
+// archives
+func (ca *ClipArchiver) Export(opts ExportOptions) (*ExportStats, error) {
+	metadata, err := ca.ExtractMetadata(opts.InputFile)
+	if err != nil {
+		return nil, err
+	}
+	if metadata.StorageInfo != nil {
+		return nil, fmt.Errorf("%s is a remote archive, export the archive it was stored from", opts.InputFile)
+	}
+	if err := CheckEncryptionKey(metadata.Attributes, opts.EncryptionKey); err != nil {
+		return nil, err
+	}
+	if opts.ChunkSize == 0 {
+		opts.ChunkSize = DefaultChunkSize
+	}
+	if opts.ChunkSize < 0 {
+		return nil, fmt.Errorf("invalid chunk size %d", opts.ChunkSize)
+	}
+
+	inFile, err := os.Open(opts.InputFile)
+	if err != nil {
+		return nil, err
+	}
+	defer inFile.Close()
+
+	outFile, err := os.Create(opts.OutputFile)
+	if err != nil {
+		return nil, err
+	}
+	defer outFile.Close()
+
+	var stats *ExportStats
+	switch opts.Format {
+	case ExportEStargz:
+		stats, err = ca.exportEStargz(metadata, inFile, outFile, opts)
+	case ExportSquashFS:
+		stats, err = ca.exportSquashFS(metadata, inFile, outFile, opts)
+	case ExportEROFS:
+		if opts.HashMapPath == "" {
+			opts.HashMapPath = strings.TrimSuffix(opts.OutputFile, filepath.Ext(opts.OutputFile)) + ".hashes.json"
+		}
+		stats, err = ca.exportEROFS(metadata, inFile, outFile, opts)
+	default:
+		err = fmt.Errorf("unsupported export format %q", opts.Format)
+	}
+	if err != nil {
+		outFile.Close()
+		os.Remove(opts.OutputFile)
+		return nil, err
+	}
+
+	info, err := outFile.Stat()
+	if err != nil {
+		return nil, err
+	}
+	stats.OutputSize = info.Size()
+	return stats, nil
+}
+
+// nodeData returns a reader of the content of a file node from off, decrypted with key if it's
+// encrypted
+func nodeData(file io.ReaderAt, node *common.ClipNode, key []byte, off int64) (io.Reader, error) {
+	var data io.Reader = io.NewSectionReader(file, node.DataPos+off, node.DataLen-off)
+	if !node.IsEncrypted() {
+		return data, nil
+	}
+
+	stream, err := common.NewContentCipher(key, node.IV, off)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting file %s: %v", node.Path, err)
+	}
+	return &cipher.StreamReader{S: stream, R: data}, nil
+}
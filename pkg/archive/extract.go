@@ -0,0 +1,154 @@
+package archive
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	common "github.com/NilayYadav/clip/pkg/common"
+	log "github.com/okteto/okteto/pkg/log"
+	"github.com/tidwall/btree"
+)
+
+// Archives can come from anyone, so extracting one must never touch anything outside the output
+// directory. Every entry is checked before anything is written, and entries are never written
+// through a symlink, whether the archive made it or it was already in the output directory.
+
+// checkExtractPaths rejects archives holding paths that aren't clean and absolute, since they could
+// point out of the output directory, and entries placed under a symlink of the archive
+func (ca *ClipArchiver) checkExtractPaths(index *btree.BTree) error {
+	var err error
+	index.Ascend(index.Min(), func(a interface{}) bool {
+		node := a.(*common.ClipNode)
+		if !strings.HasPrefix(node.Path, "/") || path.Clean(node.Path) != node.Path || strings.ContainsRune(node.Path, 0) {
+			err = fmt.Errorf("refusing to extract archive: invalid path %q", node.Path)
+			return false
+		}
+
+		for parent := path.Dir(node.Path); parent != "/"; parent = path.Dir(parent) {
+			if p := index.Get(&common.ClipNode{Path: parent}); p != nil && p.(*common.ClipNode).IsSymlink() {
+				err = fmt.Errorf("refusing to extract archive: %s is under the symlink %s", node.Path, parent)
+				return false
+			}
+		}
+		return true
+	})
+	return err
+}
+
+// outputPath returns where a node is extracted to, making sure none of the directories leading to
+// it in the output directory is a symlink
+func (ca *ClipArchiver) outputPath(root string, p string) (string, error) {
+	for parent := path.Dir(p); parent != "/"; parent = path.Dir(parent) {
+		info, err := os.Lstat(filepath.Join(root, parent))
+		if err == nil && info.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("refusing to extract %s through the symlink %s", p, parent)
+		}
+	}
+	return filepath.Join(root, p), nil
+}
+
+// extractMode returns the permissions an entry is created with
+func extractMode(node *common.ClipNode, opts ClipArchiverOptions) uint32 {
+	if opts.PreserveSetuid {
+		return node.Attr.Mode & 07777
+	}
+	return node.Attr.Mode & 0777
+}
+
+// ExtractStats counts what Extract wrote
+type ExtractStats struct {
+	Entries int
+	Skipped int   // Encrypted files without a key, and devices without AllowDevices
+	Bytes   int64 // Of the files written
+}
+
+func (ca *ClipArchiver) extractNode(file *os.File, node *common.ClipNode, opts ClipArchiverOptions, stats *ExtractStats) error {
+	outputPath, err := ca.outputPath(opts.OutputPath, node.Path)
+	if err != nil {
+		return err
+	}
+
+	switch node.NodeType {
+	case common.FileNode:
+		if node.IsEncrypted() && opts.EncryptionKey == nil {
+			log.Printf("skipping encrypted file %s, no key given", node.Path)
+			stats.Skipped++
+			return nil
+		}
+		data, err := nodeData(file, node, opts.EncryptionKey, 0)
+		if err != nil {
+			return err
+		}
+
+		// Don't follow a symlink already at the path
+		outFile, err := os.OpenFile(outputPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|oNoFollow, 0600)
+		if err != nil {
+			return fmt.Errorf("error creating file %s: %v", node.Path, err)
+		}
+		defer outFile.Close()
+
+		n, err := io.Copy(outFile, data)
+		if err != nil {
+			return fmt.Errorf("error extracting file %s: %v", node.Path, err)
+		}
+		stats.Bytes += n
+		stats.Entries++
+		if err := fchmod(outFile, extractMode(node, opts)); err != nil {
+			return err
+		}
+
+		// Capabilities need root, extraction goes on without them
+		for name, value := range node.Xattrs {
+			if err := fsetxattr(outFile, name, value); err != nil && opts.Verbose {
+				log.Printf("error setting xattr %s of %s: %v", name, node.Path, err)
+			}
+		}
+		return nil
+
+	case common.DirNode:
+		if info, err := os.Lstat(outputPath); err == nil && !info.IsDir() {
+			return fmt.Errorf("refusing to extract directory %s over something that is not a directory", node.Path)
+		}
+		// The mode is set once the directory is filled
+		if err := os.MkdirAll(outputPath, 0700); err != nil {
+			return fmt.Errorf("error creating directory %s: %v", node.Path, err)
+		}
+
+	case common.SymLinkNode:
+		// Replace what an earlier extract left there
+		if info, err := os.Lstat(outputPath); err == nil && !info.IsDir() {
+			os.Remove(outputPath)
+		}
+		if err := os.Symlink(node.Target, outputPath); err != nil {
+			return fmt.Errorf("error creating symlink %s: %v", node.Path, err)
+		}
+
+	case common.SpecialNode:
+		fileType := node.Attr.Mode & syscall.S_IFMT
+		if (fileType == syscall.S_IFCHR || fileType == syscall.S_IFBLK) && !opts.AllowDevices {
+			if opts.Verbose {
+				log.Printf("skipping device %s", node.Path)
+			}
+			stats.Skipped++
+			return nil
+		}
+
+		// Creating device nodes needs privileges, skip them rather than failing the whole extract
+		err := mknod(outputPath, fileType|extractMode(node, opts), node.Attr.Rdev)
+		if err != nil && opts.Verbose {
+			log.Printf("error creating special file %s: %v", node.Path, err)
+		}
+		if err != nil {
+			stats.Skipped++
+			return nil
+		}
+	}
+
+	stats.Entries++
+	return nil
+}
@@ -0,0 +1,63 @@
+package archive
+
+import (
+	"fmt"
+	"strings"
+
+	common "github.com/NilayYadav/clip/pkg/common"
+	"github.com/tidwall/btree"
+)
+
+// ArchiveLimits caps what reading an archive may use, so a crafted archive can't exhaust the
+// memory or disk of the host reading it. 0 means unlimited.
+type ArchiveLimits struct {
+	MaxMetadataSize int64 // Bytes of the index, once decompressed, and of the storage info
+	MaxNodes        int   // Files, directories and links in the index
+	MaxPathDepth    int   // Components of any path in the index
+	MaxExtractSize  int64 // Bytes of file data written by Extract
+}
+
+// checkSection makes sure a section of the archive lies within the file and within the metadata limit
+func (ca *ClipArchiver) checkSection(name string, pos int64, length int64, fileSize int64) error {
+	if pos < 0 || length < 0 || pos > fileSize || length > fileSize-pos {
+		return fmt.Errorf("%w: %s at %d of length %d is outside the file", common.ErrCorruptArchive, name, pos, length)
+	}
+	if ca.Limits.MaxMetadataSize > 0 && length > ca.Limits.MaxMetadataSize {
+		return fmt.Errorf("archive %s is %d bytes, more than the limit of %d", name, length, ca.Limits.MaxMetadataSize)
+	}
+	return nil
+}
+
+func (ca *ClipArchiver) checkNodes(nodes []*common.ClipNode) error {
+	if ca.Limits.MaxNodes > 0 && len(nodes) > ca.Limits.MaxNodes {
+		return fmt.Errorf("archive holds %d entries, more than the limit of %d", len(nodes), ca.Limits.MaxNodes)
+	}
+
+	if ca.Limits.MaxPathDepth > 0 {
+		for _, node := range nodes {
+			if depth := strings.Count(strings.Trim(node.Path, "/"), "/") + 1; depth > ca.Limits.MaxPathDepth {
+				return fmt.Errorf("archive path %s is %d levels deep, more than the limit of %d", node.Path, depth, ca.Limits.MaxPathDepth)
+			}
+		}
+	}
+	return nil
+}
+
+// checkExtractSize makes sure extracting an index won't write more than the extract limit
+func (ca *ClipArchiver) checkExtractSize(index *btree.BTree) error {
+	if ca.Limits.MaxExtractSize <= 0 {
+		return nil
+	}
+
+	var total int64
+	index.Ascend(index.Min(), func(a interface{}) bool {
+		if node := a.(*common.ClipNode); node.NodeType == common.FileNode {
+			total += node.DataLen
+		}
+		return total <= ca.Limits.MaxExtractSize
+	})
+	if total > ca.Limits.MaxExtractSize {
+		return fmt.Errorf("archive holds more than %d bytes of files, the extract limit", ca.Limits.MaxExtractSize)
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package archive
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	common "github.com/NilayYadav/clip/pkg/common"
+	"github.com/karrick/godirwalk"
+	"github.com/tidwall/btree"
+)
+
+// ManifestEntry maps a source file or directory to its path inside the archive
+type ManifestEntry struct {
+	Source      string
+	Destination string
+}
+
+// ReadManifest reads a manifest, one entry per line: an absolute source path and the destination
+// path inside the archive, separated by a tab, or by spaces if neither path has any. A line with a
+// single path puts the source at the same path in the archive. Blank lines and lines starting with
+// # are skipped.
+func ReadManifest(name string) ([]ManifestEntry, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []ManifestEntry
+	scanner := bufio.NewScanner(f)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var fields []string
+		if strings.Contains(line, "\t") {
+			fields = strings.Split(line, "\t")
+		} else {
+			fields = strings.Fields(line)
+		}
+
+		entry := ManifestEntry{Source: strings.TrimSpace(fields[0])}
+		switch len(fields) {
+		case 1:
+			entry.Destination = entry.Source
+		case 2:
+			entry.Destination = strings.TrimSpace(fields[1])
+		default:
+			return nil, fmt.Errorf("%s:%d: expected a source and a destination path", name, lineNumber)
+		}
+
+		if !filepath.IsAbs(entry.Source) {
+			return nil, fmt.Errorf("%s:%d: source path %s is not absolute", name, lineNumber, entry.Source)
+		}
+		entry.Destination = path.Join("/", entry.Destination)
+
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// populateIndexFromManifest creates the index of an archive assembled from the entries of a manifest.
+// Directories are added with everything in them, and the parents of every destination are created
+// if no entry provides them. It returns the source file of each node.
+func (ca *ClipArchiver) populateIndexFromManifest(index *btree.BTree, entries []ManifestEntry) (map[string]string, error) {
+	inodes := newInodeAssigner()
+	index.Set(ca.manifestDir("/", inodes))
+	sources := make(map[string]string)
+
+	add := func(source string, destination string) error {
+		if existing, exists := sources[destination]; exists {
+			return fmt.Errorf("%s and %s are both archived at %s", existing, source, destination)
+		}
+
+		node, err := ca.sourceNode(source, destination, inodes)
+		if err != nil {
+			return err
+		}
+
+		// Directories an entry provides replace the ones made up for the parents of earlier entries
+		if existing := index.Get(&common.ClipNode{Path: destination}); existing != nil && (!node.IsDir() || !existing.(*common.ClipNode).IsDir()) {
+			return fmt.Errorf("%s is archived at %s, which is already a directory", source, destination)
+		}
+
+		sources[destination] = source
+		index.Set(node)
+		return nil
+	}
+
+	for _, entry := range entries {
+		ca.addParents(index, entry.Destination, inodes)
+
+		info, err := os.Lstat(entry.Source)
+		if err != nil {
+			return nil, err
+		}
+
+		if !info.IsDir() {
+			if err := add(entry.Source, entry.Destination); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		err = godirwalk.Walk(entry.Source, &godirwalk.Options{
+			Callback: func(p string, de *godirwalk.Dirent) error {
+				return add(p, path.Join(entry.Destination, strings.TrimPrefix(p, entry.Source)))
+			},
+			Unsorted: false, // Inodes depend on the walk order
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return sources, nil
+}
+
+// addParents creates directory nodes for the parents of p missing from the index
+func (ca *ClipArchiver) addParents(index *btree.BTree, p string, inodes *inodeAssigner) {
+	for parent := path.Dir(p); parent != "/"; parent = path.Dir(parent) {
+		if index.Get(&common.ClipNode{Path: parent}) != nil {
+			return
+		}
+		index.Set(ca.manifestDir(parent, inodes))
+	}
+}
+
+// manifestDir creates a directory no manifest entry provides
+func (ca *ClipArchiver) manifestDir(p string, inodes *inodeAssigner) *common.ClipNode {
+	return &common.ClipNode{
+		Path:     p,
+		NodeType: common.DirNode,
+		Attr: common.Attr{
+			Ino:   inodes.gen.Next(),
+			Mode:  syscall.S_IFDIR | 0755,
+			Nlink: 2,
+		},
+	}
+}
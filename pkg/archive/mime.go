@@ -0,0 +1,86 @@
+package archive
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+
+	common "github.com/NilayYadav/clip/pkg/common"
+	"github.com/tidwall/btree"
+)
+
+const contentTypeSniffLen = 512 // All http.DetectContentType looks at
+
+// Types of files sniffing only finds are text, or binary, by extension. The table is fixed rather
+// than the system's mime.types, so reproducible archives don't depend on the machine.
+var extensionContentTypes = map[string]string{
+	".css":  "text/css; charset=utf-8",
+	".csv":  "text/csv; charset=utf-8",
+	".js":   "text/javascript; charset=utf-8",
+	".json": "application/json",
+	".md":   "text/markdown; charset=utf-8",
+	".mjs":  "text/javascript; charset=utf-8",
+	".svg":  "image/svg+xml",
+	".wasm": "application/wasm",
+	".xml":  "text/xml; charset=utf-8",
+	".yaml": "application/yaml",
+	".yml":  "application/yaml",
+}
+
+// contentType returns the MIME type of the file at p from the start of its content
+func contentType(p string, head []byte) string {
+	sniffed := http.DetectContentType(head)
+	switch {
+	case sniffed == "application/octet-stream", strings.HasPrefix(sniffed, "text/plain"), strings.HasPrefix(sniffed, "text/xml"):
+		if byExtension, ok := extensionContentTypes[strings.ToLower(path.Ext(p))]; ok {
+			return byExtension
+		}
+	}
+	return sniffed
+}
+
+// detectContentTypes sets the content type of the files of the index. Encrypted files are left
+// without one, it would tell what they hold.
+func (ca *ClipArchiver) detectContentTypes(index *btree.BTree, opts ClipArchiverOptions) error {
+	var err error
+	index.Ascend(index.Min(), func(a interface{}) bool {
+		node := a.(*common.ClipNode)
+		if node.NodeType != common.FileNode || node.IsEncrypted() {
+			return true
+		}
+
+		var f io.ReadCloser
+		if f, err = openSource(node, opts); err != nil {
+			err = fmt.Errorf("failed to read file contents for their type: %w", err)
+			return false
+		}
+		defer f.Close()
+
+		head := make([]byte, contentTypeSniffLen)
+		n, readErr := io.ReadFull(f, head)
+		if readErr != nil && readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
+			err = fmt.Errorf("failed to read file contents for their type: %w", readErr)
+			return false
+		}
+		node.ContentType = contentType(node.Path, head[:n])
+		return true
+	})
+	return err
+}
+
+// headWriter keeps the first bytes written to it, to sniff the type of content streamed elsewhere
+type headWriter struct {
+	head []byte
+}
+
+func (w *headWriter) Write(p []byte) (int, error) {
+	if left := contentTypeSniffLen - len(w.head); left > 0 {
+		if len(p) < left {
+			left = len(p)
+		}
+		w.head = append(w.head, p[:left]...)
+	}
+	return len(p), nil
+}
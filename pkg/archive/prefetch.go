@@ -0,0 +1,91 @@
+package archive
+
+import (
+	"log"
+	"path"
+	"strings"
+
+	"github.com/NilayYadav/clip/pkg/common"
+	"github.com/tidwall/btree"
+)
+
+// Modules python imports from its standard library before running any user code
+var pythonStartupModules = map[string]bool{
+	"site": true, "os": true, "stat": true, "posixpath": true, "genericpath": true, "_collections_abc": true,
+	"_sitebuiltins": true, "abc": true, "io": true, "codecs": true, "encodings/__init__": true,
+	"encodings/aliases": true, "encodings/utf_8": true, "encodings/latin_1": true,
+}
+
+// prefetchPaths resolves the files to prefetch on mount, in the order they were requested
+func (ca *ClipArchiver) prefetchPaths(index *btree.BTree, opts ClipArchiverOptions) []string {
+	var paths []string
+	seen := make(map[string]bool)
+
+	add := func(node *common.ClipNode) {
+		if node.NodeType == common.FileNode && !seen[node.Path] {
+			seen[node.Path] = true
+			paths = append(paths, node.Path)
+		}
+	}
+
+	for _, pattern := range opts.PrefetchPaths {
+		pattern = path.Join("/", pattern)
+
+		matched := false
+		index.Ascend(index.Min(), func(a interface{}) bool {
+			node := a.(*common.ClipNode)
+			if ok, _ := path.Match(pattern, node.Path); ok {
+				add(node)
+				matched = true
+			}
+			return true
+		})
+
+		if !matched {
+			log.Printf("No files in archive match prefetch path %s\n", pattern)
+		}
+	}
+
+	if opts.PrefetchAuto {
+		index.Ascend(index.Min(), func(a interface{}) bool {
+			node := a.(*common.ClipNode)
+			if isPythonStartupModule(node.Path) {
+				add(node)
+			}
+			return true
+		})
+	}
+
+	if opts.Verbose && len(paths) > 0 {
+		log.Printf("Prefetching %d files on mount\n", len(paths))
+	}
+
+	return paths
+}
+
+// isPythonStartupModule reports whether p is a startup module (or its bytecode) in a python standard library, e.g. /usr/lib/python3.11/os.py
+func isPythonStartupModule(p string) bool {
+	dir, name := path.Split(p)
+
+	var module string
+	switch {
+	case path.Base(dir) == "__pycache__" && strings.HasSuffix(name, ".pyc"):
+		// Bytecode is named like __pycache__/os.cpython-311.pyc
+		base, _, _ := strings.Cut(name, ".")
+		module = path.Join(path.Dir(strings.TrimSuffix(dir, "/")), base)
+	case strings.HasSuffix(name, ".py"):
+		module = strings.TrimSuffix(p, ".py")
+	default:
+		return false
+	}
+
+	// Make the module relative to the closest standard library directory, e.g. lib/python3.11
+	parts := strings.Split(module, "/")
+	for i := len(parts) - 2; i >= 0; i-- {
+		if strings.HasPrefix(parts[i], "python3") {
+			return pythonStartupModules[strings.Join(parts[i+1:], "/")]
+		}
+	}
+
+	return false
+}
@@ -3,7 +3,7 @@ package archive
 import (
 	"context"
 	"encoding/gob"
-	"errors"
+	"io"
 	"log"
 	"os"
 
@@ -27,44 +27,73 @@ func NewRClipArchiver(si common.ClipStorageInfo) (*RClipArchiver, error) {
 	}, nil
 }
 
-func (rca *RClipArchiver) Create(ctx context.Context, archivePath string, outputPath string, credentials storage.ClipStorageCredentials, progressChan chan<- int) error {
+func (rca *RClipArchiver) Create(ctx context.Context, archivePath string, outputPath string, credentials storage.ClipStorageCredentials, uploadOpts storage.UploadOpts) error {
 	metadata, err := rca.ClipArchiver.ExtractMetadata(archivePath)
 	if err != nil {
 		return err
 	}
 
-	switch rca.StorageInfo.Type() {
-	case "s3":
-		var storageInfo *common.S3StorageInfo = rca.StorageInfo.(*common.S3StorageInfo)
-		clipStorage, err := storage.NewS3ClipStorage(metadata, storage.S3ClipStorageOpts{
-			Region:         storageInfo.Region,
-			Bucket:         storageInfo.Bucket,
-			Key:            storageInfo.Key,
-			Endpoint:       storageInfo.Endpoint,
-			ForcePathStyle: storageInfo.ForcePathStyle,
-			AccessKey:      credentials.S3.AccessKey,
-			SecretKey:      credentials.S3.SecretKey,
-		})
-		if err != nil {
-			return err
-		}
+	backend, err := storage.GetBackend(rca.StorageInfo.Type())
+	if err != nil {
+		return err
+	}
 
-		log.Println("Creating an RCLIP and storing original archive on S3")
-		err = rca.ClipArchiver.CreateRemoteArchive(rca.StorageInfo, metadata, outputPath)
-		if err != nil {
-			return err
-		}
-		log.Println("Archive created, uploading...")
+	uploadOpts.Credentials = credentials
 
-		err = clipStorage.Upload(ctx, archivePath, progressChan)
+	// Backends that store content per file need to upload before the rclip can describe where it went
+	if uploader, ok := backend.(storage.ContentUploader); ok {
+		log.Printf("Storing archive contents on %s\n", rca.StorageInfo.Type())
+		storageInfo, err := uploader.UploadContent(ctx, rca.StorageInfo, metadata, archivePath, uploadOpts)
 		if err != nil {
-			log.Printf("Unable to upload archive: %+v\n", err)
-			os.Remove(outputPath)
 			return err
 		}
-	default:
-		return errors.New("unsupported storage type")
+
+		log.Println("Contents uploaded, creating an RCLIP...")
+		return rca.ClipArchiver.CreateRemoteArchive(storageInfo, metadata, outputPath)
+	}
+
+	// Recorded so the upload, and later full downloads when mounting, can be checked against it
+	digest, err := Digest(archivePath)
+	if err != nil {
+		return err
+	}
+	metadata.Attributes.ArchiveDigest = digest
+
+	log.Printf("Creating an RCLIP and storing original archive on %s\n", rca.StorageInfo.Type())
+	err = rca.ClipArchiver.CreateRemoteArchive(rca.StorageInfo, metadata, outputPath)
+	if err != nil {
+		return err
+	}
+	log.Println("Archive created, uploading...")
+
+	err = backend.Upload(ctx, rca.StorageInfo, archivePath, uploadOpts)
+	if err != nil {
+		log.Printf("Unable to upload archive: %+v\n", err)
+		os.Remove(outputPath)
+		return err
+	}
+
+	log.Println("Archive uploaded, verifying...")
+	err = VerifyStored(ctx, rca.StorageInfo, archivePath, digest, uploadOpts)
+	if err != nil {
+		log.Printf("Unable to verify uploaded archive: %+v\n", err)
+		os.Remove(outputPath)
+		return err
 	}
 
 	return nil
 }
+
+// remoteReaderAt reads a remote archive as an io.ReaderAt
+type remoteReaderAt struct {
+	ctx    context.Context
+	remote storage.RemoteArchive
+}
+
+func (r *remoteReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := r.remote.ReadRange(r.ctx, p, off)
+	if err == nil && n < len(p) {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
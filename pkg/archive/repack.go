@@ -0,0 +1,208 @@
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc64"
+	"io"
+	"os"
+	"sort"
+
+	common "github.com/NilayYadav/clip/pkg/common"
+	log "github.com/okteto/okteto/pkg/log"
+)
+
+type RepackOptions struct {
+	InputFile   string
+	OutputFile  string
+	AccessOrder bool // Put the data of files in the archive's prefetch profile first, in the order they are read
+	Verbose     bool
+}
+
+// RepackStats describes how much a repack saved
+type RepackStats struct {
+	InputSize         int64
+	OutputSize        int64
+	Files             int
+	SharedFiles       int   // Files whose content was already written for another file
+	UnreferencedBytes int64 // Data no file pointed at
+	DuplicateBytes    int64 // Data repeated for files with the same content
+}
+
+// Repack rewrites a local archive in the current format. Only data referenced by the index is copied,
+// and files with the same content share a single data block.
+func (ca *ClipArchiver) Repack(opts RepackOptions) (*RepackStats, error) {
+	metadata, err := ca.ExtractMetadata(opts.InputFile)
+	if err != nil {
+		return nil, err
+	}
+	if metadata.StorageInfo != nil {
+		return nil, fmt.Errorf("%s is a remote archive, repack the archive it was stored from", opts.InputFile)
+	}
+
+	inFile, err := os.Open(opts.InputFile)
+	if err != nil {
+		return nil, err
+	}
+	defer inFile.Close()
+
+	inInfo, err := inFile.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if err := checkOutputFile(inInfo, opts.OutputFile); err != nil {
+		return nil, err
+	}
+
+	outFile, err := os.Create(opts.OutputFile)
+	if err != nil {
+		return nil, err
+	}
+	defer outFile.Close()
+
+	if _, err := outFile.Write(make([]byte, common.ClipHeaderLength)); err != nil {
+		return nil, err
+	}
+
+	nodes := ca.dataOrder(metadata, opts.AccessOrder)
+
+	// Measure the input before the nodes are pointed at their new blocks
+	var referenced int64
+	seen := make(map[int64]bool)
+	for _, node := range nodes {
+		if !seen[node.DataPos] {
+			seen[node.DataPos] = true
+			referenced += 1 + node.DataLen + ChecksumLength
+		}
+	}
+
+	shared, written, err := ca.copyBlocks(inFile, outFile, nodes, opts.Verbose)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ca.writeIndexAndHeader(outFile, metadata.Index, metadata.Attributes); err != nil {
+		return nil, err
+	}
+
+	outInfo, err := outFile.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	return &RepackStats{
+		InputSize:         inInfo.Size(),
+		OutputSize:        outInfo.Size(),
+		Files:             len(nodes),
+		SharedFiles:       shared,
+		UnreferencedBytes: metadata.Header.IndexPos - int64(common.ClipHeaderLength) - referenced,
+		DuplicateBytes:    referenced - written,
+	}, nil
+}
+
+// checkOutputFile refuses an output file that is the input, through a link or not, as creating it would
+// truncate the input before its data is copied
+func checkOutputFile(inInfo os.FileInfo, outputFile string) error {
+	outInfo, err := os.Stat(outputFile)
+	if err == nil && os.SameFile(inInfo, outInfo) {
+		return fmt.Errorf("%s is the input archive, write to another file", outputFile)
+	}
+	return nil
+}
+
+// dataOrder returns the file nodes of an archive in the order their data should be written: the order
+// it was written in before, or prefetched files first if accessOrder is set
+func (ca *ClipArchiver) dataOrder(metadata *common.ClipArchiveMetadata, accessOrder bool) []*common.ClipNode {
+	var nodes []*common.ClipNode
+	metadata.Index.Ascend(metadata.Index.Min(), func(a interface{}) bool {
+		if node := a.(*common.ClipNode); node.NodeType == common.FileNode {
+			nodes = append(nodes, node)
+		}
+		return true
+	})
+	sort.SliceStable(nodes, func(i, j int) bool { return nodes[i].DataPos < nodes[j].DataPos })
+
+	if !accessOrder {
+		return nodes
+	}
+
+	rank := make(map[string]int, len(metadata.Attributes.PrefetchPaths))
+	for i, p := range metadata.Attributes.PrefetchPaths {
+		if _, exists := rank[p]; !exists {
+			rank[p] = i
+		}
+	}
+	sort.SliceStable(nodes, func(i, j int) bool {
+		ri, iOk := rank[nodes[i].Path]
+		rj, jOk := rank[nodes[j].Path]
+		if iOk && jOk {
+			return ri < rj
+		}
+		return iOk && !jOk
+	})
+
+	return nodes
+}
+
+// copyBlocks copies the data blocks of nodes from an archive into outFile, which must be positioned
+// right after its header, and points the nodes at their new blocks. The content of each block is
+// checked against its checksum on the way. It returns how many nodes share a block written for an
+// earlier node and the number of bytes written.
+func (ca *ClipArchiver) copyBlocks(inFile *os.File, outFile *os.File, nodes []*common.ClipNode, verbose bool) (int, int64, error) {
+	writer := bufio.NewWriterSize(outFile, 512*1024)
+	pos := int64(common.ClipHeaderLength)
+	table := crc64.MakeTable(crc64.ISO)
+
+	type block struct {
+		pos    int64
+		length int64
+	}
+	written := make(map[string]block) // Keyed by content hash
+	shared := 0
+
+	for _, node := range nodes {
+		if b, exists := written[node.ContentHash]; exists && node.ContentHash != "" {
+			node.DataPos, node.DataLen = b.pos, b.length
+			shared++
+			continue
+		}
+
+		if verbose {
+			log.Spinner(fmt.Sprintf("Copying... %s", node.Path))
+		}
+
+		if err := binary.Write(writer, binary.LittleEndian, common.BlockTypeFile); err != nil {
+			return 0, 0, err
+		}
+		pos++
+
+		hash := crc64.New(table)
+		if _, err := io.Copy(io.MultiWriter(writer, hash), io.NewSectionReader(inFile, node.DataPos, node.DataLen)); err != nil {
+			return 0, 0, fmt.Errorf("error copying %s: %v", node.Path, err)
+		}
+
+		checksum := make([]byte, ChecksumLength)
+		if _, err := inFile.ReadAt(checksum, node.DataPos+node.DataLen); err != nil {
+			return 0, 0, fmt.Errorf("error reading checksum of %s: %v", node.Path, err)
+		}
+		if !bytes.Equal(checksum, hash.Sum(nil)) {
+			return 0, 0, fmt.Errorf("%w: %s", common.ErrCrcMismatch, node.Path)
+		}
+
+		if _, err := writer.Write(checksum); err != nil {
+			return 0, 0, err
+		}
+
+		node.DataPos = pos
+		pos += node.DataLen + ChecksumLength
+		written[node.ContentHash] = block{pos: node.DataPos, length: node.DataLen}
+	}
+
+	if err := writer.Flush(); err != nil {
+		return 0, 0, err
+	}
+
+	return shared, pos - int64(common.ClipHeaderLength), nil
+}
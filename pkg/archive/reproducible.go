@@ -0,0 +1,34 @@
+package archive
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+
+	common "github.com/NilayYadav/clip/pkg/common"
+	"github.com/tidwall/btree"
+)
+
+// normalizeAttrs drops what makes two archives of the same tree differ: every timestamp is set
+// to epoch and every file is owned by root. Inodes, ordering and the rest of the attributes
+// already only depend on the tree.
+func (ca *ClipArchiver) normalizeAttrs(index *btree.BTree, epoch int64) {
+	index.Ascend(index.Min(), func(a interface{}) bool {
+		attr := &a.(*common.ClipNode).Attr
+		attr.Atime, attr.Atimensec = uint64(epoch), 0
+		attr.Mtime, attr.Mtimensec = uint64(epoch), 0
+		attr.Ctime, attr.Ctimensec = uint64(epoch), 0
+		attr.Owner.Uid, attr.Owner.Gid = 0, 0
+		return true
+	})
+}
+
+// reproducibleIV derives the IV of an encrypted file from its path and content. The same file
+// always gets the same IV, and a file whose content changes gets a new one, so keystreams are
+// never reused for different content.
+func reproducibleIV(key []byte, node *common.ClipNode) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(node.Path))
+	mac.Write([]byte{0})
+	mac.Write([]byte(node.ContentHash))
+	return mac.Sum(nil)[:16]
+}
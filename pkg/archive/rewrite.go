@@ -0,0 +1,164 @@
+package archive
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"syscall"
+
+	common "github.com/NilayYadav/clip/pkg/common"
+)
+
+// PathRewrite moves everything under From in an archive to To
+type PathRewrite struct {
+	From string
+	To   string
+}
+
+// ParsePathRewrite parses a rewrite given as from=to, like /build/out=/app
+func ParsePathRewrite(spec string) (PathRewrite, error) {
+	from, to, ok := strings.Cut(spec, "=")
+	if !ok || from == "" || to == "" {
+		return PathRewrite{}, fmt.Errorf("invalid path rewrite %q, want from=to", spec)
+	}
+	return PathRewrite{From: path.Join("/", from), To: path.Join("/", to)}, nil
+}
+
+// rewrite returns where p ends up, and whether a rewrite applies to it
+func (r PathRewrite) rewrite(p string) (string, bool) {
+	if r.From == "/" {
+		return path.Join(r.To, p), true
+	}
+	if p == r.From {
+		return r.To, true
+	}
+	if rest, ok := strings.CutPrefix(p, r.From+"/"); ok {
+		return path.Join(r.To, rest), true
+	}
+	return p, false
+}
+
+// RewritePaths rewrites the index of an archive so it's laid out the way rewrites ask, the first
+// rewrite matching a path applies. Absolute symlink targets are rewritten with the paths they point
+// to, and directories missing above a new path are made up. Files moved onto a file the archive
+// already holds replace it, directories moved onto a directory are merged with it.
+func (ca *ClipArchiver) RewritePaths(metadata *common.ClipArchiveMetadata, rewrites []PathRewrite) error {
+	if len(rewrites) == 0 {
+		return nil
+	}
+
+	rewrite := func(p string) (string, bool) {
+		for _, r := range rewrites {
+			if rewritten, ok := r.rewrite(p); ok {
+				return rewritten, true
+			}
+		}
+		return p, false
+	}
+
+	index := ca.newIndex()
+	moved := make(map[string]bool)
+	var err error
+
+	metadata.Index.Ascend(metadata.Index.Min(), func(a interface{}) bool {
+		original := a.(*common.ClipNode)
+		node := *original
+
+		var isMoved bool
+		node.Path, isMoved = rewrite(node.Path)
+		if node.IsSymlink() && path.IsAbs(node.Target) {
+			node.Target, _ = rewrite(node.Target)
+		}
+
+		if existing := index.Get(&common.ClipNode{Path: node.Path}); existing != nil {
+			existingNode := existing.(*common.ClipNode)
+			switch {
+			case existingNode.IsDir() && node.IsDir():
+				// Merge the directories, keeping the attributes of the one that was moved
+				if moved[node.Path] {
+					return true
+				}
+			case existingNode.IsDir() || node.IsDir():
+				err = fmt.Errorf("rewriting %s to %s conflicts with %s", original.Path, node.Path, existingNode.Path)
+				return false
+			case moved[node.Path] && isMoved:
+				err = fmt.Errorf("%s and %s are both rewritten to %s", existingNode.Path, original.Path, node.Path)
+				return false
+			case moved[node.Path]:
+				return true
+			}
+		}
+
+		if isMoved {
+			moved[node.Path] = true
+		}
+		index.Set(&node)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	// Make up the directories leading to rewritten paths
+	var missing []string
+	index.Ascend(index.Min(), func(a interface{}) bool {
+		p := a.(*common.ClipNode).Path
+		for parent := path.Dir(p); parent != p; p, parent = parent, path.Dir(parent) {
+			if index.Get(&common.ClipNode{Path: parent}) == nil {
+				missing = append(missing, parent)
+			}
+		}
+		return true
+	})
+	for _, p := range missing {
+		index.Set(madeUpDir(p))
+	}
+
+	for i, p := range metadata.Attributes.PrefetchPaths {
+		metadata.Attributes.PrefetchPaths[i], _ = rewrite(p)
+	}
+	if search := metadata.Attributes.SearchIndex; search != nil {
+		for i, p := range search.Paths {
+			search.Paths[i], _ = rewrite(p)
+		}
+		for i, p := range search.Binary {
+			search.Binary[i], _ = rewrite(p)
+		}
+	}
+
+	metadata.Index = index
+	return nil
+}
+
+// AddDirs adds empty directories at paths to an archive's index, with the directories leading to them,
+// so something can be mounted there. Directories the archive holds already are kept, paths the archive
+// holds something else at are an error.
+func (ca *ClipArchiver) AddDirs(metadata *common.ClipArchiveMetadata, paths []string) error {
+	for _, p := range paths {
+		for p = path.Join("/", p); ; p = path.Dir(p) {
+			node := metadata.Get(p)
+			if node != nil {
+				if !node.IsDir() {
+					return fmt.Errorf("can't make a directory at %s, the archive holds a file there", p)
+				}
+				break
+			}
+			metadata.Insert(madeUpDir(p))
+			if p == "/" {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func madeUpDir(p string) *common.ClipNode {
+	return &common.ClipNode{
+		Path:     p,
+		NodeType: common.DirNode,
+		Attr: common.Attr{
+			Mode:  syscall.S_IFDIR | 0755,
+			Nlink: 2,
+		},
+	}
+}
@@ -0,0 +1,115 @@
+package archive
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	common "github.com/NilayYadav/clip/pkg/common"
+)
+
+// Labels a root filesystem import records the image config in, lists are JSON arrays
+const (
+	LabelEntrypoint = "clip.rootfs.entrypoint"
+	LabelCmd        = "clip.rootfs.cmd"
+	LabelEnv        = "clip.rootfs.env"
+	LabelWorkingDir = "clip.rootfs.workdir"
+	LabelUser       = "clip.rootfs.user"
+)
+
+// ImageConfig is how a container runs a root filesystem, like docker inspect reports for an image
+type ImageConfig struct {
+	Entrypoint []string
+	Cmd        []string
+	Env        []string
+	WorkingDir string
+	User       string
+	Labels     map[string]string // Copied into the archive's labels as they are
+}
+
+// LoadImageConfig reads an image config from the output of docker inspect, an OCI image config, or a
+// JSON object holding just the config
+func LoadImageConfig(name string) (*ImageConfig, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	// docker inspect prints a list of images, each with its config under Config, as do OCI image
+	// configs under config
+	var wrapped struct {
+		Config *ImageConfig
+	}
+	var inspected []json.RawMessage
+	if err := json.Unmarshal(data, &inspected); err == nil {
+		if len(inspected) != 1 {
+			return nil, fmt.Errorf("image config %s lists %d images, expected one", name, len(inspected))
+		}
+		data = inspected[0]
+	}
+	if err := json.Unmarshal(data, &wrapped); err != nil {
+		return nil, fmt.Errorf("invalid image config %s: %v", name, err)
+	}
+	if wrapped.Config != nil {
+		return wrapped.Config, nil
+	}
+
+	config := &ImageConfig{}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("invalid image config %s: %v", name, err)
+	}
+	return config, nil
+}
+
+// AddLabels adds the labels recording c to labels, creating the map if it's nil. Labels given
+// explicitly win over those of the image.
+func (c *ImageConfig) AddLabels(labels map[string]string) (map[string]string, error) {
+	if labels == nil {
+		labels = make(map[string]string)
+	}
+	set := func(key string, value string) {
+		if _, ok := labels[key]; !ok && value != "" {
+			labels[key] = value
+		}
+	}
+
+	for key, value := range c.Labels {
+		set(key, value)
+	}
+	for key, list := range map[string][]string{LabelEntrypoint: c.Entrypoint, LabelCmd: c.Cmd, LabelEnv: c.Env} {
+		if list == nil {
+			continue
+		}
+		encoded, err := json.Marshal(list)
+		if err != nil {
+			return nil, err
+		}
+		set(key, string(encoded))
+	}
+	set(LabelWorkingDir, c.WorkingDir)
+	set(LabelUser, c.User)
+	return labels, nil
+}
+
+// rootfsSkipped reports whether a root filesystem import leaves an entry out: what's in /proc and /sys,
+// which the container runtime mounts over them, and the marker docker adds to exported containers
+func rootfsSkipped(p string) bool {
+	return strings.HasPrefix(p, "/proc/") || strings.HasPrefix(p, "/sys/") || p == "/.dockerenv"
+}
+
+// setRootfsAttrs keeps what a container needs of a tar entry that archives otherwise drop: setuid,
+// setgid and sticky bits, and extended attributes like file capabilities
+func setRootfsAttrs(node *common.ClipNode, hdr *tar.Header) {
+	node.Attr.Mode |= uint32(hdr.Mode) & 07000
+
+	for key, value := range hdr.PAXRecords {
+		if name, ok := strings.CutPrefix(key, "SCHILY.xattr."); ok {
+			if node.Xattrs == nil {
+				node.Xattrs = make(map[string][]byte)
+			}
+			node.Xattrs[name] = []byte(value)
+		}
+	}
+}
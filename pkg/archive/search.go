@@ -0,0 +1,42 @@
+package archive
+
+import (
+	"fmt"
+	"io"
+
+	common "github.com/NilayYadav/clip/pkg/common"
+	"github.com/tidwall/btree"
+)
+
+// buildSearchIndex indexes the trigrams of the files of the index. Encrypted files are left out, the
+// index would give their content away.
+func (ca *ClipArchiver) buildSearchIndex(index *btree.BTree, opts ClipArchiverOptions) (*common.SearchIndex, error) {
+	builder := common.NewSearchIndexBuilder()
+
+	var err error
+	index.Ascend(index.Min(), func(a interface{}) bool {
+		node := a.(*common.ClipNode)
+		if node.NodeType != common.FileNode || node.IsEncrypted() {
+			return true
+		}
+
+		var f io.ReadCloser
+		if f, err = openSource(node, opts); err != nil {
+			err = fmt.Errorf("failed to read file contents for the search index: %w", err)
+			return false
+		}
+		defer f.Close()
+
+		file := builder.File(node.Path)
+		if _, err = io.Copy(file, f); err != nil {
+			err = fmt.Errorf("failed to read file contents for the search index: %w", err)
+			return false
+		}
+		file.Commit()
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return builder.Build(), nil
+}
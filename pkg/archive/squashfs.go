@@ -0,0 +1,474 @@
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"syscall"
+
+	common "github.com/NilayYadav/clip/pkg/common"
+	log "github.com/okteto/okteto/pkg/log"
+)
+
+// SquashFS 4.0 images, as the Linux kernel reads them. Data and metadata are zlib compressed, files
+// aren't packed in fragments and there are no export or xattr tables.
+const (
+	squashfsMagic     = 0x73717368
+	squashfsBlockSize = 128 * 1024
+	squashfsBlockLog  = 17
+	squashfsMetaSize  = 8192 // Of metadata blocks, uncompressed
+	squashfsZlib      = 1
+	squashfsSuperSize = 96
+	squashfsAlign     = 4096 // Images are padded to a multiple of this for loop devices
+
+	squashfsNoFragments = 1 << 4
+	squashfsDuplicates  = 1 << 6
+	squashfsNoXattrs    = 1 << 9
+
+	squashfsUncompressedBlock = 1 << 24
+	squashfsUncompressedMeta  = 1 << 15
+	squashfsInvalid           = 0xffffffff
+	squashfsInvalidTable      = 0xffffffffffffffff
+
+	squashfsMaxDirEntries = 256 // Under one directory header
+)
+
+// Inode types. Directory entries always give the basic type.
+const (
+	squashfsDirType = iota + 1
+	squashfsFileType
+	squashfsSymlinkType
+	squashfsBlockDevType
+	squashfsCharDevType
+	squashfsFifoType
+	squashfsSocketType
+	squashfsLDirType
+	squashfsLFileType
+)
+
+type squashfsCompressor struct {
+	buf bytes.Buffer
+	zw  *zlib.Writer
+}
+
+func newSquashfsCompressor() *squashfsCompressor {
+	c := &squashfsCompressor{}
+	c.zw = zlib.NewWriter(&c.buf)
+	return c
+}
+
+// compress returns p compressed, valid until the next call
+func (c *squashfsCompressor) compress(p []byte) []byte {
+	c.buf.Reset()
+	c.zw.Reset(&c.buf)
+	c.zw.Write(p)
+	c.zw.Close()
+	return c.buf.Bytes()
+}
+
+// squashfsTable packs a table in metadata blocks, each compressed on its own. Entries are referred
+// to by the position of the block they start in and their offset in it, uncompressed.
+type squashfsTable struct {
+	out    []byte
+	cur    []byte
+	blocks []int // Positions of the blocks in out
+	c      *squashfsCompressor
+}
+
+func (t *squashfsTable) ref() (uint32, uint16) {
+	return uint32(len(t.out)), uint16(len(t.cur))
+}
+
+func (t *squashfsTable) write(p []byte) {
+	t.cur = append(t.cur, p...)
+	for len(t.cur) >= squashfsMetaSize {
+		t.flush(squashfsMetaSize)
+	}
+}
+
+func (t *squashfsTable) flush(n int) {
+	t.blocks = append(t.blocks, len(t.out))
+	if compressed := t.c.compress(t.cur[:n]); len(compressed) < n {
+		t.out = binary.LittleEndian.AppendUint16(t.out, uint16(len(compressed)))
+		t.out = append(t.out, compressed...)
+	} else {
+		t.out = binary.LittleEndian.AppendUint16(t.out, uint16(n)|squashfsUncompressedMeta)
+		t.out = append(t.out, t.cur[:n]...)
+	}
+	t.cur = append([]byte(nil), t.cur[n:]...)
+}
+
+func (t *squashfsTable) finish() []byte {
+	if len(t.cur) > 0 {
+		t.flush(len(t.cur))
+	}
+	return t.out
+}
+
+// squashfsData is where the data of a file was written, shared by its hard links and files with the
+// same content
+type squashfsData struct {
+	start uint64
+	sizes []uint32 // Of each block, flagged if it's stored uncompressed
+}
+
+type squashfsWriter struct {
+	out      *countingWriter
+	c        *squashfsCompressor
+	inodes   *squashfsTable
+	dirs     *squashfsTable
+	ids      []uint32
+	idIndex  map[uint32]uint16
+	children map[string][]*common.ClipNode
+	numbers  map[string]uint32 // Inode number of every path
+	data     map[uint64]*squashfsData
+	nlinks   map[uint64]uint32 // Paths of each hard linked inode
+	refs     map[uint64]uint64 // Inodes written for hard linked files
+	count    uint32
+}
+
+// exportSquashFS writes the archive as a SquashFS image, for hosts which loop mount images rather
+// than run a FUSE daemon. Data is streamed from the archive a block at a time; files sharing content
+// share their blocks.
+func (ca *ClipArchiver) exportSquashFS(metadata *common.ClipArchiveMetadata, inFile *os.File, outFile *os.File, opts ExportOptions) (*ExportStats, error) {
+	root := metadata.Get("/")
+	if root == nil {
+		return nil, fmt.Errorf("archive has no root directory")
+	}
+
+	out := bufio.NewWriterSize(outFile, 512*1024)
+	c := newSquashfsCompressor()
+	w := &squashfsWriter{
+		out:      &countingWriter{w: out},
+		c:        c,
+		inodes:   &squashfsTable{c: c},
+		dirs:     &squashfsTable{c: c},
+		idIndex:  make(map[uint32]uint16),
+		children: make(map[string][]*common.ClipNode),
+		numbers:  make(map[string]uint32),
+		data:     make(map[uint64]*squashfsData),
+		nlinks:   make(map[uint64]uint32),
+		refs:     make(map[uint64]uint64),
+	}
+	stats := &ExportStats{}
+
+	// The superblock is written last, once the tables are placed
+	if _, err := w.out.Write(make([]byte, squashfsSuperSize)); err != nil {
+		return nil, err
+	}
+
+	// The index is sorted by path, so the children of a directory come sorted by name, as lookups
+	// need them
+	var err error
+	shared := make(map[string]*squashfsData) // Keyed by content hash
+	metadata.Index.Ascend(metadata.Index.Min(), func(a interface{}) bool {
+		node := a.(*common.ClipNode)
+		if node.Path == "/" {
+			return true
+		}
+		if node.NodeType == common.FileNode {
+			if node.IsEncrypted() && opts.EncryptionKey == nil {
+				log.Printf("skipping encrypted file %s, no key given", node.Path)
+				stats.Skipped++
+				return true
+			}
+			if err = w.writeData(node, inFile, shared, opts); err != nil {
+				return false
+			}
+			w.nlinks[node.Attr.Ino]++
+		}
+		w.children[path.Dir(node.Path)] = append(w.children[path.Dir(node.Path)], node)
+		stats.Entries++
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	w.number(root)
+	rootRef := w.writeDir(root, w.count+1)
+
+	// Tables follow the data, the id table last
+	inodeTableStart := uint64(w.out.n)
+	if _, err := w.out.Write(w.inodes.finish()); err != nil {
+		return nil, err
+	}
+	dirTableStart := uint64(w.out.n)
+	if _, err := w.out.Write(w.dirs.finish()); err != nil {
+		return nil, err
+	}
+
+	ids := &squashfsTable{c: c}
+	for _, id := range w.ids {
+		ids.write(binary.LittleEndian.AppendUint32(nil, id))
+	}
+	idBlocksStart := uint64(w.out.n)
+	if _, err := w.out.Write(ids.finish()); err != nil {
+		return nil, err
+	}
+	idTableStart := uint64(w.out.n)
+	var idTable []byte
+	for _, pos := range ids.blocks {
+		idTable = binary.LittleEndian.AppendUint64(idTable, idBlocksStart+uint64(pos))
+	}
+	if _, err := w.out.Write(idTable); err != nil {
+		return nil, err
+	}
+
+	bytesUsed := uint64(w.out.n)
+	if pad := (squashfsAlign - bytesUsed%squashfsAlign) % squashfsAlign; pad > 0 {
+		if _, err := w.out.Write(make([]byte, pad)); err != nil {
+			return nil, err
+		}
+	}
+	if err := out.Flush(); err != nil {
+		return nil, err
+	}
+
+	sb := make([]byte, 0, squashfsSuperSize)
+	sb = binary.LittleEndian.AppendUint32(sb, squashfsMagic)
+	sb = binary.LittleEndian.AppendUint32(sb, w.count)
+	sb = binary.LittleEndian.AppendUint32(sb, uint32(root.Attr.Mtime))
+	sb = binary.LittleEndian.AppendUint32(sb, squashfsBlockSize)
+	sb = binary.LittleEndian.AppendUint32(sb, 0) // Fragments
+	sb = binary.LittleEndian.AppendUint16(sb, squashfsZlib)
+	sb = binary.LittleEndian.AppendUint16(sb, squashfsBlockLog)
+	sb = binary.LittleEndian.AppendUint16(sb, squashfsNoFragments|squashfsDuplicates|squashfsNoXattrs)
+	sb = binary.LittleEndian.AppendUint16(sb, uint16(len(w.ids)))
+	sb = binary.LittleEndian.AppendUint16(sb, 4) // Version 4.0
+	sb = binary.LittleEndian.AppendUint16(sb, 0)
+	sb = binary.LittleEndian.AppendUint64(sb, rootRef)
+	sb = binary.LittleEndian.AppendUint64(sb, bytesUsed)
+	sb = binary.LittleEndian.AppendUint64(sb, idTableStart)
+	sb = binary.LittleEndian.AppendUint64(sb, squashfsInvalidTable) // Xattrs
+	sb = binary.LittleEndian.AppendUint64(sb, inodeTableStart)
+	sb = binary.LittleEndian.AppendUint64(sb, dirTableStart)
+	sb = binary.LittleEndian.AppendUint64(sb, squashfsInvalidTable) // Fragments
+	sb = binary.LittleEndian.AppendUint64(sb, squashfsInvalidTable) // Export
+	if _, err := outFile.WriteAt(sb, 0); err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+// writeData writes the blocks of a file, unless a hard link or a file with the same content was
+// written already
+func (w *squashfsWriter) writeData(node *common.ClipNode, inFile *os.File, shared map[string]*squashfsData, opts ExportOptions) error {
+	if _, written := w.data[node.Attr.Ino]; written {
+		return nil
+	}
+	if d, exists := shared[node.ContentHash]; exists && node.ContentHash != "" {
+		w.data[node.Attr.Ino] = d
+		return nil
+	}
+
+	data, err := nodeData(inFile, node, opts.EncryptionKey, 0)
+	if err != nil {
+		return err
+	}
+
+	if opts.Verbose {
+		log.Spinner(fmt.Sprintf("Exporting... %s", node.Path))
+	}
+
+	d := &squashfsData{start: uint64(w.out.n)}
+	block := make([]byte, squashfsBlockSize)
+	for left := node.DataLen; left > 0; {
+		n := int64(len(block))
+		if left < n {
+			n = left
+		}
+		if _, err := io.ReadFull(data, block[:n]); err != nil {
+			return fmt.Errorf("error exporting %s: %v", node.Path, err)
+		}
+
+		stored, size := w.c.compress(block[:n]), uint32(0)
+		if len(stored) < int(n) {
+			size = uint32(len(stored))
+		} else {
+			stored, size = block[:n], uint32(n)|squashfsUncompressedBlock
+		}
+		if _, err := w.out.Write(stored); err != nil {
+			return err
+		}
+		d.sizes = append(d.sizes, size)
+		left -= n
+	}
+
+	w.data[node.Attr.Ino] = d
+	if node.ContentHash != "" {
+		shared[node.ContentHash] = d
+	}
+	return nil
+}
+
+// number gives inode numbers in the order writeDir writes the inodes: the entries of a directory,
+// then the directory
+func (w *squashfsWriter) number(dir *common.ClipNode) {
+	links := make(map[uint64]uint32)
+	var walk func(dir *common.ClipNode)
+	walk = func(dir *common.ClipNode) {
+		for _, child := range w.children[dir.Path] {
+			if child.IsDir() {
+				walk(child)
+				continue
+			}
+			if child.NodeType == common.FileNode {
+				if n, linked := links[child.Attr.Ino]; linked {
+					w.numbers[child.Path] = n
+					continue
+				}
+				links[child.Attr.Ino] = w.count + 1
+			}
+			w.count++
+			w.numbers[child.Path] = w.count
+		}
+		w.count++
+		w.numbers[dir.Path] = w.count
+	}
+	walk(dir)
+}
+
+type squashfsEntry struct {
+	name   string
+	ref    uint64
+	number uint32
+	kind   uint16
+}
+
+// writeDir writes the inodes of the entries of a directory, its listing and its inode, and returns
+// the reference to the inode
+func (w *squashfsWriter) writeDir(dir *common.ClipNode, parent uint32) uint64 {
+	var entries []squashfsEntry
+	subdirs := uint32(0)
+	for _, child := range w.children[dir.Path] {
+		var ref uint64
+		var kind uint16
+		if child.IsDir() {
+			ref, kind = w.writeDir(child, w.numbers[dir.Path]), squashfsDirType
+			subdirs++
+		} else {
+			ref, kind = w.writeInode(child)
+		}
+		entries = append(entries, squashfsEntry{name: path.Base(child.Path), ref: ref, number: w.numbers[child.Path], kind: kind})
+	}
+
+	var listing []byte
+	for i := 0; i < len(entries); {
+		block, base := uint32(entries[i].ref>>16), entries[i].number
+		j := i
+		for j < len(entries) && j-i < squashfsMaxDirEntries && uint32(entries[j].ref>>16) == block {
+			if delta := int64(entries[j].number) - int64(base); delta < -32768 || delta > 32767 {
+				break
+			}
+			j++
+		}
+
+		listing = binary.LittleEndian.AppendUint32(listing, uint32(j-i-1))
+		listing = binary.LittleEndian.AppendUint32(listing, block)
+		listing = binary.LittleEndian.AppendUint32(listing, base)
+		for _, e := range entries[i:j] {
+			listing = binary.LittleEndian.AppendUint16(listing, uint16(e.ref))
+			listing = binary.LittleEndian.AppendUint16(listing, uint16(int16(int64(e.number)-int64(base))))
+			listing = binary.LittleEndian.AppendUint16(listing, e.kind)
+			listing = binary.LittleEndian.AppendUint16(listing, uint16(len(e.name)-1))
+			listing = append(listing, e.name...)
+		}
+		i = j
+	}
+	start, offset := w.dirs.ref()
+	w.dirs.write(listing)
+
+	inode := w.inodeHeader(dir, squashfsLDirType)
+	inode = binary.LittleEndian.AppendUint32(inode, 2+subdirs)
+	inode = binary.LittleEndian.AppendUint32(inode, uint32(len(listing)+3)) // Counting . and ..
+	inode = binary.LittleEndian.AppendUint32(inode, start)
+	inode = binary.LittleEndian.AppendUint32(inode, parent)
+	inode = binary.LittleEndian.AppendUint16(inode, 0) // No index
+	inode = binary.LittleEndian.AppendUint16(inode, offset)
+	inode = binary.LittleEndian.AppendUint32(inode, squashfsInvalid) // No xattrs
+	return w.writeInodeBytes(inode)
+}
+
+// writeInode writes the inode of an entry other than a directory and returns the reference to it and
+// its type
+func (w *squashfsWriter) writeInode(node *common.ClipNode) (uint64, uint16) {
+	var inode []byte
+	switch node.NodeType {
+	case common.FileNode:
+		if ref, written := w.refs[node.Attr.Ino]; written {
+			return ref, squashfsFileType
+		}
+		d := w.data[node.Attr.Ino]
+		inode = w.inodeHeader(node, squashfsLFileType)
+		inode = binary.LittleEndian.AppendUint64(inode, d.start)
+		inode = binary.LittleEndian.AppendUint64(inode, uint64(node.DataLen))
+		inode = binary.LittleEndian.AppendUint64(inode, 0) // No sparse blocks
+		inode = binary.LittleEndian.AppendUint32(inode, w.nlinks[node.Attr.Ino])
+		inode = binary.LittleEndian.AppendUint32(inode, squashfsInvalid) // No fragment
+		inode = binary.LittleEndian.AppendUint32(inode, 0)
+		inode = binary.LittleEndian.AppendUint32(inode, squashfsInvalid) // No xattrs
+		for _, size := range d.sizes {
+			inode = binary.LittleEndian.AppendUint32(inode, size)
+		}
+		ref := w.writeInodeBytes(inode)
+		w.refs[node.Attr.Ino] = ref
+		return ref, squashfsFileType
+
+	case common.SymLinkNode:
+		inode = w.inodeHeader(node, squashfsSymlinkType)
+		inode = binary.LittleEndian.AppendUint32(inode, 1)
+		inode = binary.LittleEndian.AppendUint32(inode, uint32(len(node.Target)))
+		inode = append(inode, node.Target...)
+		return w.writeInodeBytes(inode), squashfsSymlinkType
+	}
+
+	kind := uint16(squashfsSocketType)
+	switch node.Attr.Mode & syscall.S_IFMT {
+	case syscall.S_IFBLK:
+		kind = squashfsBlockDevType
+	case syscall.S_IFCHR:
+		kind = squashfsCharDevType
+	case syscall.S_IFIFO:
+		kind = squashfsFifoType
+	}
+	inode = w.inodeHeader(node, kind)
+	inode = binary.LittleEndian.AppendUint32(inode, 1)
+	if kind == squashfsBlockDevType || kind == squashfsCharDevType {
+		// Rdev is already in the kernel's encoding of device numbers
+		inode = binary.LittleEndian.AppendUint32(inode, node.Attr.Rdev)
+	}
+	return w.writeInodeBytes(inode), kind
+}
+
+func (w *squashfsWriter) inodeHeader(node *common.ClipNode, kind uint16) []byte {
+	header := binary.LittleEndian.AppendUint16(nil, kind)
+	header = binary.LittleEndian.AppendUint16(header, uint16(node.Attr.Mode&07777))
+	header = binary.LittleEndian.AppendUint16(header, w.id(node.Attr.Owner.Uid))
+	header = binary.LittleEndian.AppendUint16(header, w.id(node.Attr.Owner.Gid))
+	header = binary.LittleEndian.AppendUint32(header, uint32(node.Attr.Mtime))
+	return binary.LittleEndian.AppendUint32(header, w.numbers[node.Path])
+}
+
+func (w *squashfsWriter) writeInodeBytes(inode []byte) uint64 {
+	block, offset := w.inodes.ref()
+	w.inodes.write(inode)
+	return uint64(block)<<16 | uint64(offset)
+}
+
+// id returns the position of a uid or gid in the id table, adding it if it's new
+func (w *squashfsWriter) id(id uint32) uint16 {
+	if i, exists := w.idIndex[id]; exists {
+		return i
+	}
+	i := uint16(len(w.ids))
+	w.idIndex[id] = i
+	w.ids = append(w.ids, id)
+	return i
+}
@@ -0,0 +1,137 @@
+package archive
+
+import (
+	"fmt"
+	"os"
+	"path"
+
+	common "github.com/NilayYadav/clip/pkg/common"
+	log "github.com/okteto/okteto/pkg/log"
+)
+
+type SubsetOptions struct {
+	InputFile  string
+	OutputFile string
+	Paths      []string // Glob patterns of the paths to keep, see matchPathPattern. Directories are kept with everything in them.
+	Verbose    bool
+}
+
+// SubsetStats describes what a subset kept of its archive
+type SubsetStats struct {
+	InputSize  int64
+	OutputSize int64
+	Nodes      int
+	Files      int
+}
+
+// Subset writes a new local archive holding only the selected paths of an archive, and the
+// directories leading to them. Metadata and data blocks are copied as they are, so nothing is
+// mounted or extracted.
+func (ca *ClipArchiver) Subset(opts SubsetOptions) (*SubsetStats, error) {
+	metadata, err := ca.ExtractMetadata(opts.InputFile)
+	if err != nil {
+		return nil, err
+	}
+	if metadata.StorageInfo != nil {
+		return nil, fmt.Errorf("%s is a remote archive, take a subset of the archive it was stored from", opts.InputFile)
+	}
+
+	selected := func(p string) bool {
+		for ; ; p = path.Dir(p) {
+			for _, pattern := range opts.Paths {
+				if matchPathPattern(pattern, p) {
+					return true
+				}
+			}
+			if p == "/" {
+				return false
+			}
+		}
+	}
+
+	index := ca.newIndex()
+	index.Set(metadata.Get("/"))
+	metadata.Index.Ascend(metadata.Index.Min(), func(a interface{}) bool {
+		node := a.(*common.ClipNode)
+		if node.Path == "/" || !selected(node.Path) {
+			return true
+		}
+
+		index.Set(node)
+		for parent := path.Dir(node.Path); index.Get(&common.ClipNode{Path: parent}) == nil; parent = path.Dir(parent) {
+			index.Set(metadata.Get(parent))
+		}
+		return true
+	})
+	if index.Len() == 1 {
+		return nil, fmt.Errorf("no paths in %s match %v", opts.InputFile, opts.Paths)
+	}
+
+	// Symlinks pointing out of the subset are kept, warn since they won't resolve
+	index.Ascend(index.Min(), func(a interface{}) bool {
+		node := a.(*common.ClipNode)
+		if node.IsSymlink() {
+			target := node.Target
+			if !path.IsAbs(target) {
+				target = path.Join(path.Dir(node.Path), target)
+			}
+			if index.Get(&common.ClipNode{Path: path.Clean(target)}) == nil && metadata.Get(path.Clean(target)) != nil {
+				log.Printf("Symlink %s points to %s, which is not in the subset\n", node.Path, node.Target)
+			}
+		}
+		return true
+	})
+
+	attributes := metadata.Attributes
+	attributes.PrefetchPaths = nil
+	for _, p := range metadata.Attributes.PrefetchPaths {
+		if index.Get(&common.ClipNode{Path: p}) != nil {
+			attributes.PrefetchPaths = append(attributes.PrefetchPaths, p)
+		}
+	}
+
+	inFile, err := os.Open(opts.InputFile)
+	if err != nil {
+		return nil, err
+	}
+	defer inFile.Close()
+
+	inInfo, err := inFile.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if err := checkOutputFile(inInfo, opts.OutputFile); err != nil {
+		return nil, err
+	}
+
+	outFile, err := os.Create(opts.OutputFile)
+	if err != nil {
+		return nil, err
+	}
+	defer outFile.Close()
+
+	if _, err := outFile.Write(make([]byte, common.ClipHeaderLength)); err != nil {
+		return nil, err
+	}
+
+	nodes := ca.dataOrder(&common.ClipArchiveMetadata{Index: index, Attributes: attributes}, false)
+	if _, _, err := ca.copyBlocks(inFile, outFile, nodes, opts.Verbose); err != nil {
+		return nil, err
+	}
+
+	if err := ca.writeIndexAndHeader(outFile, index, attributes); err != nil {
+		return nil, err
+	}
+
+	outInfo, err := outFile.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	return &SubsetStats{
+		InputSize:  inInfo.Size(),
+		OutputSize: outInfo.Size(),
+		Nodes:      index.Len(),
+		Files:      len(nodes),
+	}, nil
+}
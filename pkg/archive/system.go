@@ -0,0 +1,80 @@
+//go:build !windows
+
+package archive
+
+import (
+	"os"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const oNoFollow = syscall.O_NOFOLLOW
+
+// sourceStat is what is archived of a source file, its mode like in stat(2)
+type sourceStat struct {
+	dev, ino     uint64
+	size, blocks uint64
+	mode, nlink  uint32
+	uid, gid     uint32
+	rdev         uint32
+
+	atime, mtime, ctime time.Time
+}
+
+func lstat(path string) (sourceStat, error) {
+	var stat unix.Stat_t
+	if err := unix.Lstat(path, &stat); err != nil {
+		return sourceStat{}, err
+	}
+
+	return sourceStat{
+		dev:    uint64(stat.Dev),
+		ino:    stat.Ino,
+		size:   uint64(stat.Size),
+		blocks: uint64(stat.Blocks),
+		mode:   stat.Mode,
+		nlink:  uint32(stat.Nlink),
+		uid:    stat.Uid,
+		gid:    stat.Gid,
+		rdev:   uint32(stat.Rdev),
+		atime:  time.Unix(stat.Atim.Unix()),
+		mtime:  time.Unix(stat.Mtim.Unix()),
+		ctime:  time.Unix(stat.Ctim.Unix()),
+	}, nil
+}
+
+func chmod(path string, mode uint32) error {
+	return unix.Chmod(path, mode)
+}
+
+func fchmod(f *os.File, mode uint32) error {
+	return unix.Fchmod(int(f.Fd()), mode)
+}
+
+// lchtimes sets the times of path, of the link itself if it's a symlink
+func lchtimes(path string, atime, mtime time.Time) error {
+	times := []unix.Timespec{unix.NsecToTimespec(atime.UnixNano()), unix.NsecToTimespec(mtime.UnixNano())}
+	return unix.UtimesNanoAt(unix.AT_FDCWD, path, times, unix.AT_SYMLINK_NOFOLLOW)
+}
+
+func fsetxattr(f *os.File, name string, value []byte) error {
+	return unix.Fsetxattr(int(f.Fd()), name, value, 0)
+}
+
+func mknod(path string, mode uint32, dev uint32) error {
+	return unix.Mknod(path, mode, int(dev))
+}
+
+func mkdev(major, minor uint32) uint32 {
+	return uint32(unix.Mkdev(major, minor))
+}
+
+func devMajor(dev uint32) uint32 {
+	return unix.Major(uint64(dev))
+}
+
+func devMinor(dev uint32) uint32 {
+	return unix.Minor(uint64(dev))
+}
@@ -0,0 +1,111 @@
+package archive
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"time"
+)
+
+const oNoFollow = 0
+
+// sourceStat is what is archived of a source file, its mode like in stat(2)
+type sourceStat struct {
+	dev, ino     uint64
+	size, blocks uint64
+	mode, nlink  uint32
+	uid, gid     uint32
+	rdev         uint32
+
+	atime, mtime, ctime time.Time
+}
+
+// lstat reads the attributes of path from its handle, the volume and file index tell hard links
+// apart like dev and ino do. Files are owned by root and their permissions come from os.Lstat.
+func lstat(path string) (sourceStat, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return sourceStat{}, err
+	}
+
+	name, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return sourceStat{}, err
+	}
+	h, err := syscall.CreateFile(name, 0, syscall.FILE_SHARE_READ|syscall.FILE_SHARE_WRITE|syscall.FILE_SHARE_DELETE, nil,
+		syscall.OPEN_EXISTING, syscall.FILE_FLAG_BACKUP_SEMANTICS|syscall.FILE_FLAG_OPEN_REPARSE_POINT, 0)
+	if err != nil {
+		return sourceStat{}, &os.PathError{Op: "CreateFile", Path: path, Err: err}
+	}
+	defer syscall.CloseHandle(h)
+
+	var d syscall.ByHandleFileInformation
+	if err := syscall.GetFileInformationByHandle(h, &d); err != nil {
+		return sourceStat{}, &os.PathError{Op: "GetFileInformationByHandle", Path: path, Err: err}
+	}
+
+	mode := uint32(info.Mode().Perm())
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		mode |= syscall.S_IFLNK
+	case info.IsDir():
+		mode |= syscall.S_IFDIR
+	default:
+		mode |= syscall.S_IFREG
+	}
+
+	size := uint64(d.FileSizeHigh)<<32 | uint64(d.FileSizeLow)
+	return sourceStat{
+		dev:    uint64(d.VolumeSerialNumber),
+		ino:    uint64(d.FileIndexHigh)<<32 | uint64(d.FileIndexLow),
+		size:   size,
+		blocks: (size + 511) / 512,
+		mode:   mode,
+		nlink:  d.NumberOfLinks,
+		atime:  time.Unix(0, d.LastAccessTime.Nanoseconds()),
+		mtime:  time.Unix(0, d.LastWriteTime.Nanoseconds()),
+		ctime:  time.Unix(0, d.LastWriteTime.Nanoseconds()),
+	}, nil
+}
+
+func chmod(path string, mode uint32) error {
+	return os.Chmod(path, os.FileMode(mode&0777))
+}
+
+func fchmod(f *os.File, mode uint32) error {
+	return f.Chmod(os.FileMode(mode & 0777))
+}
+
+// lchtimes sets the times of path, symlinks keep theirs
+func lchtimes(path string, atime, mtime time.Time) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		return nil
+	}
+	return os.Chtimes(path, atime, mtime)
+}
+
+func fsetxattr(f *os.File, name string, value []byte) error {
+	return errors.New("extended attributes aren't supported on windows")
+}
+
+func mknod(path string, mode uint32, dev uint32) error {
+	return errors.New("special files aren't supported on windows")
+}
+
+// mkdev, devMajor and devMinor encode devices the way Linux does, which archives are made for
+
+func mkdev(major, minor uint32) uint32 {
+	return (major&0xfff)<<8 | (minor & 0xff) | (minor&0xfff00)<<12
+}
+
+func devMajor(dev uint32) uint32 {
+	return (dev >> 8) & 0xfff
+}
+
+func devMinor(dev uint32) uint32 {
+	return (dev & 0xff) | ((dev >> 12) & 0xfff00)
+}
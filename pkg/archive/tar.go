@@ -0,0 +1,281 @@
+package archive
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"syscall"
+
+	common "github.com/NilayYadav/clip/pkg/common"
+	log "github.com/okteto/okteto/pkg/log"
+	"github.com/tidwall/btree"
+)
+
+// openTar opens a tar file, or standard input for -, decompressing it if it's gzipped
+func openTar(name string) (io.Reader, io.Closer, error) {
+	f := os.Stdin
+	if name != "-" {
+		var err error
+		if f, err = os.Open(name); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	br := bufio.NewReaderSize(f, 512*1024)
+	if magic, _ := br.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		return zr, f, nil
+	}
+	return br, f, nil
+}
+
+// createFromTar creates an archive from a tar in a single pass over it, so it can be read from a pipe
+// and is never extracted. Data blocks are written in the order of the tar rather than the index;
+// files whose content was already written have their copy cut off again and share the first one.
+//
+// Root filesystems, with opts.Rootfs, keep device nodes, setuid bits and extended attributes like file
+// capabilities, and leave out the content of /proc and /sys, so the archive can be run as it is.
+func (ca *ClipArchiver) createFromTar(outFile *os.File, opts ClipArchiverOptions) error {
+	if opts.Reproducible && len(opts.EncryptPaths) > 0 {
+		// Their IVs derive from their content, which is only known once they're written
+		return fmt.Errorf("reproducible archives imported from a tar can't encrypt files")
+	}
+	if len(opts.EncryptPaths) > 0 && len(opts.EncryptionKey) != common.EncryptionKeyLength {
+		return fmt.Errorf("encrypting files needs a %d byte key", common.EncryptionKeyLength)
+	}
+
+	in, closer, err := openTar(opts.TarPath)
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+	tr := tar.NewReader(in)
+
+	if _, err := outFile.Write(make([]byte, common.ClipHeaderLength)); err != nil {
+		return err
+	}
+	writer := bufio.NewWriterSize(outFile, 512*1024)
+	pos := int64(common.ClipHeaderLength)
+
+	index := ca.newIndex()
+	inodes := newInodeAssigner()
+	index.Set(ca.manifestDir("/", inodes))
+	nlinks := make(map[uint64]uint32)
+	written := make(map[string]*common.ClipNode) // By content hash
+	var search *common.SearchIndexBuilder
+	if opts.SearchIndex {
+		search = common.NewSearchIndexBuilder()
+	}
+
+	var data io.Reader
+	opts.open = func(node *common.ClipNode) (io.ReadCloser, error) {
+		return io.NopCloser(data), nil
+	}
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("error reading tar: %v", err)
+		}
+		p := path.Join("/", hdr.Name)
+		if opts.Rootfs && rootfsSkipped(p) {
+			continue
+		}
+
+		if hdr.Typeflag == tar.TypeLink {
+			target := index.Get(&common.ClipNode{Path: path.Join("/", hdr.Linkname)})
+			if target == nil || target.(*common.ClipNode).IsDir() {
+				return fmt.Errorf("tar entry %s links to %s, which isn't a file before it", hdr.Name, hdr.Linkname)
+			}
+			node := *target.(*common.ClipNode)
+			node.Path = p
+			if err := ca.setTarNode(index, &node, inodes); err != nil {
+				return err
+			}
+			nlinks[node.Attr.Ino]++
+			continue
+		}
+
+		node := tarNode(hdr, p, inodes)
+		if node == nil {
+			if opts.Verbose {
+				log.Printf("skipping tar entry %s of type %q", hdr.Name, hdr.Typeflag)
+			}
+			continue
+		}
+		if opts.Rootfs {
+			setRootfsAttrs(node, hdr)
+		}
+		if p == "/" {
+			node.Attr.Ino = 1
+			index.Set(node)
+			continue
+		}
+		if err := ca.setTarNode(index, node, inodes); err != nil {
+			return err
+		}
+		if node.NodeType != common.FileNode {
+			continue
+		}
+		nlinks[node.Attr.Ino]++
+
+		encrypted := encryptedPath(opts, p)
+		if encrypted {
+			node.IV = make([]byte, 16)
+			if _, err := rand.Read(node.IV); err != nil {
+				return err
+			}
+		}
+
+		start := pos
+		hash := sha256.New()
+		var sinks []io.Writer
+		if !opts.SkipHashing && !encrypted {
+			sinks = append(sinks, hash)
+		}
+		var indexed *common.SearchIndexFile
+		if search != nil && !encrypted {
+			indexed = search.File(p)
+			sinks = append(sinks, indexed)
+		}
+		var head *headWriter
+		if opts.ContentTypes && !encrypted {
+			head = &headWriter{}
+			sinks = append(sinks, head)
+		}
+		data = tr
+		if len(sinks) > 0 {
+			data = io.TeeReader(tr, io.MultiWriter(sinks...))
+		}
+		if !ca.processNode(node, writer, &pos, opts) {
+			return fmt.Errorf("error importing tar entry %s", hdr.Name)
+		}
+		if indexed != nil {
+			indexed.Commit()
+		}
+		if head != nil {
+			node.ContentType = contentType(p, head.head)
+		}
+		if opts.SkipHashing || encrypted {
+			continue
+		}
+
+		node.ContentHash = hex.EncodeToString(hash.Sum(nil))
+		if first, exists := written[node.ContentHash]; exists {
+			if err := writer.Flush(); err != nil {
+				return err
+			}
+			if err := outFile.Truncate(start); err != nil {
+				return err
+			}
+			if _, err := outFile.Seek(start, io.SeekStart); err != nil {
+				return err
+			}
+			pos = start
+			node.DataPos, node.DataLen = first.DataPos, first.DataLen
+			continue
+		}
+		written[node.ContentHash] = node
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+
+	index.Ascend(index.Min(), func(a interface{}) bool {
+		if node := a.(*common.ClipNode); node.NodeType == common.FileNode {
+			node.Attr.Nlink = nlinks[node.Attr.Ino]
+		}
+		return true
+	})
+
+	if opts.Reproducible {
+		ca.normalizeAttrs(index, opts.SourceDateEpoch)
+	}
+
+	attributes := common.ClipArchiveAttributes{
+		PrefetchPaths: ca.prefetchPaths(index, opts),
+		Labels:        opts.Labels,
+	}
+	if len(opts.EncryptPaths) > 0 {
+		attributes.EncryptionKeyID = common.EncryptionKeyID(opts.EncryptionKey)
+	}
+	if search != nil {
+		attributes.SearchIndex = search.Build()
+	}
+	return ca.writeIndexAndHeader(outFile, index, attributes)
+}
+
+// setTarNode adds the node of a tar entry, replacing an earlier entry at the same path as extracting
+// the tar would. A directory can't replace a file or the other way around.
+func (ca *ClipArchiver) setTarNode(index *btree.BTree, node *common.ClipNode, inodes *inodeAssigner) error {
+	if existing := index.Get(node); existing != nil && existing.(*common.ClipNode).IsDir() != node.IsDir() {
+		return fmt.Errorf("tar entry %s is both a directory and a file", node.Path)
+	}
+	ca.addParents(index, node.Path, inodes)
+	index.Set(node)
+	return nil
+}
+
+// tarNode creates the node of a tar entry other than a hard link, or returns nil for entries with no
+// counterpart in an archive
+func tarNode(hdr *tar.Header, p string, inodes *inodeAssigner) *common.ClipNode {
+	attr := common.Attr{
+		Ino:       inodes.gen.Next(),
+		Nlink:     1,
+		Mtime:     uint64(hdr.ModTime.Unix()),
+		Mtimensec: uint32(hdr.ModTime.Nanosecond()),
+		Owner:     common.Owner{Uid: uint32(hdr.Uid), Gid: uint32(hdr.Gid)},
+	}
+	attr.Atime, attr.Atimensec = attr.Mtime, attr.Mtimensec
+	attr.Ctime, attr.Ctimensec = attr.Mtime, attr.Mtimensec
+	if !hdr.AccessTime.IsZero() {
+		attr.Atime, attr.Atimensec = uint64(hdr.AccessTime.Unix()), uint32(hdr.AccessTime.Nanosecond())
+	}
+	if !hdr.ChangeTime.IsZero() {
+		attr.Ctime, attr.Ctimensec = uint64(hdr.ChangeTime.Unix()), uint32(hdr.ChangeTime.Nanosecond())
+	}
+	perm := uint32(hdr.Mode & 0777)
+	node := &common.ClipNode{Path: p}
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		node.NodeType = common.DirNode
+		attr.Mode, attr.Nlink = syscall.S_IFDIR|perm, 2
+	case tar.TypeReg:
+		node.NodeType = common.FileNode
+		attr.Mode, attr.Size, attr.Blocks = syscall.S_IFREG|perm, uint64(hdr.Size), uint64(hdr.Size+511)/512
+	case tar.TypeSymlink:
+		node.NodeType, node.Target = common.SymLinkNode, hdr.Linkname
+		attr.Mode, attr.Size = syscall.S_IFLNK|perm, uint64(len(hdr.Linkname))
+	case tar.TypeChar, tar.TypeBlock:
+		node.NodeType = common.SpecialNode
+		attr.Mode = syscall.S_IFCHR | perm
+		if hdr.Typeflag == tar.TypeBlock {
+			attr.Mode = syscall.S_IFBLK | perm
+		}
+		attr.Rdev = mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor))
+	case tar.TypeFifo:
+		node.NodeType = common.SpecialNode
+		attr.Mode = syscall.S_IFIFO | perm
+	default:
+		return nil
+	}
+
+	node.Attr = attr
+	return node
+}
@@ -0,0 +1,609 @@
+package archive
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+
+	common "github.com/NilayYadav/clip/pkg/common"
+	"github.com/klauspost/compress/zstd"
+	"github.com/tidwall/btree"
+)
+
+const (
+	squashfsZstd              = 6
+	squashfsFragmentEntrySize = 16
+)
+
+// Extended inode types of entries other than files and directories, which exports don't write
+const (
+	squashfsLSymlinkType = iota + squashfsLFileType + 1
+	squashfsLBlockDevType
+	squashfsLCharDevType
+	squashfsLFifoType
+	squashfsLSocketType
+)
+
+// squashfsReader reads the metadata and file data of a SquashFS 4.0 image
+type squashfsReader struct {
+	f          io.ReaderAt
+	blockSize  uint32
+	compressor uint16
+	inodeTable uint64
+	dirTable   uint64
+	ids        []uint32
+	fragments  [][2]uint64 // Start and size of each fragment block
+	zstd       *zstd.Decoder
+
+	fragment      []byte // Last fragment block read, files sharing one are usually read in a row
+	fragmentIndex uint32
+}
+
+// squashfsInode is what an import needs of an inode
+type squashfsInode struct {
+	kind     uint16
+	perm     uint16
+	uid, gid uint32
+	mtime    uint32
+	number   uint32
+	nlink    uint32
+	rdev     uint32
+	target   string
+
+	// Directories
+	listingBlock  uint32
+	listingOffset uint16
+	listingSize   uint32
+
+	// Files
+	size       uint64
+	dataStart  uint64
+	blockSizes []uint32
+	frag       uint32
+	fragOffset uint32
+}
+
+func newSquashfsReader(f io.ReaderAt) (*squashfsReader, *squashfsInode, error) {
+	sb := make([]byte, squashfsSuperSize)
+	if _, err := f.ReadAt(sb, 0); err != nil {
+		return nil, nil, fmt.Errorf("error reading squashfs superblock: %v", err)
+	}
+	le := binary.LittleEndian
+	if le.Uint32(sb[0:]) != squashfsMagic {
+		return nil, nil, fmt.Errorf("not a squashfs image")
+	}
+	if major := le.Uint16(sb[28:]); major != 4 {
+		return nil, nil, fmt.Errorf("unsupported squashfs version %d", major)
+	}
+
+	r := &squashfsReader{
+		f:          f,
+		blockSize:  le.Uint32(sb[12:]),
+		compressor: le.Uint16(sb[20:]),
+		inodeTable: le.Uint64(sb[64:]),
+		dirTable:   le.Uint64(sb[72:]),
+	}
+	if r.blockSize < 4096 || r.blockSize > 1024*1024 {
+		return nil, nil, fmt.Errorf("invalid squashfs block size %d", r.blockSize)
+	}
+	switch r.compressor {
+	case squashfsZlib:
+	case squashfsZstd:
+		var err error
+		if r.zstd, err = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(uint64(r.blockSize))); err != nil {
+			return nil, nil, err
+		}
+	default:
+		return nil, nil, fmt.Errorf("unsupported squashfs compression %d, only gzip and zstd images can be imported", r.compressor)
+	}
+
+	idTable, err := r.readTable(le.Uint64(sb[48:]), int(le.Uint16(sb[26:])), 4)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading squashfs id table: %v", err)
+	}
+	for i := 0; i < len(idTable); i += 4 {
+		r.ids = append(r.ids, le.Uint32(idTable[i:]))
+	}
+
+	if count := le.Uint32(sb[16:]); count > 0 {
+		table, err := r.readTable(le.Uint64(sb[80:]), int(count), squashfsFragmentEntrySize)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error reading squashfs fragment table: %v", err)
+		}
+		for i := 0; i < len(table); i += squashfsFragmentEntrySize {
+			r.fragments = append(r.fragments, [2]uint64{le.Uint64(table[i:]), uint64(le.Uint32(table[i+8:]))})
+		}
+	}
+
+	rootRef := le.Uint64(sb[32:])
+	root, err := r.readInode(rootRef)
+	if err != nil {
+		return nil, nil, err
+	}
+	if root.kind != squashfsDirType && root.kind != squashfsLDirType {
+		return nil, nil, fmt.Errorf("squashfs root isn't a directory")
+	}
+	return r, root, nil
+}
+
+func (r *squashfsReader) decompress(p []byte, max int) ([]byte, error) {
+	if r.compressor == squashfsZstd {
+		out, err := r.zstd.DecodeAll(p, nil)
+		if err == nil && len(out) > max {
+			err = fmt.Errorf("block is larger than %d bytes", max)
+		}
+		return out, err
+	}
+
+	zr, err := zlib.NewReader(bytes.NewReader(p))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	out, err := io.ReadAll(io.LimitReader(zr, int64(max)+1))
+	if err == nil && len(out) > max {
+		err = fmt.Errorf("block is larger than %d bytes", max)
+	}
+	return out, err
+}
+
+// readMetaBlock reads the metadata block at pos and returns its content and where the next one starts
+func (r *squashfsReader) readMetaBlock(pos uint64) ([]byte, uint64, error) {
+	var header [2]byte
+	if _, err := r.f.ReadAt(header[:], int64(pos)); err != nil {
+		return nil, 0, err
+	}
+	h := binary.LittleEndian.Uint16(header[:])
+	size := uint64(h &^ squashfsUncompressedMeta)
+	if size > squashfsMetaSize {
+		return nil, 0, fmt.Errorf("invalid squashfs metadata block at %d", pos)
+	}
+
+	data := make([]byte, size)
+	if _, err := r.f.ReadAt(data, int64(pos)+2); err != nil {
+		return nil, 0, err
+	}
+	next := pos + 2 + size
+	if h&squashfsUncompressedMeta != 0 {
+		return data, next, nil
+	}
+	data, err := r.decompress(data, squashfsMetaSize)
+	return data, next, err
+}
+
+// metaReader reads metadata from offset in the block at pos, running on into the blocks after it
+type metaReader struct {
+	r    *squashfsReader
+	buf  []byte
+	next uint64
+}
+
+func (r *squashfsReader) metaReader(pos uint64, offset uint16) (*metaReader, error) {
+	data, next, err := r.readMetaBlock(pos)
+	if err != nil {
+		return nil, err
+	}
+	if int(offset) > len(data) {
+		return nil, fmt.Errorf("invalid squashfs metadata reference")
+	}
+	return &metaReader{r: r, buf: data[offset:], next: next}, nil
+}
+
+func (m *metaReader) read(n int) ([]byte, error) {
+	out := make([]byte, 0, n)
+	for len(out) < n {
+		if len(m.buf) == 0 {
+			data, next, err := m.r.readMetaBlock(m.next)
+			if err != nil {
+				return nil, err
+			}
+			if len(data) == 0 {
+				return nil, fmt.Errorf("truncated squashfs metadata")
+			}
+			m.buf, m.next = data, next
+		}
+		k := n - len(out)
+		if k > len(m.buf) {
+			k = len(m.buf)
+		}
+		out = append(out, m.buf[:k]...)
+		m.buf = m.buf[k:]
+	}
+	return out, nil
+}
+
+// readTable reads count entries of a table whose metadata blocks are listed at start
+func (r *squashfsReader) readTable(start uint64, count int, entrySize int) ([]byte, error) {
+	size := count * entrySize
+	blocks := (size + squashfsMetaSize - 1) / squashfsMetaSize
+	pointers := make([]byte, 8*blocks)
+	if _, err := r.f.ReadAt(pointers, int64(start)); err != nil {
+		return nil, err
+	}
+
+	var table []byte
+	for i := 0; i < blocks; i++ {
+		data, _, err := r.readMetaBlock(binary.LittleEndian.Uint64(pointers[8*i:]))
+		if err != nil {
+			return nil, err
+		}
+		table = append(table, data...)
+	}
+	if len(table) < size {
+		return nil, fmt.Errorf("table is truncated")
+	}
+	return table[:size], nil
+}
+
+func (r *squashfsReader) id(i uint16) (uint32, error) {
+	if int(i) >= len(r.ids) {
+		return 0, fmt.Errorf("invalid squashfs id %d", i)
+	}
+	return r.ids[i], nil
+}
+
+// readInode reads the inode ref points at: the position of its metadata block in the inode table and
+// its offset in it
+func (r *squashfsReader) readInode(ref uint64) (*squashfsInode, error) {
+	m, err := r.metaReader(r.inodeTable+ref>>16, uint16(ref))
+	if err != nil {
+		return nil, err
+	}
+	b, err := m.read(16)
+	if err != nil {
+		return nil, err
+	}
+	le := binary.LittleEndian
+	inode := &squashfsInode{kind: le.Uint16(b[0:]), perm: le.Uint16(b[2:]), mtime: le.Uint32(b[8:]), number: le.Uint32(b[12:]), nlink: 1}
+	if inode.uid, err = r.id(le.Uint16(b[4:])); err != nil {
+		return nil, err
+	}
+	if inode.gid, err = r.id(le.Uint16(b[6:])); err != nil {
+		return nil, err
+	}
+
+	switch inode.kind {
+	case squashfsDirType:
+		if b, err = m.read(16); err != nil {
+			return nil, err
+		}
+		inode.listingBlock, inode.nlink = le.Uint32(b[0:]), le.Uint32(b[4:])
+		inode.listingSize, inode.listingOffset = uint32(le.Uint16(b[8:])), le.Uint16(b[10:])
+
+	case squashfsLDirType:
+		if b, err = m.read(24); err != nil {
+			return nil, err
+		}
+		inode.nlink, inode.listingSize, inode.listingBlock = le.Uint32(b[0:]), le.Uint32(b[4:]), le.Uint32(b[8:])
+		inode.listingOffset = le.Uint16(b[18:])
+
+	case squashfsFileType, squashfsLFileType:
+		if inode.kind == squashfsFileType {
+			if b, err = m.read(16); err != nil {
+				return nil, err
+			}
+			inode.dataStart, inode.frag, inode.fragOffset, inode.size = uint64(le.Uint32(b[0:])), le.Uint32(b[4:]), le.Uint32(b[8:]), uint64(le.Uint32(b[12:]))
+		} else {
+			if b, err = m.read(40); err != nil {
+				return nil, err
+			}
+			inode.dataStart, inode.size, inode.nlink = le.Uint64(b[0:]), le.Uint64(b[8:]), le.Uint32(b[24:])
+			inode.frag, inode.fragOffset = le.Uint32(b[28:]), le.Uint32(b[32:])
+		}
+
+		blocks := inode.size / uint64(r.blockSize)
+		if inode.frag == squashfsInvalid && inode.size%uint64(r.blockSize) != 0 {
+			blocks++
+		}
+		if blocks > 1<<24 {
+			return nil, fmt.Errorf("invalid squashfs file size %d", inode.size)
+		}
+		if b, err = m.read(4 * int(blocks)); err != nil {
+			return nil, err
+		}
+		for i := 0; i < len(b); i += 4 {
+			inode.blockSizes = append(inode.blockSizes, le.Uint32(b[i:]))
+		}
+
+	case squashfsSymlinkType, squashfsLSymlinkType:
+		if b, err = m.read(8); err != nil {
+			return nil, err
+		}
+		inode.nlink = le.Uint32(b[0:])
+		size := le.Uint32(b[4:])
+		if size > 64*1024 {
+			return nil, fmt.Errorf("invalid squashfs symlink size %d", size)
+		}
+		if b, err = m.read(int(size)); err != nil {
+			return nil, err
+		}
+		inode.target = string(b)
+
+	case squashfsBlockDevType, squashfsCharDevType, squashfsLBlockDevType, squashfsLCharDevType:
+		if b, err = m.read(8); err != nil {
+			return nil, err
+		}
+		inode.nlink, inode.rdev = le.Uint32(b[0:]), le.Uint32(b[4:])
+
+	case squashfsFifoType, squashfsSocketType, squashfsLFifoType, squashfsLSocketType:
+		if b, err = m.read(4); err != nil {
+			return nil, err
+		}
+		inode.nlink = le.Uint32(b[0:])
+
+	default:
+		return nil, fmt.Errorf("invalid squashfs inode type %d", inode.kind)
+	}
+	return inode, nil
+}
+
+type squashfsDirEntry struct {
+	name   string
+	ref    uint64
+	number uint32
+}
+
+// readDir reads the listing of a directory
+func (r *squashfsReader) readDir(dir *squashfsInode) ([]squashfsDirEntry, error) {
+	if dir.listingSize <= 3 { // . and .. are counted but not stored
+		return nil, nil
+	}
+	m, err := r.metaReader(r.dirTable+uint64(dir.listingBlock), dir.listingOffset)
+	if err != nil {
+		return nil, err
+	}
+	listing, err := m.read(int(dir.listingSize - 3))
+	if err != nil {
+		return nil, err
+	}
+
+	le := binary.LittleEndian
+	var entries []squashfsDirEntry
+	for len(listing) > 0 {
+		if len(listing) < 12 {
+			return nil, fmt.Errorf("invalid squashfs directory listing")
+		}
+		count, block, base := le.Uint32(listing[0:])+1, le.Uint32(listing[4:]), le.Uint32(listing[8:])
+		listing = listing[12:]
+		for ; count > 0; count-- {
+			if len(listing) < 8 {
+				return nil, fmt.Errorf("invalid squashfs directory listing")
+			}
+			offset, delta, nameSize := le.Uint16(listing[0:]), int16(le.Uint16(listing[2:])), int(le.Uint16(listing[6:]))+1
+			if len(listing) < 8+nameSize {
+				return nil, fmt.Errorf("invalid squashfs directory listing")
+			}
+			name := string(listing[8 : 8+nameSize])
+			listing = listing[8+nameSize:]
+			if name == "." || name == ".." || name == "" || strings.ContainsRune(name, '/') {
+				return nil, fmt.Errorf("invalid squashfs directory entry %q", name)
+			}
+			entries = append(entries, squashfsDirEntry{name: name, ref: uint64(block)<<16 | uint64(offset), number: uint32(int64(base) + int64(delta))})
+		}
+	}
+	return entries, nil
+}
+
+// squashfsFile reads the content of a file, a block at a time
+type squashfsFile struct {
+	r     *squashfsReader
+	inode *squashfsInode
+	pos   uint64 // Of the next block in the image
+	block int
+	left  uint64
+	buf   []byte
+}
+
+func (r *squashfsReader) open(inode *squashfsInode) *squashfsFile {
+	return &squashfsFile{r: r, inode: inode, pos: inode.dataStart, left: inode.size}
+}
+
+func (f *squashfsFile) Read(p []byte) (int, error) {
+	for len(f.buf) == 0 {
+		if f.left == 0 {
+			return 0, io.EOF
+		}
+		if err := f.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, f.buf)
+	f.buf = f.buf[n:]
+	return n, nil
+}
+
+func (f *squashfsFile) Close() error {
+	return nil
+}
+
+// next reads the next block of the file, or the tail it keeps in a fragment
+func (f *squashfsFile) next() error {
+	r := f.r
+	want := uint64(r.blockSize)
+	if f.left < want {
+		want = f.left
+	}
+
+	if f.block < len(f.inode.blockSizes) {
+		size := f.inode.blockSizes[f.block]
+		f.block++
+		stored := uint64(size &^ squashfsUncompressedBlock)
+		if stored == 0 { // Sparse
+			f.buf = make([]byte, want)
+		} else {
+			data := make([]byte, stored)
+			if _, err := r.f.ReadAt(data, int64(f.pos)); err != nil {
+				return err
+			}
+			f.pos += stored
+			if size&squashfsUncompressedBlock == 0 {
+				var err error
+				if data, err = r.decompress(data, int(r.blockSize)); err != nil {
+					return err
+				}
+			}
+			f.buf = data
+		}
+	} else {
+		fragment, err := r.readFragment(f.inode.frag)
+		if err != nil {
+			return err
+		}
+		start := uint64(f.inode.fragOffset)
+		if start+want > uint64(len(fragment)) {
+			return fmt.Errorf("invalid squashfs fragment reference")
+		}
+		f.buf = fragment[start : start+want]
+	}
+
+	if uint64(len(f.buf)) != want {
+		return fmt.Errorf("squashfs data block has %d bytes, expected %d", len(f.buf), want)
+	}
+	f.left -= want
+	return nil
+}
+
+func (r *squashfsReader) readFragment(i uint32) ([]byte, error) {
+	if r.fragment != nil && r.fragmentIndex == i {
+		return r.fragment, nil
+	}
+	if int(i) >= len(r.fragments) {
+		return nil, fmt.Errorf("invalid squashfs fragment %d", i)
+	}
+
+	start, size := r.fragments[i][0], uint32(r.fragments[i][1])
+	data := make([]byte, size&^squashfsUncompressedBlock)
+	if _, err := r.f.ReadAt(data, int64(start)); err != nil {
+		return nil, err
+	}
+	if size&squashfsUncompressedBlock == 0 {
+		var err error
+		if data, err = r.decompress(data, int(r.blockSize)); err != nil {
+			return nil, err
+		}
+	}
+	r.fragment, r.fragmentIndex = data, i
+	return data, nil
+}
+
+// populateIndexFromSquashFS creates the index of an archive holding the tree of a SquashFS image,
+// walking its metadata. File content is read from the image as the archive is written, through
+// opts.open. Hard links keep sharing an inode.
+func (ca *ClipArchiver) populateIndexFromSquashFS(index *btree.BTree, f *os.File, opts *ClipArchiverOptions) error {
+	r, root, err := newSquashfsReader(f)
+	if err != nil {
+		return err
+	}
+
+	inodes := newInodeAssigner()
+	files := make(map[string]*squashfsInode)
+	links := make(map[uint32]*common.ClipNode) // First node of each file inode, by squashfs inode number
+	nlinks := make(map[uint64]uint32)          // Paths of each file inode, by archive inode
+	visited := make(map[uint32]bool)           // Directories, so a corrupt image can't loop
+
+	var walk func(p string, dir *squashfsInode) error
+	walk = func(p string, dir *squashfsInode) error {
+		if visited[dir.number] {
+			return fmt.Errorf("squashfs directory %s is listed twice", p)
+		}
+		visited[dir.number] = true
+
+		entries, err := r.readDir(dir)
+		if err != nil {
+			return fmt.Errorf("error reading squashfs directory %s: %v", p, err)
+		}
+		for _, entry := range entries {
+			childPath := path.Join(p, entry.name)
+			if first, linked := links[entry.number]; linked {
+				nlinks[first.Attr.Ino]++
+				node := *first
+				node.Path = childPath
+				index.Set(&node)
+				files[childPath] = files[first.Path]
+				continue
+			}
+
+			inode, err := r.readInode(entry.ref)
+			if err != nil {
+				return fmt.Errorf("error reading squashfs inode of %s: %v", childPath, err)
+			}
+			node := squashfsNode(childPath, inode, inodes)
+			index.Set(node)
+
+			switch node.NodeType {
+			case common.DirNode:
+				if err := walk(childPath, inode); err != nil {
+					return err
+				}
+			case common.FileNode:
+				nlinks[node.Attr.Ino]++
+				links[entry.number] = node
+				files[childPath] = inode
+			}
+		}
+		return nil
+	}
+
+	index.Set(squashfsNode("/", root, inodes))
+	if err := walk("/", root); err != nil {
+		return err
+	}
+
+	// Link counts are those of the archived tree, rather than trusted from the image
+	index.Ascend(index.Min(), func(a interface{}) bool {
+		if node := a.(*common.ClipNode); node.NodeType == common.FileNode {
+			node.Attr.Nlink = nlinks[node.Attr.Ino]
+		}
+		return true
+	})
+
+	opts.open = func(node *common.ClipNode) (io.ReadCloser, error) {
+		inode, exists := files[node.Path]
+		if !exists {
+			return nil, fmt.Errorf("%s isn't in the squashfs image", node.Path)
+		}
+		return r.open(inode), nil
+	}
+	return nil
+}
+
+func squashfsNode(p string, inode *squashfsInode, inodes *inodeAssigner) *common.ClipNode {
+	attr := common.Attr{
+		Ino:   inodes.gen.Next(),
+		Mtime: uint64(inode.mtime),
+		Atime: uint64(inode.mtime),
+		Ctime: uint64(inode.mtime),
+		Nlink: inode.nlink,
+		Owner: common.Owner{Uid: inode.uid, Gid: inode.gid},
+	}
+	perm := uint32(inode.perm & 0777)
+	node := &common.ClipNode{Path: p}
+
+	switch inode.kind {
+	case squashfsDirType, squashfsLDirType:
+		node.NodeType, attr.Mode = common.DirNode, syscall.S_IFDIR|perm
+	case squashfsFileType, squashfsLFileType:
+		node.NodeType, attr.Mode = common.FileNode, syscall.S_IFREG|perm
+		attr.Size, attr.Blocks = inode.size, (inode.size+511)/512
+	case squashfsSymlinkType, squashfsLSymlinkType:
+		node.NodeType, node.Target, attr.Mode = common.SymLinkNode, inode.target, syscall.S_IFLNK|perm
+		attr.Size = uint64(len(inode.target))
+	case squashfsBlockDevType, squashfsLBlockDevType:
+		node.NodeType, attr.Mode, attr.Rdev = common.SpecialNode, syscall.S_IFBLK|perm, inode.rdev
+	case squashfsCharDevType, squashfsLCharDevType:
+		node.NodeType, attr.Mode, attr.Rdev = common.SpecialNode, syscall.S_IFCHR|perm, inode.rdev
+	case squashfsFifoType, squashfsLFifoType:
+		node.NodeType, attr.Mode = common.SpecialNode, syscall.S_IFIFO|perm
+	default:
+		node.NodeType, attr.Mode = common.SpecialNode, syscall.S_IFSOCK|perm
+	}
+
+	node.Attr = attr
+	return node
+}
@@ -0,0 +1,40 @@
+package archive
+
+import (
+	"fmt"
+	"hash/crc64"
+	"os"
+
+	common "github.com/NilayYadav/clip/pkg/common"
+)
+
+// Verify checks that the index of a local archive decodes and that the data block of every file
+// matches its checksum
+func (ca *ClipArchiver) Verify(archivePath string) error {
+	metadata, err := ca.ExtractMetadata(archivePath)
+	if err != nil {
+		return err
+	}
+	if metadata.StorageInfo != nil {
+		return fmt.Errorf("%s is a remote archive, its data isn't held locally", archivePath)
+	}
+
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	table := crc64.MakeTable(crc64.ISO)
+	checked := make(map[int64]bool)
+	for _, node := range ca.dataOrder(metadata, false) {
+		if checked[node.DataPos] {
+			continue
+		}
+		if !validBlock(f, node.DataPos, node.DataLen, table) {
+			return fmt.Errorf("%w: %s", common.ErrCrcMismatch, node.Path)
+		}
+		checked[node.DataPos] = true
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package archive
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	"syscall"
+
+	common "github.com/NilayYadav/clip/pkg/common"
+	log "github.com/okteto/okteto/pkg/log"
+	"github.com/tidwall/btree"
+)
+
+// Made by a unix zip tool, the high bits of the external attributes of its entries hold their modes
+const zipCreatorUnix = 3
+
+// populateIndexFromZip creates the index of an archive holding the entries of a zip file. Parents
+// missing from the zip are created, and an entry replaces an earlier one at the same path, as when
+// unzipping. File content is read from the zip as the archive is written, through opts.open.
+func (ca *ClipArchiver) populateIndexFromZip(index *btree.BTree, zr *zip.Reader, opts *ClipArchiverOptions) error {
+	inodes := newInodeAssigner()
+	index.Set(ca.manifestDir("/", inodes))
+	files := make(map[string]*zip.File)
+
+	for _, f := range zr.File {
+		p := path.Join("/", f.Name)
+		if p == "/" {
+			continue
+		}
+
+		node, err := ca.zipNode(f, p, inodes)
+		if err != nil {
+			return err
+		}
+		if node == nil {
+			if opts.Verbose {
+				log.Printf("skipping %s, devices and sockets can't be imported from a zip", f.Name)
+			}
+			continue
+		}
+
+		if existing := index.Get(&common.ClipNode{Path: p}); existing != nil && existing.(*common.ClipNode).IsDir() != node.IsDir() {
+			return fmt.Errorf("zip entry %s is both a directory and a file", f.Name)
+		}
+
+		ca.addParents(index, p, inodes)
+		index.Set(node)
+		files[p] = f
+	}
+
+	opts.open = func(node *common.ClipNode) (io.ReadCloser, error) {
+		f, exists := files[node.Path]
+		if !exists {
+			return nil, fmt.Errorf("%s isn't in the zip", node.Path)
+		}
+		return f.Open()
+	}
+	return nil
+}
+
+// zipNode creates the node of a zip entry, or returns nil for entries with no counterpart in an
+// archive. Entries made without unix modes get the usual 0755 and 0644.
+func (ca *ClipArchiver) zipNode(f *zip.File, p string, inodes *inodeAssigner) (*common.ClipNode, error) {
+	mode := f.Mode()
+	perm := uint32(mode.Perm())
+	if f.CreatorVersion>>8 != zipCreatorUnix {
+		perm = 0644
+		if mode.IsDir() {
+			perm = 0755
+		}
+	}
+
+	attr := common.Attr{
+		Ino:       inodes.gen.Next(),
+		Nlink:     1,
+		Mtime:     uint64(f.Modified.Unix()),
+		Mtimensec: uint32(f.Modified.Nanosecond()),
+	}
+	attr.Atime, attr.Atimensec = attr.Mtime, attr.Mtimensec
+	attr.Ctime, attr.Ctimensec = attr.Mtime, attr.Mtimensec
+	node := &common.ClipNode{Path: p}
+
+	switch {
+	case mode.IsDir() || strings.HasSuffix(f.Name, "/"):
+		node.NodeType = common.DirNode
+		attr.Mode, attr.Nlink = syscall.S_IFDIR|perm, 2
+
+	case mode&fs.ModeSymlink != 0:
+		target, err := readZipEntry(f)
+		if err != nil {
+			return nil, fmt.Errorf("error reading symlink target %s: %v", f.Name, err)
+		}
+		node.NodeType, node.Target = common.SymLinkNode, target
+		attr.Mode, attr.Size = syscall.S_IFLNK|perm, uint64(len(target))
+
+	case mode&fs.ModeNamedPipe != 0:
+		node.NodeType = common.SpecialNode
+		attr.Mode = syscall.S_IFIFO | perm
+
+	case mode.IsRegular():
+		node.NodeType = common.FileNode
+		attr.Mode, attr.Size = syscall.S_IFREG|perm, f.UncompressedSize64
+		attr.Blocks = (attr.Size + 511) / 512
+
+	default:
+		return nil, nil
+	}
+
+	node.Attr = attr
+	return node, nil
+}
+
+func readZipEntry(f *zip.File) (string, error) {
+	r, err := f.Open()
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	data, err := io.ReadAll(r)
+	return string(data), err
+}
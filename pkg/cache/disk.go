@@ -0,0 +1,283 @@
+package cache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const diskTempPrefix = ".tmp-"
+
+// DiskContentCache keeps content in files named by its key under a local directory,
+// evicting the least recently used files once the total size goes over its limit.
+// Content already in the directory is picked up again when the cache is created.
+type DiskContentCache struct {
+	dir     string
+	mu      sync.Mutex
+	maxSize int64
+	size    int64
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+type diskEntry struct {
+	key  string
+	size int64
+}
+
+func NewDiskContentCache(dir string, maxSize int64) (*DiskContentCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create disk cache directory: %v", err)
+	}
+
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read disk cache directory: %v", err)
+	}
+
+	c := &DiskContentCache{
+		dir:     dir,
+		maxSize: maxSize,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+
+	var existing []os.FileInfo
+	for _, dirEntry := range dirEntries {
+		// Leftovers from stores that never finished
+		if strings.HasPrefix(dirEntry.Name(), diskTempPrefix) {
+			os.Remove(filepath.Join(dir, dirEntry.Name()))
+			continue
+		}
+
+		info, err := dirEntry.Info()
+		if err != nil || !info.Mode().IsRegular() || !validKey(info.Name()) {
+			continue
+		}
+		existing = append(existing, info)
+	}
+
+	// Oldest first, so the most recently written content ends up at the front
+	sort.Slice(existing, func(i, j int) bool {
+		return existing[i].ModTime().Before(existing[j].ModTime())
+	})
+	for _, info := range existing {
+		c.entries[info.Name()] = c.lru.PushFront(&diskEntry{key: info.Name(), size: info.Size()})
+		c.size += info.Size()
+	}
+	c.evict()
+
+	return c, nil
+}
+
+func (c *DiskContentCache) GetContent(key string, offset int64, length int64) ([]byte, error) {
+	c.mu.Lock()
+	elem, ok := c.entries[key]
+	if ok {
+		c.lru.MoveToFront(elem)
+	}
+	c.mu.Unlock()
+
+	if !ok {
+		return nil, ErrContentNotFound
+	}
+
+	f, err := os.Open(c.path(key))
+	if os.IsNotExist(err) {
+		c.remove(key)
+		return nil, ErrContentNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	size := elem.Value.(*diskEntry).size
+	if offset >= size {
+		return []byte{}, nil
+	}
+	if offset+length > size {
+		length = size - offset
+	}
+
+	data := make([]byte, length)
+	n, err := f.ReadAt(data, offset)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	return data[:n], nil
+}
+
+func (c *DiskContentCache) StoreContent(chunks chan []byte) (string, error) {
+	return c.store("", chunks)
+}
+
+// StoreContentWithKey stores content under key rather than its hash
+func (c *DiskContentCache) StoreContentWithKey(key string, chunks chan []byte) error {
+	if !validKey(key) {
+		// Drain the channel since the producer blocks until we do
+		for range chunks {
+		}
+		return fmt.Errorf("invalid disk cache key: %s", key)
+	}
+
+	_, err := c.store(key, chunks)
+	return err
+}
+
+func (c *DiskContentCache) store(key string, chunks chan []byte) (string, error) {
+	f, err := os.CreateTemp(c.dir, diskTempPrefix)
+
+	hasher := sha256.New()
+	var size int64
+
+	c.mu.Lock()
+	maxSize := c.maxSize
+	c.mu.Unlock()
+
+	// Always drain the channel, the producer blocks until we do
+	for chunk := range chunks {
+		if err != nil {
+			continue
+		}
+
+		size += int64(len(chunk))
+		if size > maxSize {
+			err = ErrContentTooLarge
+			continue
+		}
+
+		hasher.Write(chunk)
+		_, err = f.Write(chunk)
+	}
+
+	if f == nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if key == "" {
+		key = hex.EncodeToString(hasher.Sum(nil))
+	}
+
+	if err := os.Rename(f.Name(), c.path(key)); err != nil {
+		return "", err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(elem)
+		return key, nil
+	}
+
+	c.entries[key] = c.lru.PushFront(&diskEntry{key: key, size: size})
+	c.size += size
+	c.evict()
+
+	return key, nil
+}
+
+// ContentPath returns the file holding content stored under key
+func (c *DiskContentCache) ContentPath(key string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return "", false
+	}
+	c.lru.MoveToFront(elem)
+
+	return c.path(key), true
+}
+
+// Size returns the number of bytes currently cached
+func (c *DiskContentCache) Size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size
+}
+
+// Flush removes all cached content from the directory
+func (c *DiskContentCache) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, elem := range c.entries {
+		if err := os.Remove(c.path(key)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove cached content: %v", err)
+		}
+		c.lru.Remove(elem)
+		delete(c.entries, key)
+		c.size -= elem.Value.(*diskEntry).size
+	}
+	return nil
+}
+
+// SetMaxSize changes the limit of the cache, evicting content right away if it shrank
+func (c *DiskContentCache) SetMaxSize(maxSize int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.maxSize = maxSize
+	c.evict()
+}
+
+// evict removes the least recently used content until the cache fits its limit, c.mu must be held
+func (c *DiskContentCache) evict() {
+	for c.size > c.maxSize {
+		oldest := c.lru.Back()
+		entry := oldest.Value.(*diskEntry)
+		c.lru.Remove(oldest)
+		delete(c.entries, entry.key)
+		c.size -= entry.size
+		os.Remove(c.path(entry.key))
+	}
+}
+
+func (c *DiskContentCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		c.lru.Remove(elem)
+		delete(c.entries, key)
+		c.size -= elem.Value.(*diskEntry).size
+	}
+}
+
+func (c *DiskContentCache) path(key string) string {
+	return filepath.Join(c.dir, key)
+}
+
+// validKey reports whether a key is made of the characters used by content hashes and block keys,
+// so it is safe to use as a file name
+func validKey(key string) bool {
+	if key == "" {
+		return false
+	}
+
+	for _, r := range key {
+		if !(r >= '0' && r <= '9' || r >= 'a' && r <= 'f' || r == '-') {
+			return false
+		}
+	}
+
+	return true
+}
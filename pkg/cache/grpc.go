@@ -0,0 +1,122 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/NilayYadav/clip/pkg/common/contentcache"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// Large enough for the chunks clipfs stores content in, gRPC defaults to 4Mb
+const grpcMaxMessageSize = 1 << 27 // 128Mb
+
+type GRPCContentCacheOpts struct {
+	Addr     string
+	DialOpts []grpc.DialOption // Defaults to an insecure connection when empty
+	Conn     *grpc.ClientConn  // Overrides Addr/DialOpts to share an existing connection
+}
+
+// GRPCContentCache talks to an external content cache service implementing the protocol
+// defined in pkg/common/contentcache/contentcache.proto
+type GRPCContentCache struct {
+	conn   *grpc.ClientConn
+	client contentcache.ContentCacheClient
+}
+
+func NewGRPCContentCache(opts GRPCContentCacheOpts) (*GRPCContentCache, error) {
+	conn := opts.Conn
+	if conn == nil {
+		dialOpts := opts.DialOpts
+		if len(dialOpts) == 0 {
+			dialOpts = []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
+		}
+		dialOpts = append(dialOpts, grpc.WithDefaultCallOptions(
+			grpc.MaxCallRecvMsgSize(grpcMaxMessageSize),
+			grpc.MaxCallSendMsgSize(grpcMaxMessageSize),
+		))
+
+		var err error
+		conn, err = grpc.Dial(opts.Addr, dialOpts...)
+		if err != nil {
+			return nil, fmt.Errorf("cannot connect to content cache: %v", err)
+		}
+	}
+
+	return &GRPCContentCache{
+		conn:   conn,
+		client: contentcache.NewContentCacheClient(conn),
+	}, nil
+}
+
+func (c *GRPCContentCache) GetContent(hash string, offset int64, length int64) ([]byte, error) {
+	resp, err := c.client.GetContent(context.TODO(), &contentcache.GetContentRequest{
+		Hash:   hash,
+		Offset: offset,
+		Length: length,
+	})
+	if status.Code(err) == codes.NotFound {
+		return nil, ErrContentNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	return resp.Content, nil
+}
+
+func (c *GRPCContentCache) StoreContent(chunks chan []byte) (string, error) {
+	return c.store("", chunks)
+}
+
+// StoreContentWithKey stores content under key rather than its hash
+func (c *GRPCContentCache) StoreContentWithKey(key string, chunks chan []byte) error {
+	_, err := c.store(key, chunks)
+	return err
+}
+
+func (c *GRPCContentCache) store(key string, chunks chan []byte) (string, error) {
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	stream, err := c.client.StoreContent(ctx)
+
+	// Always drain the channel, the producer blocks until we do
+	first := true
+	for chunk := range chunks {
+		if err != nil {
+			continue
+		}
+
+		req := &contentcache.StoreContentRequest{Content: chunk}
+		if first {
+			req.Key = key
+			first = false
+		}
+		err = stream.Send(req)
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	// Empty content still has to announce its key
+	if first && key != "" {
+		if err := stream.Send(&contentcache.StoreContentRequest{Key: key}); err != nil {
+			return "", err
+		}
+	}
+
+	resp, err := stream.CloseAndRecv()
+	if err != nil {
+		return "", err
+	}
+
+	return resp.Hash, nil
+}
+
+func (c *GRPCContentCache) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,149 @@
+package cache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+)
+
+// MemoryContentCache keeps recently used content in memory, evicting the least recently used
+// content once the total size goes over its limit
+type MemoryContentCache struct {
+	mu      sync.Mutex
+	maxSize int64
+	size    int64
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+type memoryEntry struct {
+	key     string
+	content []byte
+}
+
+func NewMemoryContentCache(maxSize int64) *MemoryContentCache {
+	return &MemoryContentCache{
+		maxSize: maxSize,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+func (c *MemoryContentCache) GetContent(key string, offset int64, length int64) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, ErrContentNotFound
+	}
+	c.lru.MoveToFront(elem)
+
+	content := elem.Value.(*memoryEntry).content
+	size := int64(len(content))
+	if offset >= size {
+		return []byte{}, nil
+	}
+	if offset+length > size {
+		length = size - offset
+	}
+
+	data := make([]byte, length)
+	copy(data, content[offset:offset+length])
+	return data, nil
+}
+
+// Size returns the number of bytes currently cached
+func (c *MemoryContentCache) Size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size
+}
+
+// Flush drops all cached content
+func (c *MemoryContentCache) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+	c.size = 0
+	return nil
+}
+
+func (c *MemoryContentCache) StoreContent(chunks chan []byte) (string, error) {
+	return c.store("", chunks)
+}
+
+// StoreContentWithKey stores content under key rather than its hash
+func (c *MemoryContentCache) StoreContentWithKey(key string, chunks chan []byte) error {
+	_, err := c.store(key, chunks)
+	return err
+}
+
+func (c *MemoryContentCache) store(key string, chunks chan []byte) (string, error) {
+	hasher := sha256.New()
+	var content []byte
+	var tooLarge bool
+
+	c.mu.Lock()
+	maxSize := c.maxSize
+	c.mu.Unlock()
+
+	// Always drain the channel, the producer blocks until we do
+	for chunk := range chunks {
+		if tooLarge {
+			continue
+		}
+
+		if int64(len(content)+len(chunk)) > maxSize {
+			tooLarge = true
+			content = nil
+			continue
+		}
+
+		hasher.Write(chunk)
+		content = append(content, chunk...)
+	}
+
+	if tooLarge {
+		return "", ErrContentTooLarge
+	}
+
+	if key == "" {
+		key = hex.EncodeToString(hasher.Sum(nil))
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(elem)
+		return key, nil
+	}
+
+	c.entries[key] = c.lru.PushFront(&memoryEntry{key: key, content: content})
+	c.size += int64(len(content))
+	c.evict()
+
+	return key, nil
+}
+
+// SetMaxSize changes the limit of the cache, evicting content right away if it shrank
+func (c *MemoryContentCache) SetMaxSize(maxSize int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.maxSize = maxSize
+	c.evict()
+}
+
+// evict removes the least recently used content until the cache fits its limit, c.mu must be held
+func (c *MemoryContentCache) evict() {
+	for c.size > c.maxSize {
+		oldest := c.lru.Back()
+		entry := oldest.Value.(*memoryEntry)
+		c.lru.Remove(oldest)
+		delete(c.entries, entry.key)
+		c.size -= int64(len(entry.content))
+	}
+}
@@ -0,0 +1,243 @@
+package cache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	ErrContentNotFound = errors.New("content not found in cache")
+	ErrContentTooLarge = errors.New("content too large for cache")
+)
+
+const (
+	defaultRedisKeyPrefix      = "clip:content:"
+	defaultRedisChunkSize      = 1 << 20 // 1Mb
+	defaultRedisMaxContentSize = 1 << 26 // 64Mb
+	redisPipelineChunks        = 16
+)
+
+type RedisContentCacheOpts struct {
+	Addr           string
+	Password       string
+	DB             int
+	Client         redis.UniversalClient // Overrides Addr/Password/DB, e.g. to use a cluster client
+	KeyPrefix      string
+	ChunkSize      int64         // Size of the values content is split into
+	MaxContentSize int64         // Larger files are not cached
+	TTL            time.Duration // How long content is kept, 0 keeps it until evicted by redis
+}
+
+// RedisContentCache stores file content in redis, split over fixed size chunks so ranged reads
+// only fetch the chunks they touch. Content is written under a random upload id and published by
+// setting a single key from the content hash to that id, so keys never need to be renamed across cluster slots.
+type RedisContentCache struct {
+	client         redis.UniversalClient
+	keyPrefix      string
+	chunkSize      int64
+	maxContentSize int64
+	ttl            time.Duration
+}
+
+func NewRedisContentCache(opts RedisContentCacheOpts) (*RedisContentCache, error) {
+	client := opts.Client
+	if client == nil {
+		client = redis.NewClient(&redis.Options{
+			Addr:     opts.Addr,
+			Password: opts.Password,
+			DB:       opts.DB,
+		})
+	}
+
+	if err := client.Ping(context.TODO()).Err(); err != nil {
+		return nil, fmt.Errorf("cannot reach redis: %v", err)
+	}
+
+	c := &RedisContentCache{
+		client:         client,
+		keyPrefix:      opts.KeyPrefix,
+		chunkSize:      opts.ChunkSize,
+		maxContentSize: opts.MaxContentSize,
+		ttl:            opts.TTL,
+	}
+
+	if c.keyPrefix == "" {
+		c.keyPrefix = defaultRedisKeyPrefix
+	}
+	if c.chunkSize <= 0 {
+		c.chunkSize = defaultRedisChunkSize
+	}
+	if c.maxContentSize <= 0 {
+		c.maxContentSize = defaultRedisMaxContentSize
+	}
+
+	return c, nil
+}
+
+func (c *RedisContentCache) contentKey(hash string) string {
+	return c.keyPrefix + hash
+}
+
+func (c *RedisContentCache) chunkKey(uploadID string, idx int64) string {
+	return fmt.Sprintf("%schunk:%s:%d", c.keyPrefix, uploadID, idx)
+}
+
+func (c *RedisContentCache) GetContent(hash string, offset int64, length int64) ([]byte, error) {
+	ctx := context.TODO()
+
+	value, err := c.client.Get(ctx, c.contentKey(hash)).Result()
+	if err == redis.Nil {
+		return nil, ErrContentNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	uploadID, sizeStr, _ := strings.Cut(value, ":")
+	size, err := strconv.ParseInt(sizeStr, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cache entry for <%s>: %v", hash, err)
+	}
+
+	if offset >= size {
+		return []byte{}, nil
+	}
+	if offset+length > size {
+		length = size - offset
+	}
+
+	// Fetch just the part of each chunk covered by the requested range in a single round trip
+	pipe := c.client.Pipeline()
+	var cmds []*redis.StringCmd
+	for pos := offset; pos < offset+length; {
+		idx := pos / c.chunkSize
+		start := pos - idx*c.chunkSize
+		end := c.chunkSize - 1
+		if remaining := offset + length - pos; start+remaining-1 < end {
+			end = start + remaining - 1
+		}
+
+		cmds = append(cmds, pipe.GetRange(ctx, c.chunkKey(uploadID, idx), start, end))
+		pos += end - start + 1
+	}
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	content := make([]byte, 0, length)
+	for _, cmd := range cmds {
+		data, err := cmd.Bytes()
+		if err != nil {
+			return nil, err
+		}
+		// A chunk expired before its content key
+		if len(data) == 0 {
+			return nil, ErrContentNotFound
+		}
+		content = append(content, data...)
+	}
+
+	return content, nil
+}
+
+func (c *RedisContentCache) StoreContent(chunks chan []byte) (string, error) {
+	return c.store("", chunks)
+}
+
+// StoreContentWithKey stores content under key rather than its hash
+func (c *RedisContentCache) StoreContentWithKey(key string, chunks chan []byte) error {
+	_, err := c.store(key, chunks)
+	return err
+}
+
+func (c *RedisContentCache) store(key string, chunks chan []byte) (string, error) {
+	ctx := context.TODO()
+	uploadID := uuid.New().String()
+
+	hasher := sha256.New()
+	pipe := c.client.Pipeline()
+	var buf []byte
+	var size, idx int64
+	var storeErr error
+
+	flushChunk := func(data []byte) {
+		pipe.Set(ctx, c.chunkKey(uploadID, idx), data, c.ttl)
+		idx++
+
+		if idx%redisPipelineChunks == 0 {
+			if _, err := pipe.Exec(ctx); err != nil {
+				storeErr = err
+			}
+		}
+	}
+
+	// Always drain the channel, the producer blocks until we do
+	for chunk := range chunks {
+		if storeErr != nil {
+			continue
+		}
+
+		size += int64(len(chunk))
+		if size > c.maxContentSize {
+			storeErr = ErrContentTooLarge
+			continue
+		}
+
+		hasher.Write(chunk)
+		buf = append(buf, chunk...)
+		for int64(len(buf)) >= c.chunkSize {
+			flushChunk(buf[:c.chunkSize])
+			buf = buf[c.chunkSize:]
+		}
+	}
+
+	if storeErr == nil && len(buf) > 0 {
+		flushChunk(buf)
+	}
+
+	if storeErr == nil {
+		_, storeErr = pipe.Exec(ctx)
+	}
+
+	hash := hex.EncodeToString(hasher.Sum(nil))
+	if key == "" {
+		key = hash
+	}
+
+	if storeErr == nil {
+		// Publish the content, unless another node beat us to it
+		var stored bool
+		stored, storeErr = c.client.SetNX(ctx, c.contentKey(key), fmt.Sprintf("%s:%d", uploadID, size), c.ttl).Result()
+		if storeErr == nil && !stored {
+			c.deleteChunks(ctx, uploadID, idx)
+		}
+	}
+
+	if storeErr != nil {
+		c.deleteChunks(ctx, uploadID, idx)
+		return "", storeErr
+	}
+
+	return key, nil
+}
+
+func (c *RedisContentCache) deleteChunks(ctx context.Context, uploadID string, count int64) {
+	pipe := c.client.Pipeline()
+	for i := int64(0); i < count; i++ {
+		pipe.Del(ctx, c.chunkKey(uploadID, i))
+	}
+	pipe.Exec(ctx)
+}
+
+func (c *RedisContentCache) Close() error {
+	return c.client.Close()
+}
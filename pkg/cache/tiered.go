@@ -0,0 +1,253 @@
+package cache
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/NilayYadav/clip/pkg/common"
+)
+
+const promotionChunkSize = 1 << 25 // 32Mb
+
+// ContentCache is a single tier of a TieredContentCache. StoreContent must always drain the channel it is given.
+type ContentCache interface {
+	GetContent(hash string, offset int64, length int64) ([]byte, error)
+	StoreContent(chan []byte) (string, error)
+}
+
+// KeyedContentCache is implemented by tiers that can store content under a key chosen by the caller,
+// which is how blocks of files are cached
+type KeyedContentCache interface {
+	ContentCache
+	StoreContentWithKey(key string, chunks chan []byte) error
+}
+
+// TieredContentCache chains caches from fastest to slowest, e.g. memory, then local disk, then a remote cache.
+// Reads are served by the first tier holding the content, which is then promoted into the tiers above it.
+// Stores are written through to every tier. Keyed stores skip tiers that don't support keys.
+type TieredContentCache struct {
+	tiers     []ContentCache
+	mu        sync.Mutex
+	promoting map[string]bool
+}
+
+func NewTieredContentCache(tiers ...ContentCache) *TieredContentCache {
+	return &TieredContentCache{
+		tiers:     tiers,
+		promoting: make(map[string]bool),
+	}
+}
+
+// GetContent returns ErrContentNotFound if no tier holds the content, or the error of a tier that
+// failed, so callers can tell a miss from a cache that is down
+func (c *TieredContentCache) GetContent(hash string, offset int64, length int64) ([]byte, error) {
+	var tierErr error
+	for i, tier := range c.tiers {
+		content, err := tier.GetContent(hash, offset, length)
+		if err != nil {
+			if !errors.Is(err, ErrContentNotFound) {
+				tierErr = err
+			}
+			continue
+		}
+
+		if i > 0 {
+			go c.promote(hash, i)
+		}
+
+		return content, nil
+	}
+
+	if tierErr != nil {
+		return nil, tierErr
+	}
+	return nil, ErrContentNotFound
+}
+
+func (c *TieredContentCache) StoreContent(chunks chan []byte) (string, error) {
+	return storeInTiers(c.tiers, "", chunks)
+}
+
+func (c *TieredContentCache) StoreContentWithKey(key string, chunks chan []byte) error {
+	_, err := storeInTiers(c.tiers, key, chunks)
+	return err
+}
+
+// ContentPath returns a local file holding content from the first tier that keeps content in files
+func (c *TieredContentCache) ContentPath(key string) (string, bool) {
+	for _, tier := range c.tiers {
+		if pather, ok := tier.(interface {
+			ContentPath(key string) (string, bool)
+		}); ok {
+			if path, ok := pather.ContentPath(key); ok {
+				return path, true
+			}
+		}
+	}
+	return "", false
+}
+
+// Flush drops the content of every tier that can be flushed, shared tiers like remote caches can't
+func (c *TieredContentCache) Flush() error {
+	for _, tier := range c.tiers {
+		if flusher, ok := tier.(interface{ Flush() error }); ok {
+			if err := flusher.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Tiers returns the caches chained, fastest first
+func (c *TieredContentCache) Tiers() []ContentCache {
+	return c.tiers
+}
+
+// Size returns the number of bytes held by the tiers that know their size
+func (c *TieredContentCache) Size() int64 {
+	var size int64
+	for _, tier := range c.tiers {
+		if sizer, ok := tier.(interface{ Size() int64 }); ok {
+			size += sizer.Size()
+		}
+	}
+	return size
+}
+
+// promote copies content found in a lower tier into every tier above it, hash can also be a key.
+// The content is read in full before it's stored: keyed tiers store whatever they're given under the
+// key, so content cut short by a failed read would be served from then on.
+func (c *TieredContentCache) promote(hash string, from int) {
+	c.mu.Lock()
+	if c.promoting[hash] {
+		c.mu.Unlock()
+		return
+	}
+	c.promoting[hash] = true
+	c.mu.Unlock()
+
+	var content [][]byte
+	for offset := int64(0); ; offset += promotionChunkSize {
+		chunk, err := c.tiers[from].GetContent(hash, offset, promotionChunkSize)
+		if err != nil {
+			log.Printf("err reading <%s> for promotion: %v", hash, err)
+			c.donePromoting(hash)
+			return
+		}
+
+		if len(chunk) > 0 {
+			content = append(content, chunk)
+		}
+		if len(chunk) < promotionChunkSize {
+			break
+		}
+	}
+
+	chunks := make(chan []byte, len(content))
+	for _, chunk := range content {
+		chunks <- chunk
+	}
+	close(chunks)
+
+	stored, err := storeInTiers(c.tiers[:from], hash, chunks)
+	if errors.Is(err, ErrContentTooLarge) {
+		// Leave the hash marked so content that doesn't fit the upper tiers isn't read again on every hit
+		return
+	}
+	if err != nil {
+		log.Printf("err promoting <%s>: %v", hash, err)
+	} else if stored != hash {
+		log.Printf("err promoting <%s>: stored as <%s>", hash, stored)
+	}
+	c.donePromoting(hash)
+}
+
+func (c *TieredContentCache) donePromoting(hash string) {
+	c.mu.Lock()
+	delete(c.promoting, hash)
+	c.mu.Unlock()
+}
+
+// storeInTiers writes the same content to every tier at once. It succeeds as long as one tier stored the content.
+// With a key, content goes to the tiers that support keys, and to others only if the key is the content hash.
+func storeInTiers(tiers []ContentCache, key string, chunks chan []byte) (string, error) {
+	type result struct {
+		hash string
+		err  error
+	}
+
+	var stores []func(chan []byte) (string, error)
+	for _, tier := range tiers {
+		tier := tier
+
+		keyed, isKeyed := tier.(KeyedContentCache)
+		switch {
+		case key != "" && isKeyed:
+			stores = append(stores, func(chunks chan []byte) (string, error) {
+				return key, keyed.StoreContentWithKey(key, chunks)
+			})
+		case key == "" || isContentHash(key):
+			stores = append(stores, func(chunks chan []byte) (string, error) {
+				hash, err := tier.StoreContent(chunks)
+				if err == nil && key != "" && hash != key {
+					return "", common.NewError(fmt.Sprintf("content hash mismatch, expected <%s> got <%s>", key, hash), common.ErrChecksumMismatch)
+				}
+				return hash, err
+			})
+		}
+	}
+
+	tierChunks := make([]chan []byte, len(stores))
+	results := make([]chan result, len(stores))
+	for i, store := range stores {
+		tierChunks[i] = make(chan []byte, 1)
+		results[i] = make(chan result, 1)
+
+		go func(store func(chan []byte) (string, error), chunks chan []byte, results chan result) {
+			hash, err := store(chunks)
+			results <- result{hash: hash, err: err}
+		}(store, tierChunks[i], results[i])
+	}
+
+	for chunk := range chunks {
+		for _, ch := range tierChunks {
+			ch <- chunk
+		}
+	}
+	for _, ch := range tierChunks {
+		close(ch)
+	}
+
+	hash := ""
+	err := ErrContentNotFound
+	for i := range stores {
+		res := <-results[i]
+		if res.err != nil {
+			err = res.err
+			if !errors.Is(res.err, ErrContentTooLarge) {
+				log.Printf("err storing content in cache tier %d: %v", i, res.err)
+			}
+			continue
+		}
+
+		if hash == "" {
+			hash = res.hash
+		}
+	}
+
+	if hash == "" {
+		return "", err
+	}
+
+	return hash, nil
+}
+
+// isContentHash reports whether key is a hex encoded sha256 hash rather than a block key
+func isContentHash(key string) bool {
+	_, err := hex.DecodeString(key)
+	return err == nil && len(key) == 64
+}
@@ -0,0 +1,227 @@
+//go:build !windows
+
+package clip
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/NilayYadav/clip/pkg/storage"
+)
+
+type BenchOptions struct {
+	Mount       MountOptions // Archive and cache settings to benchmark, the mount point is a temporary directory
+	MaxFiles    int          // Read at most this many files sequentially, 0 reads them all
+	RandomReads int
+	ReadSize    int   // Size of each random read
+	Seed        int64 // Seeds the random reads, so runs read the same ranges
+}
+
+// BenchPhase measures one pass over the mounted archive
+type BenchPhase struct {
+	Ops            int64   `json:"ops"`
+	Bytes          int64   `json:"bytes"`
+	Seconds        float64 `json:"seconds"`
+	OpsPerSecond   float64 `json:"ops_per_second"`
+	BytesPerSecond float64 `json:"bytes_per_second"`
+	RemoteRequests int64   `json:"remote_requests"`
+	RemoteBytes    int64   `json:"remote_bytes"`
+}
+
+type BenchResult struct {
+	Archive        string     `json:"archive"`
+	Files          int        `json:"files"`
+	Bytes          int64      `json:"bytes"`
+	Metadata       BenchPhase `json:"metadata"`
+	SequentialCold BenchPhase `json:"sequential_cold"`
+	SequentialWarm BenchPhase `json:"sequential_warm"`
+	RandomCold     BenchPhase `json:"random_cold"`
+	RandomWarm     BenchPhase `json:"random_warm"`
+}
+
+type benchFile struct {
+	path string
+	size int64
+}
+
+// Bench mounts an archive and measures how fast it serves metadata, sequential reads and random
+// reads. Reads are cold the first time they're made after mounting and warm the second time, the
+// archive is mounted again between the sequential and random passes so the random reads start cold.
+func Bench(options BenchOptions) (*BenchResult, error) {
+	if options.ReadSize <= 0 {
+		options.ReadSize = 4096
+	}
+
+	mountPoint, err := os.MkdirTemp("", "clip-bench-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(mountPoint)
+
+	// Count remote reads, on top of any limit already set
+	counter := options.Mount.ReadLimits.Shared
+	if counter == nil {
+		counter = storage.NewSharedReadLimiter(0)
+		options.Mount.ReadLimits.Shared = counter
+	}
+	options.Mount.MountPoint = mountPoint
+
+	result := &BenchResult{Archive: options.Mount.ArchivePath}
+	var files []benchFile
+
+	err = benchMount(options.Mount, func() error {
+		var err error
+		result.Metadata, err = benchPhase(counter, func(phase *BenchPhase) error {
+			return filepath.WalkDir(mountPoint, func(p string, d fs.DirEntry, err error) error {
+				if err != nil {
+					return err
+				}
+				info, err := d.Info()
+				if err != nil {
+					return err
+				}
+				phase.Ops++
+				if info.Mode().IsRegular() {
+					files = append(files, benchFile{path: p, size: info.Size()})
+				}
+				return nil
+			})
+		})
+		if err != nil {
+			return err
+		}
+
+		result.Files = len(files)
+		for _, f := range files {
+			result.Bytes += f.size
+		}
+
+		sequential := files
+		if options.MaxFiles > 0 && len(sequential) > options.MaxFiles {
+			sequential = sequential[:options.MaxFiles]
+		}
+		if result.SequentialCold, err = benchPhase(counter, readSequential(sequential)); err != nil {
+			return err
+		}
+		result.SequentialWarm, err = benchPhase(counter, readSequential(sequential))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var readable []benchFile
+	for _, f := range files {
+		if f.size > 0 {
+			readable = append(readable, f)
+		}
+	}
+	if len(readable) == 0 || options.RandomReads <= 0 {
+		return result, nil
+	}
+
+	err = benchMount(options.Mount, func() error {
+		var err error
+		if result.RandomCold, err = benchPhase(counter, readRandom(readable, options)); err != nil {
+			return err
+		}
+		result.RandomWarm, err = benchPhase(counter, readRandom(readable, options))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// benchMount mounts the archive for the duration of run
+func benchMount(options MountOptions, run func() error) error {
+	m, err := NewMount(options)
+	if err != nil {
+		return err
+	}
+	if err := m.Start(context.Background()); err != nil {
+		m.Close()
+		return err
+	}
+
+	runErr := run()
+
+	if err := m.Close(); err != nil {
+		return err
+	}
+	if err := <-m.Done(); err != nil && runErr == nil {
+		return err
+	}
+	return runErr
+}
+
+// benchPhase times run, which counts its own operations and bytes
+func benchPhase(counter *storage.SharedReadLimiter, run func(phase *BenchPhase) error) (BenchPhase, error) {
+	var phase BenchPhase
+	requests, remoteBytes := counter.Requests(), counter.BytesRead()
+
+	start := time.Now()
+	err := run(&phase)
+	phase.Seconds = time.Since(start).Seconds()
+
+	phase.RemoteRequests = counter.Requests() - requests
+	phase.RemoteBytes = counter.BytesRead() - remoteBytes
+	if phase.Seconds > 0 {
+		phase.OpsPerSecond = float64(phase.Ops) / phase.Seconds
+		phase.BytesPerSecond = float64(phase.Bytes) / phase.Seconds
+	}
+	return phase, err
+}
+
+func readSequential(files []benchFile) func(phase *BenchPhase) error {
+	return func(phase *BenchPhase) error {
+		buf := make([]byte, 1<<20)
+		for _, f := range files {
+			file, err := os.Open(f.path)
+			if err != nil {
+				return err
+			}
+			n, err := io.CopyBuffer(io.Discard, file, buf)
+			file.Close()
+			if err != nil {
+				return fmt.Errorf("error reading %s: %v", f.path, err)
+			}
+			phase.Ops++
+			phase.Bytes += n
+		}
+		return nil
+	}
+}
+
+func readRandom(files []benchFile, options BenchOptions) func(phase *BenchPhase) error {
+	return func(phase *BenchPhase) error {
+		rng := rand.New(rand.NewSource(options.Seed))
+		buf := make([]byte, options.ReadSize)
+
+		for i := 0; i < options.RandomReads; i++ {
+			f := files[rng.Intn(len(files))]
+			off := rng.Int63n(f.size)
+
+			file, err := os.Open(f.path)
+			if err != nil {
+				return err
+			}
+			n, err := file.ReadAt(buf, off)
+			file.Close()
+			if err != nil && err != io.EOF {
+				return fmt.Errorf("error reading %s: %v", f.path, err)
+			}
+			phase.Ops++
+			phase.Bytes += int64(n)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,139 @@
+//go:build !windows
+
+package clip
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// Binding is a mount bound into the mount namespace of another process, like a container, see BindMount
+type Binding struct {
+	ns     *os.File // Kept open, so the binding can be undone once the process is gone and its pid reused
+	target string
+	owner  *activeMount // Mount of this process the binding is of, nil for mounts served by others
+	once   sync.Once
+}
+
+// ProcessNamespace returns the mount namespace of a process, for BindMount
+func ProcessNamespace(pid int) string {
+	return fmt.Sprintf("/proc/%d/ns/mnt", pid)
+}
+
+// BindMount binds source, a mounted archive or a directory of one, to target in the mount namespace
+// at namespace, like that of a running container, creating target if it doesn't exist. Target is
+// resolved in the namespace, its symlinks can't lead out of the container. Scratch directories come
+// along. It needs CAP_SYS_ADMIN and Linux 5.2 or later.
+//
+// Bindings of mounts served by this process are undone when the mount stops being served. The mount
+// keeps serving bindings after it's unmounted from its mount point, so close them first.
+func BindMount(source string, namespace string, target string) (*Binding, error) {
+	source, err := filepath.Abs(source)
+	if err != nil {
+		return nil, err
+	}
+	ns, err := os.Open(namespace)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open mount namespace: %v", err)
+	}
+
+	// A copy of the mount attached nowhere yet, which can be moved into another namespace
+	tree, err := unix.OpenTree(unix.AT_FDCWD, source, unix.OPEN_TREE_CLONE|unix.OPEN_TREE_CLOEXEC|unix.AT_RECURSIVE)
+	if err != nil {
+		ns.Close()
+		return nil, fmt.Errorf("failed to clone mount %s: %v", source, err)
+	}
+	defer unix.Close(tree)
+
+	err = inNamespace(ns, func() error {
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return err
+		}
+		return unix.MoveMount(tree, "", unix.AT_FDCWD, target, unix.MOVE_MOUNT_F_EMPTY_PATH)
+	})
+	if err != nil {
+		ns.Close()
+		return nil, fmt.Errorf("failed to bind %s to %s: %v", source, target, err)
+	}
+
+	b := &Binding{ns: ns, target: target}
+	activeMounts.Lock()
+	for m := range activeMounts.mounts {
+		mountPoint, _ := filepath.Abs(m.mountPoint)
+		if source == mountPoint || strings.HasPrefix(source, strings.TrimSuffix(mountPoint, "/")+"/") {
+			b.owner = m
+			m.bindings = append(m.bindings, b)
+			break
+		}
+	}
+	activeMounts.Unlock()
+	return b, nil
+}
+
+// Close unmounts the binding from the namespace. Files the process has open from it stay readable
+// until they are closed.
+func (b *Binding) Close() error {
+	var err error
+	b.once.Do(func() {
+		err = inNamespace(b.ns, func() error {
+			return unix.Unmount(b.target, unix.MNT_DETACH)
+		})
+		b.ns.Close()
+
+		if b.owner != nil {
+			activeMounts.Lock()
+			for i, other := range b.owner.bindings {
+				if other == b {
+					b.owner.bindings = append(b.owner.bindings[:i], b.owner.bindings[i+1:]...)
+					break
+				}
+			}
+			activeMounts.Unlock()
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("failed to unbind %s: %v", b.target, err)
+	}
+	return nil
+}
+
+// closeBindings undoes the bindings of a mount that is no longer served, which would only fail reads
+func closeBindings(m *activeMount) {
+	activeMounts.Lock()
+	bindings := append([]*Binding(nil), m.bindings...)
+	activeMounts.Unlock()
+
+	for _, b := range bindings {
+		if err := b.Close(); err != nil {
+			log.Printf("%v\n", err)
+		}
+	}
+}
+
+// inNamespace runs fn on a thread of its own in the mount namespace ns. The thread exits afterwards
+// rather than go back to running other goroutines in the namespace.
+func inNamespace(ns *os.File, fn func() error) error {
+	result := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread() // Never unlocked, so the thread exits with the goroutine
+
+		// Threads share their root and working directory, which entering a namespace changes
+		if err := unix.Unshare(unix.CLONE_FS); err != nil {
+			result <- fmt.Errorf("failed to unshare filesystem attributes: %v", err)
+			return
+		}
+		if err := unix.Setns(int(ns.Fd()), unix.CLONE_NEWNS); err != nil {
+			result <- fmt.Errorf("failed to enter mount namespace: %v", err)
+			return
+		}
+		result <- fn()
+	}()
+	return <-result
+}
@@ -0,0 +1,53 @@
+package clip
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+
+	"github.com/NilayYadav/clip/pkg/archive"
+	"github.com/NilayYadav/clip/pkg/common"
+)
+
+// writeChunkManifest writes the chunk manifest of the archive at archivePath, if one was asked for.
+// Its URL defaults to the one the archive stored at info is served from.
+func writeChunkManifest(options CreateOptions, archivePath string, info common.ClipStorageInfo) error {
+	if options.ChunkManifestPath == "" {
+		return nil
+	}
+
+	archiveURL := options.ChunkURL
+	if archiveURL == "" {
+		archiveURL = storageURL(info)
+	}
+	if err := archive.WriteChunkManifest(archivePath, options.ChunkManifestPath, options.ChunkSize, archiveURL); err != nil {
+		return err
+	}
+
+	log.Printf("Chunk manifest written to %s\n", options.ChunkManifestPath)
+	return nil
+}
+
+// storageURL returns the URL an archive stored at info can be fetched from over plain HTTP, empty if
+// there's none
+func storageURL(info common.ClipStorageInfo) string {
+	switch si := info.(type) {
+	case *common.HTTPStorageInfo:
+		return si.URL
+	case *common.S3StorageInfo:
+		key := (&url.URL{Path: "/" + si.Key}).EscapedPath()
+		if si.Endpoint == "" {
+			return fmt.Sprintf("https://%s.s3.%s.amazonaws.com%s", si.Bucket, si.Region, key)
+		}
+		endpoint, err := url.Parse(strings.TrimSuffix(si.Endpoint, "/"))
+		if err != nil {
+			return ""
+		}
+		if si.ForcePathStyle {
+			return fmt.Sprintf("%s/%s%s", endpoint, si.Bucket, key)
+		}
+		return fmt.Sprintf("%s://%s.%s%s%s", endpoint.Scheme, si.Bucket, endpoint.Host, endpoint.Path, key)
+	}
+	return ""
+}
@@ -5,23 +5,49 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"path"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/NilayYadav/clip/pkg/archive"
+	"github.com/NilayYadav/clip/pkg/cache"
 	"github.com/NilayYadav/clip/pkg/clipfs"
 	"github.com/NilayYadav/clip/pkg/common"
 	"github.com/NilayYadav/clip/pkg/storage"
-	"github.com/hanwen/go-fuse/v2/fs"
-	"github.com/hanwen/go-fuse/v2/fuse"
 )
 
 type CreateOptions struct {
-	InputPath    string
-	OutputPath   string
-	Verbose      bool
-	Credentials  storage.ClipStorageCredentials
-	ProgressChan chan<- int
+	InputPath            string
+	ManifestPath         string // File listing the source files to archive and their paths in the archive, used instead of InputPath
+	OutputPath           string // A path, or a location in remote storage, see storage.ParseLocation
+	Verbose              bool
+	Credentials          storage.ClipStorageCredentials
+	ProgressChan         chan<- int
+	UploadBytesPerSecond int64    // Caps upload bandwidth, 0 means unlimited
+	PrefetchPaths        []string // Files or glob patterns to prefetch on mount
+	PrefetchAuto         bool     // Also prefetch files known to be read on startup
+	EncryptPaths         []string // Glob patterns of files to encrypt, like /secrets/** or *.pem
+	EncryptionKey        []byte
+	Reproducible         bool  // The same tree always gives a byte identical archive
+	SourceDateEpoch      int64 // Timestamp of every file in reproducible archives
+
+	CheckpointPath string // Save progress here, and resume from it if an earlier run was interrupted
+	SkipHashing    bool   // Faster, but files aren't deduplicated or kept in content caches when mounted
+	SearchIndex    bool   // Index the trigrams of text files, for Archive.Grep
+	ContentTypes   bool   // Sniff the MIME type of each file, see Archive.Entry
+	RCLIPPath      string // Of an archive created in remote storage, defaults to its name with an .rclip extension
+
+	ChunkManifestPath string // Also write a JSON manifest of the archive cut in chunks here, see archive.ChunkManifest
+	ChunkSize         int64  // Of manifest chunks, defaults to archive.DefaultChunkSize
+	ChunkURL          string // URL the archive is served from, in the manifest. Defaults to the remote storage URL.
+
+	ZipPath      string // Zip file whose entries are archived, used instead of InputPath
+	SquashFSPath string // SquashFS image whose tree is archived, used instead of InputPath
+	TarPath      string // Tar or tar.gz streamed into the archive, - for standard input, used instead of InputPath
+
+	Rootfs bool              // TarPath is a container root filesystem, like docker export writes, see archive.ClipArchiverOptions
+	Labels map[string]string // Stored in the archive, like the image config recorded by archive.ImageConfig.AddLabels
 }
 
 type CreateRemoteOptions struct {
@@ -30,54 +56,277 @@ type CreateRemoteOptions struct {
 	Verbose    bool
 }
 
-type ExtractOptions struct {
+type RepackOptions struct {
+	InputFile   string
+	OutputFile  string
+	AccessOrder bool // Lay out file data in the order of the archive's prefetch profile
+	Verbose     bool
+}
+
+type SubsetOptions struct {
 	InputFile  string
-	OutputPath string
+	OutputFile string
+	Paths      []string // Paths or glob patterns to keep, directories are kept with everything in them
 	Verbose    bool
 }
 
+type ExportOptions struct {
+	InputFile     string
+	OutputFile    string
+	Format        string // See archive.ExportEStargz, archive.ExportSquashFS and archive.ExportEROFS
+	ChunkSize     int64
+	EncryptionKey []byte
+	Verbose       bool
+	HashMapPath   string
+}
+
+type ExtractOptions struct {
+	InputFile      string // A path, or a location in remote storage, see storage.ParseLocation
+	OutputPath     string
+	Verbose        bool
+	EncryptionKey  []byte // Encrypted files are skipped without it
+	Rewrites       []archive.PathRewrite
+	PreserveSetuid bool // Keep setuid, setgid and sticky bits, which are cleared by default
+	AllowDevices   bool // Create device nodes, which are skipped by default
+	Limits         archive.ArchiveLimits
+	Credentials    storage.ClipStorageCredentials
+}
+
 type MountOptions struct {
-	ArchivePath           string
+	ArchivePath           string // A path, or a location in remote storage, see storage.ParseLocation
 	MountPoint            string
 	Verbose               bool
 	CachePath             string
 	ContentCache          clipfs.ContentCache
 	ContentCacheAvailable bool
 	Credentials           storage.ClipStorageCredentials
+	Archives              []ArchiveMount // Mount several archives under MountPoint instead of ArchivePath
+	Subpath               string         // Directory inside the archive to use as the root of the mount
+	ReadLimits            storage.ReadLimits
+	MemoryCacheSize       int64  // Bytes of content kept in memory in front of ContentCache, 0 disables the tier
+	DiskCacheDir          string // Directory content is kept in on local disk in front of ContentCache
+	DiskCacheSize         int64  // Bytes of content kept in DiskCacheDir
+	TracePath             string // Record every read to this file, to build a prefetch profile from
+	CacheBlockSize        int64  // Size of the blocks file content is cached in, caches that don't support keys store whole files
+	ReadCoalesceWindow    time.Duration
+	CacheBreaker          clipfs.CacheBreakerOptions
+	Fuse                  FuseOptions
+	ReadAhead             int64  // Bytes the kernel reads ahead of sequential reads, defaults to 128Kb
+	Passthrough           bool   // Let the kernel read files straight from full copies in DiskCacheDir (needs root and Linux 6.9+)
+	Mmap                  bool   // Serve reads of local archives from a memory mapping, truncating the archive while mounted then crashes the mount
+	AllowOther            bool   // Let other users read the mount, like the containers of a pod. The kernel checks file modes.
+	HealthAddr            string // Answer health probes on this address while mounted, unix:<path> for a socket
+	ControlSocket         string // Take commands on this unix socket while mounted: flush caches, stats, log level, prefetch
+	DebugAddr             string // Serve expvar counters of reads and caches at /debug/vars on this address while mounted
+	Pprof                 bool   // Also serve profiles of the process at /debug/pprof/ on DebugAddr
+	OfflineMode           bool   // Keep serving cached content while storage is unreachable, failing only uncached reads
+	NormalizeNames        bool   // Resolve names in either Unicode normalization form, for archives of trees made on macOS
+	CaseInsensitive       bool   // Resolve names regardless of case, listings keep the case stored in the archive
+	EncryptionKey         []byte // Decrypts encrypted files, reading them without it fails with EACCES
+
+	Rewrites []archive.PathRewrite // Path prefixes to move in every mounted archive, like /build/out to /app
+	Limits   archive.ArchiveLimits // Caps on the metadata of mounted archives, for archives that can't be trusted
+
+	ReadChain []ReadSource // Tiers reads try in turn and how long they get, see ParseReadChain. Defaults to the caches, then storage
+
+	// Directories of the mount to mount writable tmpfs scratch space over, like /tmp or /home/app/.cache,
+	// made up if the archive lacks them. Each holds up to ScratchSize bytes, 0 = half of memory.
+	Scratch     []string
+	ScratchSize int64
+
+	StorageInfo common.ClipStorageInfo // Mount the archive stored here instead of ArchivePath, reading its metadata remotely
+}
+
+// ArchiveMount describes one archive exposed by a multi-archive mount
+type ArchiveMount struct {
+	ArchivePath string
+	Prefix      string // Directory under the mount point, defaults to the archive name without its extension
+	CachePath   string
+	Subpath     string
+	StorageInfo common.ClipStorageInfo // Instead of ArchivePath, see MountOptions
+}
+
+// MountPrefix returns the directory the archive is exposed under
+func (am ArchiveMount) MountPrefix() string {
+	if am.Prefix != "" {
+		return am.Prefix
+	}
+	name := archiveName(am.ArchivePath, am.StorageInfo)
+	return strings.TrimSuffix(strings.TrimSuffix(name, filepath.Ext(name)), ".tar")
 }
 
 type StoreS3Options struct {
-	ArchivePath  string
-	OutputFile   string
-	Bucket       string
-	Key          string
-	CachePath    string
-	Credentials  storage.ClipStorageCredentials
-	ProgressChan chan<- int
+	ArchivePath          string
+	OutputFile           string
+	Bucket               string
+	Key                  string
+	Region               string // Defaults to AWS_REGION, then to the region of the shared config profile
+	Endpoint             string // S3 compatible endpoint, recorded in the RCLIP so mounts reach it too
+	ForcePathStyle       bool
+	CAFile               string // CAs of a private endpoint, embedded in the RCLIP so mounts trust it too
+	CachePath            string
+	Credentials          storage.ClipStorageCredentials
+	ProgressChan         chan<- int
+	UploadBytesPerSecond int64 // Caps upload bandwidth, 0 means unlimited
+
+	Replicas []common.ClipStorageInfo // Also store the archive here, concurrently. Mounts fail over to them in order.
+}
+
+type StoreSFTPOptions struct {
+	ArchivePath          string
+	OutputFile           string
+	Host                 string
+	User                 string
+	Path                 string
+	Credentials          storage.ClipStorageCredentials
+	ProgressChan         chan<- int
+	UploadBytesPerSecond int64 // Caps upload bandwidth, 0 means unlimited
+}
+
+type StoreIPFSOptions struct {
+	ArchivePath          string
+	OutputFile           string
+	APIURL               string
+	GatewayURL           string
+	Credentials          storage.ClipStorageCredentials
+	ProgressChan         chan<- int
+	UploadBytesPerSecond int64 // Caps upload bandwidth, 0 means unlimited
+}
+
+type StoreHTTPOptions struct {
+	ArchivePath          string
+	OutputFile           string
+	URL                  string
+	Credentials          storage.ClipStorageCredentials
+	ProgressChan         chan<- int
+	UploadBytesPerSecond int64 // Caps upload bandwidth, 0 means unlimited
 }
 
-// Create Archive
+func logSource(options CreateOptions) {
+	if options.ManifestPath != "" {
+		log.Printf("Creating a new archive from manifest: %s\n", options.ManifestPath)
+		return
+	}
+	if options.ZipPath != "" {
+		log.Printf("Creating a new archive from zip: %s\n", options.ZipPath)
+		return
+	}
+	if options.SquashFSPath != "" {
+		log.Printf("Creating a new archive from squashfs image: %s\n", options.SquashFSPath)
+		return
+	}
+	if options.TarPath != "" {
+		log.Printf("Creating a new archive from tar: %s\n", options.TarPath)
+		return
+	}
+	log.Printf("Creating a new archive from directory: %s\n", options.InputPath)
+}
+
+// Create Archive. Archives created in remote storage are uploaded, and an RCLIP pointing at them is
+// written to options.RCLIPPath.
 func CreateArchive(options CreateOptions) error {
+	info, outputPath, err := storage.ParseLocation(options.OutputPath)
+	if err != nil {
+		return err
+	}
+	if info != nil {
+		if options.CheckpointPath != "" {
+			return fmt.Errorf("archives created in remote storage can't be resumed")
+		}
+
+		options.OutputPath = RCLIPPath(options)
+		return CreateAndUploadArchive(context.TODO(), options, info)
+	}
+	options.OutputPath = outputPath
+
 	log.Println("Archiving...")
-	log.Printf("Creating a new archive from directory: %s\n", options.InputPath)
+	logSource(options)
 
 	a := archive.NewClipArchiver()
-	err := a.Create(archive.ClipArchiverOptions{
-		SourcePath: options.InputPath,
-		OutputFile: options.OutputPath,
-		Verbose:    options.Verbose,
+	err = a.Create(archive.ClipArchiverOptions{
+		SourcePath:    options.InputPath,
+		ManifestPath:  options.ManifestPath,
+		ZipPath:       options.ZipPath,
+		SquashFSPath:  options.SquashFSPath,
+		TarPath:       options.TarPath,
+		Rootfs:        options.Rootfs,
+		Labels:        options.Labels,
+		OutputFile:    options.OutputPath,
+		Verbose:       options.Verbose,
+		PrefetchPaths: options.PrefetchPaths,
+		PrefetchAuto:  options.PrefetchAuto,
+		EncryptPaths:  options.EncryptPaths,
+		EncryptionKey: options.EncryptionKey,
+
+		Reproducible:    options.Reproducible,
+		SourceDateEpoch: options.SourceDateEpoch,
+		CheckpointPath:  options.CheckpointPath,
+		SkipHashing:     options.SkipHashing,
+		SearchIndex:     options.SearchIndex,
+		ContentTypes:    options.ContentTypes,
 	})
 	if err != nil {
 		return err
 	}
+	if err := writeChunkManifest(options, options.OutputPath, nil); err != nil {
+		return err
+	}
 
 	log.Println("Archive created successfully.")
 	return nil
 }
 
+// RCLIPPath returns where CreateArchive writes the RCLIP of an archive created in remote storage
+func RCLIPPath(options CreateOptions) string {
+	if options.RCLIPPath != "" {
+		return options.RCLIPPath
+	}
+	name := locationName(options.OutputPath)
+	return strings.TrimSuffix(name, filepath.Ext(name)) + ".rclip"
+}
+
+// CreateContentAddressedArchive creates an archive in the directory options.OutputPath, named after
+// its digest, and returns the digest. An archive already there under the same name is identical.
+func CreateContentAddressedArchive(options CreateOptions) (string, error) {
+	if options.CheckpointPath != "" {
+		return "", fmt.Errorf("content addressed archives can't be resumed")
+	}
+
+	dir := options.OutputPath
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+
+	tempFile, err := os.CreateTemp(dir, ".temp-clip-*.clip")
+	if err != nil {
+		return "", err
+	}
+	// Only the name is needed, the archive is created afresh with the usual permissions
+	tempFile.Close()
+	os.Remove(tempFile.Name())
+	defer os.Remove(tempFile.Name()) // Gone after the rename unless something failed
+
+	options.OutputPath = tempFile.Name()
+	if err := CreateArchive(options); err != nil {
+		return "", err
+	}
+
+	digest, err := archive.Digest(tempFile.Name())
+	if err != nil {
+		return "", err
+	}
+	if err := os.Rename(tempFile.Name(), filepath.Join(dir, archive.ContentAddressedName(digest))); err != nil {
+		return "", err
+	}
+
+	return digest, nil
+}
+
+// CreateAndUploadArchive archives options.InputPath, stores it at si and writes an RCLIP pointing at it
+// to options.OutputPath. Use common.NewMirrorStorageInfo as si to store it at several places.
 func CreateAndUploadArchive(ctx context.Context, options CreateOptions, si common.ClipStorageInfo) error {
 	log.Printf("Archiving...")
-	log.Printf("Creating a new archive from directory: %s\n", options.InputPath)
+	logSource(options)
 
 	// Create a temporary file for storing the clip
 	tempFile, err := os.CreateTemp("", "temp-clip-*.clip")
@@ -88,20 +337,42 @@ func CreateAndUploadArchive(ctx context.Context, options CreateOptions, si commo
 
 	localArchiver := archive.NewClipArchiver()
 	err = localArchiver.Create(archive.ClipArchiverOptions{
-		SourcePath: options.InputPath,
-		OutputFile: tempFile.Name(),
-		Verbose:    options.Verbose,
+		SourcePath:    options.InputPath,
+		ManifestPath:  options.ManifestPath,
+		ZipPath:       options.ZipPath,
+		SquashFSPath:  options.SquashFSPath,
+		TarPath:       options.TarPath,
+		Rootfs:        options.Rootfs,
+		Labels:        options.Labels,
+		OutputFile:    tempFile.Name(),
+		Verbose:       options.Verbose,
+		PrefetchPaths: options.PrefetchPaths,
+		PrefetchAuto:  options.PrefetchAuto,
+		EncryptPaths:  options.EncryptPaths,
+		EncryptionKey: options.EncryptionKey,
+
+		Reproducible:    options.Reproducible,
+		SourceDateEpoch: options.SourceDateEpoch,
+		SkipHashing:     options.SkipHashing,
+		SearchIndex:     options.SearchIndex,
+		ContentTypes:    options.ContentTypes,
 	})
 	if err != nil {
 		return err
 	}
+	if err := writeChunkManifest(options, tempFile.Name(), si); err != nil {
+		return err
+	}
 
 	remoteArchiver, err := archive.NewRClipArchiver(si)
 	if err != nil {
 		return err
 	}
 
-	err = remoteArchiver.Create(ctx, tempFile.Name(), options.OutputPath, options.Credentials, options.ProgressChan)
+	err = remoteArchiver.Create(ctx, tempFile.Name(), options.OutputPath, options.Credentials, storage.UploadOpts{
+		ProgressChan:   options.ProgressChan,
+		BytesPerSecond: options.UploadBytesPerSecond,
+	})
 	if err != nil {
 		return err
 	}
@@ -110,113 +381,384 @@ func CreateAndUploadArchive(ctx context.Context, options CreateOptions, si commo
 	return nil
 }
 
+// RepackArchive rewrites an archive without unreferenced or duplicate data
+func RepackArchive(options RepackOptions) error {
+	log.Printf("Repacking %s to %s\n", options.InputFile, options.OutputFile)
+
+	a := archive.NewClipArchiver()
+	stats, err := a.Repack(archive.RepackOptions{
+		InputFile:   options.InputFile,
+		OutputFile:  options.OutputFile,
+		AccessOrder: options.AccessOrder,
+		Verbose:     options.Verbose,
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Repacked %d files, %d sharing content with another file\n", stats.Files, stats.SharedFiles)
+	log.Printf("Dropped %d unreferenced and %d duplicate bytes, %d -> %d bytes\n", stats.UnreferencedBytes, stats.DuplicateBytes, stats.InputSize, stats.OutputSize)
+	return nil
+}
+
+// SubsetArchive writes a new archive holding only some paths of an archive
+func SubsetArchive(options SubsetOptions) error {
+	log.Printf("Copying %v from %s to %s\n", options.Paths, options.InputFile, options.OutputFile)
+
+	a := archive.NewClipArchiver()
+	stats, err := a.Subset(archive.SubsetOptions{
+		InputFile:  options.InputFile,
+		OutputFile: options.OutputFile,
+		Paths:      options.Paths,
+		Verbose:    options.Verbose,
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Kept %d entries, %d of them files, %d -> %d bytes\n", stats.Nodes, stats.Files, stats.InputSize, stats.OutputSize)
+	return nil
+}
+
+// ExportArchive converts an archive into an image of another format
+func ExportArchive(options ExportOptions) error {
+	log.Printf("Exporting %s to %s as %s\n", options.InputFile, options.OutputFile, options.Format)
+
+	a := archive.NewClipArchiver()
+	stats, err := a.Export(archive.ExportOptions{
+		InputFile:     options.InputFile,
+		OutputFile:    options.OutputFile,
+		Format:        options.Format,
+		ChunkSize:     options.ChunkSize,
+		EncryptionKey: options.EncryptionKey,
+		Verbose:       options.Verbose,
+		HashMapPath:   options.HashMapPath,
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Exported %d entries, skipped %d, %d bytes\n", stats.Entries, stats.Skipped, stats.OutputSize)
+	if stats.TOCDigest != "" {
+		log.Printf("TOC digest %s, annotate the layer with containerd.io/snapshot/stargz/toc.digest\n", stats.TOCDigest)
+	}
+	return nil
+}
+
 // Extract Archive
-func ExtractArchive(options ExtractOptions) error {
+func ExtractArchive(options ExtractOptions) (*archive.ExtractStats, error) {
+	return extractArchive(context.TODO(), options)
+}
+
+func extractArchive(ctx context.Context, options ExtractOptions) (*archive.ExtractStats, error) {
 	log.Println("Extracting...")
 	log.Printf("Extracting archive: %s\n", options.InputFile)
 
+	location := options.InputFile
+	if tarPath, local := localTarball(location, nil); local {
+		var err error
+		if location, err = indexTarball(tarPath, options.Verbose); err != nil {
+			return nil, err
+		}
+		defer os.Remove(location)
+	}
+
+	// Extracting reads all of the archive, so remote archives are copied first
+	archivePath, cleanup, err := localArchive(ctx, location, "", options.Credentials)
+	if err != nil {
+		return nil, err
+	}
+
 	a := archive.NewClipArchiver()
-	err := a.Extract(archive.ClipArchiverOptions{
-		ArchivePath: options.InputFile,
-		OutputPath:  options.OutputPath,
-		Verbose:     options.Verbose,
+	a.Limits = options.Limits
+	stats, err := a.Extract(archive.ClipArchiverOptions{
+		ArchivePath:   archivePath,
+		OutputPath:    options.OutputPath,
+		Verbose:       options.Verbose,
+		EncryptionKey: options.EncryptionKey,
+		Rewrites:      options.Rewrites,
+
+		PreserveSetuid: options.PreserveSetuid,
+		AllowDevices:   options.AllowDevices,
 	})
+	cleanup()
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
+	log.Printf("Extracted %d entries, skipped %d, %d bytes\n", stats.Entries, stats.Skipped, stats.Bytes)
 	log.Println("Archive extracted successfully.")
-	return nil
+	return stats, nil
 }
 
-// Mount a clip archive to a directory
-func MountArchive(options MountOptions) (func() error, <-chan error, *fuse.Server, error) {
-	log.Printf("Mounting archive %s to %s\n", options.ArchivePath, options.MountPoint)
+// NewContentCache chains the local cache tiers configured for a mount in front of the provided content cache.
+// Mounts build their own, processes running several mounts can build one to share between them.
+// It returns nil if no local tiers are configured.
+func NewContentCache(options MountOptions) (clipfs.ContentCache, error) {
+	var tiers []cache.ContentCache
 
-	if _, err := os.Stat(options.MountPoint); os.IsNotExist(err) {
-		err = os.MkdirAll(options.MountPoint, 0755)
+	if options.MemoryCacheSize > 0 {
+		tiers = append(tiers, cache.NewMemoryContentCache(options.MemoryCacheSize))
+	}
+
+	if options.DiskCacheDir != "" {
+		if options.DiskCacheSize <= 0 {
+			return nil, fmt.Errorf("a disk cache size is required with a disk cache directory")
+		}
+
+		diskCache, err := cache.NewDiskContentCache(options.DiskCacheDir, options.DiskCacheSize)
 		if err != nil {
-			return nil, nil, nil, fmt.Errorf("failed to create mount point directory: %v", err)
+			return nil, err
 		}
-		log.Println("Mount point directory created.")
+		tiers = append(tiers, diskCache)
+	}
+
+	if len(tiers) == 0 {
+		return nil, nil
+	}
+
+	if options.ContentCacheAvailable && options.ContentCache != nil {
+		tiers = append(tiers, options.ContentCache)
+	}
+
+	return cache.NewTieredContentCache(tiers...), nil
+}
+
+// loadFileSystem opens an archive, the one stored at info if it's set, and creates the clip filesystem
+// serving it. Local tarballs are indexed into a temporary archive first.
+func loadFileSystem(ctx context.Context, archivePath string, info common.ClipStorageInfo, cachePath string, subpath string, inodeOffset uint64, trace *clipfs.TraceRecorder, options MountOptions) (*clipfs.ClipFileSystem, storage.ClipStorageInterface, error) {
+	if localPath, local := localTarball(archivePath, info); local {
+		var err error
+		if archivePath, err = indexTarball(localPath, options.Verbose); err != nil {
+			return nil, nil, err
+		}
+		// Local storage keeps the archive open, so it's gone as soon as the mount is
+		defer os.Remove(archivePath)
 	}
 
 	ca := archive.NewClipArchiver()
-	metadata, err := ca.ExtractMetadata(options.ArchivePath)
+	ca.Limits = options.Limits
+	chain, err := readChain(options.ReadChain, options.ContentCache, options.ContentCacheAvailable)
 	if err != nil {
-		return nil, nil, nil, fmt.Errorf("invalid archive: %v", err)
+		return nil, nil, err
 	}
-
-	s, err := storage.NewClipStorage(options.ArchivePath, options.CachePath, metadata, options.Credentials)
+	metadata, archivePath, err := loadMetadata(ctx, ca, archivePath, info, options.Credentials)
 	if err != nil {
-		return nil, nil, nil, fmt.Errorf("could not load storage: %v", err)
+		return nil, nil, fmt.Errorf("invalid archive: %v", err)
 	}
 
-	clipfs, err := clipfs.NewFileSystem(s, clipfs.ClipFileSystemOpts{Verbose: options.Verbose, ContentCache: options.ContentCache, ContentCacheAvailable: options.ContentCacheAvailable})
-	if err != nil {
-		return nil, nil, nil, fmt.Errorf("could not create filesystem: %v", err)
+	if err := archive.CheckEncryptionKey(metadata.Attributes, options.EncryptionKey); err != nil {
+		return nil, nil, err
 	}
 
-	root, _ := clipfs.Root()
-	attrTimeout := time.Second * 60
-	entryTimeout := time.Second * 60
-	fsOptions := &fs.Options{
-		AttrTimeout:  &attrTimeout,
-		EntryTimeout: &entryTimeout,
+	if err := ca.RewritePaths(metadata, options.Rewrites); err != nil {
+		return nil, nil, err
 	}
-	server, err := fuse.NewServer(fs.NewNodeFS(root, fsOptions), options.MountPoint, &fuse.MountOptions{
-		MaxBackground:        512,
-		DisableXAttrs:        true,
-		EnableSymlinkCaching: true,
-		SyncRead:             false,
-		RememberInodes:       true,
-		MaxReadAhead:         1 << 17,
+
+	if err := ca.AddDirs(metadata, scratchDirs(subpath, options.Scratch)); err != nil {
+		return nil, nil, err
+	}
+
+	s, err := storage.NewClipStorage(metadata, storage.ClipStorageOpts{
+		ArchivePath:    archivePath,
+		CachePath:      cachePath,
+		Credentials:    options.Credentials,
+		ReadLimits:     options.ReadLimits,
+		CoalesceWindow: options.ReadCoalesceWindow,
+		Mmap:           options.Mmap,
 	})
 	if err != nil {
-		return nil, nil, nil, fmt.Errorf("could not create server: %v", err)
+		return nil, nil, fmt.Errorf("could not load storage: %v", err)
 	}
 
-	serverError := make(chan error, 1)
-	startServer := func() error {
-		go func() {
-			go server.Serve()
+	cfs, err := clipfs.NewFileSystem(s, clipfs.ClipFileSystemOpts{
+		Verbose:               options.Verbose,
+		ContentCache:          options.ContentCache,
+		ContentCacheAvailable: options.ContentCacheAvailable,
+		InodeOffset:           inodeOffset,
+		RootPath:              subpath,
+		Trace:                 trace,
+		CacheBlockSize:        options.CacheBlockSize,
+		Passthrough:           options.Passthrough,
+		OfflineMode:           options.OfflineMode,
+		NormalizeNames:        options.NormalizeNames,
+		CaseInsensitive:       options.CaseInsensitive,
+		EncryptionKey:         options.EncryptionKey,
+		CacheBreaker:          options.CacheBreaker,
+		ReadChain:             chain,
+	})
+	if err != nil {
+		s.Cleanup()
+		return nil, nil, fmt.Errorf("could not create filesystem: %v", err)
+	}
 
-			if err := server.WaitMount(); err != nil {
-				serverError <- err
-				return
-			}
+	return cfs, s, nil
+}
 
-			server.Wait()
+// scratchDirs returns where the scratch directories of a mount are in its archive
+func scratchDirs(subpath string, scratch []string) []string {
+	dirs := make([]string, 0, len(scratch))
+	for _, p := range scratch {
+		dirs = append(dirs, path.Join("/", subpath, p))
+	}
+	return dirs
+}
 
-			s.Cleanup()
+// Store CLIP in remote storage
+func StoreS3(storeS3Opts StoreS3Options) error {
+	return storeS3(storeS3Opts, false)
+}
 
-			close(serverError)
-		}()
+// StoreS3ContentAddressed stores an archive under its digest, below storeS3Opts.Key if one is given,
+// and returns the digest. Nothing is uploaded if the bucket already holds the archive.
+func StoreS3ContentAddressed(storeS3Opts StoreS3Options) (string, error) {
+	digest, err := archive.Digest(storeS3Opts.ArchivePath)
+	if err != nil {
+		return "", err
+	}
 
-		return nil
+	name := archive.ContentAddressedName(digest)
+	storeS3Opts.Key = path.Join(storeS3Opts.Key, name)
+
+	replicas := make([]common.ClipStorageInfo, 0, len(storeS3Opts.Replicas))
+	for _, replica := range storeS3Opts.Replicas {
+		var s3Replica common.S3StorageInfo
+		switch si := replica.(type) {
+		case common.S3StorageInfo:
+			s3Replica = si
+		case *common.S3StorageInfo:
+			s3Replica = *si
+		default:
+			return "", fmt.Errorf("content addressed archives can only be replicated to s3, not %s", replica.Type())
+		}
+		s3Replica.Key = path.Join(s3Replica.Key, name)
+		replicas = append(replicas, &s3Replica)
 	}
+	storeS3Opts.Replicas = replicas
 
-	return startServer, serverError, server, nil
+	return digest, storeS3(storeS3Opts, true)
 }
 
-// Store CLIP in remote storage
-func StoreS3(storeS3Opts StoreS3Options) error {
+func storeS3(storeS3Opts StoreS3Options, skipExisting bool) error {
 	log.Println("Uploading...")
-	region := os.Getenv("AWS_REGION")
+	region := storeS3Opts.Region
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
 
 	// If no key is provided, use the base name of the input archive as key
 	if storeS3Opts.Key == "" {
 		storeS3Opts.Key = filepath.Base(storeS3Opts.ArchivePath)
 	}
 
-	storageInfo := &common.S3StorageInfo{Bucket: storeS3Opts.Bucket, Key: storeS3Opts.Key, Region: region}
+	var caBundle []byte
+	if storeS3Opts.CAFile != "" {
+		var err error
+		if caBundle, err = os.ReadFile(storeS3Opts.CAFile); err != nil {
+			return fmt.Errorf("failed to read CA bundle: %v", err)
+		}
+	}
+
+	storageInfo := &common.S3StorageInfo{
+		Bucket:         storeS3Opts.Bucket,
+		Key:            storeS3Opts.Key,
+		Region:         region,
+		Endpoint:       storeS3Opts.Endpoint,
+		ForcePathStyle: storeS3Opts.ForcePathStyle,
+		CABundle:       caBundle,
+	}
+
+	var si common.ClipStorageInfo = storageInfo
+	if len(storeS3Opts.Replicas) > 0 {
+		mirror, err := common.NewMirrorStorageInfo(append([]common.ClipStorageInfo{storageInfo}, storeS3Opts.Replicas...)...)
+		if err != nil {
+			return err
+		}
+		si = mirror
+	}
+
+	a, err := archive.NewRClipArchiver(si)
+	if err != nil {
+		return err
+	}
+
+	err = a.Create(context.TODO(), storeS3Opts.ArchivePath, storeS3Opts.OutputFile, storeS3Opts.Credentials, storage.UploadOpts{
+		ProgressChan:   storeS3Opts.ProgressChan,
+		BytesPerSecond: storeS3Opts.UploadBytesPerSecond,
+		SkipExisting:   skipExisting,
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Println("Done uploading.")
+	return nil
+}
+
+// Store CLIP on an SFTP host
+func StoreSFTP(storeSFTPOpts StoreSFTPOptions) error {
+	log.Println("Uploading...")
+
+	// If no path is provided, use the base name of the input archive
+	if storeSFTPOpts.Path == "" {
+		storeSFTPOpts.Path = filepath.Base(storeSFTPOpts.ArchivePath)
+	}
+
+	storageInfo := &common.SFTPStorageInfo{Host: storeSFTPOpts.Host, User: storeSFTPOpts.User, Path: storeSFTPOpts.Path}
+	a, err := archive.NewRClipArchiver(storageInfo)
+	if err != nil {
+		return err
+	}
+
+	err = a.Create(context.TODO(), storeSFTPOpts.ArchivePath, storeSFTPOpts.OutputFile, storeSFTPOpts.Credentials, storage.UploadOpts{
+		ProgressChan:   storeSFTPOpts.ProgressChan,
+		BytesPerSecond: storeSFTPOpts.UploadBytesPerSecond,
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Println("Done uploading.")
+	return nil
+}
+
+// Publish CLIP contents to IPFS
+func StoreIPFS(storeIPFSOpts StoreIPFSOptions) error {
+	log.Println("Publishing...")
+
+	storageInfo := &common.IPFSStorageInfo{APIURL: storeIPFSOpts.APIURL, GatewayURL: storeIPFSOpts.GatewayURL}
+	a, err := archive.NewRClipArchiver(storageInfo)
+	if err != nil {
+		return err
+	}
+
+	err = a.Create(context.TODO(), storeIPFSOpts.ArchivePath, storeIPFSOpts.OutputFile, storeIPFSOpts.Credentials, storage.UploadOpts{
+		ProgressChan:   storeIPFSOpts.ProgressChan,
+		BytesPerSecond: storeIPFSOpts.UploadBytesPerSecond,
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Println("Done publishing.")
+	return nil
+}
+
+// Store CLIP on an HTTP server that accepts PUT requests
+func StoreHTTP(storeHTTPOpts StoreHTTPOptions) error {
+	log.Println("Uploading...")
+
+	storageInfo := &common.HTTPStorageInfo{URL: storeHTTPOpts.URL}
 	a, err := archive.NewRClipArchiver(storageInfo)
 	if err != nil {
 		return err
 	}
 
-	err = a.Create(context.TODO(), storeS3Opts.ArchivePath, storeS3Opts.OutputFile, storeS3Opts.Credentials, storeS3Opts.ProgressChan)
+	err = a.Create(context.TODO(), storeHTTPOpts.ArchivePath, storeHTTPOpts.OutputFile, storeHTTPOpts.Credentials, storage.UploadOpts{
+		ProgressChan:   storeHTTPOpts.ProgressChan,
+		BytesPerSecond: storeHTTPOpts.UploadBytesPerSecond,
+	})
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,304 @@
+package clip
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/NilayYadav/clip/pkg/clipfs"
+	"github.com/NilayYadav/clip/pkg/storage"
+)
+
+// ControlStats is what the control socket of a mount reports on /stats
+type ControlStats struct {
+	RemoteRequests    int64 `json:"remote_requests"`
+	RemoteBytes       int64 `json:"remote_bytes"`
+	CacheBytes        int64 `json:"cache_bytes"` // Held by the local tiers of the content cache
+	PendingCacheFills int   `json:"pending_cache_fills"`
+	CacheBypassed     bool  `json:"cache_bypassed"` // Reads skip the content cache, as it kept failing
+	Verbose           bool  `json:"verbose"`
+}
+
+// controlServer lets a running mount be managed over a unix socket, without remounting:
+//
+//	GET  /stats                     ControlStats of the mount
+//	POST /flush                     drop the local content cache and what the kernel cached
+//	POST /log-level?level=debug     log every operation, level=info stops
+//	POST /prefetch                  cache the paths in the body, one per line, relative to the mount point
+//	POST /hydrate                   cache every file of the mount
+type controlServer struct {
+	filesystems  map[string]*clipfs.ClipFileSystem // By mount prefix, "" for mounts of a single archive
+	contentCache clipfs.ContentCache
+	reads        *storage.SharedReadLimiter
+	server       *http.Server
+}
+
+func startControlServer(socketPath string, filesystems map[string]*clipfs.ClipFileSystem, contentCache clipfs.ContentCache, reads *storage.SharedReadLimiter) (*controlServer, error) {
+	os.Remove(socketPath)
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for control commands on %s: %v", socketPath, err)
+	}
+	// Anyone who can talk to the socket can flush caches and start downloads
+	if err := os.Chmod(socketPath, 0600); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to restrict control socket: %v", err)
+	}
+
+	c := &controlServer{
+		filesystems:  filesystems,
+		contentCache: contentCache,
+		reads:        reads,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stats", c.get(c.stats))
+	mux.HandleFunc("/flush", c.post(c.flush))
+	mux.HandleFunc("/log-level", c.post(c.logLevel))
+	mux.HandleFunc("/prefetch", c.post(c.prefetch))
+	mux.HandleFunc("/hydrate", c.post(c.hydrate))
+	c.server = &http.Server{Handler: mux}
+
+	go c.server.Serve(listener)
+	return c, nil
+}
+
+func (c *controlServer) Close() error {
+	return c.server.Close()
+}
+
+func (c *controlServer) get(handle func(r *http.Request) (interface{}, error)) http.HandlerFunc {
+	return c.handler(http.MethodGet, handle)
+}
+
+func (c *controlServer) post(handle func(r *http.Request) (interface{}, error)) http.HandlerFunc {
+	return c.handler(http.MethodPost, handle)
+}
+
+func (c *controlServer) handler(method string, handle func(r *http.Request) (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method != method {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			json.NewEncoder(w).Encode(map[string]string{"error": "method not allowed"})
+			return
+		}
+
+		result, err := handle(r)
+		if err != nil {
+			log.Printf("Control command %s failed: %v\n", r.URL.Path, err)
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+		json.NewEncoder(w).Encode(result)
+	}
+}
+
+func (c *controlServer) stats(r *http.Request) (interface{}, error) {
+	var stats ControlStats
+	if c.reads != nil {
+		stats.RemoteRequests = c.reads.Requests()
+		stats.RemoteBytes = c.reads.BytesRead()
+	}
+	if sizer, ok := c.contentCache.(interface{ Size() int64 }); ok {
+		stats.CacheBytes = sizer.Size()
+	}
+	for _, cfs := range c.filesystems {
+		stats.PendingCacheFills += cfs.PendingCacheFills()
+		stats.CacheBypassed = stats.CacheBypassed || cfs.CacheBypassed()
+		stats.Verbose = cfs.Verbose()
+	}
+	return stats, nil
+}
+
+func (c *controlServer) flush(r *http.Request) (interface{}, error) {
+	if flusher, ok := c.contentCache.(interface{ Flush() error }); ok {
+		if err := flusher.Flush(); err != nil {
+			return nil, err
+		}
+	}
+	for _, cfs := range c.filesystems {
+		if err := cfs.ForgetCached(); err != nil {
+			return nil, err
+		}
+	}
+	log.Println("Caches flushed.")
+	return map[string]string{}, nil
+}
+
+func (c *controlServer) logLevel(r *http.Request) (interface{}, error) {
+	var verbose bool
+	switch level := r.URL.Query().Get("level"); level {
+	case "debug":
+		verbose = true
+	case "info":
+	default:
+		return nil, fmt.Errorf("unknown log level %q, expected debug or info", level)
+	}
+
+	for _, cfs := range c.filesystems {
+		cfs.SetVerbose(verbose)
+	}
+	return map[string]bool{"verbose": verbose}, nil
+}
+
+func (c *controlServer) prefetch(r *http.Request) (interface{}, error) {
+	var paths []string
+	scanner := bufio.NewScanner(r.Body)
+	for scanner.Scan() {
+		if p := strings.TrimSpace(scanner.Text()); p != "" {
+			paths = append(paths, p)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no paths to prefetch")
+	}
+
+	byFilesystem := make(map[*clipfs.ClipFileSystem][]string)
+	for _, p := range paths {
+		cfs, rel, err := c.filesystem(p)
+		if err != nil {
+			return nil, err
+		}
+		byFilesystem[cfs] = append(byFilesystem[cfs], rel)
+	}
+
+	files := 0
+	for cfs, rels := range byFilesystem {
+		n, err := cfs.Prefetch(rels)
+		if err != nil {
+			return nil, err
+		}
+		files += n
+	}
+	return map[string]int{"files": files}, nil
+}
+
+func (c *controlServer) hydrate(r *http.Request) (interface{}, error) {
+	files := 0
+	for _, cfs := range c.filesystems {
+		n, err := cfs.Hydrate()
+		if err != nil {
+			return nil, err
+		}
+		files += n
+	}
+	return map[string]int{"files": files}, nil
+}
+
+// filesystem returns the filesystem serving a path relative to the mount point, and the path
+// relative to that filesystem
+func (c *controlServer) filesystem(p string) (*clipfs.ClipFileSystem, string, error) {
+	p = strings.TrimPrefix(path.Clean("/"+p), "/")
+	if cfs, ok := c.filesystems[""]; ok {
+		return cfs, p, nil
+	}
+
+	// The longest prefix wins, prefixes can be nested
+	prefixes := make([]string, 0, len(c.filesystems))
+	for prefix := range c.filesystems {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(prefixes)))
+	for _, prefix := range prefixes {
+		clean := strings.Trim(prefix, "/")
+		if p == clean || strings.HasPrefix(p, clean+"/") {
+			return c.filesystems[prefix], strings.TrimPrefix(strings.TrimPrefix(p, clean), "/"), nil
+		}
+	}
+	return nil, "", fmt.Errorf("no archive is mounted at %s", p)
+}
+
+// ControlClient sends commands to the control socket of a mount, see MountOptions.ControlSocket
+type ControlClient struct {
+	http *http.Client
+}
+
+func NewControlClient(socketPath string) *ControlClient {
+	return &ControlClient{
+		http: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					return (&net.Dialer{}).DialContext(ctx, "unix", socketPath)
+				},
+			},
+		},
+	}
+}
+
+func (c *ControlClient) Stats() (*ControlStats, error) {
+	var stats ControlStats
+	if err := c.do(http.MethodGet, "/stats", nil, &stats); err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+func (c *ControlClient) Flush() error {
+	return c.do(http.MethodPost, "/flush", nil, nil)
+}
+
+// SetLogLevel switches between debug, which logs every operation, and info
+func (c *ControlClient) SetLogLevel(level string) error {
+	return c.do(http.MethodPost, "/log-level?level="+url.QueryEscape(level), nil, nil)
+}
+
+// Prefetch starts caching files, paths are relative to the mount point. It returns the number of
+// files found.
+func (c *ControlClient) Prefetch(paths []string) (int, error) {
+	var result map[string]int
+	if err := c.do(http.MethodPost, "/prefetch", strings.NewReader(strings.Join(paths, "\n")), &result); err != nil {
+		return 0, err
+	}
+	return result["files"], nil
+}
+
+// Hydrate starts caching every file of the mount, it returns the number of files
+func (c *ControlClient) Hydrate() (int, error) {
+	var result map[string]int
+	if err := c.do(http.MethodPost, "/hydrate", nil, &result); err != nil {
+		return 0, err
+	}
+	return result["files"], nil
+}
+
+func (c *ControlClient) do(method string, path string, body io.Reader, out interface{}) error {
+	// The host is ignored, requests always go to the socket
+	req, err := http.NewRequest(method, "http://clip"+path, body)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("cannot reach mount: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var errResp struct{ Error string }
+		if err := json.NewDecoder(resp.Body).Decode(&errResp); err != nil || errResp.Error == "" {
+			return fmt.Errorf("control request failed: %s", resp.Status)
+		}
+		return fmt.Errorf("%s", errResp.Error)
+	}
+
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
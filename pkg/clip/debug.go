@@ -0,0 +1,118 @@
+//go:build !windows
+
+package clip
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"sync"
+
+	"github.com/NilayYadav/clip/pkg/clipfs"
+)
+
+// MountVars are the counters of a mount published under the clip expvar, by mount point
+type MountVars struct {
+	ReadsInFlight  int64               `json:"reads_in_flight"`
+	RemoteRequests int64               `json:"remote_requests"`
+	RemoteBytes    int64               `json:"remote_bytes"`
+	RemoteInFlight int64               `json:"remote_in_flight"`
+	CacheBytes     int64               `json:"cache_bytes"` // Held by the local tiers of the content cache
+	Tiers          map[string]TierVars `json:"tiers"`       // By tier of the read chain, like memory or storage
+}
+
+// TierVars are the counters of a tier of the read chain, summed over the archives of a mount
+type TierVars struct {
+	clipfs.TierStats
+	HitRatio float64 `json:"hit_ratio"` // Of the reads that tried the tier
+}
+
+var publishVars sync.Once
+
+// DebugServer serves the counters of every mount of the process at /debug/vars, in the format
+// expvar scrapers expect, and optionally profiles of the process at /debug/pprof/
+type DebugServer struct {
+	server *http.Server
+}
+
+// StartDebugServer listens on addr, which is a TCP address or unix:<path> for a socket. Only the
+// clip var is served, not the cmdline and memstats vars expvar adds, and profiles only with pprof,
+// as they expose the command line and can slow the process down.
+func StartDebugServer(addr string, pprofEnabled bool) (*DebugServer, error) {
+	listener, err := listenHealth(addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for debug requests on %s: %v", addr, err)
+	}
+
+	publishVars.Do(func() {
+		expvar.Publish("clip", expvar.Func(func() interface{} { return mountVars() }))
+	})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/vars", serveVars)
+	if pprofEnabled {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+	d := &DebugServer{server: &http.Server{Handler: mux}}
+
+	go d.server.Serve(listener)
+	return d, nil
+}
+
+func (d *DebugServer) Close() error {
+	return d.server.Close()
+}
+
+// serveVars writes the clip var in the format of expvar.Handler
+func serveVars(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintf(w, "{\n%q: %s\n}\n", "clip", expvar.Get("clip").String())
+}
+
+func mountVars() map[string]MountVars {
+	activeMounts.Lock()
+	defer activeMounts.Unlock()
+
+	vars := make(map[string]MountVars, len(activeMounts.mounts))
+	for m := range activeMounts.mounts {
+		vars[m.mountPoint] = m.vars()
+	}
+	return vars
+}
+
+func (m *activeMount) vars() MountVars {
+	v := MountVars{Tiers: make(map[string]TierVars)}
+	if m.reads != nil {
+		v.RemoteRequests = m.reads.Requests()
+		v.RemoteBytes = m.reads.BytesRead()
+		v.RemoteInFlight = m.reads.InFlight()
+	}
+	if sizer, ok := m.contentCache.(interface{ Size() int64 }); ok {
+		v.CacheBytes = sizer.Size()
+	}
+
+	for _, cfs := range m.filesystems {
+		v.ReadsInFlight += cfs.ReadsInFlight()
+		for name, stats := range cfs.ReadStats() {
+			tier := v.Tiers[name]
+			tier.Hits += stats.Hits
+			tier.Misses += stats.Misses
+			tier.Errors += stats.Errors
+			tier.Bytes += stats.Bytes
+			v.Tiers[name] = tier
+		}
+	}
+
+	for name, tier := range v.Tiers {
+		if reads := tier.Hits + tier.Misses + tier.Errors; reads > 0 {
+			tier.HitRatio = float64(tier.Hits) / float64(reads)
+		}
+		v.Tiers[name] = tier
+	}
+	return v
+}
@@ -0,0 +1,62 @@
+package clip
+
+import (
+	"path"
+	"time"
+
+	"github.com/NilayYadav/clip/pkg/common"
+)
+
+// Entry describes a file of the archive from its metadata alone
+type Entry struct {
+	Name        string    `json:"name"`
+	Type        string    `json:"type"` // dir, file, symlink or special
+	Mode        string    `json:"mode"`
+	Size        int64     `json:"size"`
+	ModTime     time.Time `json:"mtime"`
+	Target      string    `json:"target,omitempty"`       // Of symlinks
+	ContentType string    `json:"content_type,omitempty"` // MIME type, if the archive was created detecting them
+	SHA256      string    `json:"sha256,omitempty"`       // Of the content, unless it wasn't hashed
+	Encrypted   bool      `json:"encrypted,omitempty"`
+}
+
+func newEntry(name string, node *common.ClipNode) Entry {
+	return Entry{
+		Name:        name,
+		Type:        string(node.NodeType),
+		Mode:        fileMode(node.Attr.Mode).String(),
+		Size:        int64(node.Attr.Size),
+		ModTime:     time.Unix(int64(node.Attr.Mtime), int64(node.Attr.Mtimensec)),
+		Target:      node.Target,
+		ContentType: node.ContentType,
+		SHA256:      node.ContentHash,
+		Encrypted:   node.IsEncrypted(),
+	}
+}
+
+// Entry returns the entry of the file at name
+func (a *Archive) Entry(name string) (*Entry, error) {
+	node, err := a.node("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	entry := newEntry(name, node)
+	return &entry, nil
+}
+
+// List returns the entries of a directory, sorted by name, or the entry of name if it isn't one
+func (a *Archive) List(name string) ([]Entry, error) {
+	node, err := a.node("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if !node.IsDir() {
+		return []Entry{newEntry(name, node)}, nil
+	}
+
+	var entries []Entry
+	for _, child := range a.Metadata().ListDirectory(node.Path) {
+		entries = append(entries, newEntry(path.Join(name, path.Base(child.Path)), child))
+	}
+	return entries, nil
+}
@@ -0,0 +1,181 @@
+package clip
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+
+	"github.com/NilayYadav/clip/pkg/common"
+	"github.com/NilayYadav/clip/pkg/storage"
+	"github.com/NilayYadav/clip/pkg/vfs"
+)
+
+// node returns the node of a file of the archive, by its path under the mounted subpath
+func (a *Archive) node(op string, name string) (*common.ClipNode, error) {
+	node := a.Metadata().Get(path.Join("/", a.options.Subpath, name))
+	if node == nil {
+		return nil, pathError(op, name, vfs.ErrNotExist)
+	}
+	return node, nil
+}
+
+// file returns the node of a regular file of the archive
+func (a *Archive) file(op string, name string) (*common.ClipNode, error) {
+	node, err := a.node(op, name)
+	if err != nil {
+		return nil, err
+	}
+	if node.IsDir() {
+		return nil, pathError(op, name, vfs.ErrIsDir)
+	}
+	if node.NodeType != common.FileNode {
+		return nil, pathError(op, name, fmt.Errorf("not a regular file"))
+	}
+	return node, nil
+}
+
+// OpenReaderAt opens a file of the archive for random access, e.g. to read a zip or parquet file
+// inside it, and returns its size. Reads go straight to the archive's storage, past the content
+// caches, and are safe to make concurrently. Symlinks aren't followed.
+func (a *Archive) OpenReaderAt(name string) (io.ReaderAt, int64, error) {
+	node, err := a.file("open", name)
+	if err != nil {
+		return nil, 0, err
+	}
+	return &fileReaderAt{s: a.view.s, node: node, name: name, key: a.options.EncryptionKey}, node.DataLen, nil
+}
+
+type fileReaderAt struct {
+	s    storage.ClipStorageInterface
+	node *common.ClipNode
+	name string
+	key  []byte
+}
+
+func (r *fileReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, pathError("read", r.name, fs.ErrInvalid)
+	}
+	if off >= r.node.DataLen {
+		return 0, io.EOF
+	}
+	if r.node.IsEncrypted() && r.key == nil {
+		return 0, pathError("read", r.name, common.ErrMissingKey)
+	}
+
+	// Don't read past the end of the file
+	dest := p
+	if left := r.node.DataLen - off; int64(len(dest)) > left {
+		dest = dest[:left]
+	}
+
+	nRead := 0
+	for nRead < len(dest) {
+		n, err := r.s.ReadFile(r.node, dest[nRead:], off+int64(nRead))
+		if err != nil {
+			return nRead, pathError("read", r.name, err)
+		}
+		if n == 0 {
+			return nRead, pathError("read", r.name, io.ErrUnexpectedEOF)
+		}
+		nRead += n
+	}
+
+	if r.node.IsEncrypted() {
+		stream, err := common.NewContentCipher(r.key, r.node.IV, off)
+		if err != nil {
+			return 0, err
+		}
+		stream.XORKeyStream(dest, dest)
+	}
+
+	if nRead < len(p) {
+		return nRead, io.EOF
+	}
+	return nRead, nil
+}
+
+const (
+	streamChunkSize = 1 << 20
+	streamReadahead = 4 // Chunks read ahead of the reader, which bounds the memory a stream holds
+)
+
+// OpenFileStream opens a file of the archive for reading from start to end, e.g. to serve it over
+// HTTP. The chunks after the one being read are fetched from storage in parallel, a few at a time.
+// Streams are not safe for concurrent use.
+func (a *Archive) OpenFileStream(name string) (io.ReadCloser, error) {
+	r, size, err := a.OpenReaderAt(name)
+	if err != nil {
+		return nil, err
+	}
+	s := &fileStream{r: r, size: size}
+	s.fill()
+	return s, nil
+}
+
+type streamChunk struct {
+	data []byte
+	err  error
+}
+
+type fileStream struct {
+	r       io.ReaderAt
+	size    int64
+	next    int64 // Offset of the next chunk to fetch
+	pending []chan streamChunk
+	buf     []byte
+	err     error
+}
+
+// fill starts fetching chunks until streamReadahead of them are pending
+func (s *fileStream) fill() {
+	for len(s.pending) < streamReadahead && s.next < s.size {
+		off, n := s.next, int64(streamChunkSize)
+		if left := s.size - off; left < n {
+			n = left
+		}
+		s.next += n
+
+		c := make(chan streamChunk, 1)
+		go func() {
+			data := make([]byte, n)
+			_, err := s.r.ReadAt(data, off)
+			if err == io.EOF {
+				err = nil
+			}
+			c <- streamChunk{data: data, err: err}
+		}()
+		s.pending = append(s.pending, c)
+	}
+}
+
+func (s *fileStream) Read(p []byte) (int, error) {
+	for len(s.buf) == 0 {
+		if s.err != nil {
+			return 0, s.err
+		}
+		if len(s.pending) == 0 {
+			return 0, io.EOF
+		}
+
+		chunk := <-s.pending[0]
+		s.pending = s.pending[1:]
+		if chunk.err != nil {
+			s.err = chunk.err
+			return 0, s.err
+		}
+		s.buf = chunk.data
+		s.fill()
+	}
+
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+	return n, nil
+}
+
+// Close drops the chunks read ahead, reads in flight finish in the background
+func (s *fileStream) Close() error {
+	s.pending, s.buf, s.err = nil, nil, fs.ErrClosed
+	return nil
+}
@@ -0,0 +1,39 @@
+package clip
+
+import (
+	"fmt"
+)
+
+// FuseOptions tune how the kernel talks to a mount, zero values keep the defaults. How far the kernel
+// reads ahead is MountOptions.ReadAhead.
+//
+// Larger values trade memory for throughput. The defaults suit archives in local files or caches.
+// For large files read sequentially from remote storage, MaxWrite of 1Mb lets every request fetch
+// more at once and MaxBackground of 1024 keeps more read ahead in flight, at the cost of up to
+// MaxWrite bytes of buffers per request in flight. Mounts of many small files gain little from
+// either, and on hosts short of memory MaxWrite of 128Kb and MaxBackground of 64 bound what a
+// busy mount can hold.
+type FuseOptions struct {
+	MaxWrite            int // Largest read the kernel sends, up to 1Mb on Linux 4.20 and later, defaults to 128Kb
+	MaxBackground       int // Reads, like read ahead, the kernel keeps in flight at once, defaults to 512
+	CongestionThreshold int // Reads in flight at which the kernel starts holding read ahead back, defaults to 3/4 of MaxBackground
+}
+
+const defaultMaxBackground = 512
+
+func (o FuseOptions) maxBackground() int {
+	if o.MaxBackground <= 0 {
+		return defaultMaxBackground
+	}
+	return o.MaxBackground
+}
+
+func (o FuseOptions) check() error {
+	if o.MaxWrite < 0 || o.MaxBackground < 0 || o.CongestionThreshold < 0 {
+		return fmt.Errorf("fuse options can't be negative")
+	}
+	if o.CongestionThreshold > o.maxBackground() {
+		return fmt.Errorf("the fuse congestion threshold can't be above max background (%d)", o.maxBackground())
+	}
+	return nil
+}
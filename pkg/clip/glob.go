@@ -0,0 +1,67 @@
+package clip
+
+import (
+	"path"
+	"strings"
+
+	"github.com/NilayYadav/clip/pkg/common"
+)
+
+// Glob returns the names of the files matching pattern, in the syntax of path.Match, like fs.Glob.
+// Only the part of the index after the literal start of pattern is scanned, so patterns like
+// usr/lib/*.so are fast in any archive.
+func (a *Archive) Glob(pattern string) ([]string, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+
+	prefix := pattern
+	if i := strings.IndexAny(pattern, `*?[\`); i >= 0 {
+		prefix = pattern[:i]
+	}
+
+	var names []string
+	a.scan(prefix, func(name string, node *common.ClipNode) bool {
+		if matched, _ := path.Match(pattern, name); matched {
+			names = append(names, name)
+		}
+		return true
+	})
+	return names, nil
+}
+
+// Find returns the names of the files starting with prefix and ending with suffix, in lexical order,
+// e.g. everything under usr/lib/ or every file ending with .so for an empty prefix. Names are matched
+// as plain strings.
+func (a *Archive) Find(prefix string, suffix string) []string {
+	var names []string
+	a.scan(prefix, func(name string, node *common.ClipNode) bool {
+		if strings.HasSuffix(name, suffix) {
+			names = append(names, name)
+		}
+		return true
+	})
+	return names
+}
+
+// scan calls fn with the nodes whose names under the mounted subpath start with prefix, in index
+// order, until it returns false
+func (a *Archive) scan(prefix string, fn func(name string, node *common.ClipNode) bool) {
+	root := path.Join("/", a.options.Subpath)
+	base := root
+	if base != "/" {
+		base += "/"
+	}
+
+	index := a.Metadata().Index
+	index.Ascend(&common.ClipNode{Path: base + prefix}, func(item interface{}) bool {
+		node := item.(*common.ClipNode)
+		if !strings.HasPrefix(node.Path, base+prefix) {
+			return false // Paths with a common prefix are all in a row
+		}
+		if node.Path == root {
+			return true // The root itself has no name
+		}
+		return fn(strings.TrimPrefix(node.Path, base), node)
+	})
+}
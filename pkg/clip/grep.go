@@ -0,0 +1,171 @@
+package clip
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/NilayYadav/clip/pkg/common"
+)
+
+const grepMaxLine = 16 << 20 // Files with longer lines aren't text either
+
+type GrepOptions struct {
+	Pattern    string   // Regular expression, in the syntax of the regexp package
+	IgnoreCase bool     // Match letters regardless of case
+	Include    string   // Only search files matching this glob, a glob with no slash matches base names like grep --include
+	Paths      []string // Only search under these paths of the archive, all of it by default
+	Parallel   int      // Files searched at once, defaults to 8
+	FilesOnly  bool     // Stop at the first match in each file, when only the files matching are wanted
+}
+
+// GrepMatch is a line matching a search
+type GrepMatch struct {
+	Name string // Of the file, relative to the root of the archive
+	Line int    // Line number, starting at 1
+	Text string // The line, without its newline
+}
+
+type grepResult struct {
+	matches []GrepMatch
+	err     error
+}
+
+// Grep searches the content of the regular files of the archive for lines matching a regular
+// expression, calling fn with each match in the order of the files and then lines. Several files are
+// searched at once, each streamed with parallel ranged reads, see OpenFileStream, so archives in remote
+// storage are searched without downloading them whole. Binary files, and encrypted files without a
+// key, are skipped. Archives created with a search index only have the files that may match read.
+func (a *Archive) Grep(ctx context.Context, options GrepOptions, fn func(GrepMatch) error) error {
+	pattern := options.Pattern
+	if options.IgnoreCase {
+		pattern = "(?i)" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return fmt.Errorf("invalid pattern: %v", err)
+	}
+	if _, err := path.Match(options.Include, ""); err != nil {
+		return fmt.Errorf("invalid include glob %q: %v", options.Include, err)
+	}
+	if options.Parallel <= 0 {
+		options.Parallel = 8
+	}
+
+	names, err := a.grepFiles(options)
+	if err != nil {
+		return err
+	}
+	names = a.searchCandidates(names, pattern)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Files are searched in parallel and their results taken in order, at most Parallel are pending
+	results := make(chan chan grepResult, options.Parallel)
+	go func() {
+		defer close(results)
+		for _, name := range names {
+			name, c := name, make(chan grepResult, 1)
+			select {
+			case results <- c:
+			case <-ctx.Done():
+				return
+			}
+			go func() {
+				matches, err := a.grepFile(ctx, name, re, options.FilesOnly)
+				c <- grepResult{matches: matches, err: err}
+			}()
+		}
+	}()
+
+	for c := range results {
+		result := <-c
+		if result.err != nil {
+			return result.err
+		}
+		for _, match := range result.matches {
+			if err := fn(match); err != nil {
+				return err
+			}
+		}
+	}
+	return ctx.Err()
+}
+
+// grepFiles lists the names of the files a search goes through, from the metadata
+func (a *Archive) grepFiles(options GrepOptions) ([]string, error) {
+	roots := options.Paths
+	if len(roots) == 0 {
+		roots = []string{"."}
+	}
+
+	var names []string
+	for _, root := range roots {
+		err := a.WalkDir(root, func(name string, d fs.DirEntry, err error) error {
+			if err != nil || !d.Type().IsRegular() {
+				return err
+			}
+			if node := d.(*nodeEntry).node; node.IsEncrypted() && a.options.EncryptionKey == nil {
+				return nil
+			}
+			if options.Include != "" {
+				subject := name
+				if !strings.Contains(options.Include, "/") {
+					subject = path.Base(name)
+				}
+				if matched, _ := path.Match(options.Include, subject); !matched {
+					return nil
+				}
+			}
+			names = append(names, name)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return names, nil
+}
+
+// grepFile returns the matching lines of a file, or just the first one, or none if it's binary
+func (a *Archive) grepFile(ctx context.Context, name string, re *regexp.Regexp, first bool) ([]GrepMatch, error) {
+	stream, err := a.OpenFileStream(name)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+
+	br := bufio.NewReaderSize(stream, 64*1024)
+	if start, _ := br.Peek(common.SearchBinaryPeek); bytes.IndexByte(start, 0) >= 0 {
+		return nil, nil
+	}
+
+	var matches []GrepMatch
+	scanner := bufio.NewScanner(br)
+	scanner.Buffer(make([]byte, 64*1024), grepMaxLine)
+	for line := 1; scanner.Scan(); line++ {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if re.Match(scanner.Bytes()) {
+			matches = append(matches, GrepMatch{Name: name, Line: line, Text: scanner.Text()})
+			if first {
+				return matches, nil
+			}
+		}
+	}
+	if errors.Is(scanner.Err(), bufio.ErrTooLong) {
+		return nil, nil
+	}
+	if scanner.Err() != nil {
+		return nil, fmt.Errorf("error reading %s: %v", name, scanner.Err())
+	}
+	return matches, nil
+}
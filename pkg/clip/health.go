@@ -0,0 +1,128 @@
+package clip
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/NilayYadav/clip/pkg/storage"
+)
+
+const healthCheckTimeout = time.Second * 5
+
+// healthServer answers probes for a mount. /healthz checks the fuse server still answers requests,
+// /readyz also checks the archive's storage can be reached.
+type healthServer struct {
+	mountPoint string
+	storages   []storage.ClipStorageInterface
+	fuseCheck  chan struct{} // Holds a token while a fuse check runs, checks of a wedged mount never return
+	server     *http.Server
+}
+
+// listenHealth listens on addr, which is a TCP address or unix:<path> for a socket
+func listenHealth(addr string) (net.Listener, error) {
+	if socketPath, ok := strings.CutPrefix(addr, "unix:"); ok {
+		os.Remove(socketPath)
+		return net.Listen("unix", socketPath)
+	}
+	return net.Listen("tcp", addr)
+}
+
+func startHealthServer(addr string, mountPoint string, storages []storage.ClipStorageInterface) (*healthServer, error) {
+	listener, err := listenHealth(addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for health checks on %s: %v", addr, err)
+	}
+
+	h := &healthServer{
+		mountPoint: mountPoint,
+		storages:   storages,
+		fuseCheck:  make(chan struct{}, 1),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		h.respond(w, map[string]error{"fuse": h.checkFuse()})
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		h.respond(w, map[string]error{"fuse": h.checkFuse(), "storage": h.checkStorage(r.Context())})
+	})
+	h.server = &http.Server{Handler: mux}
+
+	go h.server.Serve(listener)
+	return h, nil
+}
+
+func (h *healthServer) Close() error {
+	return h.server.Close()
+}
+
+// checkFuse lists the root of the mount, which the kernel always asks the fuse server for
+func (h *healthServer) checkFuse() error {
+	select {
+	case h.fuseCheck <- struct{}{}:
+	default:
+		return fmt.Errorf("previous check has not returned")
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		defer func() { <-h.fuseCheck }()
+
+		f, err := os.Open(h.mountPoint)
+		if err == nil {
+			// Empty directories return io.EOF
+			if _, err = f.Readdirnames(1); errors.Is(err, io.EOF) {
+				err = nil
+			}
+			f.Close()
+		}
+		result <- err
+	}()
+
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(healthCheckTimeout):
+		return fmt.Errorf("no answer after %v", healthCheckTimeout)
+	}
+}
+
+func (h *healthServer) checkStorage(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+
+	for _, s := range h.storages {
+		if err := storage.CheckHealth(ctx, s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// respond reports every check, and fails with 503 if any of them failed
+func (h *healthServer) respond(w http.ResponseWriter, checks map[string]error) {
+	status := http.StatusOK
+	results := make(map[string]string, len(checks))
+	for name, err := range checks {
+		if err != nil {
+			log.Printf("Health check %s failed: %v\n", name, err)
+			results[name] = err.Error()
+			status = http.StatusServiceUnavailable
+			continue
+		}
+		results[name] = "ok"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(results)
+}
@@ -0,0 +1,53 @@
+package clip
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+
+	"github.com/NilayYadav/clip/pkg/archive"
+	"github.com/NilayYadav/clip/pkg/common"
+	"github.com/NilayYadav/clip/pkg/storage"
+)
+
+type LinkOptions struct {
+	Location    string                 // Of the remote archive, see storage.ParseLocation
+	StorageInfo common.ClipStorageInfo // Instead of Location
+	OutputFile  string                 // RCLIP path, defaults to the archive name with an .rclip extension
+	Credentials storage.ClipStorageCredentials
+}
+
+// Link creates an RCLIP pointing at an archive already in remote storage, as StoreS3 and the like
+// do for the archives they upload. Only the header and metadata of the archive are read.
+func Link(ctx context.Context, options LinkOptions) error {
+	info := options.StorageInfo
+	if info == nil {
+		var err error
+		if info, _, err = storage.ParseLocation(options.Location); err != nil {
+			return err
+		}
+		if info == nil {
+			return fmt.Errorf("an RCLIP can only point at remote storage, %s is local", options.Location)
+		}
+	}
+
+	name := archiveName(options.Location, info)
+	if options.OutputFile == "" {
+		options.OutputFile = strings.TrimSuffix(name, filepath.Ext(name)) + ".rclip"
+	}
+
+	a := archive.NewClipArchiver()
+	metadata, _, err := loadMetadata(ctx, a, options.Location, info, options.Credentials)
+	if err != nil {
+		return fmt.Errorf("unable to read the archive metadata: %v", err)
+	}
+
+	if err := a.CreateRemoteArchive(info, metadata, options.OutputFile); err != nil {
+		return err
+	}
+
+	log.Printf("Linked %s to %s\n", options.OutputFile, name)
+	return nil
+}
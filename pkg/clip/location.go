@@ -0,0 +1,209 @@
+package clip
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/NilayYadav/clip/pkg/archive"
+	"github.com/NilayYadav/clip/pkg/common"
+	"github.com/NilayYadav/clip/pkg/storage"
+)
+
+// Size of the ranges a remote archive is copied in
+const stageReadSize = 8 * 1024 * 1024
+
+// locationName returns the file name of the archive at location, see storage.ParseLocation
+func locationName(location string) string {
+	if u, err := url.Parse(location); err == nil && len(u.Scheme) > 1 {
+		return path.Base(u.Path)
+	}
+	return filepath.Base(location)
+}
+
+// archiveName returns the file name of an archive given by its location or, if it's set, the storage
+// info it's stored at
+func archiveName(location string, info common.ClipStorageInfo) string {
+	switch si := info.(type) {
+	case nil:
+		return locationName(location)
+	case *common.S3StorageInfo:
+		return path.Base(si.Key)
+	case *common.SFTPStorageInfo:
+		return path.Base(si.Path)
+	case *common.HTTPStorageInfo:
+		return locationName(si.URL)
+	}
+	return info.Type()
+}
+
+// loadMetadata reads the metadata of the archive stored at info or, if it's nil, at location, see
+// storage.ParseLocation. It returns the local path of the archive too, empty for archives in remote
+// storage. Those are read without downloading their data, as if through an RCLIP pointing at them.
+func loadMetadata(ctx context.Context, ca *archive.ClipArchiver, location string, info common.ClipStorageInfo, credentials storage.ClipStorageCredentials) (*common.ClipArchiveMetadata, string, error) {
+	if info == nil {
+		var localPath string
+		var err error
+		if info, localPath, err = storage.ParseLocation(location); err != nil {
+			return nil, "", err
+		}
+		if info == nil {
+			metadata, err := ca.ExtractMetadata(localPath)
+			return metadata, localPath, err
+		}
+	}
+
+	backend, err := storage.GetBackend(info.Type())
+	if err != nil {
+		return nil, "", err
+	}
+	remote, err := backend.Open(ctx, info, storage.ClipStorageOpts{Credentials: credentials})
+	if err != nil {
+		return nil, "", err
+	}
+	defer remote.Close()
+
+	metadata, err := ca.ExtractRemoteMetadata(ctx, remote, info)
+	return metadata, "", err
+}
+
+// localArchive returns a local path holding the archive at location. Archives in remote storage,
+// or pointed at by a local RCLIP, are copied to stagingDir, the temp dir by default. cleanup removes
+// the copy; without it a later call for the same location resumes the copy.
+func localArchive(ctx context.Context, location string, stagingDir string, credentials storage.ClipStorageCredentials) (string, func(), error) {
+	info, localPath, err := resolveArchive(location)
+	if err != nil {
+		return "", nil, err
+	}
+	if info == nil {
+		return localPath, func() {}, nil
+	}
+
+	stagedPath, err := stageArchive(ctx, info, location, stagingDir, credentials)
+	if err != nil {
+		return "", nil, err
+	}
+	return stagedPath, func() { os.Remove(stagedPath) }, nil
+}
+
+// resolveArchive resolves the location of an archive, see storage.ParseLocation. Local RCLIPs resolve
+// to the storage info they hold.
+func resolveArchive(location string) (common.ClipStorageInfo, string, error) {
+	info, localPath, err := storage.ParseLocation(location)
+	if err != nil || info != nil {
+		return info, localPath, err
+	}
+
+	metadata, err := archive.NewClipArchiver().ExtractMetadata(localPath)
+	if err != nil {
+		return nil, "", err
+	}
+	return metadata.StorageInfo, localPath, nil
+}
+
+// stageArchive copies the remote archive at info, found at location, to stagingDir and returns the
+// path of the copy. A partial copy left by an earlier run is continued, unless the source has changed
+// since.
+func stageArchive(ctx context.Context, info common.ClipStorageInfo, location string, stagingDir string, credentials storage.ClipStorageCredentials) (string, error) {
+	backend, err := storage.GetBackend(info.Type())
+	if err != nil {
+		return "", err
+	}
+	remote, err := backend.Open(ctx, info, storage.ClipStorageOpts{Credentials: credentials})
+	if err != nil {
+		return "", err
+	}
+	defer remote.Close()
+
+	header := make([]byte, common.ClipHeaderLength)
+	if n, err := remote.ReadRange(ctx, header, 0); n < len(header) {
+		return "", fmt.Errorf("failed to read archive header: %v", err)
+	}
+	size, err := archiveSize(header)
+	if err != nil {
+		return "", err
+	}
+
+	dir := stagingDir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	name := sha256.Sum256([]byte(location))
+	stagedPath := filepath.Join(dir, fmt.Sprintf("clip-staged-%s.clip", hex.EncodeToString(name[:8])))
+
+	f, err := os.OpenFile(stagedPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	// The header describes where the index is, so a changed source almost always has another one
+	off := fi.Size()
+	stagedHeader := make([]byte, common.ClipHeaderLength)
+	if off < int64(len(header)) || off > size {
+		off = 0
+	} else if _, err := f.ReadAt(stagedHeader, 0); err != nil || !bytes.Equal(stagedHeader, header) {
+		log.Printf("%s changed since it was last copied, copying it again\n", location)
+		off = 0
+	}
+	if off > 0 {
+		log.Printf("Resuming copy at %d of %d bytes\n", off, size)
+	}
+	if err := f.Truncate(off); err != nil {
+		return "", err
+	}
+
+	buf := make([]byte, stageReadSize)
+	for off < size {
+		chunk := buf
+		if left := size - off; left < int64(len(chunk)) {
+			chunk = chunk[:left]
+		}
+
+		n, err := remote.ReadRange(ctx, chunk, off)
+		if err != nil && err != io.EOF {
+			return "", fmt.Errorf("failed to copy archive at %d: %v", off, err)
+		}
+		if n < len(chunk) {
+			return "", fmt.Errorf("archive is shorter than its header says, %d bytes", size)
+		}
+
+		if _, err := f.WriteAt(chunk, off); err != nil {
+			return "", err
+		}
+		off += int64(n)
+	}
+
+	if err := f.Sync(); err != nil {
+		return "", err
+	}
+	return stagedPath, nil
+}
+
+// archiveSize returns the size of an archive from its header: it ends with its index
+func archiveSize(headerBytes []byte) (int64, error) {
+	header, err := archive.NewClipArchiver().DecodeHeader(headerBytes)
+	if err != nil {
+		return 0, common.ErrFileHeaderMismatch
+	}
+	if err := archive.CheckHeader(header); err != nil {
+		return 0, err
+	}
+	if header.StorageInfoLength > 0 {
+		return 0, fmt.Errorf("remote archive is an RCLIP, use the archive it points at")
+	}
+	return header.IndexPos + header.IndexLength, nil
+}
@@ -0,0 +1,479 @@
+//go:build !windows
+
+package clip
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NilayYadav/clip/pkg/clipfs"
+	"github.com/NilayYadav/clip/pkg/storage"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"golang.org/x/sys/unix"
+)
+
+// Mount is an archive mounted by NewMount. It's served from Start until Close, until the context given
+// to Start is done, or until it's unmounted from outside.
+type Mount struct {
+	options     MountOptions
+	server      *fuse.Server
+	active      *activeMount
+	storages    []storage.ClipStorageInterface
+	filesystems map[string]*clipfs.ClipFileSystem
+	trace       *clipfs.TraceRecorder
+
+	mu       sync.Mutex
+	started  bool
+	scratch  bool          // Scratch directories are mounted over the archive
+	ready    chan struct{} // Closed once mounted
+	finished chan struct{} // Closed once the mount is gone, after err is set
+	err      error
+}
+
+// MountPoint returns the directory the archive is mounted to
+func (m *Mount) MountPoint() string {
+	return m.options.MountPoint
+}
+
+// Start serves the archive, and returns once it is mounted. The mount is unmounted once ctx is done,
+// waiting for it to be mounted included.
+func (m *Mount) Start(ctx context.Context) error {
+	m.mu.Lock()
+	if m.started {
+		m.mu.Unlock()
+		return fmt.Errorf("%s is already started", m.options.MountPoint)
+	}
+	select {
+	case <-m.finished:
+		m.mu.Unlock()
+		return fmt.Errorf("%s is closed", m.options.MountPoint)
+	default:
+	}
+	m.started = true
+	m.mu.Unlock()
+
+	go m.serve(ctx)
+
+	select {
+	case <-m.ready:
+		return nil
+	case <-m.finished:
+		if m.err != nil {
+			return m.err
+		}
+		return fmt.Errorf("%s was unmounted while mounting", m.options.MountPoint)
+	}
+}
+
+// Ready is closed once the archive is mounted
+func (m *Mount) Ready() <-chan struct{} {
+	return m.ready
+}
+
+// Done receives nil once the mount is gone, or the error it failed with, and is then closed
+func (m *Mount) Done() <-chan error {
+	done := make(chan error, 1)
+	go func() {
+		<-m.finished
+		done <- m.err
+		close(done)
+	}()
+	return done
+}
+
+// Stats returns the counters of the mount, as published under the clip expvar
+func (m *Mount) Stats() MountVars {
+	return m.active.vars()
+}
+
+// Close unmounts the archive and waits for the mount to be gone. It fails with the mount left as it
+// is if the archive can't be unmounted, like while its files are in use with some kernels.
+func (m *Mount) Close() error {
+	m.mu.Lock()
+	if !m.started {
+		// Never served, only what NewMount opened is left to clean up
+		m.started = true
+		m.mu.Unlock()
+		m.cleanup()
+		close(m.finished)
+		return nil
+	}
+	m.mu.Unlock()
+
+	select {
+	case <-m.finished:
+		return nil
+	default:
+	}
+	if err := m.unmount(); err != nil {
+		return fmt.Errorf("failed to unmount %s: %v", m.options.MountPoint, err)
+	}
+	<-m.finished
+	return nil
+}
+
+// unmount unmounts the archive, after the scratch directories over it, which keep it busy
+func (m *Mount) unmount() error {
+	m.mu.Lock()
+	if m.scratch {
+		unmountScratch(m.options.MountPoint, m.options.Scratch)
+		m.scratch = false
+	}
+	m.mu.Unlock()
+	return m.server.Unmount()
+}
+
+// serve runs the fuse server and what comes with the mount until the archive is unmounted
+func (m *Mount) serve(ctx context.Context) {
+	options, server := m.options, m.server
+	defer close(m.finished)
+	defer m.cleanup()
+
+	go server.Serve()
+
+	// Unmounting before the mount is done leaves it mounted
+	mounted := make(chan error, 1)
+	go func() {
+		mounted <- server.WaitMount()
+	}()
+	select {
+	case m.err = <-mounted:
+	case <-ctx.Done():
+		if m.err = <-mounted; m.err == nil {
+			m.err = ctx.Err()
+			server.Unmount()
+		}
+	}
+	if m.err != nil {
+		return
+	}
+
+	if err := mountScratch(options.MountPoint, options.Scratch, options.ScratchSize); err != nil {
+		server.Unmount()
+		m.err = err
+		return
+	}
+	m.mu.Lock()
+	m.scratch = len(options.Scratch) > 0
+	m.mu.Unlock()
+
+	addActiveMount(m.active)
+
+	if options.Fuse.CongestionThreshold > 0 {
+		if err := setCongestionThreshold(options.MountPoint, options.Fuse.CongestionThreshold); err != nil {
+			log.Printf("Keeping the default congestion threshold: %v\n", err)
+		}
+	}
+
+	var health *healthServer
+	if options.HealthAddr != "" {
+		var err error
+		health, err = startHealthServer(options.HealthAddr, options.MountPoint, m.storages)
+		if err != nil {
+			log.Printf("Not answering health checks: %v\n", err)
+		}
+	}
+
+	var control *controlServer
+	if options.ControlSocket != "" {
+		var err error
+		control, err = startControlServer(options.ControlSocket, m.filesystems, options.ContentCache, options.ReadLimits.Shared)
+		if err != nil {
+			log.Printf("Not taking control commands: %v\n", err)
+		}
+	}
+
+	var debug *DebugServer
+	if options.DebugAddr != "" {
+		var err error
+		debug, err = StartDebugServer(options.DebugAddr, options.Pprof)
+		if err != nil {
+			log.Printf("Not serving debug requests: %v\n", err)
+		}
+	}
+
+	close(m.ready)
+
+	unmounted := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			m.unmount()
+		case <-unmounted:
+		}
+	}()
+
+	server.Wait()
+	close(unmounted)
+	removeActiveMount(m.active)
+	closeBindings(m.active)
+
+	if health != nil {
+		health.Close()
+	}
+
+	if control != nil {
+		control.Close()
+		os.Remove(options.ControlSocket)
+	}
+
+	if debug != nil {
+		debug.Close()
+	}
+}
+
+// cleanup releases the storages and trace of the mount
+func (m *Mount) cleanup() {
+	for _, s := range m.storages {
+		s.Cleanup()
+	}
+
+	if m.trace != nil {
+		m.trace.Close()
+	}
+}
+
+// NewMount prepares an archive to be mounted with Start
+func NewMount(options MountOptions) (*Mount, error) {
+	return newMount(options, nil)
+}
+
+// newMount is NewMount with the local cache tiers of the mount built already, unless contentCache is nil
+// Mount prepares the archive to be mounted at mountPoint with the options it was opened with, see
+// NewMount. The mount reads the archive on its own, it keeps working after Close.
+func (a *Archive) Mount(mountPoint string) (*Mount, error) {
+	options := a.options
+	options.MountPoint = mountPoint
+	return NewMount(options)
+}
+
+func newMount(options MountOptions, contentCache clipfs.ContentCache) (*Mount, error) {
+	if len(options.Archives) > 0 {
+		log.Printf("Mounting %d archives to %s\n", len(options.Archives), options.MountPoint)
+	} else {
+		log.Printf("Mounting archive %s to %s\n", archiveName(options.ArchivePath, options.StorageInfo), options.MountPoint)
+	}
+
+	if _, err := os.Stat(options.MountPoint); os.IsNotExist(err) {
+		err = os.MkdirAll(options.MountPoint, 0755)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create mount point directory: %v", err)
+		}
+		log.Println("Mount point directory created.")
+	}
+
+	if err := options.Fuse.check(); err != nil {
+		return nil, err
+	}
+
+	if options.Passthrough && options.DiskCacheDir == "" {
+		return nil, fmt.Errorf("passthrough needs a disk cache directory to keep local copies in")
+	}
+
+	var err error
+	if contentCache == nil {
+		contentCache, err = NewContentCache(options)
+		if err != nil {
+			return nil, err
+		}
+	}
+	active := &activeMount{mountPoint: options.MountPoint, contentCache: contentCache}
+	if contentCache != nil {
+		options.ContentCache = contentCache
+		options.ContentCacheAvailable = true
+	}
+
+	// The control socket and debug listener report what was read remotely
+	if (options.ControlSocket != "" || options.DebugAddr != "") && options.ReadLimits.Shared == nil {
+		options.ReadLimits.Shared = storage.NewSharedReadLimiter(0)
+	}
+	active.reads = options.ReadLimits.Shared
+	if options.ReadLimits.Mount == "" {
+		options.ReadLimits.Mount = options.MountPoint
+	}
+
+	var trace *clipfs.TraceRecorder
+	if len(options.Scratch) > 0 && len(options.Archives) > 0 {
+		return nil, fmt.Errorf("scratch directories are only supported when mounting a single archive")
+	}
+
+	if options.TracePath != "" {
+		if len(options.Archives) > 0 {
+			return nil, fmt.Errorf("tracing is only supported when mounting a single archive")
+		}
+
+		trace, err = clipfs.NewTraceRecorder(options.TracePath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var root fs.InodeEmbedder
+	var rootIno uint64 = 1
+	var storages []storage.ClipStorageInterface
+	filesystems := make(map[string]*clipfs.ClipFileSystem)
+
+	if len(options.Archives) > 0 {
+		prefixes, err := mountPrefixes(options.Archives)
+		if err != nil {
+			return nil, err
+		}
+
+		for i, am := range options.Archives {
+			prefix := prefixes[i]
+
+			// Give each archive its own inode range so inode numbers don't collide across archives.
+			// Ranges follow the order archives are given in, which keeps inodes stable across remounts.
+			cfs, s, err := loadFileSystem(context.TODO(), am.ArchivePath, am.StorageInfo, am.CachePath, am.Subpath, uint64(i+1)<<40, nil, options)
+			if err != nil {
+				for _, s := range storages {
+					s.Cleanup()
+				}
+				return nil, err
+			}
+
+			filesystems[prefix] = cfs
+			storages = append(storages, s)
+		}
+
+		root = clipfs.NewMultiArchiveRoot(filesystems)
+	} else {
+		cfs, s, err := loadFileSystem(context.TODO(), options.ArchivePath, options.StorageInfo, options.CachePath, options.Subpath, 0, trace, options)
+		if err != nil {
+			if trace != nil {
+				trace.Close()
+			}
+			return nil, err
+		}
+
+		root, _ = cfs.Root()
+		rootIno = cfs.RootIno()
+		filesystems[""] = cfs
+		storages = append(storages, s)
+	}
+
+	active.filesystems, active.storages = filesystems, storages
+
+	readAhead := options.ReadAhead
+	if readAhead <= 0 {
+		readAhead = 1 << 17
+	}
+
+	attrTimeout := time.Second * 60
+	entryTimeout := time.Second * 60
+	fsOptions := &fs.Options{
+		AttrTimeout:    &attrTimeout,
+		EntryTimeout:   &entryTimeout,
+		RootStableAttr: &fs.StableAttr{Ino: rootIno},
+	}
+	server, err := fuse.NewServer(fs.NewNodeFS(root, fsOptions), options.MountPoint, &fuse.MountOptions{
+		MaxBackground:        options.Fuse.maxBackground(),
+		MaxWrite:             options.Fuse.MaxWrite,
+		AllowOther:           options.AllowOther,
+		Name:                 "clip",
+		FsName:               fsName(options),
+		Options:              mountFlags(options),
+		IgnoreSecurityLabels: !storesXattrs(filesystems), // Unless an archive keeps capabilities, they're answered without asking clipfs
+		EnableSymlinkCaching: true,
+		SyncRead:             false,
+		RememberInodes:       true,
+		MaxReadAhead:         int(readAhead),
+	})
+	if err != nil {
+		for _, s := range storages {
+			s.Cleanup()
+		}
+		if trace != nil {
+			trace.Close()
+		}
+		return nil, fmt.Errorf("could not create server: %v", err)
+	}
+
+	return &Mount{
+		options:     options,
+		server:      server,
+		active:      active,
+		storages:    storages,
+		filesystems: filesystems,
+		trace:       trace,
+		ready:       make(chan struct{}),
+		finished:    make(chan struct{}),
+	}, nil
+}
+
+// fsName is the source of the mount in /proc/mounts, which systemd matches fstab entries to mounts by
+// mountPrefixes returns the cleaned directories archives are mounted under. Prefixes can't be empty,
+// hold . or .. components, or be or nest under the prefix of another archive, which would hide it.
+func mountPrefixes(archives []ArchiveMount) ([]string, error) {
+	prefixes := make([]string, len(archives))
+	for i, am := range archives {
+		prefix := am.MountPrefix()
+		for _, name := range strings.Split(prefix, "/") {
+			if name == "." || name == ".." {
+				return nil, fmt.Errorf("invalid mount prefix: %q", prefix)
+			}
+		}
+		cleaned := strings.Trim(path.Clean("/"+prefix), "/")
+		if cleaned == "" {
+			return nil, fmt.Errorf("invalid mount prefix: %q", prefix)
+		}
+
+		for j, other := range prefixes[:i] {
+			if cleaned == other || strings.HasPrefix(cleaned, other+"/") || strings.HasPrefix(other, cleaned+"/") {
+				return nil, fmt.Errorf("mount prefix %s of %s overlaps %s of %s", cleaned, am.ArchivePath, other, archives[j].ArchivePath)
+			}
+		}
+		prefixes[i] = cleaned
+	}
+	return prefixes, nil
+}
+
+func fsName(options MountOptions) string {
+	if options.ArchivePath == "" {
+		return "clip"
+	}
+	// Commas would split the mount options
+	return strings.ReplaceAll(options.ArchivePath, ",", ";")
+}
+
+// mountFlags returns the options passed to the kernel on top of the ones go-fuse sets
+func mountFlags(options MountOptions) []string {
+	if options.AllowOther {
+		// Otherwise any user could read files only their owner may
+		return []string{"default_permissions"}
+	}
+	return nil
+}
+
+// storesXattrs reports whether any of the archives of a mount keeps extended attributes of its own
+func storesXattrs(filesystems map[string]*clipfs.ClipFileSystem) bool {
+	for _, cfs := range filesystems {
+		if cfs.StoresXattrs() {
+			return true
+		}
+	}
+	return false
+}
+
+// setCongestionThreshold changes the congestion threshold of a mount through the fuse control filesystem,
+// go-fuse always asks for 3/4 of max background. It needs root and /sys/fs/fuse/connections mounted.
+func setCongestionThreshold(mountPoint string, threshold int) error {
+	var st unix.Stat_t
+	if err := unix.Stat(mountPoint, &st); err != nil {
+		return fmt.Errorf("failed to find the fuse connection of the mount: %v", err)
+	}
+
+	p := fmt.Sprintf("/sys/fs/fuse/connections/%d/congestion_threshold", unix.Major(st.Dev)<<20|unix.Minor(st.Dev))
+	if err := os.WriteFile(p, []byte(strconv.Itoa(threshold)), 0644); err != nil {
+		return fmt.Errorf("failed to set the fuse congestion threshold: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package clip
+
+import (
+	"context"
+	"io/fs"
+
+	"github.com/NilayYadav/clip/pkg/common"
+)
+
+// Archive is an archive opened for use as a library: read through FS, mounted, or extracted, with the
+// storage, cache and key options it was opened with
+type Archive struct {
+	location string
+	options  MountOptions
+	view     *ArchiveView
+}
+
+// Open opens the archive at location, a path or a location in remote storage like s3://bucket/key, see
+// storage.ParseLocation. Local tarballs are indexed on the fly. Only the options describing the
+// archive and its caches are used until it's mounted; ArchivePath, Archives and StorageInfo are
+// ignored.
+func Open(ctx context.Context, location string, options MountOptions) (*Archive, error) {
+	options.ArchivePath, options.Archives, options.StorageInfo = location, nil, nil
+
+	view, err := openArchiveView(ctx, options)
+	if err != nil {
+		return nil, err
+	}
+	return &Archive{location: location, options: options, view: view}, nil
+}
+
+// FS returns the files of the archive, read without mounting it
+func (a *Archive) FS() fs.FS {
+	return a.view
+}
+
+// View returns the files of the archive with the rest of what ArchiveView offers, like Readlink
+func (a *Archive) View() *ArchiveView {
+	return a.view
+}
+
+// Metadata returns the index and attributes of the archive
+func (a *Archive) Metadata() *common.ClipArchiveMetadata {
+	return a.view.s.Metadata()
+}
+
+// Extract extracts the archive to outputPath. Its key, path rewrites, limits and credentials are the
+// ones it was opened with.
+func (a *Archive) Extract(ctx context.Context, outputPath string, options ExtractOptions) error {
+	options.InputFile = a.location
+	options.OutputPath = outputPath
+	options.EncryptionKey = a.options.EncryptionKey
+	options.Rewrites = a.options.Rewrites
+	options.Limits = a.options.Limits
+	options.Credentials = a.options.Credentials
+	_, err := extractArchive(ctx, options)
+	return err
+}
+
+// Close releases the storage backing the archive, files opened from FS can't be read afterwards
+func (a *Archive) Close() error {
+	return a.view.Close()
+}
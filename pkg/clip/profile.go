@@ -0,0 +1,64 @@
+package clip
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/NilayYadav/clip/pkg/archive"
+	"github.com/NilayYadav/clip/pkg/common"
+)
+
+type AttachProfileOptions struct {
+	ArchivePath string
+	TracePath   string
+}
+
+// AttachProfile embeds the files read in a trace recorded with MountOptions.TracePath into an archive,
+// so later mounts prefetch them in the order they were first read
+func AttachProfile(options AttachProfileOptions) error {
+	f, err := os.Open(options.TracePath)
+	if err != nil {
+		return fmt.Errorf("failed to open trace: %v", err)
+	}
+	defer f.Close()
+
+	entries, err := common.ReadTrace(f)
+	if err != nil {
+		return fmt.Errorf("invalid trace: %v", err)
+	}
+
+	a := archive.NewClipArchiver()
+	metadata, err := a.ExtractMetadata(options.ArchivePath)
+	if err != nil {
+		return fmt.Errorf("invalid archive: %v", err)
+	}
+
+	var paths []string
+	seen := make(map[string]bool)
+	for _, entry := range entries {
+		node := metadata.Get(entry.Path)
+		if seen[entry.Path] || node == nil || node.NodeType != common.FileNode {
+			continue
+		}
+		seen[entry.Path] = true
+		paths = append(paths, entry.Path)
+	}
+
+	// Keep hints given at create time that the trace didn't touch
+	attributes := metadata.Attributes
+	for _, p := range attributes.PrefetchPaths {
+		if !seen[p] {
+			seen[p] = true
+			paths = append(paths, p)
+		}
+	}
+	attributes.PrefetchPaths = paths
+
+	if err := a.UpdateAttributes(options.ArchivePath, attributes); err != nil {
+		return fmt.Errorf("failed to update archive: %v", err)
+	}
+
+	log.Printf("Attached profile with %d reads over %d files to %s\n", len(entries), len(paths), options.ArchivePath)
+	return nil
+}
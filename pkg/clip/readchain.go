@@ -0,0 +1,101 @@
+package clip
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/NilayYadav/clip/pkg/cache"
+	"github.com/NilayYadav/clip/pkg/clipfs"
+)
+
+// ReadSource is a tier of MountOptions.ReadChain
+type ReadSource struct {
+	Name        string        // memory, disk, cache for ContentCache, or storage for the archive itself
+	Timeout     time.Duration // 0 waits as long as the tier takes
+	SkipOnError bool          // Go on to the next tier when this one fails or times out
+}
+
+// ParseReadChain parses the tiers reads try in turn, separated by commas, each a source followed by an
+// optional timeout and skip or fail, like memory,disk:100ms,cache:500ms:skip,storage:30s. Caches skip
+// to the next tier when they fail unless told otherwise, and storage, which reads from a full local copy
+// of the archive when there is one, must come last. Content found in a lower tier isn't copied into the
+// tiers above it, as it is without a read chain.
+func ParseReadChain(spec string) ([]ReadSource, error) {
+	var chain []ReadSource
+	seen := make(map[string]bool)
+	for _, item := range strings.Split(spec, ",") {
+		fields := strings.Split(strings.TrimSpace(item), ":")
+		source := ReadSource{Name: fields[0], SkipOnError: fields[0] != "storage"}
+		switch source.Name {
+		case "memory", "disk", "cache", "storage":
+		default:
+			return nil, fmt.Errorf("invalid read chain %q: unknown tier %q, expected memory, disk, cache or storage", spec, source.Name)
+		}
+		if seen[source.Name] {
+			return nil, fmt.Errorf("invalid read chain %q: %s is listed twice", spec, source.Name)
+		}
+		seen[source.Name] = true
+
+		for _, field := range fields[1:] {
+			switch field {
+			case "skip":
+				source.SkipOnError = true
+			case "fail":
+				source.SkipOnError = false
+			default:
+				timeout, err := time.ParseDuration(field)
+				if err != nil || timeout < 0 {
+					return nil, fmt.Errorf("invalid read chain %q: %s takes a timeout, skip or fail, not %q", spec, source.Name, field)
+				}
+				source.Timeout = timeout
+			}
+		}
+		chain = append(chain, source)
+	}
+
+	if chain[len(chain)-1].Name != "storage" {
+		return nil, fmt.Errorf("invalid read chain %q: it must end with storage", spec)
+	}
+	return chain, nil
+}
+
+// readChain returns the tiers of a content cache built by NewContentCache that sources name, nil
+// without sources so the filesystem reads through the whole cache
+func readChain(sources []ReadSource, contentCache clipfs.ContentCache, available bool) ([]clipfs.ReadTier, error) {
+	if len(sources) == 0 {
+		return nil, nil
+	}
+
+	caches := make(map[string]clipfs.ContentCache)
+	if available && contentCache != nil {
+		if tiered, ok := contentCache.(*cache.TieredContentCache); ok {
+			for _, tier := range tiered.Tiers() {
+				switch tier.(type) {
+				case *cache.MemoryContentCache:
+					caches["memory"] = tier
+				case *cache.DiskContentCache:
+					caches["disk"] = tier
+				default:
+					caches["cache"] = tier
+				}
+			}
+		} else {
+			caches["cache"] = contentCache
+		}
+	}
+
+	var chain []clipfs.ReadTier
+	for _, source := range sources {
+		tier := clipfs.ReadTier{Name: source.Name, Timeout: source.Timeout, SkipOnError: source.SkipOnError}
+		if source.Name != "storage" {
+			c, ok := caches[source.Name]
+			if !ok {
+				return nil, fmt.Errorf("the read chain reads from the %s cache, which the mount doesn't have", source.Name)
+			}
+			tier.Cache = c
+		}
+		chain = append(chain, tier)
+	}
+	return chain, nil
+}
@@ -0,0 +1,162 @@
+//go:build !windows
+
+package clip
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/NilayYadav/clip/pkg/cache"
+	"github.com/NilayYadav/clip/pkg/clipfs"
+	"github.com/NilayYadav/clip/pkg/storage"
+	"golang.org/x/sys/unix"
+)
+
+// MountTunables are the settings of mounts that can change while they're mounted, see Reload.
+// Zero values keep the current setting.
+type MountTunables struct {
+	MemoryCacheSize int64  `json:"memory_cache_size,omitempty"` // Of mounts with a memory cache
+	DiskCacheSize   int64  `json:"disk_cache_size,omitempty"`   // Of mounts with a disk cache
+	ReadAhead       int64  `json:"read_ahead,omitempty"`        // Bytes the kernel reads ahead of sequential reads
+	LogLevel        string `json:"log_level,omitempty"`         // debug logs every operation, info doesn't
+}
+
+func LoadMountTunables(name string) (MountTunables, error) {
+	var t MountTunables
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return t, err
+	}
+	if err := json.Unmarshal(data, &t); err != nil {
+		return t, fmt.Errorf("invalid tunables file %s: %v", name, err)
+	}
+	if t.LogLevel != "" && t.LogLevel != "debug" && t.LogLevel != "info" {
+		return t, fmt.Errorf("invalid tunables file %s: unknown log level %q, expected debug or info", name, t.LogLevel)
+	}
+	return t, nil
+}
+
+// activeMount is what Reload changes of a mount served by this process
+type activeMount struct {
+	mountPoint   string
+	filesystems  map[string]*clipfs.ClipFileSystem
+	contentCache clipfs.ContentCache // Only if the mount built it, shared caches are resized by their owner
+	storages     []storage.ClipStorageInterface
+	reads        *storage.SharedReadLimiter // Counts remote reads, nil unless something reports them
+	bindings     []*Binding                 // Into other mount namespaces, see BindMount
+}
+
+var activeMounts = struct {
+	sync.Mutex
+	mounts map[*activeMount]bool
+}{mounts: make(map[*activeMount]bool)}
+
+func addActiveMount(m *activeMount) {
+	activeMounts.Lock()
+	defer activeMounts.Unlock()
+	activeMounts.mounts[m] = true
+}
+
+func removeActiveMount(m *activeMount) {
+	activeMounts.Lock()
+	defer activeMounts.Unlock()
+	delete(activeMounts.mounts, m)
+}
+
+// Reload applies tunables to every mount served by this process and has their storages resolve
+// credentials again, so rotated credential files are picked up. Reads in flight aren't interrupted,
+// they finish with the settings they started with.
+func Reload(t MountTunables) error {
+	activeMounts.Lock()
+	mounts := make([]*activeMount, 0, len(activeMounts.mounts))
+	for m := range activeMounts.mounts {
+		mounts = append(mounts, m)
+	}
+	activeMounts.Unlock()
+
+	var errs []error
+	for _, m := range mounts {
+		if err := m.reload(t); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", m.mountPoint, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (m *activeMount) reload(t MountTunables) error {
+	if t.LogLevel != "" {
+		for _, cfs := range m.filesystems {
+			cfs.SetVerbose(t.LogLevel == "debug")
+		}
+	}
+
+	// One setting failing to apply doesn't keep the others, like rotated credentials, from being picked up
+	var errs []error
+	if m.contentCache != nil {
+		if err := ResizeContentCache(m.contentCache, t.MemoryCacheSize, t.DiskCacheSize); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if t.ReadAhead > 0 {
+		if err := setReadAhead(m.mountPoint, t.ReadAhead); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	for _, s := range m.storages {
+		if err := storage.ReloadCredentials(s); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	log.Printf("Reloaded settings of %s\n", m.mountPoint)
+	return nil
+}
+
+// ResizeContentCache changes the limits of the memory and disk tiers of a cache built by
+// NewContentCache, 0 keeps the current limit. Other caches, like the ones of clipd tenants, which
+// have limits of their own, are left as they are.
+func ResizeContentCache(contentCache clipfs.ContentCache, memoryCacheSize int64, diskCacheSize int64) error {
+	tiered, ok := contentCache.(*cache.TieredContentCache)
+	if !ok {
+		return nil
+	}
+
+	for _, tier := range tiered.Tiers() {
+		switch tier := tier.(type) {
+		case *cache.MemoryContentCache:
+			if memoryCacheSize > 0 {
+				tier.SetMaxSize(memoryCacheSize)
+			}
+		case *cache.DiskContentCache:
+			if diskCacheSize > 0 {
+				tier.SetMaxSize(diskCacheSize)
+			}
+		}
+	}
+	return nil
+}
+
+// setReadAhead changes how far the kernel reads ahead in the files of a mount, through the backing
+// device of the mount. Files opened afterwards read ahead that far.
+func setReadAhead(mountPoint string, readAhead int64) error {
+	var st unix.Stat_t
+	if err := unix.Stat(mountPoint, &st); err != nil {
+		return fmt.Errorf("failed to find the device of the mount: %v", err)
+	}
+
+	p := fmt.Sprintf("/sys/class/bdi/%d:%d/read_ahead_kb", unix.Major(st.Dev), unix.Minor(st.Dev))
+	if err := os.WriteFile(p, []byte(strconv.FormatInt((readAhead+1023)/1024, 10)), 0644); err != nil {
+		return fmt.Errorf("failed to set read ahead: %v", err)
+	}
+	return nil
+}
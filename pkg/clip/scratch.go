@@ -0,0 +1,39 @@
+//go:build !windows
+
+package clip
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// mountScratch mounts an empty tmpfs over each scratch directory of a mount, which must be served
+// already. Anyone can write to them, like /tmp, and what's written is gone with the mount.
+func mountScratch(mountPoint string, scratch []string, size int64) error {
+	data := "mode=1777"
+	if size > 0 {
+		data = fmt.Sprintf("%s,size=%d", data, size)
+	}
+
+	for i, p := range scratch {
+		target := filepath.Join(mountPoint, p)
+		if err := unix.Mount("clip-scratch", target, "tmpfs", unix.MS_NOSUID|unix.MS_NODEV, data); err != nil {
+			unmountScratch(mountPoint, scratch[:i])
+			return fmt.Errorf("failed to mount scratch directory %s: %v", target, err)
+		}
+	}
+	return nil
+}
+
+// unmountScratch detaches scratch directories mounted by mountScratch, so the mount under them can go
+func unmountScratch(mountPoint string, scratch []string) {
+	for _, p := range scratch {
+		target := filepath.Join(mountPoint, p)
+		if err := unix.Unmount(target, unix.MNT_DETACH); err != nil {
+			log.Printf("Failed to unmount scratch directory %s: %v\n", target, err)
+		}
+	}
+}
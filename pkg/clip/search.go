@@ -0,0 +1,103 @@
+package clip
+
+import (
+	"context"
+	"path"
+	"regexp/syntax"
+	"strings"
+
+	"github.com/NilayYadav/clip/pkg/common"
+)
+
+// Search returns the names of the files with a line matching pattern, a regular expression, see Grep.
+// With the search index of archives created with one, only the files holding the literal text the
+// pattern needs are read.
+func (a *Archive) Search(ctx context.Context, pattern string) ([]string, error) {
+	var names []string
+	err := a.Grep(ctx, GrepOptions{Pattern: pattern, FilesOnly: true}, func(match GrepMatch) error {
+		names = append(names, match.Name)
+		return nil
+	})
+	return names, err
+}
+
+// searchCandidates narrows the files of a search down to those the search index of the archive says
+// may match, if it has one
+func (a *Archive) searchCandidates(names []string, pattern string) []string {
+	search := a.Metadata().Attributes.SearchIndex
+	if search == nil {
+		return names
+	}
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return names
+	}
+
+	indexed := make(map[string]bool, len(search.Paths)+len(search.Binary))
+	for _, p := range search.Paths {
+		indexed[p] = false
+	}
+	for _, p := range search.Binary {
+		indexed[p] = false
+	}
+	for _, p := range search.Lookup(requiredTrigrams(re.Simplify())) {
+		indexed[p] = true
+	}
+
+	var candidates []string
+	for _, name := range names {
+		// Files the index doesn't know, like encrypted ones, are searched anyway
+		if match, known := indexed[path.Join("/", a.options.Subpath, name)]; match || !known {
+			candidates = append(candidates, name)
+		}
+	}
+	return candidates
+}
+
+// requiredTrigrams returns trigrams every match of re holds, from the literal text it can't match
+// without
+func requiredTrigrams(re *syntax.Regexp) []uint32 {
+	switch re.Op {
+	case syntax.OpLiteral:
+		return literalTrigrams(re)
+	case syntax.OpCapture, syntax.OpPlus:
+		return requiredTrigrams(re.Sub[0])
+	case syntax.OpRepeat:
+		if re.Min > 0 {
+			return requiredTrigrams(re.Sub[0])
+		}
+	case syntax.OpConcat:
+		// Literals next to each other make up longer text
+		var trigrams []uint32
+		run := &syntax.Regexp{Op: syntax.OpLiteral}
+		for _, sub := range re.Sub {
+			if sub.Op == syntax.OpLiteral && sub.Flags&syntax.FoldCase == run.Flags&syntax.FoldCase {
+				run.Rune = append(run.Rune, sub.Rune...)
+				continue
+			}
+			trigrams = append(trigrams, literalTrigrams(run)...)
+			run = &syntax.Regexp{Op: syntax.OpLiteral}
+			if sub.Op == syntax.OpLiteral {
+				run.Rune, run.Flags = sub.Rune, sub.Flags
+				continue
+			}
+			trigrams = append(trigrams, requiredTrigrams(sub)...)
+		}
+		return append(trigrams, literalTrigrams(run)...)
+	}
+	return nil
+}
+
+func literalTrigrams(re *syntax.Regexp) []uint32 {
+	text := string(re.Rune)
+	// Folding matches letters beyond ASCII, even k and s match the Kelvin sign and the long s
+	if re.Flags&syntax.FoldCase != 0 && strings.IndexFunc(text, func(r rune) bool { return r > 0x7f || r == 'k' || r == 'K' || r == 's' || r == 'S' }) >= 0 {
+		return nil
+	}
+
+	var trigrams []uint32
+	for i := 0; i+2 < len(text); i++ {
+		trigrams = append(trigrams, common.Trigram(text[i], text[i+1], text[i+2]))
+	}
+	return trigrams
+}
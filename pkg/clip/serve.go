@@ -0,0 +1,185 @@
+package clip
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/NilayYadav/clip/pkg/archive"
+	"github.com/NilayYadav/clip/pkg/common"
+	"golang.org/x/net/netutil"
+)
+
+type ServeOptions struct {
+	Addr           string
+	ArchivePaths   []string // Local archives to publish, each one at /<file name>
+	BearerToken    string   // If set, clients must send it in their Authorization header
+	MaxConnections int      // Caps concurrent connections, 0 means unlimited
+	PublicURL      string   // Base URL other hosts reach the server at, needed for RClipDir
+	RClipDir       string   // Write an rclip for every published archive to this directory
+	Verbose        bool
+
+	TLS               *common.TLSFiles // Serve HTTPS and require client certificates
+	AuthorizationFile string           // Archive names each client certificate may read, needs TLS
+}
+
+// Serve publishes local archives over HTTP with range requests, so other hosts can mount them
+// through the http backend. It blocks until the server fails.
+func Serve(options ServeOptions) error {
+	archives := make(map[string]string)
+	var err error
+	for _, archivePath := range options.ArchivePaths {
+		name := filepath.Base(archivePath)
+		if _, exists := archives[name]; exists {
+			return fmt.Errorf("duplicate archive name: %s", name)
+		}
+
+		metadata, err := archive.NewClipArchiver().ExtractMetadata(archivePath)
+		if err != nil {
+			return fmt.Errorf("invalid archive %s: %v", archivePath, err)
+		}
+		if metadata.StorageInfo != nil {
+			return fmt.Errorf("%s is an rclip, only archives holding their content can be served", archivePath)
+		}
+
+		if options.RClipDir != "" {
+			if err := writeServedRClip(options, name, archivePath, metadata); err != nil {
+				return err
+			}
+		}
+
+		archives[name] = archivePath
+	}
+
+	handler := &archiveHandler{archives: archives, options: options}
+	if options.AuthorizationFile != "" {
+		if options.TLS == nil {
+			return fmt.Errorf("authorization needs tls to identify clients")
+		}
+		handler.authz, err = common.LoadArchiveAuthorization(options.AuthorizationFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	listener, err := net.Listen("tcp", options.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", options.Addr, err)
+	}
+	if options.MaxConnections > 0 {
+		listener = netutil.LimitListener(listener, options.MaxConnections)
+	}
+	if options.TLS != nil {
+		tlsConfig, err := common.ServerTLSConfig(*options.TLS)
+		if err != nil {
+			listener.Close()
+			return err
+		}
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+
+	log.Printf("Serving %d archives on %s\n", len(archives), listener.Addr())
+
+	server := &http.Server{Handler: handler}
+	return server.Serve(listener)
+}
+
+// writeServedRClip writes an rclip reading an archive from this server, pinned to its current version
+func writeServedRClip(options ServeOptions, name string, archivePath string, metadata *common.ClipArchiveMetadata) error {
+	if options.PublicURL == "" {
+		return fmt.Errorf("a public url is required to write rclips")
+	}
+
+	fi, err := os.Stat(archivePath)
+	if err != nil {
+		return err
+	}
+
+	storageInfo := &common.HTTPStorageInfo{
+		URL:  strings.TrimSuffix(options.PublicURL, "/") + "/" + name,
+		ETag: archiveETag(fi),
+	}
+
+	rclipPath := filepath.Join(options.RClipDir, strings.TrimSuffix(name, filepath.Ext(name))+".rclip")
+	if err := archive.NewClipArchiver().CreateRemoteArchive(storageInfo, metadata, rclipPath); err != nil {
+		return fmt.Errorf("failed to write rclip for %s: %v", archivePath, err)
+	}
+
+	log.Printf("Wrote %s\n", rclipPath)
+	return nil
+}
+
+// archiveETag identifies the version of an archive without hashing it, replacing the file changes it
+func archiveETag(fi os.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, fi.Size(), fi.ModTime().UnixNano())
+}
+
+type archiveHandler struct {
+	archives map[string]string
+	options  ServeOptions
+	authz    common.ArchiveAuthorization
+}
+
+func (h *archiveHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.options.Verbose {
+		log.Printf("%s %s %s range=%q\n", r.RemoteAddr, r.Method, r.URL.Path, r.Header.Get("Range"))
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !h.authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/")
+	if h.authz != nil && !h.authz.Allowed(common.PeerIdentities(r.TLS), name) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	archivePath, ok := h.archives[name]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	f, err := os.Open(archivePath)
+	if err != nil {
+		log.Printf("err opening %s: %v\n", archivePath, err)
+		http.Error(w, "archive unavailable", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		http.Error(w, "archive unavailable", http.StatusInternalServerError)
+		return
+	}
+
+	// ServeContent handles Range and If-None-Match against the ETag
+	w.Header().Set("ETag", archiveETag(fi))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, fi.Name(), fi.ModTime(), f)
+}
+
+func (h *archiveHandler) authorized(r *http.Request) bool {
+	if h.options.BearerToken == "" {
+		return true
+	}
+
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(h.options.BearerToken)) == 1
+}
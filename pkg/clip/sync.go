@@ -0,0 +1,139 @@
+package clip
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/NilayYadav/clip/pkg/archive"
+	"github.com/NilayYadav/clip/pkg/common"
+	"github.com/NilayYadav/clip/pkg/storage"
+)
+
+type SyncOptions struct {
+	Source               string                         // Location of the archive, see storage.ParseLocation. A local RCLIP stands for the archive it points at.
+	Destination          string                         // Location to copy it to
+	OutputFile           string                         // Write an RCLIP pointing at the destination here, optional
+	StagingDir           string                         // Holds the partial copy of a remote source, so an interrupted sync resumes. Defaults to the temp dir.
+	Credentials          storage.ClipStorageCredentials // Used for both the source and the destination
+	UploadBytesPerSecond int64                          // Caps upload bandwidth, 0 means unlimited
+}
+
+// Sync copies an archive from one storage location to another. A remote source is first copied to a
+// staging file, which an interrupted sync picks up from, see localArchive. The copy must pass its
+// checksums before it's stored at the destination, and the stored archive is checked against it
+// afterwards.
+func Sync(ctx context.Context, options SyncOptions) error {
+	dstInfo, dstPath, err := storage.ParseLocation(options.Destination)
+	if err != nil {
+		return err
+	}
+	if dstInfo == nil && options.OutputFile != "" {
+		return fmt.Errorf("an RCLIP can only point at remote storage, %s is local", options.Destination)
+	}
+
+	archivePath, cleanup, err := localArchive(ctx, options.Source, options.StagingDir, options.Credentials)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Checking %s\n", options.Source)
+	a := archive.NewClipArchiver()
+	if err := a.Verify(archivePath); err != nil {
+		cleanup()
+		return fmt.Errorf("archive failed its integrity check: %v", err)
+	}
+
+	digest, err := archive.Digest(archivePath)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Copying %s to %s\n", options.Source, options.Destination)
+	if dstInfo == nil {
+		err = copyArchive(archivePath, dstPath, digest)
+	} else {
+		err = syncUpload(ctx, dstInfo, archivePath, digest, options)
+	}
+	if err != nil {
+		return err
+	}
+
+	if options.OutputFile != "" {
+		metadata, err := a.ExtractMetadata(archivePath)
+		if err != nil {
+			return err
+		}
+		metadata.Attributes.ArchiveDigest = digest
+		if err := a.CreateRemoteArchive(dstInfo, metadata, options.OutputFile); err != nil {
+			return err
+		}
+	}
+
+	cleanup()
+
+	log.Printf("Synced %s (sha256 %s)\n", options.Destination, digest)
+	return nil
+}
+
+// syncUpload stores an archive at info and checks it was stored intact. Nothing is uploaded if the
+// destination can tell it already holds the archive.
+func syncUpload(ctx context.Context, info common.ClipStorageInfo, archivePath string, digest string, options SyncOptions) error {
+	backend, err := storage.GetBackend(info.Type())
+	if err != nil {
+		return err
+	}
+
+	opts := storage.UploadOpts{
+		Credentials:    options.Credentials,
+		BytesPerSecond: options.UploadBytesPerSecond,
+	}
+
+	if verifier, ok := backend.(storage.UploadVerifier); ok {
+		if stored, err := verifier.VerifyUpload(ctx, info, archivePath, opts); err == nil && stored {
+			log.Printf("%s already holds the archive\n", options.Destination)
+			return nil
+		}
+	}
+
+	if err := backend.Upload(ctx, info, archivePath, opts); err != nil {
+		return err
+	}
+	return archive.VerifyStored(ctx, info, archivePath, digest, opts)
+}
+
+// copyArchive copies an archive to a local path, through a temporary file so the path never holds
+// a partial copy
+func copyArchive(archivePath string, outputPath string, digest string) error {
+	in, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmpPath := outputPath + ".tmp"
+	out, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	copied, err := archive.Digest(tmpPath)
+	if err != nil {
+		return err
+	}
+	if copied != digest {
+		return fmt.Errorf("%w: copy of %s doesn't match, digest is %s, expected %s", common.ErrChecksumMismatch, archivePath, copied, digest)
+	}
+	return os.Rename(tmpPath, outputPath)
+}
@@ -0,0 +1,55 @@
+package clip
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/NilayYadav/clip/pkg/archive"
+	"github.com/NilayYadav/clip/pkg/common"
+	"github.com/NilayYadav/clip/pkg/storage"
+)
+
+// Extensions of the tarballs mounts index on the fly
+var tarballExtensions = []string{".tar", ".tar.gz", ".tgz"}
+
+// localTarball returns the path of the tarball at location, if it's a local one
+func localTarball(location string, info common.ClipStorageInfo) (string, bool) {
+	if info != nil {
+		return "", false
+	}
+	si, localPath, err := storage.ParseLocation(location)
+	if err != nil || si != nil {
+		return "", false
+	}
+
+	for _, ext := range tarballExtensions {
+		if strings.HasSuffix(localPath, ext) {
+			return localPath, true
+		}
+	}
+	return "", false
+}
+
+// indexTarball streams a tarball into a temporary archive, so it can be mounted like any other. The
+// caller removes the archive once it's open.
+func indexTarball(tarPath string, verbose bool) (string, error) {
+	tempFile, err := os.CreateTemp("", "clip-tarball-*.clip")
+	if err != nil {
+		return "", err
+	}
+	tempFile.Close()
+
+	log.Printf("Indexing tarball %s\n", tarPath)
+	err = archive.NewClipArchiver().Create(archive.ClipArchiverOptions{
+		TarPath:    tarPath,
+		OutputFile: tempFile.Name(),
+		Verbose:    verbose,
+	})
+	if err != nil {
+		os.Remove(tempFile.Name())
+		return "", fmt.Errorf("error indexing tarball %s: %v", tarPath, err)
+	}
+	return tempFile.Name(), nil
+}
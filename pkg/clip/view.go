@@ -0,0 +1,262 @@
+package clip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"syscall"
+	"time"
+
+	"github.com/NilayYadav/clip/pkg/clipfs"
+	"github.com/NilayYadav/clip/pkg/common"
+	"github.com/NilayYadav/clip/pkg/storage"
+	"github.com/NilayYadav/clip/pkg/vfs"
+)
+
+// ArchiveView reads an archive directly, without mounting it. It goes through the same storage and
+// content caches as mounts, but needs neither root nor /dev/fuse, so it also works in sandboxes that
+// forbid FUSE. It implements fs.FS, fs.StatFS and fs.ReadDirFS.
+type ArchiveView struct {
+	cfs *clipfs.ClipFileSystem
+	s   storage.ClipStorageInterface
+}
+
+// OpenArchiveView opens options.ArchivePath, or options.StorageInfo, for reading. Only the options describing the archive and
+// its caches are used, MountPoint, Archives, TracePath and Passthrough are ignored.
+func OpenArchiveView(options MountOptions) (*ArchiveView, error) {
+	return openArchiveView(context.TODO(), options)
+}
+
+func openArchiveView(ctx context.Context, options MountOptions) (*ArchiveView, error) {
+	contentCache, err := NewContentCache(options)
+	if err != nil {
+		return nil, err
+	}
+	if contentCache != nil {
+		options.ContentCache = contentCache
+		options.ContentCacheAvailable = true
+	}
+	options.Passthrough = false
+
+	cfs, s, err := loadFileSystem(ctx, options.ArchivePath, options.StorageInfo, options.CachePath, options.Subpath, 0, nil, options)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ArchiveView{cfs: cfs, s: s}, nil
+}
+
+// Close releases the storage backing the view, files opened from it can't be read afterwards
+func (v *ArchiveView) Close() error {
+	v.s.Cleanup()
+	return nil
+}
+
+// FileSystem returns the archive as a vfs.FileSystem, for frontends other than go-fuse like WinFSP
+func (v *ArchiveView) FileSystem() vfs.FileSystem {
+	return v.cfs
+}
+
+// Stat returns information about a file. Names are slash separated, with or without a leading slash.
+func (v *ArchiveView) Stat(name string) (fs.FileInfo, error) {
+	attr, err := v.cfs.Stat(name)
+	if err != nil {
+		return nil, pathError("stat", name, err)
+	}
+	return &fileInfo{name: path.Base(path.Join("/", name)), attr: attr}, nil
+}
+
+func (v *ArchiveView) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, err := v.cfs.ReadDir(name)
+	if err != nil {
+		return nil, pathError("readdir", name, err)
+	}
+
+	dirEntries := make([]fs.DirEntry, 0, len(entries))
+	for _, entry := range entries {
+		dirEntries = append(dirEntries, &dirEntry{view: v, dir: name, entry: entry})
+	}
+	return dirEntries, nil
+}
+
+func (v *ArchiveView) Readlink(name string) (string, error) {
+	target, err := v.cfs.Readlink(name)
+	if err != nil {
+		return "", pathError("readlink", name, err)
+	}
+	return target, nil
+}
+
+// OpenFile opens a file or directory for reading
+func (v *ArchiveView) OpenFile(name string) (*ViewFile, error) {
+	info, err := v.Stat(name)
+	if err != nil {
+		return nil, pathError("open", name, errors.Unwrap(err))
+	}
+	return &ViewFile{view: v, name: name, info: info}, nil
+}
+
+// Open implements fs.FS, names must be valid fs paths
+func (v *ArchiveView) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	return v.OpenFile(name)
+}
+
+// ViewFile is a file opened from an ArchiveView. It's safe to use ReadAt concurrently.
+type ViewFile struct {
+	view    *ArchiveView
+	name    string
+	info    fs.FileInfo
+	off     int64
+	entries []fs.DirEntry
+	listed  bool
+}
+
+func (f *ViewFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *ViewFile) ReadAt(p []byte, off int64) (int, error) {
+	if f.info.IsDir() {
+		return 0, pathError("read", f.name, vfs.ErrIsDir)
+	}
+	if off < 0 {
+		return 0, pathError("read", f.name, fs.ErrInvalid)
+	}
+
+	nRead := 0
+	for nRead < len(p) {
+		n, err := f.view.cfs.ReadFile(f.name, p[nRead:], off+int64(nRead))
+		if err != nil {
+			return nRead, pathError("read", f.name, err)
+		}
+		if n == 0 {
+			return nRead, io.EOF
+		}
+		nRead += n
+	}
+
+	return nRead, nil
+}
+
+func (f *ViewFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.off)
+	f.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *ViewFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += f.info.Size()
+	default:
+		return 0, pathError("seek", f.name, fs.ErrInvalid)
+	}
+
+	if offset < 0 {
+		return 0, pathError("seek", f.name, fs.ErrInvalid)
+	}
+	f.off = offset
+	return offset, nil
+}
+
+// ReadDir implements fs.ReadDirFile for directories
+func (f *ViewFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !f.listed {
+		entries, err := f.view.ReadDir(f.name)
+		if err != nil {
+			return nil, err
+		}
+		f.entries = entries
+		f.listed = true
+	}
+
+	if n <= 0 {
+		entries := f.entries
+		f.entries = nil
+		return entries, nil
+	}
+
+	if len(f.entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(f.entries) {
+		n = len(f.entries)
+	}
+
+	entries := f.entries[:n]
+	f.entries = f.entries[n:]
+	return entries, nil
+}
+
+func (f *ViewFile) Close() error {
+	return nil
+}
+
+type fileInfo struct {
+	name string
+	attr vfs.Attr
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return int64(fi.attr.Size) }
+func (fi *fileInfo) Mode() fs.FileMode  { return fileMode(fi.attr.Mode) }
+func (fi *fileInfo) ModTime() time.Time { return fi.attr.Mtime }
+func (fi *fileInfo) IsDir() bool        { return fi.Mode().IsDir() }
+func (fi *fileInfo) Sys() interface{}   { return fi.attr }
+
+type dirEntry struct {
+	view  *ArchiveView
+	dir   string
+	entry vfs.DirEntry
+}
+
+func (de *dirEntry) Name() string      { return de.entry.Name }
+func (de *dirEntry) IsDir() bool       { return de.Type().IsDir() }
+func (de *dirEntry) Type() fs.FileMode { return fileMode(de.entry.Mode).Type() }
+
+func (de *dirEntry) Info() (fs.FileInfo, error) {
+	return de.view.Stat(path.Join(de.dir, de.entry.Name))
+}
+
+// fileMode converts a stat(2) mode to an fs.FileMode
+func fileMode(mode uint32) fs.FileMode {
+	fileMode := fs.FileMode(mode & 0777)
+	switch mode & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		fileMode |= fs.ModeDir
+	case syscall.S_IFLNK:
+		fileMode |= fs.ModeSymlink
+	case syscall.S_IFIFO:
+		fileMode |= fs.ModeNamedPipe
+	case syscall.S_IFSOCK:
+		fileMode |= fs.ModeSocket
+	case syscall.S_IFCHR:
+		fileMode |= fs.ModeDevice | fs.ModeCharDevice
+	case syscall.S_IFBLK:
+		fileMode |= fs.ModeDevice
+	}
+	return fileMode
+}
+
+// pathError reports vfs errors the way the os and io/fs packages do
+func pathError(op string, name string, err error) error {
+	switch {
+	case errors.Is(err, vfs.ErrNotExist):
+		err = common.NewError(fs.ErrNotExist.Error(), fs.ErrNotExist, common.ErrNotFound)
+	case errors.Is(err, vfs.ErrUnavailable):
+		err = fmt.Errorf("%w: %w", err, syscall.EIO)
+	}
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
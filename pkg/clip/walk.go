@@ -0,0 +1,96 @@
+package clip
+
+import (
+	"io/fs"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/NilayYadav/clip/pkg/common"
+	"github.com/NilayYadav/clip/pkg/vfs"
+)
+
+// WalkDir walks the tree at root like fs.WalkDir, in the same lexical order, from the metadata of the
+// archive alone: no content is read. The subtree is listed in a single pass over the index, so walks
+// stay fast with millions of entries. fn can return fs.SkipDir or fs.SkipAll as with fs.WalkDir.
+func (a *Archive) WalkDir(root string, fn fs.WalkDirFunc) error {
+	rootNode, err := a.node("lstat", root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		err = walkNode(root, rootNode, a.subtree(rootNode.Path), fn)
+	}
+	if err == fs.SkipDir || err == fs.SkipAll {
+		return nil
+	}
+	return err
+}
+
+func walkNode(name string, node *common.ClipNode, children map[string][]*common.ClipNode, fn fs.WalkDirFunc) error {
+	if err := fn(name, &nodeEntry{node: node}, nil); err != nil || !node.IsDir() {
+		if err == fs.SkipDir && node.IsDir() {
+			return nil // Skip this directory
+		}
+		return err
+	}
+
+	for _, child := range children[node.Path] {
+		if err := walkNode(path.Join(name, path.Base(child.Path)), child, children, fn); err != nil {
+			if err == fs.SkipDir {
+				break // A file skipped the rest of its directory
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// subtree returns the nodes of every directory under dir, by directory path. Siblings sort by name in
+// the index, so they're kept in order.
+func (a *Archive) subtree(dir string) map[string][]*common.ClipNode {
+	prefix := dir
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	children := make(map[string][]*common.ClipNode)
+	index := a.Metadata().Index
+	index.Ascend(&common.ClipNode{Path: prefix}, func(item interface{}) bool {
+		node := item.(*common.ClipNode)
+		if !strings.HasPrefix(node.Path, prefix) {
+			return false // Paths under dir are all in a row
+		}
+		if node.Path != dir {
+			parent := path.Dir(node.Path)
+			children[parent] = append(children[parent], node)
+		}
+		return true
+	})
+	return children
+}
+
+// nodeEntry is a directory entry made from the archive metadata
+type nodeEntry struct {
+	node *common.ClipNode
+}
+
+func (e *nodeEntry) Name() string      { return path.Base(e.node.Path) }
+func (e *nodeEntry) IsDir() bool       { return e.node.IsDir() }
+func (e *nodeEntry) Type() fs.FileMode { return fileMode(e.node.Attr.Mode).Type() }
+
+func (e *nodeEntry) Info() (fs.FileInfo, error) {
+	attr := e.node.Attr
+	return &fileInfo{name: e.Name(), attr: vfs.Attr{
+		Ino:    attr.Ino,
+		Size:   attr.Size,
+		Blocks: attr.Blocks,
+		Mode:   attr.Mode,
+		Nlink:  attr.Nlink,
+		Uid:    attr.Uid,
+		Gid:    attr.Gid,
+		Rdev:   attr.Rdev,
+		Atime:  time.Unix(int64(attr.Atime), int64(attr.Atimensec)),
+		Mtime:  time.Unix(int64(attr.Mtime), int64(attr.Mtimensec)),
+		Ctime:  time.Unix(int64(attr.Ctime), int64(attr.Ctimensec)),
+	}}, nil
+}
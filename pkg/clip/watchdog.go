@@ -0,0 +1,151 @@
+//go:build !windows
+
+package clip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"github.com/NilayYadav/clip/pkg/storage"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	DefaultMinBackoff = time.Second
+	DefaultMaxBackoff = time.Minute
+)
+
+// WatchdogOptions tune how Supervise remounts an archive whose connection died
+type WatchdogOptions struct {
+	MinBackoff  time.Duration // Wait before remounting, doubled for every remount in a row up to MaxBackoff
+	MaxBackoff  time.Duration // Mounts staying up this long count as recovered, the next remount waits MinBackoff again
+	MaxRestarts int           // Give up after this many remounts in a row, 0 to never give up
+}
+
+// Supervise mounts an archive and serves it until ctx is done or it's unmounted, like NewMount and
+// Start. When the connection to the kernel dies instead, like after it's aborted through
+// /sys/fs/fuse/connections, the dead mount is detached and the archive mounted again at the same
+// mount point, with the content cache it had warmed. A dead mount left by a process that was killed
+// is detached before mounting too. mounted is called with each mount once it's ready.
+//
+// It fails right away if the archive can't be mounted the first time, later mounts are retried with
+// backoff.
+func Supervise(ctx context.Context, options MountOptions, watchdog WatchdogOptions, mounted func(m *Mount)) error {
+	if watchdog.MinBackoff <= 0 {
+		watchdog.MinBackoff = DefaultMinBackoff
+	}
+	if watchdog.MaxBackoff < watchdog.MinBackoff {
+		watchdog.MaxBackoff = DefaultMaxBackoff
+		if watchdog.MaxBackoff < watchdog.MinBackoff {
+			watchdog.MaxBackoff = watchdog.MinBackoff
+		}
+	}
+
+	// Built once, so every mount reads through the caches the ones before it filled
+	contentCache, err := NewContentCache(options)
+	if err != nil {
+		return err
+	}
+	if (options.ControlSocket != "" || options.DebugAddr != "") && options.ReadLimits.Shared == nil {
+		options.ReadLimits.Shared = storage.NewSharedReadLimiter(0)
+	}
+
+	backoff := watchdog.MinBackoff
+	restarts := 0
+	for first := true; ; first = false {
+		if !first {
+			restarts++
+			if watchdog.MaxRestarts > 0 && restarts > watchdog.MaxRestarts {
+				detachDeadMount(options.MountPoint)
+				return fmt.Errorf("gave up remounting %s after %d remounts in a row", options.MountPoint, watchdog.MaxRestarts)
+			}
+			log.Printf("Remounting %s in %v\n", options.MountPoint, backoff)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				detachDeadMount(options.MountPoint)
+				return nil
+			}
+			backoff *= 2
+			if backoff > watchdog.MaxBackoff {
+				backoff = watchdog.MaxBackoff
+			}
+		}
+
+		if err := detachDeadMount(options.MountPoint); err != nil {
+			if first {
+				return err
+			}
+			log.Printf("%v\n", err)
+			continue
+		}
+
+		m, err := newMount(options, contentCache)
+		if err == nil {
+			err = m.Start(ctx)
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			if first {
+				return err
+			}
+			log.Printf("Failed to remount %s: %v\n", options.MountPoint, err)
+			continue
+		}
+
+		if mounted != nil {
+			mounted(m)
+		}
+		start := time.Now()
+		err = <-m.Done()
+		if ctx.Err() != nil {
+			return nil
+		}
+		if !deadMount(options.MountPoint) {
+			return err // Unmounted rather than cut off
+		}
+
+		log.Printf("Connection of %s died\n", options.MountPoint)
+		if time.Since(start) >= watchdog.MaxBackoff {
+			backoff, restarts = watchdog.MinBackoff, 0
+		}
+	}
+}
+
+// deadMount reports whether mountPoint is a mount whose connection is gone, which fails every access.
+// The kernel answers stat from cached attributes, statfs always asks the connection.
+func deadMount(mountPoint string) bool {
+	var st unix.Statfs_t
+	err := unix.Statfs(mountPoint, &st)
+	return errors.Is(err, syscall.ENOTCONN) || errors.Is(err, syscall.ECONNABORTED)
+}
+
+// detachDeadMount detaches the mount at mountPoint if its connection is gone, so it can be mounted
+// again. Users other than root detach it with fusermount.
+func detachDeadMount(mountPoint string) error {
+	if !deadMount(mountPoint) {
+		return nil
+	}
+
+	log.Printf("Detaching dead mount %s\n", mountPoint)
+	err := unix.Unmount(mountPoint, unix.MNT_DETACH)
+	if err == nil {
+		return nil
+	}
+	for _, fusermount := range []string{"fusermount3", "fusermount"} {
+		if _, lookErr := exec.LookPath(fusermount); lookErr == nil {
+			if output, fuseErr := exec.Command(fusermount, "-u", "-z", mountPoint).CombinedOutput(); fuseErr != nil {
+				return fmt.Errorf("failed to detach dead mount %s: %v: %s", mountPoint, fuseErr, output)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("failed to detach dead mount %s: %v", mountPoint, err)
+}
@@ -0,0 +1,104 @@
+//go:build !windows
+
+package clipd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/NilayYadav/clip/pkg/common"
+)
+
+// Client asks a daemon for mounts. Mounts belong to the daemon, they outlive the client.
+type Client struct {
+	http    *http.Client
+	baseURL string
+}
+
+func NewClient(socketPath string) *Client {
+	if socketPath == "" {
+		socketPath = DefaultSocketPath
+	}
+
+	return &Client{
+		// The host is ignored, requests always go to the socket
+		baseURL: "http://clipd",
+		http: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					return (&net.Dialer{}).DialContext(ctx, "unix", socketPath)
+				},
+			},
+		},
+	}
+}
+
+// NewTLSClient talks to a daemon listening on the network, authenticating with a client certificate
+func NewTLSClient(addr string, files common.TLSFiles) (*Client, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig, err := common.ClientTLSConfig(files, host)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Client{
+		baseURL: "https://" + addr,
+		http:    &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}},
+	}, nil
+}
+
+func (c *Client) Mount(req MountRequest) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	return c.do(http.MethodPost, "/mounts", bytes.NewReader(body), nil)
+}
+
+func (c *Client) Unmount(mountPoint string) error {
+	return c.do(http.MethodDelete, "/mounts?mountpoint="+url.QueryEscape(mountPoint), nil, nil)
+}
+
+func (c *Client) List() ([]MountInfo, error) {
+	var mounts []MountInfo
+	if err := c.do(http.MethodGet, "/mounts", nil, &mounts); err != nil {
+		return nil, err
+	}
+	return mounts, nil
+}
+
+func (c *Client) do(method string, path string, body io.Reader, out interface{}) error {
+	req, err := http.NewRequest(method, c.baseURL+path, body)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("cannot reach daemon: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var errResp errorResponse
+		if err := json.NewDecoder(resp.Body).Decode(&errResp); err != nil || errResp.Error == "" {
+			return fmt.Errorf("daemon request failed: %s", resp.Status)
+		}
+		return fmt.Errorf("%s", errResp.Error)
+	}
+
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
@@ -0,0 +1,495 @@
+//go:build !windows
+
+// Package clipd runs a host daemon that owns every clip mount on a machine, and a client
+// that asks it for mounts over a unix socket. Mounts share the daemon's content cache and
+// stay up when the processes that requested them exit.
+package clipd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/NilayYadav/clip/pkg/clip"
+	"github.com/NilayYadav/clip/pkg/clipfs"
+	"github.com/NilayYadav/clip/pkg/common"
+	"github.com/NilayYadav/clip/pkg/storage"
+)
+
+const DefaultSocketPath = "/run/clipd.sock"
+
+type DaemonOptions struct {
+	SocketPath      string
+	Verbose         bool
+	MemoryCacheSize int64  // Bytes of content kept in memory, shared by all mounts
+	DiskCacheDir    string // Directory content is cached in on local disk, shared by all mounts
+	DiskCacheSize   int64
+	CacheBlockSize  int64
+	ReadAhead       int64                          // Bytes the kernel reads ahead of sequential reads, defaults to 128Kb
+	Credentials     storage.ClipStorageCredentials // Used by every mount
+	Tenants         map[string]TenantLimits        // Tenants not listed here are unlimited
+
+	// Remote requests in flight at once, for each mount and for all of them together, 0 = unlimited.
+	// Mounts waiting for requests of others to finish take turns.
+	MountConcurrentRequests int
+	MaxConcurrentRequests   int
+
+	// Also accept clients over the network, authenticated with mutual TLS. Clients on the socket are trusted.
+	ListenAddr        string
+	TLS               *common.TLSFiles
+	AuthorizationFile string // Archive paths each client certificate may mount, required with ListenAddr
+	NetworkRoot       string // Directory the mount points and cache paths of network clients must be under, required with ListenAddr
+
+	// Serve expvar counters of every mount at /debug/vars on this address, and with Pprof profiles of
+	// the daemon at /debug/pprof/
+	DebugAddr string
+	Pprof     bool
+}
+
+// MountRequest describes a mount a client asks the daemon for
+type MountRequest struct {
+	ArchivePath string
+	MountPoint  string
+	CachePath   string `json:",omitempty"`
+	Subpath     string `json:",omitempty"`
+	Tenant      string `json:",omitempty"` // Whose limits the mount counts against
+}
+
+type MountInfo struct {
+	MountRequest
+	MountedAt time.Time
+}
+
+type mount struct {
+	info   MountInfo
+	mount  *clip.Mount
+	tenant *tenant
+	done   chan struct{}
+}
+
+type Daemon struct {
+	options      DaemonOptions
+	contentCache clipfs.ContentCache
+	mu           sync.Mutex
+	mounts       map[string]*mount // Keyed by mount point
+	mounting     map[string]bool   // Mount points of mounts still being made, which hold a slot of their tenant
+	tenants      map[string]*tenant
+	server       *http.Server
+	tlsServer    *http.Server
+	debug        *clip.DebugServer
+	authz        common.ArchiveAuthorization
+}
+
+func NewDaemon(options DaemonOptions) (*Daemon, error) {
+	if options.SocketPath == "" {
+		options.SocketPath = DefaultSocketPath
+	}
+
+	storage.SetMaxConcurrentRequests(options.MaxConcurrentRequests, options.MountConcurrentRequests)
+
+	contentCache, err := clip.NewContentCache(clip.MountOptions{
+		MemoryCacheSize: options.MemoryCacheSize,
+		DiskCacheDir:    options.DiskCacheDir,
+		DiskCacheSize:   options.DiskCacheSize,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	d := &Daemon{
+		options:      options,
+		contentCache: contentCache,
+		mounts:       make(map[string]*mount),
+		mounting:     make(map[string]bool),
+		tenants:      make(map[string]*tenant),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/mounts", d.handleMounts)
+	mux.HandleFunc("/metrics", d.handleMetrics)
+	d.server = &http.Server{Handler: mux}
+
+	if options.ListenAddr != "" {
+		if options.TLS == nil || options.AuthorizationFile == "" || options.NetworkRoot == "" {
+			return nil, fmt.Errorf("network clients need tls, an authorization file and a network root")
+		}
+		root, err := filepath.Abs(options.NetworkRoot)
+		if err == nil {
+			root, err = filepath.EvalSymlinks(root)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid network root: %v", err)
+		}
+		d.options.NetworkRoot = root
+
+		tlsConfig, err := common.ServerTLSConfig(*options.TLS)
+		if err != nil {
+			return nil, err
+		}
+		d.authz, err = common.LoadArchiveAuthorization(options.AuthorizationFile)
+		if err != nil {
+			return nil, err
+		}
+		d.tlsServer = &http.Server{Addr: options.ListenAddr, Handler: mux, TLSConfig: tlsConfig}
+	}
+
+	return d, nil
+}
+
+// Reload applies tunables to the shared content cache, to every mount and to the mounts made
+// afterwards. The caches of tenants with their own keep their limits.
+func (d *Daemon) Reload(t clip.MountTunables) error {
+	d.mu.Lock()
+	if t.ReadAhead > 0 {
+		d.options.ReadAhead = t.ReadAhead
+	}
+	if t.LogLevel != "" {
+		d.options.Verbose = t.LogLevel == "debug"
+	}
+	d.mu.Unlock()
+
+	var resizeErr error
+	if d.contentCache != nil {
+		resizeErr = clip.ResizeContentCache(d.contentCache, t.MemoryCacheSize, t.DiskCacheSize)
+	}
+	return errors.Join(resizeErr, clip.Reload(t))
+}
+
+// Serve accepts client requests until Close is called
+func (d *Daemon) Serve() error {
+	// A socket left behind by a daemon that didn't shut down cleanly is removed, one still in use isn't
+	if conn, err := net.Dial("unix", d.options.SocketPath); err == nil {
+		conn.Close()
+		return fmt.Errorf("a daemon is already listening on %s", d.options.SocketPath)
+	}
+	os.Remove(d.options.SocketPath)
+
+	listener, err := net.Listen("unix", d.options.SocketPath)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", d.options.SocketPath, err)
+	}
+	if err := os.Chmod(d.options.SocketPath, 0600); err != nil {
+		listener.Close()
+		return err
+	}
+
+	log.Printf("Daemon listening on %s\n", d.options.SocketPath)
+
+	if d.options.DebugAddr != "" {
+		if d.debug, err = clip.StartDebugServer(d.options.DebugAddr, d.options.Pprof); err != nil {
+			listener.Close()
+			return err
+		}
+	}
+
+	errs := make(chan error, 2)
+	go func() {
+		errs <- d.server.Serve(listener)
+	}()
+
+	servers := 1
+	if d.tlsServer != nil {
+		servers++
+		go func() {
+			log.Printf("Daemon listening on %s\n", d.options.ListenAddr)
+			errs <- d.tlsServer.ListenAndServeTLS("", "")
+		}()
+	}
+
+	for i := 0; i < servers; i++ {
+		if err := <-errs; !errors.Is(err, http.ErrServerClosed) {
+			d.server.Close()
+			if d.tlsServer != nil {
+				d.tlsServer.Close()
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// Close stops accepting requests and unmounts everything the daemon mounted
+func (d *Daemon) Close() error {
+	err := d.server.Shutdown(context.Background())
+	if d.tlsServer != nil {
+		if tlsErr := d.tlsServer.Shutdown(context.Background()); err == nil {
+			err = tlsErr
+		}
+	}
+	if d.debug != nil {
+		d.debug.Close()
+	}
+
+	d.mu.Lock()
+	mountPoints := make([]string, 0, len(d.mounts))
+	for mountPoint := range d.mounts {
+		mountPoints = append(mountPoints, mountPoint)
+	}
+	d.mu.Unlock()
+
+	for _, mountPoint := range mountPoints {
+		if unmountErr := d.Unmount(mountPoint); unmountErr != nil {
+			log.Printf("err unmounting %s: %v\n", mountPoint, unmountErr)
+		}
+	}
+
+	return err
+}
+
+// Mount mounts an archive and keeps it mounted until Unmount or Close
+func (d *Daemon) Mount(req MountRequest) error {
+	if req.ArchivePath == "" || req.MountPoint == "" {
+		return fmt.Errorf("an archive and a mount point are required")
+	}
+
+	// The mount point and a slot of the tenant are held while the archive is mounted, which can take
+	// long for remote archives, without keeping other requests waiting
+	d.mu.Lock()
+	if _, exists := d.mounts[req.MountPoint]; exists || d.mounting[req.MountPoint] {
+		d.mu.Unlock()
+		return fmt.Errorf("%s is already mounted", req.MountPoint)
+	}
+
+	t, err := d.tenant(req.Tenant)
+	if err != nil {
+		d.mu.Unlock()
+		return err
+	}
+	if t.limits.MaxMounts > 0 && t.mounts >= t.limits.MaxMounts {
+		d.mu.Unlock()
+		return fmt.Errorf("%w: %s already has %d mounts", errTenantLimit, t.name, t.mounts)
+	}
+	d.mounting[req.MountPoint] = true
+	t.mounts++
+
+	contentCache := d.contentCache
+	if t.contentCache != nil {
+		contentCache = t.contentCache
+	}
+	options := clip.MountOptions{
+		ArchivePath:           req.ArchivePath,
+		MountPoint:            req.MountPoint,
+		CachePath:             req.CachePath,
+		Subpath:               req.Subpath,
+		Verbose:               d.options.Verbose,
+		Credentials:           d.options.Credentials,
+		ContentCache:          contentCache,
+		ContentCacheAvailable: contentCache != nil,
+		CacheBlockSize:        d.options.CacheBlockSize,
+		ReadAhead:             d.options.ReadAhead,
+		ReadLimits:            storage.ReadLimits{Shared: t.reads},
+	}
+	d.mu.Unlock()
+
+	mounted, err := clip.NewMount(options)
+	if err == nil {
+		err = mounted.Start(context.Background())
+	}
+
+	d.mu.Lock()
+	delete(d.mounting, req.MountPoint)
+	if err != nil {
+		t.mounts--
+		d.mu.Unlock()
+		return err
+	}
+	m := &mount{
+		info:   MountInfo{MountRequest: req, MountedAt: time.Now()},
+		mount:  mounted,
+		tenant: t,
+		done:   make(chan struct{}),
+	}
+	d.mounts[req.MountPoint] = m
+	d.mu.Unlock()
+
+	// Forget mounts once they go away, including ones unmounted from outside the daemon
+	go func() {
+		if err := <-mounted.Done(); err != nil {
+			log.Printf("err serving %s: %v\n", req.MountPoint, err)
+		}
+
+		d.mu.Lock()
+		if d.mounts[req.MountPoint] == m {
+			delete(d.mounts, req.MountPoint)
+		}
+		m.tenant.mounts--
+		d.mu.Unlock()
+		close(m.done)
+	}()
+
+	log.Printf("Mounted %s to %s\n", req.ArchivePath, req.MountPoint)
+	return nil
+}
+
+// Unmount unmounts a mount made by the daemon and waits for it to go away
+func (d *Daemon) Unmount(mountPoint string) error {
+	d.mu.Lock()
+	m, exists := d.mounts[mountPoint]
+	d.mu.Unlock()
+	if !exists {
+		return fmt.Errorf("%s is not mounted by the daemon", mountPoint)
+	}
+
+	if err := m.mount.Close(); err != nil {
+		return err
+	}
+	<-m.done
+
+	log.Printf("Unmounted %s\n", mountPoint)
+	return nil
+}
+
+func (d *Daemon) Mounts() []MountInfo {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	mounts := make([]MountInfo, 0, len(d.mounts))
+	for _, m := range d.mounts {
+		mounts = append(mounts, m.info)
+	}
+	sort.Slice(mounts, func(i, j int) bool { return mounts[i].MountPoint < mounts[j].MountPoint })
+	return mounts
+}
+
+// allowed reports whether the client may use an archive, clients without certificates came in over the socket
+func (d *Daemon) allowed(r *http.Request, archivePath string) bool {
+	return r.TLS == nil || d.authz.Allowed(common.PeerIdentities(r.TLS), archivePath)
+}
+
+// cleanLocation cleans the path of an archive location, so authorization patterns can't be matched
+// through .. elements that lead elsewhere
+func cleanLocation(location string) string {
+	if u, err := url.Parse(location); err == nil && len(u.Scheme) > 1 {
+		if u.Path != "" {
+			u.Path, u.RawPath = path.Clean(u.Path), ""
+		}
+		return u.String()
+	}
+	return path.Clean(location)
+}
+
+// underRoot resolves a path given by a network client, failing unless it's below root. Links in the
+// part of the path that exists are resolved, so they can't lead out of root.
+func underRoot(root string, p string) (string, error) {
+	if !filepath.IsAbs(p) {
+		return "", fmt.Errorf("not an absolute path")
+	}
+
+	existing, missing := filepath.Clean(p), ""
+	for {
+		resolved, err := filepath.EvalSymlinks(existing)
+		if err == nil {
+			existing = resolved
+			break
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+		missing = filepath.Join(filepath.Base(existing), missing)
+		existing = filepath.Dir(existing)
+	}
+
+	resolved := filepath.Join(existing, missing)
+	rel, err := filepath.Rel(root, resolved)
+	if err != nil || rel == "." || !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("outside of %s", root)
+	}
+	return resolved, nil
+}
+
+func (d *Daemon) handleMounts(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		var mounts []MountInfo
+		for _, m := range d.Mounts() {
+			if d.allowed(r, m.ArchivePath) {
+				mounts = append(mounts, m)
+			}
+		}
+		writeJSON(w, http.StatusOK, mounts)
+	case http.MethodPost:
+		var req MountRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid mount request: %v", err))
+			return
+		}
+		if req.ArchivePath != "" {
+			req.ArchivePath = cleanLocation(req.ArchivePath)
+		}
+		if !d.allowed(r, req.ArchivePath) {
+			writeError(w, http.StatusForbidden, fmt.Errorf("not allowed to mount %s", req.ArchivePath))
+			return
+		}
+		if r.TLS != nil {
+			var err error
+			if req.MountPoint, err = underRoot(d.options.NetworkRoot, req.MountPoint); err != nil {
+				writeError(w, http.StatusForbidden, fmt.Errorf("not allowed to mount at %s: %v", req.MountPoint, err))
+				return
+			}
+			if req.CachePath != "" {
+				if req.CachePath, err = underRoot(d.options.NetworkRoot, req.CachePath); err != nil {
+					writeError(w, http.StatusForbidden, fmt.Errorf("not allowed to cache to %s: %v", req.CachePath, err))
+					return
+				}
+			}
+		}
+		req.Tenant = tenantName(r, req.Tenant)
+		if err := d.Mount(req); errors.Is(err, errTenantLimit) {
+			writeError(w, http.StatusTooManyRequests, err)
+			return
+		} else if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		mountPoint := r.URL.Query().Get("mountpoint")
+		if r.TLS != nil {
+			// Mounts of network clients are known by their resolved mount point
+			if resolved, err := underRoot(d.options.NetworkRoot, mountPoint); err == nil {
+				mountPoint = resolved
+			}
+		}
+
+		d.mu.Lock()
+		m, exists := d.mounts[mountPoint]
+		d.mu.Unlock()
+		if exists && !d.allowed(r, m.info.ArchivePath) {
+			writeError(w, http.StatusForbidden, fmt.Errorf("not allowed to unmount %s", mountPoint))
+			return
+		}
+
+		if err := d.Unmount(mountPoint); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+type errorResponse struct {
+	Error string
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, errorResponse{Error: err.Error()})
+}
@@ -0,0 +1,151 @@
+//go:build !windows
+
+package clipd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/NilayYadav/clip/pkg/cache"
+	"github.com/NilayYadav/clip/pkg/clipfs"
+	"github.com/NilayYadav/clip/pkg/storage"
+)
+
+var errTenantLimit = errors.New("tenant limit reached")
+
+// TenantLimits caps what the mounts of one tenant may use together, 0 means unlimited
+type TenantLimits struct {
+	MaxMounts      int
+	CacheBytes     int64 // Content cached for the tenant, kept apart from the shared cache and other tenants
+	BytesPerSecond int64 // Remote reads of all the tenant's mounts
+}
+
+// LoadTenants reads a tenants file, a JSON object mapping tenant names to their limits
+func LoadTenants(name string) (map[string]TenantLimits, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var tenants map[string]TenantLimits
+	if err := json.Unmarshal(data, &tenants); err != nil {
+		return nil, fmt.Errorf("invalid tenants file %s: %v", name, err)
+	}
+
+	for name := range tenants {
+		if !validTenantName(name) {
+			return nil, fmt.Errorf("invalid tenant name %q", name)
+		}
+	}
+
+	return tenants, nil
+}
+
+// The name ends up in cache directory names
+func validTenantName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, `/\`)
+}
+
+// tenant accounts for the mounts made on behalf of one client. Tenants without limits are still
+// accounted, they just share the daemon's cache and bandwidth.
+type tenant struct {
+	name         string
+	limits       TenantLimits
+	mounts       int
+	contentCache clipfs.ContentCache // Nil if the tenant uses the shared cache
+	cacheSize    func() int64
+	reads        *storage.SharedReadLimiter
+}
+
+// tenant returns the tenant named name, creating it on first use. d.mu must be held.
+func (d *Daemon) tenant(name string) (*tenant, error) {
+	if t, exists := d.tenants[name]; exists {
+		return t, nil
+	}
+
+	limits := d.options.Tenants[name]
+	t := &tenant{
+		name:   name,
+		limits: limits,
+		reads:  storage.NewSharedReadLimiter(limits.BytesPerSecond),
+	}
+
+	if limits.CacheBytes > 0 {
+		if d.options.DiskCacheDir != "" {
+			diskCache, err := cache.NewDiskContentCache(filepath.Join(d.options.DiskCacheDir, "tenants", name), limits.CacheBytes)
+			if err != nil {
+				return nil, err
+			}
+			t.contentCache, t.cacheSize = diskCache, diskCache.Size
+		} else {
+			memoryCache := cache.NewMemoryContentCache(limits.CacheBytes)
+			t.contentCache, t.cacheSize = memoryCache, memoryCache.Size
+		}
+	}
+
+	d.tenants[name] = t
+	return t, nil
+}
+
+// tenantName returns the tenant a request is made for. Network clients are always accounted to the
+// common name of their certificate, clients on the socket name a tenant in the request.
+func tenantName(r *http.Request, requested string) string {
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		return r.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	return requested
+}
+
+// handleMetrics reports usage per tenant in the Prometheus text format. Network clients only see their own tenant.
+func (d *Daemon) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	tenants := make([]*tenant, 0, len(d.tenants))
+	for _, t := range d.tenants {
+		if r.TLS == nil || t.name == tenantName(r, "") {
+			tenants = append(tenants, t)
+		}
+	}
+	mounts := make(map[string]int, len(tenants))
+	for _, t := range tenants {
+		mounts[t.name] = t.mounts
+	}
+	d.mu.Unlock()
+	sort.Slice(tenants, func(i, j int) bool { return tenants[i].name < tenants[j].name })
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	metric := func(name string, kind string, help string, value func(t *tenant) int64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+		for _, t := range tenants {
+			fmt.Fprintf(w, "%s{tenant=%q} %d\n", name, t.name, value(t))
+		}
+	}
+
+	metric("clipd_tenant_mounts", "gauge", "Archives currently mounted for the tenant.", func(t *tenant) int64 {
+		return int64(mounts[t.name])
+	})
+	metric("clipd_tenant_mounts_limit", "gauge", "Maximum concurrent mounts of the tenant, 0 if unlimited.", func(t *tenant) int64 {
+		return int64(t.limits.MaxMounts)
+	})
+	metric("clipd_tenant_cache_bytes", "gauge", "Bytes held in the tenant's own content cache.", func(t *tenant) int64 {
+		if t.cacheSize == nil {
+			return 0
+		}
+		return t.cacheSize()
+	})
+	metric("clipd_tenant_cache_limit_bytes", "gauge", "Size of the tenant's own content cache, 0 if it uses the shared cache.", func(t *tenant) int64 {
+		return t.limits.CacheBytes
+	})
+	metric("clipd_tenant_remote_read_bytes_total", "counter", "Bytes read from remote storage by the tenant's mounts.", func(t *tenant) int64 {
+		return t.reads.BytesRead()
+	})
+	metric("clipd_tenant_remote_read_limit_bytes_per_second", "gauge", "Remote read bandwidth of the tenant, 0 if unlimited.", func(t *tenant) int64 {
+		return t.limits.BytesPerSecond
+	})
+}
@@ -0,0 +1,140 @@
+package clipfs
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/NilayYadav/clip/pkg/common"
+)
+
+const defaultCacheBlockSize = 1 << 20 // 1Mb
+
+// KeyedContentCache can be implemented by content caches that store content under a key chosen by the caller.
+// Files are then cached as fixed size blocks keyed by their content hash and block index, so reading a few
+// bytes of a large file only caches the blocks around them instead of the whole file.
+type KeyedContentCache interface {
+	ContentCache
+	StoreContentWithKey(key string, chunks chan []byte) error
+}
+
+func (cfs *ClipFileSystem) log(format string, v ...interface{}) {
+	if cfs.Verbose() {
+		log.Printf(fmt.Sprintf("[CLIPFS] %s", format), v...)
+	}
+}
+
+func blockKey(hash string, idx int64) string {
+	return fmt.Sprintf("%s-%d", hash, idx)
+}
+
+// blockCache returns the content cache if files should be cached as blocks
+func (cfs *ClipFileSystem) blockCache() (KeyedContentCache, bool) {
+	if cfs.blockSize <= 0 {
+		return nil, false
+	}
+	cache, ok := cfs.contentCache.(KeyedContentCache)
+	return cache, ok
+}
+
+// readBlocks reads the blocks a read lies in from storage and caches them
+func (cfs *ClipFileSystem) readBlocks(cache KeyedContentCache, node *common.ClipNode, dest []byte, off int64) (int, error) {
+	nRead := 0
+	for nRead < len(dest) {
+		pos := off + int64(nRead)
+		idx := pos / cfs.blockSize
+		blockOff := pos - idx*cfs.blockSize
+
+		block, err := cfs.fillBlock(cache, node, idx)
+		if err != nil {
+			return nRead, err
+		}
+		if blockOff >= int64(len(block)) {
+			break
+		}
+		nRead += copy(dest[nRead:], block[blockOff:])
+	}
+
+	return nRead, nil
+}
+
+// fillBlock reads a block from storage and caches it in the background. Concurrent fills of the
+// same block share a single read from storage, and fills that happen while the block is still
+// being stored reuse the block rather than reading it again.
+func (cfs *ClipFileSystem) fillBlock(cache KeyedContentCache, node *common.ClipNode, idx int64) ([]byte, error) {
+	key := blockKey(node.ContentHash, idx)
+
+	block, err, _ := cfs.fills.Do(key, func() (interface{}, error) {
+		cfs.pendingBlocksMu.Lock()
+		block, pending := cfs.pendingBlocks[key]
+		cfs.pendingBlocksMu.Unlock()
+		if pending {
+			return block, nil
+		}
+
+		block, err := cfs.readBlock(node, idx)
+		if err != nil {
+			return nil, err
+		}
+
+		cfs.pendingBlocksMu.Lock()
+		cfs.pendingBlocks[key] = block
+		cfs.pendingBlocksMu.Unlock()
+
+		go cfs.cacheBlock(cache, node, idx, block)
+		return block, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return block.([]byte), nil
+}
+
+func (cfs *ClipFileSystem) readBlock(node *common.ClipNode, idx int64) ([]byte, error) {
+	offset := idx * cfs.blockSize
+	length := cfs.blockSize
+	if offset+length > node.DataLen {
+		length = node.DataLen - offset
+	}
+
+	block := make([]byte, length)
+	nRead, err := cfs.readStorage(node, block, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	return block[:nRead], nil
+}
+
+// cacheBlock stores a block filled by fillBlock, which keeps it pending until the store is done
+func (cfs *ClipFileSystem) cacheBlock(cache KeyedContentCache, node *common.ClipNode, idx int64, block []byte) {
+	key := blockKey(node.ContentHash, idx)
+
+	defer func() {
+		cfs.pendingBlocksMu.Lock()
+		delete(cfs.pendingBlocks, key)
+		cfs.pendingBlocksMu.Unlock()
+	}()
+
+	chunks := make(chan []byte, 1)
+	chunks <- block
+	close(chunks)
+
+	if err := cache.StoreContentWithKey(key, chunks); err != nil {
+		cfs.log("err storing block %d of %s: %v", idx, node.Path, err)
+	}
+}
+
+// cacheBlocks stores every block of a file that isn't cached yet
+func (cfs *ClipFileSystem) cacheBlocks(cache KeyedContentCache, node *common.ClipNode) {
+	for idx := int64(0); idx*cfs.blockSize < node.DataLen; idx++ {
+		if _, err := cache.GetContent(blockKey(node.ContentHash, idx), 0, 1); err == nil {
+			continue
+		}
+
+		if _, err := cfs.fillBlock(cache, node, idx); err != nil {
+			cfs.log("err reading block %d of %s: %v", idx, node.Path, err)
+			return
+		}
+	}
+}
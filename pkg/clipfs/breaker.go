@@ -0,0 +1,114 @@
+package clipfs
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/NilayYadav/clip/pkg/cache"
+)
+
+// CacheBreakerOptions configure when reads stop going to the content cache. After FailureThreshold
+// reads in a row fail or take longer than SlowRead, the cache is bypassed and reads go straight to
+// storage for Cooldown. A single read then tries the cache again, closing the breaker if it works.
+type CacheBreakerOptions struct {
+	FailureThreshold int // 0 disables the breaker
+	SlowRead         time.Duration
+	Cooldown         time.Duration
+}
+
+// cacheBreaker keeps a content cache that is down or overloaded from adding its latency and errors to
+// every read
+type cacheBreaker struct {
+	opts CacheBreakerOptions
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time // Zero while the breaker is closed
+	probing   bool      // A read is trying the cache after the cool down
+}
+
+func newCacheBreaker(opts CacheBreakerOptions) *cacheBreaker {
+	if opts.FailureThreshold <= 0 {
+		return nil
+	}
+	return &cacheBreaker{opts: opts}
+}
+
+// allow reports whether a read may use the cache, every allowed read must be recorded
+func (b *cacheBreaker) allow() bool {
+	if b == nil {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.openUntil.IsZero() {
+		return true
+	}
+	if time.Now().Before(b.openUntil) || b.probing {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// record counts a read from the cache that took took and failed with err. Misses are no failure.
+func (b *cacheBreaker) record(err error, took time.Duration) {
+	if b == nil {
+		return
+	}
+
+	failed := err != nil && !errors.Is(err, cache.ErrContentNotFound)
+	slow := b.opts.SlowRead > 0 && took > b.opts.SlowRead
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+
+	if !failed && !slow {
+		if !b.openUntil.IsZero() {
+			log.Println("Content cache is back, reading from it again")
+		}
+		b.failures = 0
+		b.openUntil = time.Time{}
+		return
+	}
+
+	b.failures++
+	if b.failures >= b.opts.FailureThreshold || !b.openUntil.IsZero() {
+		if b.openUntil.IsZero() {
+			if failed {
+				log.Printf("Content cache keeps failing, reading from storage for %v: %v\n", b.opts.Cooldown, err)
+			} else {
+				log.Printf("Content cache keeps taking over %v, reading from storage for %v\n", b.opts.SlowRead, b.opts.Cooldown)
+			}
+		}
+		b.openUntil = time.Now().Add(b.opts.Cooldown)
+	}
+}
+
+// open reports whether reads are bypassing the cache
+func (b *cacheBreaker) open() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !b.openUntil.IsZero()
+}
+
+// getContent reads from the content cache through the breaker
+func (cfs *ClipFileSystem) getContent(c ContentCache, key string, off int64, length int64) ([]byte, error) {
+	start := time.Now()
+	content, err := c.GetContent(key, off, length)
+	cfs.cacheBreaker.record(err, time.Since(start))
+	return content, err
+}
+
+// CacheBypassed reports whether reads skip the content cache because it kept failing, see
+// CacheBreakerOptions
+func (cfs *ClipFileSystem) CacheBypassed() bool {
+	return cfs.cacheBreaker.open()
+}
@@ -2,36 +2,62 @@ package clipfs
 
 import (
 	"fmt"
+	"hash/fnv"
+	"path"
 	"sync"
 
 	"github.com/NilayYadav/clip/pkg/common"
 	"github.com/NilayYadav/clip/pkg/storage"
-	"github.com/hanwen/go-fuse/v2/fs"
-	"github.com/hanwen/go-fuse/v2/fuse"
+	"golang.org/x/sync/singleflight"
 )
 
 type ClipFileSystemOpts struct {
 	Verbose               bool
 	ContentCache          ContentCache
 	ContentCacheAvailable bool
+	InodeOffset           uint64 // Added to every inode number so several archives can share a mount
+	RootPath              string // Directory inside the archive to expose as the filesystem root
+	Trace                 *TraceRecorder
+	CacheBlockSize        int64  // Size of the blocks files are cached in when the content cache supports keys, defaults to 1Mb
+	Passthrough           bool   // Let the kernel read files straight from full local copies held by the content cache
+	OfflineMode           bool   // Keep serving cached content while storage is unreachable
+	NormalizeNames        bool   // Match names that differ from the archive's only in Unicode normalization (NFC or NFD)
+	CaseInsensitive       bool   // Match names regardless of case, keeping the case of the archive in listings
+	EncryptionKey         []byte // Decrypts encrypted files, which can't be read without it
+	CacheBreaker          CacheBreakerOptions
+	ReadChain             []ReadTier // Sources reads try in turn, defaults to ContentCache then storage
 }
 
+// ClipFileSystem serves an archive. Metadata lookups, reads and caching work on archive nodes and
+// don't depend on any fuse library, frontends sit on top: FSNode for go-fuse and vfs.FileSystem for
+// everything else.
 type ClipFileSystem struct {
+	fuseNodes
 	s                     storage.ClipStorageInterface
-	root                  *FSNode
-	lookupCache           map[string]*lookupCacheEntry
+	rootNode              *common.ClipNode
 	contentCache          ContentCache
 	contentCacheAvailable bool
-	cacheMutex            sync.RWMutex
-	verbose               bool
+	verbose               int32 // Set to log every operation, see SetVerbose
 	cachingStatus         map[string]bool
 	cacheEventChan        chan cacheEvent
 	cachingStatusMu       sync.Mutex
-}
-
-type lookupCacheEntry struct {
-	inode *fs.Inode
-	attr  fuse.Attr
+	inodeOffset           uint64
+	trace                 *TraceRecorder
+	blockSize             int64
+	fills                 singleflight.Group
+	pendingBlocks         map[string][]byte // Blocks read from storage that are still being stored in the cache
+	pendingBlocksMu       sync.Mutex
+	passthrough           bool
+	offlineMode           bool
+	offline               int32 // Set while storage is unreachable in offline mode
+	normalizeNames        bool
+	foldedIndex           map[string]*common.ClipNode // Casefolded paths to nodes, nil unless case insensitive
+	encryptionKey         []byte
+	cacheBreaker          *cacheBreaker // Nil without a failure threshold
+	readChain             []ReadTier
+	tierStats             []TierStats // Counters of the tiers of readChain, updated atomically
+	readsInFlight         int64
+	storesXattrs          bool // Some node has Xattrs, see StoresXattrs
 }
 
 type ContentCache interface {
@@ -40,46 +66,83 @@ type ContentCache interface {
 }
 
 type cacheEvent struct {
-	node *FSNode
+	node      *common.ClipNode
+	wholeFile bool // Store the file as a single piece of content even if the cache supports blocks
 }
 
 func NewFileSystem(s storage.ClipStorageInterface, opts ClipFileSystemOpts) (*ClipFileSystem, error) {
 	cfs := &ClipFileSystem{
 		s:                     s,
-		verbose:               opts.Verbose,
-		lookupCache:           make(map[string]*lookupCacheEntry),
 		contentCache:          opts.ContentCache,
 		cacheEventChan:        make(chan cacheEvent, 10000),
 		cachingStatus:         make(map[string]bool),
 		contentCacheAvailable: opts.ContentCacheAvailable,
+		inodeOffset:           opts.InodeOffset,
+		trace:                 opts.Trace,
+		blockSize:             opts.CacheBlockSize,
+		pendingBlocks:         make(map[string][]byte),
+		passthrough:           opts.Passthrough,
+		offlineMode:           opts.OfflineMode,
+		normalizeNames:        opts.NormalizeNames,
+		encryptionKey:         opts.EncryptionKey,
+		cacheBreaker:          newCacheBreaker(opts.CacheBreaker),
+		readChain:             opts.ReadChain,
+	}
+
+	if cfs.blockSize == 0 {
+		cfs.blockSize = defaultCacheBlockSize
+	}
+	if cfs.readChain == nil {
+		cfs.readChain = defaultReadChain(cfs.contentCache)
+	} else if err := checkReadChain(cfs.readChain); err != nil {
+		return nil, err
+	}
+	cfs.tierStats = make([]TierStats, len(cfs.readChain))
+	cfs.SetVerbose(opts.Verbose)
+
+	rootPath := "/"
+	if opts.RootPath != "" {
+		rootPath = path.Join("/", opts.RootPath)
 	}
 
 	metadata := s.Metadata()
-	rootNode := metadata.Get("/")
+	rootNode := metadata.Get(rootPath)
 	if rootNode == nil {
 		return nil, common.ErrMissingArchiveRoot
 	}
+	if !rootNode.IsDir() {
+		return nil, fmt.Errorf("root path is not a directory: %s", rootPath)
+	}
 
-	cfs.root = &FSNode{
-		filesystem: cfs,
-		attr:       rootNode.Attr,
-		clipNode:   rootNode,
+	if opts.CaseInsensitive {
+		cfs.buildFoldedIndex()
 	}
+	cfs.storesXattrs = hasXattrs(metadata)
+
+	cfs.rootNode = rootNode
+	cfs.initFuseNodes()
 
 	go cfs.processCacheEvents()
+	go cfs.prefetch()
 
 	return cfs, nil
 }
 
-func (cfs *ClipFileSystem) Root() (fs.InodeEmbedder, error) {
-	if cfs.root == nil {
-		return nil, fmt.Errorf("root not initialized")
+// ino returns the inode number exposed to the kernel for a node. It only depends on the archive
+// and the inode offset, never on the order nodes are looked up in, so it survives remounts.
+func (cfs *ClipFileSystem) ino(node *common.ClipNode) uint64 {
+	if node.Attr.Ino == 0 {
+		// Nodes without a stored inode get one derived from their path, above the inodes archives assign
+		// and below the ones go-fuse generates itself
+		h := fnv.New64a()
+		h.Write([]byte(node.Path))
+		return (h.Sum64()>>3 | 1<<62) + cfs.inodeOffset
 	}
-	return cfs.root, nil
+	return node.Attr.Ino + cfs.inodeOffset
 }
 
-func (cfs *ClipFileSystem) CacheFile(node *FSNode) {
-	hash := node.clipNode.ContentHash
+func (cfs *ClipFileSystem) CacheFile(node *common.ClipNode) {
+	hash := node.ContentHash
 
 	// Check and update caching status
 	cfs.cachingStatusMu.Lock()
@@ -94,6 +157,39 @@ func (cfs *ClipFileSystem) CacheFile(node *FSNode) {
 	cfs.cacheEventChan <- cacheEvent{node: node}
 }
 
+// prefetch loads the files the archive lists for prefetching into the content cache, so they are
+// served from the cache the first time they are read
+func (cfs *ClipFileSystem) prefetch() {
+	metadata := cfs.s.Metadata()
+	if len(metadata.Attributes.PrefetchPaths) == 0 || !cfs.contentCacheAvailable || cfs.s.CachedLocally() {
+		return
+	}
+
+	for _, p := range metadata.Attributes.PrefetchPaths {
+		clipNode := metadata.Get(p)
+		if clipNode == nil || clipNode.ContentHash == "" || clipNode.DataLen == 0 {
+			continue
+		}
+
+		cfs.prefetchNode(clipNode)
+	}
+}
+
+// prefetchNode caches a file unless it's cached already, it reports whether it had to
+func (cfs *ClipFileSystem) prefetchNode(clipNode *common.ClipNode) bool {
+	// Already cached, for tiered caches the lookup also promotes it to the fastest tier
+	key := clipNode.ContentHash
+	if _, ok := cfs.blockCache(); ok {
+		key = blockKey(clipNode.ContentHash, 0)
+	}
+	if _, err := cfs.contentCache.GetContent(key, 0, 1); err == nil {
+		return false
+	}
+
+	cfs.CacheFile(clipNode)
+	return true
+}
+
 func (cfs *ClipFileSystem) clearCachingStatus(hash string) {
 	cfs.cachingStatusMu.Lock()
 	delete(cfs.cachingStatus, hash)
@@ -102,7 +198,12 @@ func (cfs *ClipFileSystem) clearCachingStatus(hash string) {
 
 func (cfs *ClipFileSystem) processCacheEvents() {
 	for cacheEvent := range cfs.cacheEventChan {
-		clipNode := cacheEvent.node.clipNode
+		clipNode := cacheEvent.node
+
+		if cache, ok := cfs.blockCache(); ok && !cacheEvent.wholeFile {
+			cfs.cacheBlocks(cache, clipNode)
+			continue
+		}
 
 		if clipNode.DataLen > 0 {
 			chunks := make(chan []byte, 1)
@@ -120,9 +221,9 @@ func (cfs *ClipFileSystem) processCacheEvents() {
 					}
 
 					fileContent := make([]byte, chunkSize) // Create a new buffer for each chunk
-					nRead, err := cfs.s.ReadFile(clipNode, fileContent, offset)
+					nRead, err := cfs.readStorage(clipNode, fileContent, offset)
 					if err != nil {
-						cacheEvent.node.log("err reading file: %v", err)
+						cfs.log("err reading file %s: %v", clipNode.Path, err)
 						break
 					}
 
@@ -135,9 +236,33 @@ func (cfs *ClipFileSystem) processCacheEvents() {
 
 			hash, err := cfs.contentCache.StoreContent(chunks)
 			if err != nil || hash != clipNode.ContentHash {
-				cacheEvent.node.log("err storing file contents: %v", err)
-				cfs.clearCachingStatus(clipNode.ContentHash)
+				cfs.log("err storing file contents of %s: %v", clipNode.Path, err)
+				if cacheEvent.wholeFile {
+					cfs.clearCachingStatus(wholeFileStatusKey(clipNode.ContentHash))
+				} else {
+					cfs.clearCachingStatus(clipNode.ContentHash)
+				}
 			}
 		}
 	}
 }
+
+// readRange clamps a read to the end of the file and records it in the trace, it returns the part of dest to read into
+func (cfs *ClipFileSystem) readRange(node *common.ClipNode, dest []byte, off int64) []byte {
+	if off >= node.DataLen {
+		return dest[:0]
+	}
+
+	// Don't read past the end of the file
+	if off+int64(len(dest)) > node.DataLen {
+		dest = dest[:node.DataLen-off]
+	}
+
+	cfs.trace.Record(node.Path, off, int64(len(dest)))
+	return dest
+}
+
+// usesContentCache reports whether reads of a node go through the content cache
+func (cfs *ClipFileSystem) usesContentCache(node *common.ClipNode) bool {
+	return cfs.contentCacheAvailable && node.ContentHash != "" && !cfs.s.CachedLocally()
+}
@@ -0,0 +1,94 @@
+package clipfs
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"sync/atomic"
+
+	"github.com/NilayYadav/clip/pkg/common"
+)
+
+// SetVerbose turns logging of every operation on or off while the filesystem is mounted
+func (cfs *ClipFileSystem) SetVerbose(verbose bool) {
+	var v int32
+	if verbose {
+		v = 1
+	}
+	atomic.StoreInt32(&cfs.verbose, v)
+}
+
+// Verbose reports whether every operation is logged
+func (cfs *ClipFileSystem) Verbose() bool {
+	return atomic.LoadInt32(&cfs.verbose) == 1
+}
+
+// Prefetch caches files in the background, paths are relative to the filesystem root and
+// directories bring every file under them. Files already cached are skipped. It returns the
+// number of files found, or an error without caching anything if a path doesn't exist.
+func (cfs *ClipFileSystem) Prefetch(paths []string) (int, error) {
+	var nodes []*common.ClipNode
+	for _, p := range paths {
+		node := cfs.resolve(path.Join(cfs.rootNode.Path, p))
+		if node == nil {
+			return 0, common.NewError(fmt.Sprintf("no such file in archive: %s", p), common.ErrNotFound)
+		}
+		nodes = append(nodes, cfs.files(node)...)
+	}
+
+	// Checking the cache can take a request per file, and queueing blocks once the queue is full
+	go func() {
+		for _, node := range nodes {
+			if cfs.usesContentCache(node) && node.DataLen > 0 {
+				cfs.prefetchNode(node)
+			}
+		}
+	}()
+	return len(nodes), nil
+}
+
+// Hydrate queues every file of the filesystem for the content cache, see Prefetch
+func (cfs *ClipFileSystem) Hydrate() (int, error) {
+	return cfs.Prefetch([]string{"."})
+}
+
+// files returns the regular files at or under node
+func (cfs *ClipFileSystem) files(node *common.ClipNode) []*common.ClipNode {
+	if !node.IsDir() {
+		if node.NodeType == common.FileNode {
+			return []*common.ClipNode{node}
+		}
+		return nil
+	}
+
+	prefix := strings.TrimSuffix(node.Path, "/") + "/"
+	index := cfs.s.Metadata().Index
+
+	var files []*common.ClipNode
+	index.Ascend(&common.ClipNode{Path: prefix}, func(a interface{}) bool {
+		child := a.(*common.ClipNode)
+		if !strings.HasPrefix(child.Path, prefix) {
+			return false
+		}
+		if child.NodeType == common.FileNode {
+			files = append(files, child)
+		}
+		return true
+	})
+	return files
+}
+
+// ForgetCached forgets which files were cached, so they are cached again the next time they are
+// read after the content cache was flushed. What the kernel cached is dropped as well.
+func (cfs *ClipFileSystem) ForgetCached() error {
+	cfs.cachingStatusMu.Lock()
+	cfs.cachingStatus = make(map[string]bool)
+	cfs.cachingStatusMu.Unlock()
+
+	return cfs.InvalidateAll()
+}
+
+// PendingCacheFills returns the number of files waiting to be stored in the content cache
+func (cfs *ClipFileSystem) PendingCacheFills() int {
+	return len(cfs.cacheEventChan)
+}
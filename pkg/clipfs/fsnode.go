@@ -1,62 +1,117 @@
+//go:build !windows
+
 package clipfs
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"os"
 	"path"
+	"sync"
 	"syscall"
 
 	"github.com/NilayYadav/clip/pkg/common"
+	"github.com/NilayYadav/clip/pkg/storage"
 	"github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
+	"golang.org/x/sys/unix"
 )
 
 type FSNode struct {
 	fs.Inode
-	filesystem   *ClipFileSystem
-	clipNode     *common.ClipNode
-	attr         fuse.Attr
-	supportsMmap bool
+	filesystem *ClipFileSystem
+	clipNode   *common.ClipNode
+	attr       common.Attr
 }
 
-func (n *FSNode) log(format string, v ...interface{}) {
-	if n.filesystem.verbose {
-		log.Printf(fmt.Sprintf("[CLIPFS] (%s) %s", n.clipNode.Path, format), v...)
+// fuseNodes holds the go-fuse nodes of a ClipFileSystem
+type fuseNodes struct {
+	root        *FSNode
+	lookupCache map[string]*lookupCacheEntry
+	cacheMutex  sync.RWMutex
+}
+
+func (cfs *ClipFileSystem) initFuseNodes() {
+	cfs.lookupCache = make(map[string]*lookupCacheEntry)
+	cfs.root = &FSNode{
+		filesystem: cfs,
+		attr:       cfs.rootNode.Attr,
+		clipNode:   cfs.rootNode,
 	}
 }
 
-func (n *FSNode) OnAdd(ctx context.Context) {
-	n.log("OnAdd called")
+// passthroughHandle hands the kernel a local copy of a file's content, so it can read it without calling us.
+// Reads are still served by FSNode.Read if the kernel doesn't support passthrough or we aren't allowed to use it.
+type passthroughHandle struct {
+	path string
+	f    *os.File
 }
 
-func (n *FSNode) Init(ctx context.Context) {
-	n.supportsMmap = true
+func (h *passthroughHandle) PassthroughFd() (int, bool) {
+	f, err := os.Open(h.path)
+	if err != nil {
+		return 0, false
+	}
+	h.f = f
+	return int(f.Fd()), true
 }
 
-func (n *FSNode) Mmap(ctx context.Context, f fs.FileHandle, off int64, sz int64, flags uint32) (bool, error) {
-	n.log("Mmap called with offset: %d, size: %d, flags: %d", off, sz, flags)
+// Release closes our descriptor, the kernel keeps its own reference to the backing file
+func (h *passthroughHandle) Release(ctx context.Context) syscall.Errno {
+	if h.f != nil {
+		h.f.Close()
+	}
+	return fs.OK
+}
 
-	// Check if we need to pad with null terminator
-	if off+sz > int64(n.clipNode.DataLen) {
-		// Create a padded buffer that includes null terminator
-		paddedSize := off + sz
-		paddedBuf := make([]byte, paddedSize)
+type lookupCacheEntry struct {
+	inode *fs.Inode
+	attr  fuse.Attr
+}
 
-		// Read the actual file content
-		_, err := n.filesystem.s.ReadFile(n.clipNode, paddedBuf[:n.clipNode.DataLen], 0)
-		if err != nil {
-			return false, err
-		}
+func (cfs *ClipFileSystem) Root() (fs.InodeEmbedder, error) {
+	if cfs.root == nil {
+		return nil, fmt.Errorf("root not initialized")
+	}
+	return cfs.root, nil
+}
 
-		// Add null terminator
-		paddedBuf[n.clipNode.DataLen] = 0
+// RootIno returns the inode number of the filesystem root, which go-fuse needs to be told about
+func (cfs *ClipFileSystem) RootIno() uint64 {
+	return cfs.ino(cfs.rootNode)
+}
 
-		// Return the padded buffer
-		return true, nil
+// fuseAttr converts the attributes of a node as stored in the index to the ones go-fuse serves
+func fuseAttr(attr common.Attr) fuse.Attr {
+	return fuse.Attr{
+		Ino:       attr.Ino,
+		Size:      attr.Size,
+		Blocks:    attr.Blocks,
+		Atime:     attr.Atime,
+		Mtime:     attr.Mtime,
+		Ctime:     attr.Ctime,
+		Atimensec: attr.Atimensec,
+		Mtimensec: attr.Mtimensec,
+		Ctimensec: attr.Ctimensec,
+		Mode:      attr.Mode,
+		Nlink:     attr.Nlink,
+		Owner:     fuse.Owner{Uid: attr.Uid, Gid: attr.Gid},
+		Rdev:      attr.Rdev,
+		Blksize:   attr.Blksize,
+		Padding:   attr.Padding,
 	}
+}
 
-	return false, nil
+func (n *FSNode) log(format string, v ...interface{}) {
+	if n.filesystem.Verbose() {
+		log.Printf(fmt.Sprintf("[CLIPFS] (%s) %s", n.clipNode.Path, format), v...)
+	}
+}
+
+func (n *FSNode) OnAdd(ctx context.Context) {
+	n.log("OnAdd called")
 }
 
 func (n *FSNode) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
@@ -65,15 +120,19 @@ func (n *FSNode) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOu
 	node := n.clipNode
 
 	// Fill in the AttrOut struct
-	out.Ino = node.Attr.Ino
+	out.Ino = n.filesystem.ino(node)
 	out.Size = node.Attr.Size
 	out.Blocks = node.Attr.Blocks
 	out.Atime = node.Attr.Atime
+	out.Atimensec = node.Attr.Atimensec
 	out.Mtime = node.Attr.Mtime
+	out.Mtimensec = node.Attr.Mtimensec
 	out.Ctime = node.Attr.Ctime
+	out.Ctimensec = node.Attr.Ctimensec
 	out.Mode = node.Attr.Mode
 	out.Nlink = node.Attr.Nlink
-	out.Owner = node.Attr.Owner
+	out.Rdev = node.Attr.Rdev
+	out.Owner = fuse.Owner{Uid: node.Attr.Uid, Gid: node.Attr.Gid}
 
 	return fs.OK
 }
@@ -95,21 +154,22 @@ func (n *FSNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*
 	}
 
 	// Lookup the child node
-	child := n.filesystem.s.Metadata().Get(childPath)
+	child := n.filesystem.child(n.clipNode.Path, name)
 	if child == nil {
 		// No child with the requested name exists
 		return nil, syscall.ENOENT
 	}
 
 	// Fill out the child node's attributes
-	out.Attr = child.Attr
+	out.Attr = fuseAttr(child.Attr)
+	out.Attr.Ino = n.filesystem.ino(child)
 
 	// Create a new Inode for the child
-	childInode := n.NewInode(ctx, &FSNode{filesystem: n.filesystem, clipNode: child, attr: child.Attr}, fs.StableAttr{Mode: child.Attr.Mode, Ino: child.Attr.Ino})
+	childInode := n.NewInode(ctx, &FSNode{filesystem: n.filesystem, clipNode: child, attr: child.Attr}, fs.StableAttr{Mode: child.Attr.Mode, Ino: out.Attr.Ino})
 
 	// Cache the result
 	n.filesystem.cacheMutex.Lock()
-	n.filesystem.lookupCache[childPath] = &lookupCacheEntry{inode: childInode, attr: child.Attr}
+	n.filesystem.lookupCache[childPath] = &lookupCacheEntry{inode: childInode, attr: out.Attr}
 	n.filesystem.cacheMutex.Unlock()
 
 	return childInode, fs.OK
@@ -122,64 +182,85 @@ func (n *FSNode) Opendir(ctx context.Context) syscall.Errno {
 
 func (n *FSNode) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
 	n.log("Open called with flags: %v", flags)
-	if flags&syscall.MAP_PRIVATE != 0 || flags&syscall.MAP_SHARED != 0 {
-		// Set FUSE direct IO flag for mmap
-		fuseFlags |= fuse.FOPEN_DIRECT_IO
+	if flags&syscall.O_ACCMODE != syscall.O_RDONLY {
+		return nil, 0, syscall.EROFS
 	}
 
-	return nil, fuseFlags, fs.OK
+	if n.filesystem.passthrough && n.clipNode.NodeType == common.FileNode {
+		if path, ok := n.filesystem.localContentPath(n.clipNode); ok {
+			return &passthroughHandle{path: path}, fuse.FOPEN_KEEP_CACHE, fs.OK
+		}
+
+		// Make a local copy for the next time the file is opened
+		go n.filesystem.cacheWholeFile(n.clipNode)
+	}
+
+	// Archive content never changes, so the kernel can keep cached pages across opens.
+	// Reads, including those backing mmap, go through the page cache.
+	return nil, fuse.FOPEN_KEEP_CACHE, fs.OK
 }
 
 func (n *FSNode) Read(ctx context.Context, f fs.FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
 	n.log("Read called with offset: %v", off)
 
-	if off >= int64(n.clipNode.DataLen) {
-		// Return zeros for reads beyond file size
-		for i := range dest {
-			dest[i] = 0
-		}
-		return fuse.ReadResultData(dest), fs.OK
+	// Reads at or past the end of the file hit EOF, the kernel zero fills the rest of mapped pages
+	dest = n.filesystem.readRange(n.clipNode, dest, off)
+	if len(dest) == 0 {
+		return fuse.ReadResultData(nil), fs.OK
 	}
 
-	// Length of the content to read
-	length := int64(len(dest))
+	// Serve straight from mapped archives, or splice from local archive files, rather than copying
+	// the data through dest
+	if !n.filesystem.usesContentCache(n.clipNode) && !n.clipNode.IsEncrypted() {
+		if mr, ok := n.filesystem.s.(storage.MappedReader); ok {
+			if data, ok := mr.Mapped(n.clipNode, off, len(dest)); ok {
+				return fuse.ReadResultData(data), fs.OK
+			}
+		}
+		if fr, ok := n.filesystem.s.(storage.FdReader); ok {
+			if fd, pos, ok := fr.Fd(n.clipNode, off); ok {
+				return fuse.ReadResultFd(fd, pos, len(dest)), fs.OK
+			}
+		}
+	}
 
-	// Don't even try to read 0 byte files
-	if n.clipNode.DataLen == 0 {
-		nRead := 0
-		return fuse.ReadResultData(dest[:nRead]), fs.OK
+	nRead, err := n.filesystem.readContent(n.clipNode, dest, off)
+	if errors.Is(err, common.ErrStorageOffline) {
+		return nil, syscall.EHOSTUNREACH
+	} else if errors.Is(err, common.ErrMissingKey) {
+		return nil, syscall.EACCES
+	} else if err != nil {
+		return nil, syscall.EIO
 	}
 
-	// If we have provided a contentCache, try and use it
-	// Switch back local filesystem if all content is cached on disk
-	if n.filesystem.contentCacheAvailable && n.clipNode.ContentHash != "" && !n.filesystem.s.CachedLocally() {
-		content, err := n.filesystem.contentCache.GetContent(n.clipNode.ContentHash, off, length)
+	return fuse.ReadResultData(dest[:nRead]), fs.OK
+}
 
-		// Content found in cache
-		if err == nil {
-			copy(dest, content)
-			return fuse.ReadResultData(dest[:len(content)]), fs.OK
-		} else { // Cache miss - read from the underlying source and store in cache
-			nRead, err := n.filesystem.s.ReadFile(n.clipNode, dest, off)
-			if err != nil {
-				return nil, syscall.EIO
-			}
+// CopyFileRange is only called by the kernel when both files live in this mount, and the destination can't be written.
+// Copies out to other filesystems are served by Read, which splices from local archives.
+func (n *FSNode) CopyFileRange(ctx context.Context, fhIn fs.FileHandle, offIn uint64, out *fs.Inode, fhOut fs.FileHandle, offOut uint64, length uint64, flags uint64) (uint32, syscall.Errno) {
+	n.log("CopyFileRange called with offset: %v, length: %v", offIn, length)
+	return 0, syscall.EROFS
+}
 
-			// Store entire file in CAS
-			go func() {
-				n.filesystem.CacheFile(n)
-			}()
+// Lseek implements SEEK_DATA and SEEK_HOLE. Archives don't store sparse files, so all
+// of a file is data, followed by the implicit hole at its end.
+func (n *FSNode) Lseek(ctx context.Context, f fs.FileHandle, off uint64, whence uint32) (uint64, syscall.Errno) {
+	n.log("Lseek called with offset: %v, whence: %v", off, whence)
 
-			return fuse.ReadResultData(dest[:nRead]), fs.OK
-		}
+	size := uint64(n.clipNode.DataLen)
+	if off >= size {
+		return 0, syscall.ENXIO
 	}
 
-	nRead, err := n.filesystem.s.ReadFile(n.clipNode, dest, off)
-	if err != nil {
-		return nil, syscall.EIO
+	switch whence {
+	case unix.SEEK_DATA:
+		return off, fs.OK
+	case unix.SEEK_HOLE:
+		return size, fs.OK
+	default:
+		return 0, syscall.EINVAL
 	}
-
-	return fuse.ReadResultData(dest[:nRead]), fs.OK
 }
 
 func (n *FSNode) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
@@ -200,7 +281,11 @@ func (n *FSNode) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
 func (n *FSNode) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
 	n.log("Readdir called")
 
-	dirEntries := n.filesystem.s.Metadata().ListDirectory(n.clipNode.Path)
+	entries := n.filesystem.dirEntries(n.clipNode)
+	dirEntries := make([]fuse.DirEntry, 0, len(entries))
+	for _, entry := range entries {
+		dirEntries = append(dirEntries, fuse.DirEntry{Name: entry.Name, Mode: entry.Mode, Ino: entry.Ino})
+	}
 	return fs.NewListDirStream(dirEntries), fs.OK
 }
 
@@ -228,3 +313,39 @@ func (n *FSNode) Rename(ctx context.Context, oldName string, newParent fs.InodeE
 	n.log("Rename called with oldName: %s, newName: %s, flags: %v", oldName, newName, flags)
 	return syscall.EROFS
 }
+
+func (n *FSNode) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
+	n.log("Getxattr called with attr: %s", attr)
+
+	value, ok := n.filesystem.xattr(n.clipNode, attr)
+	if !ok {
+		return 0, syscall.ENODATA
+	}
+	if len(dest) < len(value) {
+		return uint32(len(value)), syscall.ERANGE
+	}
+	return uint32(copy(dest, value)), fs.OK
+}
+
+func (n *FSNode) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
+	n.log("Listxattr called")
+
+	var list []byte
+	for _, name := range n.filesystem.xattrs(n.clipNode) {
+		list = append(append(list, name...), 0)
+	}
+	if len(dest) < len(list) {
+		return uint32(len(list)), syscall.ERANGE
+	}
+	return uint32(copy(dest, list)), fs.OK
+}
+
+func (n *FSNode) Setxattr(ctx context.Context, attr string, data []byte, flags uint32) syscall.Errno {
+	n.log("Setxattr called with attr: %s", attr)
+	return syscall.EROFS
+}
+
+func (n *FSNode) Removexattr(ctx context.Context, attr string) syscall.Errno {
+	n.log("Removexattr called with attr: %s", attr)
+	return syscall.EROFS
+}
@@ -0,0 +1,16 @@
+package clipfs
+
+// fuseNodes is empty on Windows, archives are served through vfs.FileSystem there
+type fuseNodes struct{}
+
+func (cfs *ClipFileSystem) initFuseNodes() {}
+
+// InvalidatePath does nothing on Windows, where nothing is cached outside of the filesystem
+func (cfs *ClipFileSystem) InvalidatePath(p string) error {
+	return nil
+}
+
+// InvalidateAll does nothing on Windows, see InvalidatePath
+func (cfs *ClipFileSystem) InvalidateAll() error {
+	return nil
+}
@@ -0,0 +1,90 @@
+//go:build !windows
+
+package clipfs
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+)
+
+// InvalidatePath drops what the kernel has cached for a path relative to the filesystem root:
+// its directory entry, attributes and data. Paths the kernel never looked up are ignored.
+func (cfs *ClipFileSystem) InvalidatePath(p string) error {
+	fullPath := path.Join(cfs.rootNode.Path, p)
+	if fullPath == cfs.rootNode.Path {
+		return cfs.notifyContent(fullPath, cfs.root.EmbeddedInode())
+	}
+
+	cfs.cacheMutex.Lock()
+	entry, found := cfs.lookupCache[fullPath]
+	delete(cfs.lookupCache, fullPath)
+	cfs.cacheMutex.Unlock()
+
+	if !found {
+		return nil
+	}
+
+	if err := cfs.notifyContent(fullPath, entry.inode); err != nil {
+		return err
+	}
+
+	return cfs.notifyEntry(fullPath)
+}
+
+// InvalidateAll drops everything the kernel has cached for the filesystem
+func (cfs *ClipFileSystem) InvalidateAll() error {
+	cfs.cacheMutex.Lock()
+	entries := cfs.lookupCache
+	cfs.lookupCache = make(map[string]*lookupCacheEntry)
+	cfs.cacheMutex.Unlock()
+
+	for p, entry := range entries {
+		if err := cfs.notifyContent(p, entry.inode); err != nil {
+			return err
+		}
+		if err := cfs.notifyEntry(p); err != nil {
+			return err
+		}
+	}
+
+	return cfs.notifyContent(cfs.rootNode.Path, cfs.root.EmbeddedInode())
+}
+
+// notifyContent invalidates the attributes and all cached data of an inode
+func (cfs *ClipFileSystem) notifyContent(p string, inode *fs.Inode) error {
+	return notifyErr("data", p, inode.NotifyContent(0, 0))
+}
+
+// notifyEntry invalidates the directory entry for a path, its parent must be known to the kernel
+func (cfs *ClipFileSystem) notifyEntry(p string) error {
+	dir, name := path.Split(p)
+	dir = strings.TrimSuffix(dir, "/")
+
+	var parent *fs.Inode
+	if dir == strings.TrimSuffix(cfs.rootNode.Path, "/") {
+		parent = cfs.root.EmbeddedInode()
+	} else {
+		cfs.cacheMutex.RLock()
+		entry, found := cfs.lookupCache[dir]
+		cfs.cacheMutex.RUnlock()
+		if !found {
+			// The parent was invalidated as well, which takes its entries with it
+			return nil
+		}
+		parent = entry.inode
+	}
+
+	return notifyErr("entry", p, parent.NotifyEntry(name))
+}
+
+// notifyErr ignores ENOENT, which the kernel returns for inodes and entries it already forgot
+func notifyErr(kind string, p string, errno syscall.Errno) error {
+	if errno == fs.OK || errno == syscall.ENOENT {
+		return nil
+	}
+	return fmt.Errorf("failed to invalidate %s for %s: %v", kind, p, errno)
+}
@@ -0,0 +1,51 @@
+//go:build !windows
+
+package clipfs
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+)
+
+// MultiArchiveRoot is a synthetic directory that exposes several clip filesystems
+// under a single mount, each one rooted at its own prefix
+type MultiArchiveRoot struct {
+	fs.Inode
+	filesystems map[string]*ClipFileSystem
+}
+
+func NewMultiArchiveRoot(filesystems map[string]*ClipFileSystem) *MultiArchiveRoot {
+	return &MultiArchiveRoot{filesystems: filesystems}
+}
+
+func (r *MultiArchiveRoot) OnAdd(ctx context.Context) {
+	// Add archives in a fixed order so the inodes go-fuse generates for intermediate directories are the same on every mount
+	prefixes := make([]string, 0, len(r.filesystems))
+	for prefix := range r.filesystems {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+
+	for _, prefix := range prefixes {
+		cfs := r.filesystems[prefix]
+		components := strings.Split(strings.Trim(prefix, "/"), "/")
+
+		// Create any intermediate directories leading up to the archive root
+		parent := &r.Inode
+		for _, name := range components[:len(components)-1] {
+			child := parent.GetChild(name)
+			if child == nil {
+				child = parent.NewPersistentInode(ctx, &fs.Inode{}, fs.StableAttr{Mode: syscall.S_IFDIR})
+				parent.AddChild(name, child, false)
+			}
+			parent = child
+		}
+
+		archiveRoot := parent.NewPersistentInode(ctx, cfs.root, fs.StableAttr{Mode: syscall.S_IFDIR, Ino: cfs.ino(cfs.rootNode)})
+		parent.AddChild(components[len(components)-1], archiveRoot, false)
+	}
+}
@@ -0,0 +1,127 @@
+package clipfs
+
+import (
+	"fmt"
+	"hash/fnv"
+	"path"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/NilayYadav/clip/pkg/common"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Longest name the kernel passes to a filesystem. Archives built elsewhere can hold longer names,
+// they are listed under an alias that fits and resolves back to the original node.
+const maxNameLength = 255
+
+// Suffix of an alias: "~" followed by 16 hex digits of the name's hash
+const longNameSuffixLength = 17
+
+// entryName returns the name a node is listed under
+func entryName(node *common.ClipNode) string {
+	name := path.Base(node.Path)
+	if len(name) <= maxNameLength {
+		return name
+	}
+
+	hash := fnv.New64a()
+	hash.Write([]byte(name))
+
+	// Cut the prefix on a rune boundary so the alias stays valid UTF-8
+	prefix := name[:maxNameLength-longNameSuffixLength]
+	for len(prefix) > 0 && !utf8.ValidString(prefix) {
+		prefix = prefix[:len(prefix)-1]
+	}
+
+	return fmt.Sprintf("%s~%016x", prefix, hash.Sum64())
+}
+
+// isLongNameAlias reports whether name could be an alias made by entryName
+func isLongNameAlias(name string) bool {
+	if len(name) < longNameSuffixLength || len(name) > maxNameLength {
+		return false
+	}
+	suffix := name[len(name)-longNameSuffixLength:]
+	return suffix[0] == '~' && strings.Trim(suffix[1:], "0123456789abcdef") == ""
+}
+
+// child returns the node named name in the directory dir. Names the archive doesn't hold as given
+// are tried in the other Unicode normalization form if the filesystem normalizes names, ignoring
+// case if it is case insensitive, and as the alias of a name too long to be listed as is.
+func (cfs *ClipFileSystem) child(dir string, name string) *common.ClipNode {
+	metadata := cfs.s.Metadata()
+	if node := metadata.Get(path.Join(dir, name)); node != nil {
+		return node
+	}
+
+	if cfs.normalizeNames {
+		for _, form := range []norm.Form{norm.NFC, norm.NFD} {
+			if normalized := form.String(name); normalized != name {
+				if node := metadata.Get(path.Join(dir, normalized)); node != nil {
+					return node
+				}
+			}
+		}
+	}
+
+	if cfs.foldedIndex != nil {
+		if node, exists := cfs.foldedIndex[cfs.foldKey(path.Join(dir, name))]; exists {
+			return node
+		}
+	}
+
+	if isLongNameAlias(name) {
+		for _, node := range metadata.ListDirectory(dir) {
+			if len(path.Base(node.Path)) > maxNameLength && entryName(node) == name {
+				return node
+			}
+		}
+	}
+
+	return nil
+}
+
+// resolve returns the node for an absolute archive path, resolving each component with child if
+// the path isn't held as given
+func (cfs *ClipFileSystem) resolve(p string) *common.ClipNode {
+	if node := cfs.s.Metadata().Get(p); node != nil {
+		return node
+	}
+
+	dir := "/"
+	var node *common.ClipNode
+	for _, name := range strings.Split(strings.Trim(p, "/"), "/") {
+		if node = cfs.child(dir, name); node == nil {
+			return nil
+		}
+		dir = node.Path
+	}
+	return node
+}
+
+// foldKey returns the key of a path in the casefolded index
+func (cfs *ClipFileSystem) foldKey(p string) string {
+	if cfs.normalizeNames {
+		p = norm.NFC.String(p)
+	}
+	// Casers keep state, so each call gets its own
+	return cases.Fold().String(p)
+}
+
+// buildFoldedIndex maps the casefolded path of every node to the node. When several paths fold
+// to the same key the first one in the archive's order wins, the others stay reachable by their
+// exact name.
+func (cfs *ClipFileSystem) buildFoldedIndex() {
+	index := cfs.s.Metadata().Index
+	cfs.foldedIndex = make(map[string]*common.ClipNode, index.Len())
+	index.Ascend(index.Min(), func(a interface{}) bool {
+		node := a.(*common.ClipNode)
+		key := cfs.foldKey(node.Path)
+		if _, exists := cfs.foldedIndex[key]; !exists {
+			cfs.foldedIndex[key] = node
+		}
+		return true
+	})
+}
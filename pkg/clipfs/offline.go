@@ -0,0 +1,91 @@
+package clipfs
+
+import (
+	"context"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/NilayYadav/clip/pkg/common"
+	"github.com/NilayYadav/clip/pkg/storage"
+)
+
+const (
+	offlineCheckTimeout  = time.Second * 5
+	offlineProbeInterval = time.Second * 5
+)
+
+// readStorage reads content from the archive's storage, decrypting it if the file is encrypted
+func (cfs *ClipFileSystem) readStorage(node *common.ClipNode, dest []byte, off int64) (int, error) {
+	if !node.IsEncrypted() {
+		return cfs.readArchive(node, dest, off)
+	}
+	if cfs.encryptionKey == nil {
+		return 0, common.ErrMissingKey
+	}
+
+	nRead, err := cfs.readArchive(node, dest, off)
+	if err != nil {
+		return nRead, err
+	}
+
+	stream, err := common.NewContentCipher(cfs.encryptionKey, node.IV, off)
+	if err != nil {
+		return 0, err
+	}
+	stream.XORKeyStream(dest[:nRead], dest[:nRead])
+	return nRead, nil
+}
+
+// readArchive reads content as stored in the archive. In offline mode a read that fails because
+// the storage can't be reached takes the filesystem offline: reads that need the storage then fail
+// straight away with common.ErrStorageOffline, while cached content keeps being served, until a
+// background probe finds the storage reachable again.
+func (cfs *ClipFileSystem) readArchive(node *common.ClipNode, dest []byte, off int64) (int, error) {
+	if !cfs.offlineMode {
+		return cfs.s.ReadFile(node, dest, off)
+	}
+
+	if atomic.LoadInt32(&cfs.offline) == 1 {
+		return 0, common.ErrStorageOffline
+	}
+
+	nRead, err := cfs.s.ReadFile(node, dest, off)
+	if err == nil {
+		return nRead, nil
+	}
+
+	// Only go offline if the storage itself is down, not for errors specific to this read
+	if cfs.checkStorage() == nil {
+		return nRead, err
+	}
+
+	if atomic.CompareAndSwapInt32(&cfs.offline, 0, 1) {
+		log.Printf("Storage unreachable, serving cached content only: %v\n", err)
+		go cfs.probeStorage()
+	}
+	return 0, common.ErrStorageOffline
+}
+
+func (cfs *ClipFileSystem) checkStorage() error {
+	ctx, cancel := context.WithTimeout(context.Background(), offlineCheckTimeout)
+	defer cancel()
+	return storage.CheckHealth(ctx, cfs.s)
+}
+
+// probeStorage brings the filesystem back online once the storage can be reached again
+func (cfs *ClipFileSystem) probeStorage() {
+	ticker := time.NewTicker(offlineProbeInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := cfs.checkStorage(); err != nil {
+			cfs.log("storage still unreachable: %v", err)
+			continue
+		}
+
+		atomic.StoreInt32(&cfs.offline, 0)
+		log.Println("Storage reachable again")
+		return
+	}
+}
@@ -0,0 +1,54 @@
+package clipfs
+
+import (
+	"os"
+
+	"github.com/NilayYadav/clip/pkg/common"
+)
+
+// ContentPather can be implemented by content caches that keep content in local files
+type ContentPather interface {
+	ContentPath(key string) (string, bool)
+}
+
+func wholeFileStatusKey(hash string) string {
+	return hash + ":whole"
+}
+
+// localContentPath returns a local file holding exactly the content of node
+func (cfs *ClipFileSystem) localContentPath(node *common.ClipNode) (string, bool) {
+	pather, ok := cfs.contentCache.(ContentPather)
+	if !ok || !cfs.contentCacheAvailable || node.ContentHash == "" {
+		return "", false
+	}
+
+	path, ok := pather.ContentPath(node.ContentHash)
+	if !ok {
+		return "", false
+	}
+
+	if info, err := os.Stat(path); err != nil || info.Size() != node.DataLen {
+		return "", false
+	}
+
+	return path, true
+}
+
+// cacheWholeFile stores a full copy of a file in the content cache, so later opens can pass through to it
+func (cfs *ClipFileSystem) cacheWholeFile(node *common.ClipNode) {
+	if !cfs.contentCacheAvailable || node.ContentHash == "" || node.DataLen == 0 {
+		return
+	}
+
+	key := wholeFileStatusKey(node.ContentHash)
+
+	cfs.cachingStatusMu.Lock()
+	if cfs.cachingStatus[key] {
+		cfs.cachingStatusMu.Unlock()
+		return
+	}
+	cfs.cachingStatus[key] = true
+	cfs.cachingStatusMu.Unlock()
+
+	cfs.cacheEventChan <- cacheEvent{node: node, wholeFile: true}
+}
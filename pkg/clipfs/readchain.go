@@ -0,0 +1,219 @@
+package clipfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/NilayYadav/clip/pkg/cache"
+	"github.com/NilayYadav/clip/pkg/common"
+)
+
+// ReadTier is a source of the read chain, see ClipFileSystemOpts.ReadChain
+type ReadTier struct {
+	Name        string        // For errors and logs, like memory or disk
+	Cache       ContentCache  // Nil for the archive's storage, which must be the last tier
+	Timeout     time.Duration // 0 waits for the tier as long as it takes
+	SkipOnError bool          // Go on to the next tier when this one fails or times out instead of failing the read
+}
+
+// defaultReadChain reads from the content cache, going to storage when it misses or fails
+func defaultReadChain(contentCache ContentCache) []ReadTier {
+	if contentCache == nil {
+		return []ReadTier{{Name: "storage"}}
+	}
+	return []ReadTier{{Name: "cache", Cache: contentCache, SkipOnError: true}, {Name: "storage"}}
+}
+
+// TierStats counts what a tier of the read chain served
+type TierStats struct {
+	Hits   int64 `json:"hits"`
+	Misses int64 `json:"misses"` // Including reads the tier only served part of
+	Errors int64 `json:"errors"` // Failures and timeouts
+	Bytes  int64 `json:"bytes"`  // Served to reads
+}
+
+// ReadStats returns the counters of each tier of the read chain, by tier name
+func (cfs *ClipFileSystem) ReadStats() map[string]TierStats {
+	stats := make(map[string]TierStats, len(cfs.readChain))
+	for i, tier := range cfs.readChain {
+		counters := &cfs.tierStats[i]
+		stats[tier.Name] = TierStats{
+			Hits:   atomic.LoadInt64(&counters.Hits),
+			Misses: atomic.LoadInt64(&counters.Misses),
+			Errors: atomic.LoadInt64(&counters.Errors),
+			Bytes:  atomic.LoadInt64(&counters.Bytes),
+		}
+	}
+	return stats
+}
+
+// ReadsInFlight returns the number of reads of file content being served
+func (cfs *ClipFileSystem) ReadsInFlight() int64 {
+	return atomic.LoadInt64(&cfs.readsInFlight)
+}
+
+func checkReadChain(chain []ReadTier) error {
+	if len(chain) == 0 || chain[len(chain)-1].Cache != nil {
+		return fmt.Errorf("the read chain must end with storage")
+	}
+	for _, tier := range chain[:len(chain)-1] {
+		if tier.Cache == nil {
+			return fmt.Errorf("the read chain must end with storage, %s can't come after it", tier.Name)
+		}
+	}
+	return nil
+}
+
+// readContent reads part of a file, which must lie within the file, from the tiers of the read chain
+// in turn. Each tier reads what the ones before it missed. Cache tiers are skipped for files that
+// don't use the content cache, and while the breaker is open. Content read from storage is cached in
+// the background.
+func (cfs *ClipFileSystem) readContent(node *common.ClipNode, dest []byte, off int64) (int, error) {
+	// Don't even try to read 0 byte files
+	if node.DataLen == 0 || len(dest) == 0 {
+		return 0, nil
+	}
+
+	atomic.AddInt64(&cfs.readsInFlight, 1)
+	defer atomic.AddInt64(&cfs.readsInFlight, -1)
+
+	cached := cfs.usesContentCache(node)
+	checkedBreaker := false
+
+	nRead := 0
+	for i, tier := range cfs.readChain {
+		if tier.Cache != nil {
+			// Switch back to the local filesystem if all content is cached on disk, and skip the cache
+			// while it keeps failing
+			if cached && !checkedBreaker {
+				cached = cfs.cacheBreaker.allow()
+				checkedBreaker = true
+			}
+			if !cached {
+				continue
+			}
+		}
+
+		tier, pos, fill := tier, off+int64(nRead), cached
+		n, err := cfs.readTier(tier, dest[nRead:], func(buf []byte) (int, error) {
+			if tier.Cache != nil {
+				return cfs.readFromCache(tier.Cache, node, buf, pos)
+			}
+			if !fill {
+				return cfs.readStorage(node, buf, pos)
+			}
+			return cfs.readFromStorage(node, buf, pos)
+		})
+		nRead += n
+
+		counters := &cfs.tierStats[i]
+		atomic.AddInt64(&counters.Bytes, int64(n))
+		switch {
+		case err == nil:
+			atomic.AddInt64(&counters.Hits, 1)
+		case errors.Is(err, cache.ErrContentNotFound):
+			atomic.AddInt64(&counters.Misses, 1)
+		default:
+			atomic.AddInt64(&counters.Errors, 1)
+		}
+
+		if err == nil {
+			return nRead, nil
+		}
+		if tier.Cache == nil {
+			return nRead, err
+		}
+		if !errors.Is(err, cache.ErrContentNotFound) {
+			if !tier.SkipOnError {
+				return nRead, err
+			}
+			cfs.log("%s failed reading %s, trying the next tier: %v", tier.Name, node.Path, err)
+		}
+	}
+
+	return nRead, cache.ErrContentNotFound
+}
+
+// readTier reads from a single tier. With a timeout the tier reads into a buffer of its own, so
+// a read that is given up on can't write into dest after readTier has returned.
+func (cfs *ClipFileSystem) readTier(tier ReadTier, dest []byte, read func(buf []byte) (int, error)) (int, error) {
+	if tier.Timeout <= 0 {
+		return read(dest)
+	}
+
+	type result struct {
+		n   int
+		err error
+	}
+	buf := make([]byte, len(dest))
+	done := make(chan result, 1)
+	go func() {
+		n, err := read(buf)
+		done <- result{n, err}
+	}()
+
+	timer := time.NewTimer(tier.Timeout)
+	defer timer.Stop()
+	select {
+	case r := <-done:
+		return copy(dest, buf[:r.n]), r.err
+	case <-timer.C:
+		return 0, fmt.Errorf("%s didn't answer within %v: %w", tier.Name, tier.Timeout, context.DeadlineExceeded)
+	}
+}
+
+// readFromCache reads from a cache tier, block by block when files are cached as blocks. It returns
+// what was read up to the first block the tier misses, with cache.ErrContentNotFound.
+func (cfs *ClipFileSystem) readFromCache(c ContentCache, node *common.ClipNode, dest []byte, off int64) (int, error) {
+	if _, ok := cfs.blockCache(); !ok {
+		content, err := cfs.getContent(c, node.ContentHash, off, int64(len(dest)))
+		if err != nil {
+			return 0, err
+		}
+		return copy(dest, content), nil
+	}
+
+	nRead := 0
+	for nRead < len(dest) {
+		pos := off + int64(nRead)
+		idx := pos / cfs.blockSize
+		blockOff := pos - idx*cfs.blockSize
+
+		length := cfs.blockSize - blockOff
+		if remaining := int64(len(dest) - nRead); remaining < length {
+			length = remaining
+		}
+
+		content, err := cfs.getContent(c, blockKey(node.ContentHash, idx), blockOff, length)
+		if err != nil {
+			return nRead, err
+		}
+		if int64(len(content)) != length {
+			return nRead, cache.ErrContentNotFound
+		}
+		nRead += copy(dest[nRead:], content)
+	}
+	return nRead, nil
+}
+
+// readFromStorage reads from storage, caching what was read in the background: the blocks it lies in
+// when the cache supports them, the whole file otherwise
+func (cfs *ClipFileSystem) readFromStorage(node *common.ClipNode, dest []byte, off int64) (int, error) {
+	// Cache only the blocks touched by reads when the cache can store them
+	if cache, ok := cfs.blockCache(); ok {
+		return cfs.readBlocks(cache, node, dest, off)
+	}
+
+	// Cache miss - read from the underlying source and store the entire file in the cache
+	nRead, err := cfs.readStorage(node, dest, off)
+	if err != nil {
+		return 0, err
+	}
+
+	go cfs.CacheFile(node)
+
+	return nRead, nil
+}
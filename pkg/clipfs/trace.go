@@ -0,0 +1,42 @@
+package clipfs
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/NilayYadav/clip/pkg/common"
+)
+
+// TraceRecorder appends every read served by a filesystem to a trace file, see common.TraceEntry
+type TraceRecorder struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+func NewTraceRecorder(path string) (*TraceRecorder, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create trace file: %v", err)
+	}
+	return &TraceRecorder{f: f}, nil
+}
+
+// Record adds a read to the trace, it does nothing on a nil recorder
+func (t *TraceRecorder) Record(path string, offset int64, length int64) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// Written straight to the file so the trace survives the mount being killed
+	fmt.Fprintln(t.f, common.TraceEntry{Path: path, Offset: offset, Length: length})
+}
+
+func (t *TraceRecorder) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.f.Close()
+}
@@ -0,0 +1,96 @@
+package clipfs
+
+import (
+	"path"
+	"time"
+
+	"github.com/NilayYadav/clip/pkg/common"
+	"github.com/NilayYadav/clip/pkg/vfs"
+)
+
+// ClipFileSystem implements vfs.FileSystem to serve frontends other than go-fuse,
+// with the same content caching as the go-fuse nodes
+
+// node returns the archive node for a path relative to the filesystem root
+func (cfs *ClipFileSystem) node(p string) (*common.ClipNode, error) {
+	node := cfs.resolve(path.Join(cfs.rootNode.Path, p))
+	if node == nil {
+		return nil, vfs.ErrNotExist
+	}
+	return node, nil
+}
+
+func (cfs *ClipFileSystem) Stat(p string) (vfs.Attr, error) {
+	node, err := cfs.node(p)
+	if err != nil {
+		return vfs.Attr{}, err
+	}
+
+	return vfs.Attr{
+		Ino:    cfs.ino(node),
+		Size:   node.Attr.Size,
+		Blocks: node.Attr.Blocks,
+		Mode:   node.Attr.Mode,
+		Nlink:  node.Attr.Nlink,
+		Uid:    node.Attr.Uid,
+		Gid:    node.Attr.Gid,
+		Rdev:   node.Attr.Rdev,
+		Atime:  time.Unix(int64(node.Attr.Atime), int64(node.Attr.Atimensec)),
+		Mtime:  time.Unix(int64(node.Attr.Mtime), int64(node.Attr.Mtimensec)),
+		Ctime:  time.Unix(int64(node.Attr.Ctime), int64(node.Attr.Ctimensec)),
+	}, nil
+}
+
+func (cfs *ClipFileSystem) ReadDir(p string) ([]vfs.DirEntry, error) {
+	node, err := cfs.node(p)
+	if err != nil {
+		return nil, err
+	}
+	if !node.IsDir() {
+		return nil, vfs.ErrNotDir
+	}
+
+	return cfs.dirEntries(node), nil
+}
+
+func (cfs *ClipFileSystem) dirEntries(dir *common.ClipNode) []vfs.DirEntry {
+	children := cfs.s.Metadata().ListDirectory(dir.Path)
+
+	entries := make([]vfs.DirEntry, 0, len(children))
+	for _, child := range children {
+		entries = append(entries, vfs.DirEntry{Name: entryName(child), Mode: child.Attr.Mode, Ino: cfs.ino(child)})
+	}
+
+	return entries
+}
+
+func (cfs *ClipFileSystem) Readlink(p string) (string, error) {
+	node, err := cfs.node(p)
+	if err != nil {
+		return "", err
+	}
+	if !node.IsSymlink() {
+		return "", vfs.ErrNotSymlink
+	}
+
+	return node.Target, nil
+}
+
+// ReadFile reads part of a file, reads past its end are short or empty
+func (cfs *ClipFileSystem) ReadFile(p string, dest []byte, off int64) (int, error) {
+	node, err := cfs.node(p)
+	if err != nil {
+		return 0, err
+	}
+	if node.IsDir() {
+		return 0, vfs.ErrIsDir
+	}
+
+	nRead, err := cfs.readContent(node, cfs.readRange(node, dest, off), off)
+	if err != nil {
+		cfs.log("err reading %s: %v", node.Path, err)
+		return nRead, vfs.ErrUnavailable
+	}
+
+	return nRead, nil
+}
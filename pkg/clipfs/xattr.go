@@ -0,0 +1,105 @@
+package clipfs
+
+import (
+	"sort"
+
+	"github.com/NilayYadav/clip/pkg/common"
+)
+
+// Virtual extended attributes, answered from the metadata of the archive
+const (
+	xattrSHA256 = "user.clip.sha256" // Hex encoded sha256 of the content, for files that were hashed
+	xattrCached = "user.clip.cached" // How much of the content is readable without storage, see cacheStatus
+)
+
+const (
+	cacheStatusNone    = "none"
+	cacheStatusPartial = "partial"
+	cacheStatusFull    = "full"
+)
+
+// xattrs returns the names of the extended attributes of a node, the virtual ones and those stored in
+// the archive
+func (cfs *ClipFileSystem) xattrs(node *common.ClipNode) []string {
+	var names []string
+	for name := range node.Xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	if node.NodeType != common.FileNode {
+		return names
+	}
+	names = append(names, xattrCached)
+	if node.ContentHash != "" {
+		names = append(names, xattrSHA256)
+	}
+	return names
+}
+
+// StoresXattrs reports whether any file of the archive has extended attributes of its own, like
+// the capabilities kept by root filesystem imports
+func (cfs *ClipFileSystem) StoresXattrs() bool {
+	return cfs.storesXattrs
+}
+
+func hasXattrs(metadata *common.ClipArchiveMetadata) bool {
+	found := false
+	metadata.Index.Ascend(metadata.Index.Min(), func(a interface{}) bool {
+		found = len(a.(*common.ClipNode).Xattrs) > 0
+		return !found
+	})
+	return found
+}
+
+// xattr returns the value of an extended attribute of a node
+func (cfs *ClipFileSystem) xattr(node *common.ClipNode, name string) ([]byte, bool) {
+	if value, ok := node.Xattrs[name]; ok {
+		return value, true
+	}
+
+	switch name {
+	case xattrSHA256:
+		if node.NodeType == common.FileNode && node.ContentHash != "" {
+			return []byte(node.ContentHash), true
+		}
+	case xattrCached:
+		if node.NodeType == common.FileNode {
+			return []byte(cfs.cacheStatus(node)), true
+		}
+	}
+	return nil, false
+}
+
+// cacheStatus tells whether the content of a file can be read without going to storage: in full,
+// in part when only some of its blocks are cached, or not at all
+func (cfs *ClipFileSystem) cacheStatus(node *common.ClipNode) string {
+	if node.DataLen == 0 || cfs.s.CachedLocally() {
+		return cacheStatusFull
+	}
+	if !cfs.usesContentCache(node) {
+		return cacheStatusNone
+	}
+	if _, err := cfs.contentCache.GetContent(node.ContentHash, 0, 1); err == nil {
+		return cacheStatusFull // Cached as a whole
+	}
+
+	cache, ok := cfs.blockCache()
+	if !ok {
+		return cacheStatusNone
+	}
+	cached, blocks := 0, 0
+	for idx := int64(0); idx*cfs.blockSize < node.DataLen; idx++ {
+		if _, err := cache.GetContent(blockKey(node.ContentHash, idx), 0, 1); err == nil {
+			cached++
+		}
+		blocks++
+	}
+	switch cached {
+	case 0:
+		return cacheStatusNone
+	case blocks:
+		return cacheStatusFull
+	}
+	return cacheStatusPartial
+}
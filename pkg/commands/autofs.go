@@ -0,0 +1,79 @@
+//go:build !windows
+
+package commands
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/okteto/okteto/pkg/log"
+	"github.com/spf13/cobra"
+)
+
+// Archive extensions autofs keys are looked up with, in order
+var autofsExtensions = []string{".rclip", ".clip", ".tar.gz", ".tgz", ".tar"}
+
+var autofsDir string
+var autofsOptions string
+
+var AutofsCmd = &cobra.Command{
+	Use:   "autofs <key>",
+	Short: "Print the autofs map entry mounting the archive named key, as autofs program map",
+	Long: "Print the autofs map entry mounting the archive named key, as autofs program map, so archives are mounted with " +
+		"mount.clip on first access and unmounted once idle. With /etc/auto.clip a link to clip-autofs and the archives, " +
+		"or RCLIPs of archives in remote storage, in /var/lib/clip/archives, /etc/auto.master holds:\n\n" +
+		"  /mnt/clips  program:/etc/auto.clip  --timeout=300\n\n" +
+		"and /etc/clip/config.yaml:\n\n" +
+		"  commands:\n" +
+		"    autofs:\n" +
+		"      dir: /var/lib/clip/archives\n" +
+		"      options: cache=/var/cache/clip\n\n" +
+		"Then /mnt/clips/app mounts app.rclip, or app.clip, until it's left unused for 5 minutes.",
+	Args: cobra.ExactArgs(1),
+	RunE: runAutofs,
+}
+
+func init() {
+	AutofsCmd.Flags().StringVar(&autofsDir, "dir", "", "Directory holding the archives, or RCLIPs of archives in remote storage, named after their keys")
+	AutofsCmd.Flags().StringVar(&autofsOptions, "options", "", "Comma separated mount.clip options of every archive, like cache=/var/cache/clip")
+}
+
+func runAutofs(cmd *cobra.Command, args []string) error {
+	// autofs reads the entry from standard output, and takes anything printed there for one
+	log.SetOutput(os.Stderr)
+
+	if autofsDir == "" {
+		return fmt.Errorf("--dir must be provided")
+	}
+	entry, err := autofsEntry(autofsDir, args[0], autofsOptions)
+	if err != nil {
+		return err
+	}
+	fmt.Println(entry)
+	return nil
+}
+
+// autofsEntry returns the map entry of the archive named key in dir. Keys are a single name, so
+// lookups can't leave dir, and autofs takes a failure for a key that doesn't exist.
+func autofsEntry(dir string, key string, options string) (string, error) {
+	if key == "" || key != filepath.Base(key) || strings.HasPrefix(key, ".") || strings.ContainsAny(key, " \t\n\\,:") {
+		return "", fmt.Errorf("invalid key %q", key)
+	}
+
+	for _, ext := range autofsExtensions {
+		archivePath := filepath.Join(dir, key+ext)
+		if info, err := os.Stat(archivePath); err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+
+		mountOptions := "-fstype=clip,ro"
+		if options != "" {
+			mountOptions += "," + options
+		}
+		// The leading colon tells autofs the location is a path rather than host:path
+		return mountOptions + " :" + archivePath, nil
+	}
+	return "", fmt.Errorf("no archive named %s in %s", key, dir)
+}
@@ -0,0 +1,59 @@
+//go:build !windows
+
+package commands
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/NilayYadav/clip/pkg/clip"
+	"github.com/NilayYadav/clip/pkg/common"
+	"github.com/NilayYadav/clip/pkg/storage"
+	"github.com/spf13/cobra"
+)
+
+var benchOpts = &clip.BenchOptions{}
+var benchTLS = &common.TLSFiles{}
+var benchS3 = &storage.S3ClipStorageCredentials{}
+var benchProxy = &storage.ProxyConfig{}
+
+var BenchCmd = &cobra.Command{
+	Use:   "bench",
+	Short: "Mount an archive and measure its read throughput and metadata performance, as JSON",
+	RunE:  runBench,
+}
+
+func init() {
+	mount := &benchOpts.Mount
+	BenchCmd.Flags().StringVarP(&mount.ArchivePath, "input", "i", "", "Archive file to benchmark, or a location like s3://bucket/key")
+	BenchCmd.Flags().StringVarP(&mount.CachePath, "cache", "c", "", "Cache clip locally")
+	BenchCmd.Flags().Int64Var(&mount.MemoryCacheSize, "memory-cache-size", 0, "Bytes of file content to cache in memory (0 = disabled)")
+	BenchCmd.Flags().StringVar(&mount.DiskCacheDir, "disk-cache-dir", "", "Directory to cache file content in on local disk, use an empty one for cold numbers")
+	BenchCmd.Flags().Int64Var(&mount.DiskCacheSize, "disk-cache-size", 1<<30, "Bytes of file content to cache on local disk")
+	BenchCmd.Flags().Int64Var(&mount.CacheBlockSize, "cache-block-size", 1<<20, "Size of the blocks file content is cached in")
+	BenchCmd.Flags().DurationVar(&mount.ReadCoalesceWindow, "read-coalesce-window", 0, "Batch nearby small remote reads arriving within this window into one request (0 = disabled)")
+	BenchCmd.Flags().IntVar(&benchOpts.MaxFiles, "max-files", 0, "Read at most this many files in the sequential passes (0 = all)")
+	BenchCmd.Flags().IntVar(&benchOpts.RandomReads, "random-reads", 1000, "Number of reads at random offsets in each random pass")
+	BenchCmd.Flags().IntVar(&benchOpts.ReadSize, "read-size", 4096, "Size of each random read")
+	BenchCmd.Flags().Int64Var(&benchOpts.Seed, "seed", 1, "Seed for the random reads, runs with the same seed read the same ranges")
+	addTLSFlags(BenchCmd.Flags(), benchTLS)
+	addS3Flags(BenchCmd.Flags(), benchS3)
+	addProxyFlags(BenchCmd.Flags(), benchProxy)
+	BenchCmd.Flags().StringVar(&benchS3.Endpoint, "s3-endpoint", "", "Reach S3 at this endpoint instead of the one stored in the archive")
+	BenchCmd.MarkFlagRequired("input")
+}
+
+func runBench(cmd *cobra.Command, args []string) error {
+	benchOpts.Mount.Credentials.HTTP = httpCredentials(benchTLS)
+	benchOpts.Mount.Credentials.S3 = s3Credentials(benchS3)
+	benchOpts.Mount.Credentials.Proxy = proxyConfig(benchProxy)
+
+	result, err := clip.Bench(*benchOpts)
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(result)
+}
@@ -0,0 +1,158 @@
+package commands
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+// configFile holds flag values, keyed by flag name, for commands to use when they aren't given on the
+// command line. Archive overrides win over the command's section, which wins over the defaults:
+//
+//	defaults:
+//	  disk-cache-dir: /var/cache/clip
+//	  s3-profile: prod
+//	commands:
+//	  mount:
+//	    memory-cache-size: 268435456
+//	  daemon start:
+//	    max-concurrent-requests: 64
+//	archives:
+//	  s3://images/app-*.clip:
+//	    subpath: app
+//	    encryption-key: /etc/clip/app.key
+type configFile struct {
+	Defaults map[string]interface{}            `yaml:"defaults" toml:"defaults"` // For every command with the flag
+	Commands map[string]map[string]interface{} `yaml:"commands" toml:"commands"` // By command, like "mount" or "store s3"
+	Archives map[string]map[string]interface{} `yaml:"archives" toml:"archives"` // By archive path or glob, for commands given a matching archive
+}
+
+var configPath string
+
+// defaultConfigPaths are tried in turn without --config, the first one found is used
+func defaultConfigPaths() []string {
+	var paths []string
+	if dir, err := os.UserConfigDir(); err == nil {
+		for _, name := range []string{"config.yaml", "config.yml", "config.toml"} {
+			paths = append(paths, filepath.Join(dir, "clip", name))
+		}
+	}
+	for _, name := range []string{"config.yaml", "config.yml", "config.toml"} {
+		paths = append(paths, filepath.Join("/etc/clip", name))
+	}
+	return paths
+}
+
+// loadConfig returns nil without an explicit or default config file
+func loadConfig() (*configFile, error) {
+	name := configPath
+	if name == "" {
+		for _, p := range defaultConfigPaths() {
+			if _, err := os.Stat(p); err == nil {
+				name = p
+				break
+			}
+		}
+		if name == "" {
+			return nil, nil
+		}
+	}
+
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %v", err)
+	}
+
+	config := &configFile{}
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".toml":
+		err = toml.Unmarshal(data, config)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, config)
+	default:
+		return nil, fmt.Errorf("config file %s must end in .yaml, .yml or .toml", name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %v", name, err)
+	}
+	return config, nil
+}
+
+// apply sets the flags of cmd that weren't given, most specific section first so it wins
+func (c *configFile) apply(cmd *cobra.Command, args []string) error {
+	flags := cmd.Flags()
+	archives := append([]string(nil), args...)
+	if input := flags.Lookup("input"); input != nil && input.Value.String() != "" {
+		archives = append(archives, input.Value.String())
+	}
+
+	// Sorted, so overlapping patterns apply in the same order every time
+	patterns := make([]string, 0, len(c.Archives))
+	for pattern := range c.Archives {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+	for _, pattern := range patterns {
+		for _, archive := range archives {
+			if matched, _ := path.Match(pattern, archive); matched || pattern == archive {
+				// The same overrides serve different commands, flags a command lacks are left out
+				if err := setFlags(flags, c.Archives[pattern], false); err != nil {
+					return fmt.Errorf("config for archive %s: %v", pattern, err)
+				}
+				break
+			}
+		}
+	}
+
+	name := strings.TrimPrefix(cmd.CommandPath(), cmd.Root().Name()+" ")
+	if values, ok := c.Commands[name]; ok {
+		if err := setFlags(flags, values, true); err != nil {
+			return fmt.Errorf("config for %s: %v", name, err)
+		}
+	}
+
+	if err := setFlags(flags, c.Defaults, false); err != nil {
+		return fmt.Errorf("config defaults: %v", err)
+	}
+	return nil
+}
+
+// setFlags sets flags that haven't been set yet, lists set repeatable flags once per item. With strict,
+// values for flags that don't exist are an error.
+func setFlags(flags *pflag.FlagSet, values map[string]interface{}, strict bool) error {
+	for name, value := range values {
+		flag := flags.Lookup(name)
+		if flag == nil {
+			if strict {
+				return fmt.Errorf("unknown flag %s", name)
+			}
+			continue
+		}
+		if flag.Changed || name == "config" {
+			continue
+		}
+
+		items, ok := value.([]interface{})
+		if !ok {
+			items = []interface{}{value}
+		}
+		for _, item := range items {
+			switch item.(type) {
+			case map[string]interface{}, []interface{}:
+				return fmt.Errorf("flag %s takes a value or a list of values", name)
+			}
+			if err := flags.Set(name, fmt.Sprint(item)); err != nil {
+				return fmt.Errorf("flag %s: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
@@ -1,25 +1,174 @@
 package commands
 
 import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/NilayYadav/clip/pkg/archive"
 	"github.com/NilayYadav/clip/pkg/clip"
+	"github.com/NilayYadav/clip/pkg/common"
+	"github.com/NilayYadav/clip/pkg/storage"
 	"github.com/spf13/cobra"
 )
 
 var createOpts = &clip.CreateOptions{}
+var createKeyFile string
+var createResume bool
+var createContentAddressed bool
+var createStorage = &storageFlags{}
+var createImageConfig string
+var createLabels []string
 
 var CreateCmd = &cobra.Command{
-	Use:   "create",
+	Use:   "create [output]",
 	Short: "Create an archive from the specified path",
+	Args:  cobra.MaximumNArgs(1),
 	RunE:  runCreate,
 }
 
 func init() {
 	CreateCmd.Flags().StringVarP(&createOpts.InputPath, "input", "i", "", "Input directory to archive")
-	CreateCmd.Flags().StringVarP(&createOpts.OutputPath, "output", "o", "test.clip", "Output file for the archive")
+	CreateCmd.Flags().StringVarP(&createOpts.OutputPath, "output", "o", "test.clip", "Output file for the archive, or a location like s3://bucket/key to upload it to")
 	CreateCmd.Flags().BoolVarP(&createOpts.Verbose, "verbose", "v", false, "Verbose output")
-	CreateCmd.MarkFlagRequired("input")
+	CreateCmd.Flags().StringArrayVar(&createOpts.PrefetchPaths, "prefetch", nil, "File or glob pattern, relative to the input directory, to prefetch on mount (repeatable)")
+	CreateCmd.Flags().BoolVar(&createOpts.PrefetchAuto, "prefetch-auto", false, "Prefetch files known to be read on startup, like the python standard library modules imported by site")
+	CreateCmd.Flags().StringArrayVar(&createOpts.EncryptPaths, "encrypt", nil, "Glob pattern of files to encrypt, like /secrets/** or *.pem (repeatable)")
+	CreateCmd.Flags().StringVar(&createKeyFile, "encryption-key", "", "File holding the 32 byte key to encrypt files with, raw or hex encoded")
+	CreateCmd.Flags().StringVar(&createOpts.ManifestPath, "manifest", "", "File listing absolute source paths and their paths in the archive, one pair per line, instead of --input")
+	CreateCmd.Flags().StringVar(&createOpts.ZipPath, "from-zip", "", "Zip file to archive the entries of, with their unix modes if it has them, instead of --input")
+	CreateCmd.Flags().StringVar(&createOpts.SquashFSPath, "from-squashfs", "", "SquashFS image (gzip or zstd compressed) to archive the tree of, instead of --input")
+	CreateCmd.Flags().StringVar(&createOpts.TarPath, "from-tar", "", "Tar or tar.gz to stream into the archive without extracting it, - for standard input, instead of --input")
+	CreateCmd.Flags().BoolVar(&createOpts.Rootfs, "rootfs", false, "The --from-tar tar is a container root filesystem, like docker export writes: keep devices, setuid bits and xattrs, and leave out /proc and /sys")
+	CreateCmd.Flags().StringVar(&createImageConfig, "image-config", "", "Image config, like docker inspect prints, whose entrypoint, command, environment, working directory and user are stored as labels")
+	CreateCmd.Flags().StringArrayVar(&createLabels, "label", nil, "Label stored in the archive, as key=value (repeatable)")
+	CreateCmd.Flags().BoolVar(&createOpts.SkipHashing, "skip-hashing", false, "Don't hash file contents: faster, but files aren't deduplicated or kept in content caches when mounted")
+	CreateCmd.Flags().BoolVar(&createOpts.SearchIndex, "search-index", false, "Index the trigrams of text files in the archive, so clip grep reads only the files that may match")
+	CreateCmd.Flags().BoolVar(&createOpts.ContentTypes, "content-types", false, "Sniff the MIME type of each file and store it in the metadata, as shown by clip ls --json")
+	CreateCmd.Flags().BoolVar(&createContentAddressed, "content-addressed", false, "Name the archive <sha256>.clip after its digest, in the --output directory (default .), and print the digest")
+	CreateCmd.Flags().BoolVar(&createResume, "resume", false, "Save progress to <output>.checkpoint and resume from it if an earlier run was interrupted")
+	CreateCmd.Flags().StringVar(&createOpts.RCLIPPath, "rclip", "", "RCLIP written for an archive uploaded to remote storage (defaults to its name with an .rclip extension)")
+	CreateCmd.Flags().StringVar(&createOpts.ChunkManifestPath, "chunk-manifest", "", "Also write a JSON manifest of the archive's chunks, their digests, offsets and URLs, for CDNs")
+	CreateCmd.Flags().Int64Var(&createOpts.ChunkSize, "chunk-size", 0, "Size of the chunks in --chunk-manifest (default 4MiB)")
+	CreateCmd.Flags().StringVar(&createOpts.ChunkURL, "chunk-url", "", "URL the archive is served from, listed in --chunk-manifest (defaults to its remote storage URL)")
+	addStorageFlags(CreateCmd.Flags(), createStorage)
+	CreateCmd.Flags().BoolVar(&createOpts.Reproducible, "reproducible", false, "Give the same tree a byte identical archive: timestamps set to $SOURCE_DATE_EPOCH or 0, files owned by root")
+	CreateCmd.MarkFlagsMutuallyExclusive("input", "manifest", "from-zip", "from-squashfs", "from-tar")
 }
 
 func runCreate(cmd *cobra.Command, args []string) error {
-	return clip.CreateArchive(*createOpts)
+	if createOpts.InputPath == "" && createOpts.ManifestPath == "" && createOpts.ZipPath == "" && createOpts.SquashFSPath == "" && createOpts.TarPath == "" {
+		return fmt.Errorf("either --input, --manifest, --from-zip, --from-squashfs or --from-tar must be provided")
+	}
+	outputGiven := cmd.Flags().Changed("output")
+	if len(args) == 1 {
+		if outputGiven {
+			return fmt.Errorf("the output was given both as an argument and with --output")
+		}
+		createOpts.OutputPath, outputGiven = args[0], true
+	}
+	if len(createOpts.EncryptPaths) > 0 && createKeyFile == "" {
+		return fmt.Errorf("--encrypt needs --encryption-key")
+	}
+	if createOpts.Rootfs && createOpts.TarPath == "" {
+		return fmt.Errorf("--rootfs needs --from-tar")
+	}
+	labels, err := createLabelsFrom(createLabels, createImageConfig)
+	if err != nil {
+		return err
+	}
+	createOpts.Labels = labels
+
+	key, err := encryptionKey(createKeyFile)
+	if err != nil {
+		return err
+	}
+	createOpts.EncryptionKey = key
+	createOpts.Credentials = createStorage.credentials()
+
+	if epoch := os.Getenv("SOURCE_DATE_EPOCH"); epoch != "" && createOpts.Reproducible {
+		if createOpts.SourceDateEpoch, err = strconv.ParseInt(epoch, 10, 64); err != nil {
+			return fmt.Errorf("invalid SOURCE_DATE_EPOCH %q: %v", epoch, err)
+		}
+	}
+
+	if createResume {
+		createOpts.CheckpointPath = createOpts.OutputPath + ".checkpoint"
+	}
+
+	start := time.Now()
+	if createContentAddressed {
+		if !outputGiven {
+			createOpts.OutputPath = "."
+		}
+		digest, err := clip.CreateContentAddressedArchive(*createOpts)
+		if err != nil {
+			return err
+		}
+		if !outputJSON {
+			fmt.Println(digest)
+			return nil
+		}
+		archivePath := filepath.Join(createOpts.OutputPath, archive.ContentAddressedName(digest))
+		info, err := os.Stat(archivePath)
+		if err != nil {
+			return err
+		}
+		return printJSON(createResult{Archive: archivePath, Digest: digest, Size: info.Size(), DurationMs: since(start)})
+	}
+
+	if err := clip.CreateArchive(*createOpts); err != nil {
+		return err
+	}
+	if !outputJSON {
+		return nil
+	}
+
+	info, archivePath, err := storage.ParseLocation(createOpts.OutputPath)
+	if err != nil {
+		return err
+	}
+	if info != nil {
+		return printJSON(createResult{Location: createOpts.OutputPath, RCLIP: clip.RCLIPPath(*createOpts), DurationMs: since(start)})
+	}
+	size, digest, err := archiveDigest(archivePath)
+	if err != nil {
+		return err
+	}
+	return printJSON(createResult{Archive: archivePath, Digest: digest, Size: size, DurationMs: since(start)})
+}
+
+// encryptionKey loads the key in a --encryption-key file, if one was given
+func encryptionKey(name string) ([]byte, error) {
+	if name == "" {
+		return nil, nil
+	}
+	return common.LoadEncryptionKey(name)
+}
+
+// createLabelsFrom parses --label flags and adds the labels of an --image-config file, if one was given
+func createLabelsFrom(flags []string, imageConfig string) (map[string]string, error) {
+	var labels map[string]string
+	for _, flag := range flags {
+		key, value, ok := strings.Cut(flag, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid label %q, expected key=value", flag)
+		}
+		if labels == nil {
+			labels = make(map[string]string)
+		}
+		labels[key] = value
+	}
+	if imageConfig == "" {
+		return labels, nil
+	}
+
+	config, err := archive.LoadImageConfig(imageConfig)
+	if err != nil {
+		return nil, err
+	}
+	return config.AddLabels(labels)
 }
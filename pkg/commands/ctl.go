@@ -0,0 +1,138 @@
+//go:build !windows
+
+package commands
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/NilayYadav/clip/pkg/clip"
+	log "github.com/okteto/okteto/pkg/log"
+	"github.com/spf13/cobra"
+)
+
+var CtlCmd = &cobra.Command{
+	Use:   "ctl",
+	Short: "Manage a running mount through its control socket, see mount --control-socket",
+}
+
+var CtlStatsCmd = &cobra.Command{
+	Use:   "stats",
+	Short: "Print the remote reads, cache size and pending cache fills of the mount, as JSON",
+	Args:  cobra.NoArgs,
+	RunE:  runCtlStats,
+}
+
+var CtlFlushCmd = &cobra.Command{
+	Use:   "flush",
+	Short: "Drop the local content cache of the mount and what the kernel cached",
+	Args:  cobra.NoArgs,
+	RunE:  runCtlFlush,
+}
+
+var CtlLogLevelCmd = &cobra.Command{
+	Use:   "log-level <debug|info>",
+	Short: "Start or stop logging every operation of the mount",
+	Args:  cobra.ExactArgs(1),
+	RunE:  runCtlLogLevel,
+}
+
+var CtlPrefetchCmd = &cobra.Command{
+	Use:   "prefetch [path...]",
+	Short: "Cache files of the mount in the background, paths are relative to the mount point and directories bring everything under them",
+	RunE:  runCtlPrefetch,
+}
+
+var CtlHydrateCmd = &cobra.Command{
+	Use:   "hydrate",
+	Short: "Cache every file of the mount in the background",
+	Args:  cobra.NoArgs,
+	RunE:  runCtlHydrate,
+}
+
+var ctlSocketPath string
+var ctlPathsFile string
+
+func init() {
+	CtlCmd.AddCommand(CtlStatsCmd, CtlFlushCmd, CtlLogLevelCmd, CtlPrefetchCmd, CtlHydrateCmd)
+	CtlCmd.PersistentFlags().StringVarP(&ctlSocketPath, "socket", "s", "", "Control socket of the mount")
+	CtlCmd.MarkPersistentFlagRequired("socket")
+
+	CtlPrefetchCmd.Flags().StringVar(&ctlPathsFile, "from", "", "File listing paths to prefetch, one per line, - for stdin")
+}
+
+func runCtlStats(cmd *cobra.Command, args []string) error {
+	stats, err := clip.NewControlClient(ctlSocketPath).Stats()
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(stats)
+}
+
+func runCtlFlush(cmd *cobra.Command, args []string) error {
+	if err := clip.NewControlClient(ctlSocketPath).Flush(); err != nil {
+		return err
+	}
+	log.Success("Caches flushed.")
+	return nil
+}
+
+func runCtlLogLevel(cmd *cobra.Command, args []string) error {
+	return clip.NewControlClient(ctlSocketPath).SetLogLevel(args[0])
+}
+
+func runCtlPrefetch(cmd *cobra.Command, args []string) error {
+	paths := args
+	if ctlPathsFile != "" {
+		listed, err := readPathList(ctlPathsFile)
+		if err != nil {
+			return err
+		}
+		paths = append(paths, listed...)
+	}
+	if len(paths) == 0 {
+		return fmt.Errorf("no paths to prefetch, give them as arguments or with --from")
+	}
+
+	files, err := clip.NewControlClient(ctlSocketPath).Prefetch(paths)
+	if err != nil {
+		return err
+	}
+	log.Success(fmt.Sprintf("Prefetching %d files.", files))
+	return nil
+}
+
+func runCtlHydrate(cmd *cobra.Command, args []string) error {
+	files, err := clip.NewControlClient(ctlSocketPath).Hydrate()
+	if err != nil {
+		return err
+	}
+	log.Success(fmt.Sprintf("Hydrating %d files.", files))
+	return nil
+}
+
+// readPathList reads a path per line, skipping blank lines
+func readPathList(name string) ([]string, error) {
+	f := os.Stdin
+	if name != "-" {
+		var err error
+		if f, err = os.Open(name); err != nil {
+			return nil, err
+		}
+		defer f.Close()
+	}
+
+	var paths []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if p := strings.TrimSpace(scanner.Text()); p != "" {
+			paths = append(paths, p)
+		}
+	}
+	return paths, scanner.Err()
+}
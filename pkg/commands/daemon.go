@@ -0,0 +1,209 @@
+//go:build !windows
+
+package commands
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/NilayYadav/clip/pkg/clip"
+	"github.com/NilayYadav/clip/pkg/clipd"
+	"github.com/NilayYadav/clip/pkg/common"
+	"github.com/NilayYadav/clip/pkg/storage"
+	log "github.com/okteto/okteto/pkg/log"
+	"github.com/spf13/cobra"
+)
+
+var DaemonCmd = &cobra.Command{
+	Use:   "daemon",
+	Short: "Run clipd, which owns the mounts on this host, or ask it for mounts",
+}
+
+var DaemonStartCmd = &cobra.Command{
+	Use:   "start",
+	Short: "Run the daemon in the foreground",
+	RunE:  runDaemonStart,
+}
+
+var DaemonMountCmd = &cobra.Command{
+	Use:   "mount",
+	Short: "Ask the daemon to mount an archive",
+	RunE:  runDaemonMount,
+}
+
+var DaemonUnmountCmd = &cobra.Command{
+	Use:   "unmount",
+	Short: "Ask the daemon to unmount an archive",
+	RunE:  runDaemonUnmount,
+}
+
+var DaemonListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the daemon's mounts",
+	RunE:  runDaemonList,
+}
+
+var daemonOpts = &clipd.DaemonOptions{}
+var daemonMountReq = &clipd.MountRequest{}
+var daemonSocketPath string
+var daemonAddr string
+var daemonTenantsFile string
+var daemonTunablesFile string
+var daemonStartTLS = &common.TLSFiles{}
+var daemonClientTLS = &common.TLSFiles{}
+var daemonS3 = &storage.S3ClipStorageCredentials{}
+var daemonProxy = &storage.ProxyConfig{}
+
+func init() {
+	DaemonCmd.AddCommand(DaemonStartCmd, DaemonMountCmd, DaemonUnmountCmd, DaemonListCmd)
+	DaemonCmd.PersistentFlags().StringVar(&daemonSocketPath, "socket", clipd.DefaultSocketPath, "Unix socket the daemon listens on")
+
+	DaemonStartCmd.Flags().BoolVarP(&daemonOpts.Verbose, "verbose", "v", false, "Verbose output")
+	DaemonStartCmd.Flags().Int64Var(&daemonOpts.MemoryCacheSize, "memory-cache-size", 0, "Bytes of file content to cache in memory for all mounts (0 = disabled)")
+	DaemonStartCmd.Flags().StringVar(&daemonOpts.DiskCacheDir, "disk-cache-dir", "", "Directory to cache file content in on local disk for all mounts")
+	DaemonStartCmd.Flags().Int64Var(&daemonOpts.DiskCacheSize, "disk-cache-size", 1<<30, "Bytes of file content to cache on local disk")
+	DaemonStartCmd.Flags().Int64Var(&daemonOpts.CacheBlockSize, "cache-block-size", 1<<20, "Size of the blocks file content is cached in")
+	DaemonStartCmd.Flags().Int64Var(&daemonOpts.ReadAhead, "read-ahead", 1<<17, "Bytes the kernel reads ahead of sequential reads")
+	DaemonStartCmd.Flags().StringVar(&daemonTunablesFile, "tunables", "", "JSON file with cache sizes, read ahead and log level, read again on SIGHUP along with credential files")
+	DaemonStartCmd.Flags().IntVar(&daemonOpts.MountConcurrentRequests, "mount-concurrent-requests", 0, "Limit each mount to this many remote requests in flight at once (0 = unlimited)")
+	DaemonStartCmd.Flags().IntVar(&daemonOpts.MaxConcurrentRequests, "max-concurrent-requests", 0, "Limit all mounts together to this many remote requests in flight at once (0 = unlimited)")
+	DaemonStartCmd.Flags().StringVar(&daemonOpts.ListenAddr, "listen", "", "Also accept clients on this address over mutual TLS (needs --tls-cert, --authz and --network-root)")
+	DaemonStartCmd.Flags().StringVar(&daemonOpts.AuthorizationFile, "authz", "", "JSON file mapping client certificate identities to the archives they may mount")
+	DaemonStartCmd.Flags().StringVar(&daemonOpts.NetworkRoot, "network-root", "", "Directory clients over --listen must mount and cache under")
+	DaemonStartCmd.Flags().StringVar(&daemonOpts.DebugAddr, "debug-addr", "", "Serve expvar counters of every mount at /debug/vars on this address, or unix:<path>")
+	DaemonStartCmd.Flags().BoolVar(&daemonOpts.Pprof, "pprof", false, "Also serve CPU, heap and goroutine profiles of the daemon at /debug/pprof/ on --debug-addr")
+	DaemonStartCmd.Flags().StringVar(&daemonTenantsFile, "tenants", "", "JSON file with the mount, cache and bandwidth limits of each tenant")
+	addTLSFlags(DaemonStartCmd.Flags(), daemonStartTLS)
+	addS3Flags(DaemonStartCmd.Flags(), daemonS3)
+	addProxyFlags(DaemonStartCmd.Flags(), daemonProxy)
+	DaemonStartCmd.Flags().StringVar(&daemonS3.Endpoint, "s3-endpoint", "", "Reach S3 at this endpoint instead of the one stored in each archive")
+
+	for _, cmd := range []*cobra.Command{DaemonMountCmd, DaemonUnmountCmd, DaemonListCmd} {
+		cmd.Flags().StringVar(&daemonAddr, "addr", "", "Reach a daemon on another host at this address instead of the local socket")
+		addTLSFlags(cmd.Flags(), daemonClientTLS)
+	}
+
+	DaemonMountCmd.Flags().StringVarP(&daemonMountReq.ArchivePath, "input", "i", "", "Archive file to mount, or a location like s3://bucket/key")
+	DaemonMountCmd.Flags().StringVarP(&daemonMountReq.MountPoint, "mountpoint", "m", "", "Directory to mount the archive")
+	DaemonMountCmd.Flags().StringVarP(&daemonMountReq.CachePath, "cache", "c", "", "Cache clip locally")
+	DaemonMountCmd.Flags().StringVar(&daemonMountReq.Subpath, "subpath", "", "Directory inside the archive to mount as the root")
+	DaemonMountCmd.Flags().StringVar(&daemonMountReq.Tenant, "tenant", "", "Tenant whose limits the mount counts against, ignored over --addr where the certificate decides")
+	DaemonMountCmd.MarkFlagRequired("input")
+	DaemonMountCmd.MarkFlagRequired("mountpoint")
+
+	DaemonUnmountCmd.Flags().StringVarP(&daemonMountReq.MountPoint, "mountpoint", "m", "", "Directory the archive is mounted to")
+	DaemonUnmountCmd.MarkFlagRequired("mountpoint")
+}
+
+func runDaemonStart(cmd *cobra.Command, args []string) error {
+	daemonOpts.SocketPath = daemonSocketPath
+	// The certificate flags belong to the daemon's own listener, archives are fetched with the token only
+	daemonOpts.Credentials.HTTP = httpCredentials(nil)
+	daemonOpts.Credentials.S3 = s3Credentials(daemonS3)
+	daemonOpts.Credentials.Proxy = proxyConfig(daemonProxy)
+	daemonOpts.TLS = tlsFiles(daemonStartTLS)
+	if daemonTenantsFile != "" {
+		tenants, err := clipd.LoadTenants(daemonTenantsFile)
+		if err != nil {
+			return err
+		}
+		daemonOpts.Tenants = tenants
+	}
+
+	if daemonTunablesFile != "" {
+		tunables, err := clip.LoadMountTunables(daemonTunablesFile)
+		if err != nil {
+			return err
+		}
+		daemonTunables(daemonOpts, tunables)
+	}
+
+	d, err := clipd.NewDaemon(*daemonOpts)
+	if err != nil {
+		return err
+	}
+
+	go reloadOnHangup(daemonTunablesFile, d.Reload)
+
+	// Unmount everything on the way out, the root command's handler exits without cleaning up
+	signal.Reset(os.Interrupt)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	closed := make(chan error, 1)
+	go func() {
+		<-sigs
+		log.Println("Shutting down, unmounting everything...")
+		closed <- d.Close()
+	}()
+
+	if err := d.Serve(); err != nil {
+		return err
+	}
+	return <-closed
+}
+
+// daemonTunables overrides the flags of the daemon with the settings of a tunables file
+func daemonTunables(options *clipd.DaemonOptions, t clip.MountTunables) {
+	if t.MemoryCacheSize > 0 {
+		options.MemoryCacheSize = t.MemoryCacheSize
+	}
+	if t.DiskCacheSize > 0 {
+		options.DiskCacheSize = t.DiskCacheSize
+	}
+	if t.ReadAhead > 0 {
+		options.ReadAhead = t.ReadAhead
+	}
+	if t.LogLevel != "" {
+		options.Verbose = t.LogLevel == "debug"
+	}
+}
+
+// daemonClient connects to the local socket, or to --addr over mutual TLS
+func daemonClient() (*clipd.Client, error) {
+	if daemonAddr == "" {
+		return clipd.NewClient(daemonSocketPath), nil
+	}
+	return clipd.NewTLSClient(daemonAddr, *daemonClientTLS)
+}
+
+func runDaemonMount(cmd *cobra.Command, args []string) error {
+	client, err := daemonClient()
+	if err != nil {
+		return err
+	}
+	if err := client.Mount(*daemonMountReq); err != nil {
+		return err
+	}
+	log.Success(fmt.Sprintf("Mounted to %s successfully.", daemonMountReq.MountPoint))
+	return nil
+}
+
+func runDaemonUnmount(cmd *cobra.Command, args []string) error {
+	client, err := daemonClient()
+	if err != nil {
+		return err
+	}
+	return client.Unmount(daemonMountReq.MountPoint)
+}
+
+func runDaemonList(cmd *cobra.Command, args []string) error {
+	client, err := daemonClient()
+	if err != nil {
+		return err
+	}
+	mounts, err := client.List()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "MOUNTPOINT\tARCHIVE\tMOUNTED")
+	for _, m := range mounts {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", m.MountPoint, m.ArchivePath, m.MountedAt.Format(time.RFC3339))
+	}
+	return w.Flush()
+}
@@ -0,0 +1,47 @@
+package commands
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+const envPrefix = "CLIP_"
+
+// envNames returns the variables a flag of cmd is read from, most specific first: CLIP_MOUNT_DISK_CACHE_DIR
+// for the mount command only, then CLIP_DISK_CACHE_DIR for every command with --disk-cache-dir
+func envNames(cmd *cobra.Command, flag string) []string {
+	name := strings.ToUpper(strings.ReplaceAll(flag, "-", "_"))
+	words := strings.Fields(strings.TrimPrefix(cmd.CommandPath(), cmd.Root().Name()))
+	if len(words) == 0 {
+		return []string{envPrefix + name}
+	}
+	command := strings.ToUpper(strings.ReplaceAll(strings.Join(words, "_"), "-", "_"))
+	return []string{envPrefix + command + "_" + name, envPrefix + name}
+}
+
+// applyEnv sets the flags of cmd that weren't given on the command line from the environment, so
+// every option can be set without a wrapper script. Flags given on the command line win over the
+// environment, which wins over the config file. Repeatable flags take a single value this way.
+func applyEnv(cmd *cobra.Command) error {
+	var err error
+	cmd.Flags().VisitAll(func(flag *pflag.Flag) {
+		if err != nil || flag.Changed || flag.Name == "help" {
+			return
+		}
+		for _, name := range envNames(cmd, flag.Name) {
+			value, ok := os.LookupEnv(name)
+			if !ok {
+				continue
+			}
+			if setErr := cmd.Flags().Set(flag.Name, value); setErr != nil {
+				err = fmt.Errorf("invalid %s: %v", name, setErr)
+			}
+			return
+		}
+	})
+	return err
+}
@@ -0,0 +1,36 @@
+package commands
+
+import (
+	"github.com/NilayYadav/clip/pkg/archive"
+	"github.com/NilayYadav/clip/pkg/clip"
+	"github.com/spf13/cobra"
+)
+
+var exportOpts = &clip.ExportOptions{}
+var exportKeyFile string
+
+var ExportCmd = &cobra.Command{
+	Use:   "export <in.clip> <out>",
+	Short: "Convert an archive into an image of another format, like an eStargz layer, or a SquashFS or EROFS image",
+	Args:  cobra.ExactArgs(2),
+	RunE:  runExport,
+}
+
+func init() {
+	ExportCmd.Flags().StringVarP(&exportOpts.Format, "format", "f", archive.ExportEStargz, "Format to export to: estargz, squashfs or erofs")
+	ExportCmd.Flags().Int64Var(&exportOpts.ChunkSize, "chunk-size", 0, "Files are cut in chunks of this size, each compressed on its own (default 4MiB)")
+	ExportCmd.Flags().StringVar(&exportKeyFile, "encryption-key", "", "File holding the key to decrypt encrypted files with, they are skipped without it")
+	ExportCmd.Flags().StringVar(&exportOpts.HashMapPath, "hash-map", "", "Where to write the content hashes of the files of an EROFS image, for content caches (defaults to <out>.hashes.json)")
+	ExportCmd.Flags().BoolVarP(&exportOpts.Verbose, "verbose", "v", false, "Verbose output")
+}
+
+func runExport(cmd *cobra.Command, args []string) error {
+	exportOpts.InputFile, exportOpts.OutputFile = args[0], args[1]
+
+	key, err := encryptionKey(exportKeyFile)
+	if err != nil {
+		return err
+	}
+	exportOpts.EncryptionKey = key
+	return clip.ExportArchive(*exportOpts)
+}
@@ -1,11 +1,18 @@
 package commands
 
 import (
+	"time"
+
+	"github.com/NilayYadav/clip/pkg/archive"
 	"github.com/NilayYadav/clip/pkg/clip"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
 var extractOpts = &clip.ExtractOptions{}
+var extractKeyFile string
+var extractRewrites []string
+var extractStorage = &storageFlags{}
 
 var ExtractCmd = &cobra.Command{
 	Use:   "extract",
@@ -14,12 +21,62 @@ var ExtractCmd = &cobra.Command{
 }
 
 func init() {
-	ExtractCmd.Flags().StringVarP(&extractOpts.InputFile, "input", "i", "", "Input file to extract")
+	ExtractCmd.Flags().StringVarP(&extractOpts.InputFile, "input", "i", "", "Input file to extract, or a location like s3://bucket/key to download it from")
 	ExtractCmd.Flags().StringVarP(&extractOpts.OutputPath, "output", "o", ".", "Output path for the extraction")
 	ExtractCmd.Flags().BoolVarP(&extractOpts.Verbose, "verbose", "v", false, "Verbose output")
+	ExtractCmd.Flags().StringVar(&extractKeyFile, "encryption-key", "", "File holding the key to decrypt encrypted files with, they are skipped without it")
+	ExtractCmd.Flags().StringArrayVar(&extractRewrites, "rewrite", nil, "Move a path prefix of the archive, as from=to like /build/out=/app (repeatable)")
+	ExtractCmd.Flags().BoolVar(&extractOpts.PreserveSetuid, "preserve-setuid", false, "Keep setuid, setgid and sticky bits")
+	ExtractCmd.Flags().BoolVar(&extractOpts.AllowDevices, "devices", false, "Create device nodes, they are skipped without this")
+	addStorageFlags(ExtractCmd.Flags(), extractStorage)
+	addLimitFlags(ExtractCmd.Flags(), &extractOpts.Limits)
+	ExtractCmd.Flags().Int64Var(&extractOpts.Limits.MaxExtractSize, "max-extract-size", 0, "Refuse archives holding more than this many bytes of files (0 = unlimited)")
 	ExtractCmd.MarkFlagRequired("input")
 }
 
 func runExtract(cmd *cobra.Command, args []string) error {
-	return clip.ExtractArchive(*extractOpts)
+	key, err := encryptionKey(extractKeyFile)
+	if err != nil {
+		return err
+	}
+	extractOpts.EncryptionKey = key
+	extractOpts.Credentials = extractStorage.credentials()
+
+	if extractOpts.Rewrites, err = pathRewrites(extractRewrites); err != nil {
+		return err
+	}
+
+	start := time.Now()
+	stats, err := clip.ExtractArchive(*extractOpts)
+	if err != nil || !outputJSON {
+		return err
+	}
+	return printJSON(extractResult{
+		Archive:    extractOpts.InputFile,
+		Output:     extractOpts.OutputPath,
+		Entries:    stats.Entries,
+		Skipped:    stats.Skipped,
+		Bytes:      stats.Bytes,
+		DurationMs: since(start),
+	})
+}
+
+// addLimitFlags registers the flags capping what reading an untrusted archive may use
+func addLimitFlags(flags *pflag.FlagSet, limits *archive.ArchiveLimits) {
+	flags.Int64Var(&limits.MaxMetadataSize, "max-metadata-size", 0, "Refuse archives whose index, once decompressed, is larger than this many bytes (0 = unlimited)")
+	flags.IntVar(&limits.MaxNodes, "max-entries", 0, "Refuse archives holding more than this many files, directories and links (0 = unlimited)")
+	flags.IntVar(&limits.MaxPathDepth, "max-path-depth", 0, "Refuse archives with paths nested deeper than this (0 = unlimited)")
+}
+
+// pathRewrites parses --rewrite flags
+func pathRewrites(specs []string) ([]archive.PathRewrite, error) {
+	var rewrites []archive.PathRewrite
+	for _, spec := range specs {
+		rewrite, err := archive.ParsePathRewrite(spec)
+		if err != nil {
+			return nil, err
+		}
+		rewrites = append(rewrites, rewrite)
+	}
+	return rewrites, nil
 }
@@ -0,0 +1,59 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/NilayYadav/clip/pkg/clip"
+	"github.com/spf13/cobra"
+)
+
+var grepOpts = &clip.GrepOptions{}
+var grepStorage = &storageFlags{}
+var grepKeyFile string
+var grepLineNumbers bool
+
+var GrepCmd = &cobra.Command{
+	Use:   "grep <pattern> <archive> [path...]",
+	Short: "Search the files of an archive for lines matching a regular expression, without mounting or downloading it",
+	Args:  cobra.MinimumNArgs(2),
+	RunE:  runGrep,
+}
+
+func init() {
+	GrepCmd.Flags().BoolVarP(&grepOpts.IgnoreCase, "ignore-case", "i", false, "Match letters regardless of case")
+	GrepCmd.Flags().StringVar(&grepOpts.Include, "include", "", "Only search files matching this glob, like *.go, matched against base names unless it holds a slash")
+	GrepCmd.Flags().IntVar(&grepOpts.Parallel, "parallel", 8, "Number of files searched at once")
+	GrepCmd.Flags().BoolVarP(&grepLineNumbers, "line-number", "n", false, "Print the line number of each match")
+	GrepCmd.Flags().BoolVarP(&grepOpts.FilesOnly, "files-with-matches", "l", false, "Only print the names of the files with a match")
+	GrepCmd.Flags().StringVar(&grepKeyFile, "encryption-key", "", "File holding the key to decrypt encrypted files with, they are skipped without it")
+	addStorageFlags(GrepCmd.Flags(), grepStorage)
+}
+
+func runGrep(cmd *cobra.Command, args []string) error {
+	grepOpts.Pattern, grepOpts.Paths = args[0], args[2:]
+
+	key, err := encryptionKey(grepKeyFile)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	a, err := clip.Open(ctx, args[1], clip.MountOptions{EncryptionKey: key, Credentials: grepStorage.credentials()})
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+
+	return a.Grep(ctx, *grepOpts, func(match clip.GrepMatch) error {
+		switch {
+		case grepOpts.FilesOnly:
+			fmt.Println(match.Name)
+		case grepLineNumbers:
+			fmt.Printf("%s:%d:%s\n", match.Name, match.Line, match.Text)
+		default:
+			fmt.Printf("%s:%s\n", match.Name, match.Text)
+		}
+		return nil
+	})
+}
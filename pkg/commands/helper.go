@@ -0,0 +1,231 @@
+//go:build !windows
+
+package commands
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/NilayYadav/clip/pkg/clip"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// Exit codes of mount helpers, see mount(8)
+const (
+	exitUsage        = 1
+	exitSystemError  = 2
+	exitMountFailure = 32
+)
+
+// exitError is an error the process exits with a code of its own for, see ExitCode
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	return e.err.Error()
+}
+
+func (e *exitError) Unwrap() error {
+	return e.err
+}
+
+// ExitCode returns the code to exit with after err, 1 unless the command failing chose another
+func ExitCode(err error) int {
+	var exit *exitError
+	if errors.As(err, &exit) {
+		return exit.code
+	}
+	return 1
+}
+
+// Mount options mount(8) and systemd pass to every helper, which don't change how archives are mounted
+var genericMountOptions = map[string]bool{
+	"defaults": true, "ro": true, "rw": true, "auto": true, "noauto": true, "nofail": true, "_netdev": true,
+	"user": true, "users": true, "nouser": true, "owner": true, "group": true, "exec": true, "noexec": true,
+	"suid": true, "nosuid": true, "dev": true, "nodev": true, "async": true, "sync": true,
+	"atime": true, "noatime": true, "relatime": true, "strictatime": true, "diratime": true, "nodiratime": true,
+}
+
+// Mount options named after something else than the mount flag they set
+var mountOptionAliases = map[string]string{
+	"cache": "disk-cache-dir",
+}
+
+var helperOptions string
+var helperSloppy bool
+var helperFake bool
+var helperForeground bool
+var helperNotifyFd int
+
+var MountHelperCmd = &cobra.Command{
+	Use:   "mount.clip <archive> <mountpoint> [-sfnv] [-o options]",
+	Short: "Mount an archive listed in /etc/fstab or a systemd mount unit, as mount(8) helper",
+	Long: "Mount an archive listed in /etc/fstab or a systemd mount unit, installed as /sbin/mount.clip for mount(8):\n\n" +
+		"  s3://images/app.rclip  /mnt/app  clip  ro,cache=/var/cache/clip,memory-cache-size=268435456  0 0\n\n" +
+		"Options are the flags of clip mount, like subpath=app, allow_other or auto_remount, and cache= for --disk-cache-dir. " +
+		"log= sends the output of the mount to a file. Options of every filesystem, like noauto and x-systemd.automount, " +
+		"are left to mount(8) and systemd. The archive is served in the background once mounted, until it is unmounted. " +
+		"It exits with 1 for invalid options and 32 when the archive can't be mounted.",
+	Args: cobra.ExactArgs(2),
+	RunE: runMountHelper,
+}
+
+func init() {
+	MountHelperCmd.Flags().StringVarP(&helperOptions, "options", "o", "", "Comma separated mount options")
+	MountHelperCmd.Flags().BoolVarP(&helperSloppy, "sloppy", "s", false, "Ignore unknown mount options")
+	MountHelperCmd.Flags().BoolVarP(&helperFake, "fake", "f", false, "Check the options without mounting")
+	MountHelperCmd.Flags().BoolP("no-mtab", "n", false, "Ignored, /etc/mtab isn't written")
+	MountHelperCmd.Flags().BoolVarP(&mountOptions.Verbose, "verbose", "v", false, "Verbose output")
+	MountHelperCmd.Flags().StringP("type", "t", "clip", "Ignored, the filesystem type mount(8) was given")
+	MountHelperCmd.Flags().BoolVar(&helperForeground, "foreground", false, "Serve the archive in the foreground instead of in the background")
+	MountHelperCmd.Flags().IntVar(&helperNotifyFd, "notify-fd", -1, "Write ok to this file descriptor once mounted, or why mounting failed")
+	MountHelperCmd.Flags().MarkHidden("notify-fd")
+}
+
+func runMountHelper(cmd *cobra.Command, args []string) error {
+	logFile, err := applyMountOptions(MountCmd.Flags(), helperOptions, helperSloppy)
+	if err != nil {
+		return &exitError{exitUsage, err}
+	}
+	if err := mountFromFlags(args); err != nil {
+		return &exitError{exitUsage, err}
+	}
+	if helperFake {
+		return nil
+	}
+
+	if !helperForeground {
+		return daemonizeMount(logFile)
+	}
+
+	var notify *os.File
+	if helperNotifyFd >= 0 {
+		notify = os.NewFile(uintptr(helperNotifyFd), "notify")
+	}
+	return serveMountHelper(notify)
+}
+
+// applyMountOptions sets the flags of the mount command from comma separated mount options, key=value
+// or key for flags that are on or off. It returns the file the log= option sends output to.
+func applyMountOptions(flags *pflag.FlagSet, options string, sloppy bool) (string, error) {
+	var logFile string
+	for _, option := range strings.Split(options, ",") {
+		key, value, hasValue := strings.Cut(option, "=")
+		if key == "" || genericMountOptions[key] || strings.HasPrefix(key, "x-") || key == "comment" {
+			continue
+		}
+		if key == "log" {
+			logFile = value
+			continue
+		}
+
+		name := strings.ReplaceAll(key, "_", "-")
+		if alias, ok := mountOptionAliases[name]; ok {
+			name = alias
+		}
+		flag := flags.Lookup(name)
+		if flag == nil || name == "input" || name == "mountpoint" || name == "archive" {
+			if sloppy {
+				continue
+			}
+			return "", fmt.Errorf("unknown mount option %s", key)
+		}
+
+		if !hasValue {
+			if flag.NoOptDefVal == "" {
+				return "", fmt.Errorf("mount option %s needs a value, as %s=", key, key)
+			}
+			value = flag.NoOptDefVal
+		}
+		if err := flags.Set(name, value); err != nil {
+			return "", fmt.Errorf("invalid mount option %s: %v", key, err)
+		}
+	}
+	return logFile, nil
+}
+
+// daemonizeMount runs the helper again in the foreground of a session of its own, which outlives it,
+// and waits for the archive to be mounted
+func daemonizeMount(logFile string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return &exitError{exitSystemError, err}
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return &exitError{exitSystemError, err}
+	}
+	defer r.Close()
+
+	server := exec.Command(exe, append(os.Args[1:], "--foreground", "--notify-fd=3")...)
+	server.ExtraFiles = []*os.File{w}
+	server.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if logFile != "" {
+		f, err := os.OpenFile(logFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			w.Close()
+			return &exitError{exitSystemError, fmt.Errorf("failed to open log file: %v", err)}
+		}
+		defer f.Close()
+		server.Stdout, server.Stderr = f, f
+	}
+
+	err = server.Start()
+	w.Close()
+	if err != nil {
+		return &exitError{exitSystemError, err}
+	}
+
+	message, _ := io.ReadAll(r)
+	if string(message) == "ok" {
+		return nil
+	}
+	server.Wait()
+	if len(message) == 0 {
+		return &exitError{exitMountFailure, fmt.Errorf("mount process exited before mounting the archive")}
+	}
+	return &exitError{exitMountFailure, errors.New(string(message))}
+}
+
+// serveMountHelper mounts the archive and serves it until it is unmounted, telling notify whether
+// mounting worked
+func serveMountHelper(notify *os.File) error {
+	fail := func(err error) error {
+		if notify != nil {
+			notify.WriteString(err.Error())
+			notify.Close()
+		}
+		return &exitError{exitMountFailure, err}
+	}
+
+	// Unmount when stopped rather than leave a dead mount behind
+	signal.Reset(os.Interrupt)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	mounted := false
+	err := serveMount(ctx, func(m *clip.Mount) {
+		if !mounted && notify != nil {
+			notify.WriteString("ok")
+			notify.Close()
+		}
+		mounted = true
+	})
+	if err != nil && !mounted {
+		return fail(fmt.Errorf("failed to mount archive: %v", err))
+	}
+	if err != nil {
+		return &exitError{exitMountFailure, fmt.Errorf("server error: %v", err)}
+	}
+	return nil
+}
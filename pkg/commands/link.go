@@ -0,0 +1,51 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/NilayYadav/clip/pkg/clip"
+	"github.com/NilayYadav/clip/pkg/common"
+	"github.com/spf13/cobra"
+)
+
+var linkOpts = &clip.LinkOptions{}
+var linkS3 = &common.S3StorageInfo{}
+var linkStorage = &storageFlags{}
+
+var LinkCmd = &cobra.Command{
+	Use:   "link [location]",
+	Short: "Create an RCLIP archive for an archive already in remote storage, e.g. s3://bucket/app.clip, reading only its metadata",
+	Args:  cobra.MaximumNArgs(1),
+	RunE:  runLink,
+}
+
+func init() {
+	LinkCmd.Flags().StringVarP(&linkOpts.OutputFile, "output", "o", "", "Output RCLIP archive path (defaults to the archive name with an .rclip extension)")
+	LinkCmd.Flags().StringVarP(&linkS3.Bucket, "bucket", "b", "", "S3 bucket name, instead of a location")
+	LinkCmd.Flags().StringVarP(&linkS3.Key, "key", "k", "", "S3 bucket key")
+	LinkCmd.Flags().StringVar(&linkS3.Region, "region", "", "S3 region (defaults to AWS_REGION)")
+	LinkCmd.Flags().StringVar(&linkS3.Endpoint, "endpoint", "", "Endpoint of an S3 compatible service, stored in the RCLIP")
+	LinkCmd.Flags().BoolVar(&linkS3.ForcePathStyle, "force-path-style", false, "Address the bucket in the path instead of the host name")
+	addStorageFlags(LinkCmd.Flags(), linkStorage)
+}
+
+func runLink(cmd *cobra.Command, args []string) error {
+	switch {
+	case len(args) == 1 && linkS3.Bucket != "":
+		return fmt.Errorf("either a location or --bucket must be provided, not both")
+	case len(args) == 1:
+		linkOpts.Location = args[0]
+	case linkS3.Bucket != "" && linkS3.Key != "":
+		if linkS3.Region == "" {
+			linkS3.Region = os.Getenv("AWS_REGION")
+		}
+		linkOpts.StorageInfo = linkS3
+	default:
+		return fmt.Errorf("either a location or --bucket and --key must be provided")
+	}
+
+	linkOpts.Credentials = linkStorage.credentials()
+	return clip.Link(context.Background(), *linkOpts)
+}
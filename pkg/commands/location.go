@@ -0,0 +1,37 @@
+package commands
+
+import (
+	"os"
+
+	"github.com/NilayYadav/clip/pkg/common"
+	"github.com/NilayYadav/clip/pkg/storage"
+	"github.com/spf13/pflag"
+)
+
+// storageFlags holds the flags reaching remote storage, for commands taking archive locations such
+// as s3://bucket/key, see storage.ParseLocation
+type storageFlags struct {
+	tls   common.TLSFiles
+	s3    storage.S3ClipStorageCredentials
+	sftp  storage.SFTPClipStorageCredentials
+	proxy storage.ProxyConfig
+}
+
+func addStorageFlags(flags *pflag.FlagSet, f *storageFlags) {
+	flags.StringVar(&f.sftp.PrivateKeyPath, "identity", "", "Private key used to authenticate with SFTP hosts (optional)")
+	flags.StringVar(&f.sftp.KnownHostsPath, "known-hosts", "", "known_hosts file used to verify SFTP hosts (optional)")
+	flags.BoolVar(&f.sftp.InsecureIgnoreHostKey, "insecure-ignore-host-key", false, "Skip SFTP host key verification")
+	addTLSFlags(flags, &f.tls)
+	addS3Flags(flags, &f.s3)
+	addProxyFlags(flags, &f.proxy)
+}
+
+func (f *storageFlags) credentials() storage.ClipStorageCredentials {
+	f.sftp.Password = os.Getenv("SFTP_PASSWORD")
+	return storage.ClipStorageCredentials{
+		S3:    s3Credentials(&f.s3),
+		SFTP:  &f.sftp,
+		HTTP:  httpCredentials(&f.tls),
+		Proxy: proxyConfig(&f.proxy),
+	}
+}
@@ -0,0 +1,59 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/NilayYadav/clip/pkg/clip"
+	"github.com/spf13/cobra"
+)
+
+var lsStorage = &storageFlags{}
+var lsLong bool
+
+var LsCmd = &cobra.Command{
+	Use:   "ls <archive> [path]",
+	Short: "List a directory of an archive from its metadata, without mounting it",
+	Args:  cobra.RangeArgs(1, 2),
+	RunE:  runLs,
+}
+
+func init() {
+	LsCmd.Flags().BoolVarP(&lsLong, "long", "l", false, "Print the mode, size, modification time and content type of each entry")
+	addStorageFlags(LsCmd.Flags(), lsStorage)
+}
+
+func runLs(cmd *cobra.Command, args []string) error {
+	dir := "."
+	if len(args) > 1 {
+		dir = args[1]
+	}
+
+	a, err := clip.Open(context.Background(), args[0], clip.MountOptions{Credentials: lsStorage.credentials()})
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+
+	entries, err := a.List(dir)
+	if err != nil {
+		return err
+	}
+
+	// With --json the entries come with their content types and hashes
+	if outputJSON {
+		return printJSON(entries)
+	}
+	for _, entry := range entries {
+		if !lsLong {
+			fmt.Println(entry.Name)
+			continue
+		}
+		name := entry.Name
+		if entry.Target != "" {
+			name += " -> " + entry.Target
+		}
+		fmt.Printf("%s %10d %s %-24s %s\n", entry.Mode, entry.Size, entry.ModTime.Format("2006-01-02 15:04"), entry.ContentType, name)
+	}
+	return nil
+}
@@ -1,30 +1,94 @@
+//go:build !windows
+
 package commands
 
 import (
+	"context"
 	"fmt"
+	"os"
 	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	log "github.com/okteto/okteto/pkg/log"
 
 	"github.com/NilayYadav/clip/pkg/clip"
+	"github.com/NilayYadav/clip/pkg/common"
+	"github.com/NilayYadav/clip/pkg/storage"
 	"github.com/spf13/cobra"
 )
 
 var mountOptions = &clip.MountOptions{}
+var mountArchives []string
+var mountProcessRequests int
+var mountS3 = &storage.S3ClipStorageCredentials{}
+var mountProxy = &storage.ProxyConfig{}
+var mountTLS = &common.TLSFiles{}
+var mountKeyFile string
+var mountRewrites []string
+var mountReadChain string
+var mountTunablesFile string
+var mountAutoRemount bool
+var mountWatchdog = &clip.WatchdogOptions{}
 
 var MountCmd = &cobra.Command{
-	Use:   "mount",
-	Short: "Mount an archive to a specified mount point",
+	Use:   "mount [archive] [mountpoint]",
+	Short: "Mount an archive, or a tarball indexed on the fly, to a specified mount point",
+	Args:  cobra.MaximumNArgs(2),
 	Run:   runMount,
 }
 
 func init() {
-	MountCmd.Flags().StringVarP(&mountOptions.ArchivePath, "input", "i", "", "Archive file to mount")
+	MountCmd.Flags().StringVarP(&mountOptions.ArchivePath, "input", "i", "", "Archive file to mount, a tar or tar.gz, or a location like s3://bucket/key")
 	MountCmd.Flags().StringVarP(&mountOptions.MountPoint, "mountpoint", "m", "", "Directory to mount the archive")
 	MountCmd.Flags().BoolVarP(&mountOptions.Verbose, "verbose", "v", false, "Verbose output")
 	MountCmd.Flags().StringVarP(&mountOptions.CachePath, "cache", "c", "", "Cache clip locally")
-	MountCmd.MarkFlagRequired("input")
-	MountCmd.MarkFlagRequired("mountpoint")
+	MountCmd.Flags().StringVar(&mountOptions.Subpath, "subpath", "", "Directory inside the archive to mount as the root")
+	MountCmd.Flags().Int64Var(&mountOptions.ReadLimits.BytesPerSecond, "read-bytes-per-sec", 0, "Limit remote reads to this many bytes per second (0 = unlimited)")
+	MountCmd.Flags().Float64Var(&mountOptions.ReadLimits.RequestsPerSecond, "read-requests-per-sec", 0, "Limit remote reads to this many requests per second (0 = unlimited)")
+	MountCmd.Flags().IntVar(&mountOptions.ReadLimits.MaxConcurrent, "max-concurrent-requests", 0, "Limit each archive to this many remote requests in flight at once (0 = unlimited)")
+	MountCmd.Flags().IntVar(&mountProcessRequests, "max-process-requests", 0, "Limit all the mounted archives together to this many remote requests in flight at once (0 = unlimited)")
+	MountCmd.Flags().DurationVar(&mountOptions.ReadCoalesceWindow, "read-coalesce-window", 0, "Batch nearby small remote reads arriving within this window into one request (0 = disabled)")
+	MountCmd.Flags().Int64Var(&mountOptions.MemoryCacheSize, "memory-cache-size", 0, "Bytes of file content to cache in memory (0 = disabled)")
+	MountCmd.Flags().StringVar(&mountOptions.DiskCacheDir, "disk-cache-dir", "", "Directory to cache file content in on local disk")
+	MountCmd.Flags().Int64Var(&mountOptions.DiskCacheSize, "disk-cache-size", 1<<30, "Bytes of file content to cache on local disk")
+	MountCmd.Flags().Int64Var(&mountOptions.CacheBlockSize, "cache-block-size", 1<<20, "Size of the blocks file content is cached in")
+	MountCmd.Flags().BoolVar(&mountOptions.Passthrough, "passthrough", false, "Let the kernel read files straight from local copies in the disk cache (needs root and Linux 6.9+)")
+	MountCmd.Flags().Int64Var(&mountOptions.ReadAhead, "read-ahead", 1<<17, "Bytes the kernel reads ahead of sequential reads")
+	MountCmd.Flags().StringVar(&mountTunablesFile, "tunables", "", "JSON file with cache sizes, read ahead and log level, read again on SIGHUP along with credential files")
+	MountCmd.Flags().BoolVar(&mountAutoRemount, "auto-remount", false, "Mount the archive again, with the cache it warmed, when its connection to the kernel dies or a killed mount is left behind")
+	MountCmd.Flags().DurationVar(&mountWatchdog.MinBackoff, "remount-backoff", clip.DefaultMinBackoff, "Wait before remounting, doubled for every remount in a row")
+	MountCmd.Flags().DurationVar(&mountWatchdog.MaxBackoff, "remount-max-backoff", clip.DefaultMaxBackoff, "Longest wait before remounting, mounts staying up this long reset the backoff")
+	MountCmd.Flags().IntVar(&mountWatchdog.MaxRestarts, "remount-max-restarts", 0, "Give up after this many remounts in a row (0 = never)")
+	MountCmd.Flags().StringVar(&mountOptions.TracePath, "trace", "", "Record every read to this file, for clip profile attach")
+	MountCmd.Flags().StringArrayVarP(&mountArchives, "archive", "a", nil, "Archive to mount under a subdirectory, as path[=prefix] (repeatable)")
+	addS3Flags(MountCmd.Flags(), mountS3)
+	addProxyFlags(MountCmd.Flags(), mountProxy)
+	MountCmd.Flags().StringVar(&mountS3.Endpoint, "s3-endpoint", "", "Reach S3 at this endpoint instead of the one stored in the archive")
+	MountCmd.Flags().BoolVar(&mountOptions.OfflineMode, "offline", false, "Keep serving cached content when storage is unreachable, uncached reads fail with EHOSTUNREACH until it's back")
+	MountCmd.Flags().IntVar(&mountOptions.CacheBreaker.FailureThreshold, "cache-breaker-failures", 5, "Read from storage directly for a while after this many content cache reads in a row fail or are slow (0 = never)")
+	MountCmd.Flags().DurationVar(&mountOptions.CacheBreaker.SlowRead, "cache-breaker-slow", time.Second, "Content cache reads taking longer than this count as failed")
+	MountCmd.Flags().DurationVar(&mountOptions.CacheBreaker.Cooldown, "cache-breaker-cooldown", 30*time.Second, "How long reads skip a failing content cache before trying it again")
+	MountCmd.Flags().StringVar(&mountReadChain, "read-chain", "", "Tiers reads try in turn, as tier[:timeout][:skip|fail] separated by commas, like memory,disk:100ms,cache:500ms,storage:30s")
+	MountCmd.Flags().IntVar(&mountOptions.Fuse.MaxWrite, "fuse-max-write", 0, "Largest read the kernel sends, up to 1Mb (0 = 128Kb), 1Mb suits large files read sequentially from remote storage")
+	MountCmd.Flags().IntVar(&mountOptions.Fuse.MaxBackground, "fuse-max-background", 0, "Reads, like read ahead, the kernel keeps in flight at once (0 = 512), more buy throughput with memory")
+	MountCmd.Flags().IntVar(&mountOptions.Fuse.CongestionThreshold, "fuse-congestion-threshold", 0, "Reads in flight at which the kernel holds read ahead back (0 = 3/4 of --fuse-max-background, needs root)")
+	MountCmd.Flags().BoolVar(&mountOptions.Mmap, "mmap", true, "Serve local archives from a memory mapping instead of reading them for every request")
+	MountCmd.Flags().BoolVar(&mountOptions.AllowOther, "allow-other", false, "Let other users read the mount, with file modes checked by the kernel (non-root users need user_allow_other in /etc/fuse.conf)")
+	MountCmd.Flags().BoolVar(&mountOptions.NormalizeNames, "normalize-names", false, "Match names in either Unicode normalization form (NFC or NFD), for archives of trees made on macOS")
+	MountCmd.Flags().BoolVar(&mountOptions.CaseInsensitive, "case-insensitive", false, "Resolve names regardless of case, keeping the case stored in the archive in listings")
+	MountCmd.Flags().StringVar(&mountOptions.HealthAddr, "health-addr", "", "Answer /healthz and /readyz probes on this address, or unix:<path> for a socket")
+	MountCmd.Flags().StringVar(&mountOptions.DebugAddr, "debug-addr", "", "Serve expvar counters of cache hits, bytes read per tier and requests in flight at /debug/vars on this address, or unix:<path>")
+	MountCmd.Flags().BoolVar(&mountOptions.Pprof, "pprof", false, "Also serve CPU, heap and goroutine profiles of the mount at /debug/pprof/ on --debug-addr")
+	MountCmd.Flags().StringVar(&mountOptions.ControlSocket, "control-socket", "", "Take clip ctl commands on this unix socket: stats, flush, log-level, prefetch and hydrate")
+	MountCmd.Flags().StringVar(&mountKeyFile, "encryption-key", "", "File holding the key to decrypt encrypted files with, reading them fails with EACCES without it")
+	MountCmd.Flags().StringArrayVar(&mountOptions.Scratch, "scratch", nil, "Mount writable tmpfs scratch space over this directory of the mount, like /tmp, unmounted along with the archive, umount from outside needs -R (repeatable)")
+	MountCmd.Flags().Int64Var(&mountOptions.ScratchSize, "scratch-size", 0, "Bytes each scratch directory can hold (0 = half of memory)")
+	MountCmd.Flags().StringArrayVar(&mountRewrites, "rewrite", nil, "Move a path prefix of the archive, as from=to like /build/out=/app (repeatable)")
+	addLimitFlags(MountCmd.Flags(), &mountOptions.Limits)
+	addTLSFlags(MountCmd.Flags(), mountTLS)
 }
 
 func forceUnmount() {
@@ -32,24 +96,163 @@ func forceUnmount() {
 	unmountCommand.Run()
 }
 
+// archiveSpec splits an --archive flag, path[=prefix]. Locations with a query, which holds "=" itself,
+// can't be given a prefix and are mounted under their name.
+func archiveSpec(spec string) (string, string) {
+	if strings.Contains(spec, "?") {
+		return spec, ""
+	}
+	archivePath, prefix, _ := strings.Cut(spec, "=")
+	return archivePath, prefix
+}
+
+// mountFromFlags fills mountOptions in from the flags and arguments of the mount command
+func mountFromFlags(args []string) error {
+	if len(args) > 0 {
+		mountOptions.ArchivePath = args[0]
+	}
+	if len(args) > 1 {
+		mountOptions.MountPoint = args[1]
+	}
+	if mountOptions.MountPoint == "" {
+		return fmt.Errorf("A mount point must be provided")
+	}
+	if mountOptions.ArchivePath == "" && len(mountArchives) == 0 {
+		return fmt.Errorf("Either --input or --archive must be provided")
+	}
+
+	for _, spec := range mountArchives {
+		archivePath, prefix := archiveSpec(spec)
+		mountOptions.Archives = append(mountOptions.Archives, clip.ArchiveMount{ArchivePath: archivePath, Prefix: prefix})
+	}
+
+	mountOptions.Credentials.HTTP = httpCredentials(mountTLS)
+	mountOptions.Credentials.S3 = s3Credentials(mountS3)
+	mountOptions.Credentials.Proxy = proxyConfig(mountProxy)
+	storage.SetMaxConcurrentRequests(mountProcessRequests, 0)
+
+	key, err := encryptionKey(mountKeyFile)
+	if err != nil {
+		return fmt.Errorf("Failed to load encryption key: %v", err)
+	}
+	mountOptions.EncryptionKey = key
+
+	if mountOptions.Rewrites, err = pathRewrites(mountRewrites); err != nil {
+		return err
+	}
+
+	if mountReadChain != "" {
+		if mountOptions.ReadChain, err = clip.ParseReadChain(mountReadChain); err != nil {
+			return err
+		}
+	}
+
+	if mountTunablesFile != "" {
+		tunables, err := clip.LoadMountTunables(mountTunablesFile)
+		if err != nil {
+			return err
+		}
+		applyTunables(mountOptions, tunables)
+	}
+	return nil
+}
+
 func runMount(cmd *cobra.Command, args []string) {
+	if err := mountFromFlags(args); err != nil {
+		log.Fatalf("%v", err)
+	}
+
 	forceUnmount() // Force unmount the file system if it's already mounted
 
-	startServer, serverError, _, err := clip.MountArchive(*mountOptions)
-	if err != nil {
+	start := time.Now()
+	mounted := false
+	err := serveMount(context.Background(), func(m *clip.Mount) {
+		if mounted {
+			return // Remounted after its connection died
+		}
+		mounted = true
+
+		if outputJSON {
+			archives := []string{mountOptions.ArchivePath}
+			if len(mountOptions.Archives) > 0 {
+				archives = archives[:0]
+				for _, am := range mountOptions.Archives {
+					archives = append(archives, am.ArchivePath)
+				}
+			}
+			printJSON(mountResult{
+				MountPoint:    mountOptions.MountPoint,
+				Archives:      archives,
+				PID:           os.Getpid(),
+				ControlSocket: mountOptions.ControlSocket,
+				DurationMs:    since(start),
+			})
+		} else {
+			log.Success(fmt.Sprintf("Mounted to %s successfully.", mountOptions.MountPoint))
+		}
+		go reloadOnHangup(mountTunablesFile, clip.Reload)
+	})
+	if err != nil && !mounted {
 		log.Fatalf("Failed to mount archive: %v", err)
 	}
+	if err != nil {
+		log.Fatalf("Server error: %v", err)
+	}
+}
+
+// serveMount mounts the archive of the mount flags and serves it until it's unmounted or ctx is done,
+// mounting it again whenever its connection dies with --auto-remount. mounted is called once it's
+// mounted, and again after every remount.
+func serveMount(ctx context.Context, mounted func(m *clip.Mount)) error {
+	if mountAutoRemount {
+		return clip.Supervise(ctx, *mountOptions, *mountWatchdog, mounted)
+	}
 
-	err = startServer()
+	m, err := clip.NewMount(*mountOptions)
 	if err != nil {
-		log.Fatalf("Failed to start server: %v", err)
+		return err
 	}
+	if err := m.Start(ctx); err != nil {
+		return err
+	}
+	mounted(m)
+	return <-m.Done()
+}
 
-	log.Success(fmt.Sprintf("Mounted %s to %s successfully.", mountOptions.ArchivePath, mountOptions.MountPoint))
-	for err := range serverError {
-		if err != nil {
-			log.Fatalf("Server error: %v", err)
-		}
+// applyTunables overrides the flags of a mount with the settings of a tunables file
+func applyTunables(options *clip.MountOptions, t clip.MountTunables) {
+	if t.MemoryCacheSize > 0 {
+		options.MemoryCacheSize = t.MemoryCacheSize
+	}
+	if t.DiskCacheSize > 0 {
+		options.DiskCacheSize = t.DiskCacheSize
+	}
+	if t.ReadAhead > 0 {
+		options.ReadAhead = t.ReadAhead
 	}
+	if t.LogLevel != "" {
+		options.Verbose = t.LogLevel == "debug"
+	}
+}
+
+// reloadOnHangup calls reload on SIGHUP, with the tunables file read again
+func reloadOnHangup(tunablesFile string, reload func(clip.MountTunables) error) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
 
+	for range sigs {
+		var tunables clip.MountTunables
+		if tunablesFile != "" {
+			var err error
+			if tunables, err = clip.LoadMountTunables(tunablesFile); err != nil {
+				log.Warning("Not reloading: %v", err)
+				continue
+			}
+		}
+		if err := reload(tunables); err != nil {
+			log.Warning("Reload failed: %v", err)
+			continue
+		}
+		log.Println("Reloaded settings.")
+	}
 }
@@ -0,0 +1,128 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	log "github.com/okteto/okteto/pkg/log"
+
+	"github.com/NilayYadav/clip/pkg/clip"
+	"github.com/NilayYadav/clip/pkg/common"
+	"github.com/NilayYadav/clip/pkg/storage"
+	"github.com/NilayYadav/clip/pkg/winfsp"
+	"github.com/spf13/cobra"
+)
+
+var mountOptions = &clip.MountOptions{}
+var mountS3 = &storage.S3ClipStorageCredentials{}
+var mountProxy = &storage.ProxyConfig{}
+var mountTLS = &common.TLSFiles{}
+var mountKeyFile string
+var mountRewrites []string
+var mountVolumeName string
+var mountWinFSPOptions []string
+
+// MountCmd mounts archives through WinFSP, which has to be installed. The archive is served until the
+// command is interrupted.
+var MountCmd = &cobra.Command{
+	Use:   "mount [archive] [mountpoint]",
+	Short: "Mount an archive, or a tarball indexed on the fly, to a drive letter or a directory through WinFSP",
+	Args:  cobra.MaximumNArgs(2),
+	Run:   runMount,
+}
+
+func init() {
+	MountCmd.Flags().StringVarP(&mountOptions.ArchivePath, "input", "i", "", "Archive file to mount, a tar or tar.gz, or a location like s3://bucket/key")
+	MountCmd.Flags().StringVarP(&mountOptions.MountPoint, "mountpoint", "m", "", "Drive letter like X: or directory that doesn't exist yet to mount the archive")
+	MountCmd.Flags().BoolVarP(&mountOptions.Verbose, "verbose", "v", false, "Verbose output")
+	MountCmd.Flags().StringVarP(&mountOptions.CachePath, "cache", "c", "", "Cache clip locally")
+	MountCmd.Flags().StringVar(&mountOptions.Subpath, "subpath", "", "Directory inside the archive to mount as the root")
+	MountCmd.Flags().Int64Var(&mountOptions.ReadLimits.BytesPerSecond, "read-bytes-per-sec", 0, "Limit remote reads to this many bytes per second (0 = unlimited)")
+	MountCmd.Flags().Float64Var(&mountOptions.ReadLimits.RequestsPerSecond, "read-requests-per-sec", 0, "Limit remote reads to this many requests per second (0 = unlimited)")
+	MountCmd.Flags().IntVar(&mountOptions.ReadLimits.MaxConcurrent, "max-concurrent-requests", 0, "Limit the archive to this many remote requests in flight at once (0 = unlimited)")
+	MountCmd.Flags().Int64Var(&mountOptions.MemoryCacheSize, "memory-cache-size", 0, "Bytes of file content to cache in memory (0 = disabled)")
+	MountCmd.Flags().StringVar(&mountOptions.DiskCacheDir, "disk-cache-dir", "", "Directory to cache file content in on local disk")
+	MountCmd.Flags().Int64Var(&mountOptions.DiskCacheSize, "disk-cache-size", 1<<30, "Bytes of file content to cache on local disk")
+	MountCmd.Flags().Int64Var(&mountOptions.CacheBlockSize, "cache-block-size", 1<<20, "Size of the blocks file content is cached in")
+	addS3Flags(MountCmd.Flags(), mountS3)
+	addProxyFlags(MountCmd.Flags(), mountProxy)
+	MountCmd.Flags().StringVar(&mountS3.Endpoint, "s3-endpoint", "", "Reach S3 at this endpoint instead of the one stored in the archive")
+	MountCmd.Flags().BoolVar(&mountOptions.OfflineMode, "offline", false, "Keep serving cached content when storage is unreachable")
+	MountCmd.Flags().IntVar(&mountOptions.CacheBreaker.FailureThreshold, "cache-breaker-failures", 5, "Read from storage directly for a while after this many content cache reads in a row fail or are slow (0 = never)")
+	MountCmd.Flags().DurationVar(&mountOptions.CacheBreaker.SlowRead, "cache-breaker-slow", time.Second, "Content cache reads taking longer than this count as failed")
+	MountCmd.Flags().DurationVar(&mountOptions.CacheBreaker.Cooldown, "cache-breaker-cooldown", 30*time.Second, "How long reads skip a failing content cache before trying it again")
+	MountCmd.Flags().BoolVar(&mountOptions.NormalizeNames, "normalize-names", false, "Match names in either Unicode normalization form (NFC or NFD), for archives of trees made on macOS")
+	MountCmd.Flags().BoolVar(&mountOptions.CaseInsensitive, "case-insensitive", true, "Resolve names regardless of case, keeping the case stored in the archive in listings")
+	MountCmd.Flags().StringVar(&mountKeyFile, "encryption-key", "", "File holding the key to decrypt encrypted files with, reading them fails without it")
+	MountCmd.Flags().StringArrayVar(&mountRewrites, "rewrite", nil, "Move a path prefix of the archive, as from=to like /build/out=/app (repeatable)")
+	MountCmd.Flags().StringVar(&mountVolumeName, "volume-name", "", "Label Explorer shows for the mount, defaults to the archive name")
+	MountCmd.Flags().StringArrayVar(&mountWinFSPOptions, "winfsp-option", nil, "Extra WinFSP option, like uid=-1 (repeatable)")
+	addLimitFlags(MountCmd.Flags(), &mountOptions.Limits)
+	addTLSFlags(MountCmd.Flags(), mountTLS)
+}
+
+func runMount(cmd *cobra.Command, args []string) {
+	if len(args) > 0 {
+		mountOptions.ArchivePath = args[0]
+	}
+	if len(args) > 1 {
+		mountOptions.MountPoint = args[1]
+	}
+	if mountOptions.MountPoint == "" {
+		log.Fatalf("A mount point must be provided")
+	}
+	if mountOptions.ArchivePath == "" {
+		log.Fatalf("An archive must be provided")
+	}
+
+	mountOptions.Credentials.HTTP = httpCredentials(mountTLS)
+	mountOptions.Credentials.S3 = s3Credentials(mountS3)
+	mountOptions.Credentials.Proxy = proxyConfig(mountProxy)
+
+	key, err := encryptionKey(mountKeyFile)
+	if err != nil {
+		log.Fatalf("Failed to load encryption key: %v", err)
+	}
+	mountOptions.EncryptionKey = key
+
+	if mountOptions.Rewrites, err = pathRewrites(mountRewrites); err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	a, err := clip.Open(context.Background(), mountOptions.ArchivePath, *mountOptions)
+	if err != nil {
+		log.Fatalf("Failed to open archive: %v", err)
+	}
+	defer a.Close()
+
+	volumeName := mountVolumeName
+	if volumeName == "" {
+		volumeName = clip.ArchiveMount{ArchivePath: mountOptions.ArchivePath}.MountPrefix()
+	}
+	var options []string
+	for _, option := range mountWinFSPOptions {
+		options = append(options, "-o", option)
+	}
+
+	// WinFSP doesn't report when the mount is up, only once it's gone
+	if outputJSON {
+		printJSON(mountResult{
+			MountPoint: mountOptions.MountPoint,
+			Archives:   []string{mountOptions.ArchivePath},
+			PID:        os.Getpid(),
+		})
+	} else {
+		log.Success(fmt.Sprintf("Mounting to %s, interrupt to unmount.", mountOptions.MountPoint))
+	}
+
+	err = winfsp.Mount(a.View().FileSystem(), mountOptions.MountPoint, winfsp.MountOptions{
+		Verbose:    mountOptions.Verbose,
+		VolumeName: volumeName,
+		Options:    options,
+	})
+	if err != nil {
+		log.Fatalf("Failed to mount archive: %v", err)
+	}
+}
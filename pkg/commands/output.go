@@ -0,0 +1,93 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/NilayYadav/clip/pkg/archive"
+	log "github.com/okteto/okteto/pkg/log"
+)
+
+// With --json, standard output only holds the result of the command, for scripts to parse
+var outputJSON bool
+
+func setupOutput() {
+	if outputJSON {
+		log.SetOutput(os.Stderr)
+	}
+}
+
+// createResult is what clip create --json prints
+type createResult struct {
+	Archive    string `json:"archive,omitempty"`  // Local archive written
+	Location   string `json:"location,omitempty"` // Of an archive created in remote storage
+	RCLIP      string `json:"rclip,omitempty"`    // Pointing at the archive in remote storage
+	Digest     string `json:"digest,omitempty"`   // sha256 of a local archive
+	Size       int64  `json:"size,omitempty"`
+	DurationMs int64  `json:"duration_ms"`
+}
+
+// extractResult is what clip extract --json prints
+type extractResult struct {
+	Archive    string `json:"archive"`
+	Output     string `json:"output"`
+	Entries    int    `json:"entries"`
+	Skipped    int    `json:"skipped"`
+	Bytes      int64  `json:"bytes"`
+	DurationMs int64  `json:"duration_ms"`
+}
+
+// storeResult is what the clip store commands print with --json
+type storeResult struct {
+	Archive    string `json:"archive"`
+	RCLIP      string `json:"rclip"`
+	Storage    string `json:"storage"` // s3, sftp, ipfs or http
+	Digest     string `json:"digest"`  // sha256 of the archive stored
+	Size       int64  `json:"size"`
+	DurationMs int64  `json:"duration_ms"`
+}
+
+// mountResult is what clip mount --json prints once the archive is mounted
+type mountResult struct {
+	MountPoint    string   `json:"mount_point"`
+	Archives      []string `json:"archives"`
+	PID           int      `json:"pid"` // Of the process serving the mount, unmounting stops it
+	ControlSocket string   `json:"control_socket,omitempty"`
+	DurationMs    int64    `json:"duration_ms"`
+}
+
+// errorResult is printed instead of a result when a command fails with --json
+type errorResult struct {
+	Error string `json:"error"`
+}
+
+func printJSON(v interface{}) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+// PrintError reports a failed command, as JSON with --json
+func PrintError(err error) {
+	if outputJSON {
+		printJSON(errorResult{Error: err.Error()})
+		return
+	}
+	log.Fail(fmt.Sprintf("Failed to execute command: %v", err))
+}
+
+func since(start time.Time) int64 {
+	return time.Since(start).Milliseconds()
+}
+
+// archiveDigest returns the size and sha256 of a local archive
+func archiveDigest(archivePath string) (size int64, digest string, err error) {
+	info, err := os.Stat(archivePath)
+	if err != nil {
+		return 0, "", err
+	}
+	digest, err = archive.Digest(archivePath)
+	return info.Size(), digest, err
+}
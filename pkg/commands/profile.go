@@ -0,0 +1,33 @@
+package commands
+
+import (
+	"github.com/NilayYadav/clip/pkg/clip"
+	"github.com/spf13/cobra"
+)
+
+var ProfileCmd = &cobra.Command{
+	Use:   "profile",
+	Short: "Manage the prefetch profiles stored in archives",
+}
+
+var ProfileAttachCmd = &cobra.Command{
+	Use:   "attach",
+	Short: "Embed a trace recorded with mount --trace into an archive as its prefetch profile",
+	RunE:  runProfileAttach,
+}
+
+var attachProfileOpts = &clip.AttachProfileOptions{}
+
+func init() {
+	ProfileCmd.AddCommand(ProfileAttachCmd)
+
+	ProfileAttachCmd.Flags().StringVarP(&attachProfileOpts.ArchivePath, "input", "i", "", "Archive to attach the profile to")
+	ProfileAttachCmd.Flags().StringVarP(&attachProfileOpts.TracePath, "trace", "t", "", "Trace file recorded with mount --trace")
+
+	ProfileAttachCmd.MarkFlagRequired("input")
+	ProfileAttachCmd.MarkFlagRequired("trace")
+}
+
+func runProfileAttach(cmd *cobra.Command, args []string) error {
+	return clip.AttachProfile(*attachProfileOpts)
+}
@@ -0,0 +1,25 @@
+package commands
+
+import (
+	"github.com/NilayYadav/clip/pkg/clip"
+	"github.com/spf13/cobra"
+)
+
+var repackOpts = &clip.RepackOptions{}
+
+var RepackCmd = &cobra.Command{
+	Use:   "repack <in.clip> <out.clip>",
+	Short: "Rewrite an archive dropping unreferenced and duplicate data",
+	Args:  cobra.ExactArgs(2),
+	RunE:  runRepack,
+}
+
+func init() {
+	RepackCmd.Flags().BoolVar(&repackOpts.AccessOrder, "access-order", false, "Put the data of files in the archive's prefetch profile first, in the order they are read")
+	RepackCmd.Flags().BoolVarP(&repackOpts.Verbose, "verbose", "v", false, "Verbose output")
+}
+
+func runRepack(cmd *cobra.Command, args []string) error {
+	repackOpts.InputFile, repackOpts.OutputFile = args[0], args[1]
+	return clip.RepackArchive(*repackOpts)
+}
@@ -0,0 +1,29 @@
+package commands
+
+import (
+	"github.com/spf13/cobra"
+)
+
+// Setup adds the flags every command takes to the root command. Before a command runs its flags are
+// filled in from CLIP_* environment variables and then from the config file, see applyEnv, flags
+// given on the command line always win.
+func Setup(root *cobra.Command) {
+	root.PersistentFlags().StringVar(&configPath, "config", "", "YAML or TOML file with flag defaults, by default the first of ~/.config/clip/config.{yaml,yml,toml} and /etc/clip/config.{yaml,yml,toml}")
+	root.PersistentFlags().BoolVar(&outputJSON, "json", false, "Print the result as JSON on standard output, with progress and logs on standard error")
+	root.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+		if err := applyEnv(cmd); err != nil {
+			return err
+		}
+		config, err := loadConfig()
+		if err != nil {
+			return err
+		}
+		if config != nil {
+			if err := config.apply(cmd, args); err != nil {
+				return err
+			}
+		}
+		setupOutput()
+		return nil
+	}
+}
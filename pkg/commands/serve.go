@@ -0,0 +1,63 @@
+package commands
+
+import (
+	"os"
+
+	"github.com/NilayYadav/clip/pkg/clip"
+	"github.com/NilayYadav/clip/pkg/common"
+	"github.com/NilayYadav/clip/pkg/storage"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+var ServeCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Publish local archives over HTTP so other hosts can mount them with range requests",
+	RunE:  runServe,
+}
+
+var serveOpts = &clip.ServeOptions{}
+var serveTLS = &common.TLSFiles{}
+
+// addTLSFlags registers the certificate flags shared by every command that talks mutual TLS
+func addTLSFlags(flags *pflag.FlagSet, files *common.TLSFiles) {
+	flags.StringVar(&files.CertFile, "tls-cert", "", "Certificate presented to the other side, reloaded when it changes")
+	flags.StringVar(&files.KeyFile, "tls-key", "", "Private key of --tls-cert")
+	flags.StringVar(&files.CAFile, "tls-ca", "", "CA bundle the other side's certificate must chain to")
+}
+
+// tlsFiles returns nil when no certificate flags were set
+func tlsFiles(files *common.TLSFiles) *common.TLSFiles {
+	if files == nil || files.CertFile == "" && files.KeyFile == "" && files.CAFile == "" {
+		return nil
+	}
+	return files
+}
+
+// httpCredentials collects what HTTP storage needs to reach a protected server, nil if nothing is needed
+func httpCredentials(files *common.TLSFiles) *storage.HTTPClipStorageCredentials {
+	token := os.Getenv("CLIP_HTTP_TOKEN")
+	if token == "" && tlsFiles(files) == nil {
+		return nil
+	}
+	return &storage.HTTPClipStorageCredentials{BearerToken: token, TLS: tlsFiles(files)}
+}
+
+func init() {
+	ServeCmd.Flags().StringArrayVarP(&serveOpts.ArchivePaths, "input", "i", nil, "Archive to publish (repeatable)")
+	ServeCmd.Flags().StringVar(&serveOpts.Addr, "addr", ":8080", "Address to listen on")
+	ServeCmd.Flags().IntVar(&serveOpts.MaxConnections, "max-connections", 0, "Maximum concurrent connections (0 = unlimited)")
+	ServeCmd.Flags().StringVar(&serveOpts.PublicURL, "public-url", "", "Base URL other hosts reach this server at")
+	ServeCmd.Flags().StringVar(&serveOpts.RClipDir, "rclip-dir", "", "Write an RCLIP for every published archive to this directory (needs --public-url)")
+	ServeCmd.Flags().BoolVarP(&serveOpts.Verbose, "verbose", "v", false, "Log every request")
+	ServeCmd.Flags().StringVar(&serveOpts.AuthorizationFile, "authz", "", "JSON file mapping client certificate identities to the archives they may read (needs --tls-cert)")
+	addTLSFlags(ServeCmd.Flags(), serveTLS)
+
+	ServeCmd.MarkFlagRequired("input")
+}
+
+func runServe(cmd *cobra.Command, args []string) error {
+	serveOpts.BearerToken = os.Getenv("CLIP_HTTP_TOKEN")
+	serveOpts.TLS = tlsFiles(serveTLS)
+	return clip.Serve(*serveOpts)
+}
@@ -0,0 +1,85 @@
+//go:build !windows
+
+package commands
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/NilayYadav/clip/pkg/clip"
+	"github.com/NilayYadav/clip/pkg/common"
+	"github.com/NilayYadav/clip/pkg/sidecar"
+	"github.com/NilayYadav/clip/pkg/storage"
+	"github.com/spf13/cobra"
+)
+
+var sidecarOpts = &sidecar.Options{}
+var sidecarArchives []string
+var sidecarS3 = &storage.S3ClipStorageCredentials{}
+var sidecarProxy = &storage.ProxyConfig{}
+var sidecarTLS = &common.TLSFiles{}
+var sidecarKeyFile string
+
+var SidecarCmd = &cobra.Command{
+	Use:   "sidecar",
+	Short: "Mount archives into a volume shared by the containers of a Kubernetes pod, ready once they are warm",
+	Long: "Mount archives into a volume shared by the containers of a Kubernetes pod, and keep them mounted until SIGTERM.\n\n" +
+		"Run it as a native sidecar, an init container with restartPolicy: Always, with a startupProbe on /readyz so the " +
+		"other containers only start once the archives are mounted and warm, or as a plain sidecar with a readinessProbe. " +
+		"The volume, like an emptyDir, must be mounted with mountPropagation: Bidirectional here, which needs a privileged " +
+		"container, and HostToContainer in the containers reading it.",
+	Args: cobra.NoArgs,
+	RunE: runSidecar,
+}
+
+func init() {
+	mount := &sidecarOpts.Mount
+	SidecarCmd.Flags().StringVar(&sidecarOpts.Root, "root", "", "Volume shared with the pod's containers to mount the archives under")
+	SidecarCmd.Flags().StringArrayVarP(&sidecarArchives, "archive", "a", nil, "Archive to mount under --root, as path[=dir], dir defaults to its name without extension (repeatable)")
+	SidecarCmd.Flags().StringArrayVar(&sidecarOpts.Warm, "warm", nil, "File or directory under --root to read in full before the pod is ready (repeatable)")
+	SidecarCmd.Flags().IntVar(&sidecarOpts.WarmConcurrency, "warm-concurrency", sidecar.DefaultWarmConcurrency, "Files read at once while warming")
+	SidecarCmd.Flags().StringVar(&sidecarOpts.ReadyAddr, "ready-addr", ":8080", "Answer /readyz and /healthz probes on this address, or unix:<path> for a socket")
+	SidecarCmd.Flags().StringVar(&sidecarOpts.ReadyFile, "ready-file", "", "File created once the archives are mounted and warm, removed when they are unmounted")
+	SidecarCmd.Flags().BoolVarP(&mount.Verbose, "verbose", "v", false, "Verbose output")
+	SidecarCmd.Flags().Int64Var(&mount.MemoryCacheSize, "memory-cache-size", 0, "Bytes of file content to cache in memory for all the archives (0 = disabled)")
+	SidecarCmd.Flags().StringVar(&mount.DiskCacheDir, "disk-cache-dir", "", "Directory to cache file content in on local disk for all the archives")
+	SidecarCmd.Flags().Int64Var(&mount.DiskCacheSize, "disk-cache-size", 1<<30, "Bytes of file content to cache on local disk")
+	SidecarCmd.Flags().Int64Var(&mount.CacheBlockSize, "cache-block-size", 1<<20, "Size of the blocks file content is cached in")
+	SidecarCmd.Flags().Int64Var(&mount.ReadAhead, "read-ahead", 1<<17, "Bytes the kernel reads ahead of sequential reads")
+	SidecarCmd.Flags().BoolVar(&mount.OfflineMode, "offline", false, "Keep serving cached content when storage is unreachable, uncached reads fail with EHOSTUNREACH until it's back")
+	SidecarCmd.Flags().StringVar(&mount.DebugAddr, "debug-addr", "", "Serve expvar counters of every mount at /debug/vars on this address, or unix:<path>")
+	SidecarCmd.Flags().BoolVar(&mount.Pprof, "pprof", false, "Also serve CPU, heap and goroutine profiles at /debug/pprof/ on --debug-addr")
+	SidecarCmd.Flags().StringVar(&sidecarKeyFile, "encryption-key", "", "File holding the key to decrypt encrypted files with, reading them fails with EACCES without it")
+	addS3Flags(SidecarCmd.Flags(), sidecarS3)
+	addProxyFlags(SidecarCmd.Flags(), sidecarProxy)
+	SidecarCmd.Flags().StringVar(&sidecarS3.Endpoint, "s3-endpoint", "", "Reach S3 at this endpoint instead of the one stored in each archive")
+	addLimitFlags(SidecarCmd.Flags(), &mount.Limits)
+	addTLSFlags(SidecarCmd.Flags(), sidecarTLS)
+}
+
+func runSidecar(cmd *cobra.Command, args []string) error {
+	for _, spec := range sidecarArchives {
+		archivePath, prefix := archiveSpec(spec)
+		sidecarOpts.Mounts = append(sidecarOpts.Mounts, clip.ArchiveMount{ArchivePath: archivePath, Prefix: prefix})
+	}
+
+	sidecarOpts.Mount.Credentials.HTTP = httpCredentials(sidecarTLS)
+	sidecarOpts.Mount.Credentials.S3 = s3Credentials(sidecarS3)
+	sidecarOpts.Mount.Credentials.Proxy = proxyConfig(sidecarProxy)
+	sidecarOpts.Mount.Mmap = true
+
+	key, err := encryptionKey(sidecarKeyFile)
+	if err != nil {
+		return err
+	}
+	sidecarOpts.Mount.EncryptionKey = key
+
+	// Kubernetes sends SIGTERM when the pod goes away, the root command's handler exits without unmounting
+	signal.Reset(os.Interrupt)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	return sidecar.Run(ctx, *sidecarOpts)
+}
@@ -1,8 +1,16 @@
 package commands
 
 import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
 	"github.com/NilayYadav/clip/pkg/clip"
+	"github.com/NilayYadav/clip/pkg/common"
+	"github.com/NilayYadav/clip/pkg/storage"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
 var StoreCmd = &cobra.Command{
@@ -16,7 +24,34 @@ var StoreS3Cmd = &cobra.Command{
 	RunE:  runStoreS3,
 }
 
+var StoreSFTPCmd = &cobra.Command{
+	Use:   "sftp",
+	Short: "Generate an RCLIP archive backed by an SFTP host.",
+	RunE:  runStoreSFTP,
+}
+
+var StoreIPFSCmd = &cobra.Command{
+	Use:   "ipfs",
+	Short: "Publish CLIP contents to IPFS and generate an RCLIP archive pointing at them.",
+	RunE:  runStoreIPFS,
+}
+
+var StoreHTTPCmd = &cobra.Command{
+	Use:   "http",
+	Short: "Upload a CLIP archive with HTTP PUT and generate an RCLIP archive that reads it with range requests.",
+	RunE:  runStoreHTTP,
+}
+
 var storeS3Opts = &clip.StoreS3Options{}
+var storeHTTPTLS = &common.TLSFiles{}
+var storeHTTPOpts = &clip.StoreHTTPOptions{}
+var storeIPFSOpts = &clip.StoreIPFSOptions{}
+var storeSFTPOpts = &clip.StoreSFTPOptions{}
+var sftpCredentials = &storage.SFTPClipStorageCredentials{}
+var storeS3Credentials = &storage.S3ClipStorageCredentials{}
+var storeProxy = &storage.ProxyConfig{}
+var storeS3ContentAddressed bool
+var storeS3Replicas []string
 
 func init() {
 	StoreCmd.AddCommand(StoreS3Cmd)
@@ -25,12 +60,199 @@ func init() {
 	StoreS3Cmd.Flags().StringVarP(&storeS3Opts.OutputFile, "output", "o", "", "Output RCLIP archive path")
 	StoreS3Cmd.Flags().StringVarP(&storeS3Opts.Bucket, "bucket", "b", "", "S3 bucket name")
 	StoreS3Cmd.Flags().StringVarP(&storeS3Opts.Key, "key", "k", "", "S3 bucket key (optional)")
+	StoreS3Cmd.Flags().StringVar(&storeS3Opts.Region, "region", "", "S3 region (defaults to AWS_REGION or the profile's region)")
+	StoreS3Cmd.Flags().StringVar(&storeS3Opts.Endpoint, "endpoint", "", "Endpoint of an S3 compatible service, stored in the RCLIP")
+	StoreS3Cmd.Flags().BoolVar(&storeS3Opts.ForcePathStyle, "force-path-style", false, "Address the bucket in the path instead of the host name")
+	StoreS3Cmd.Flags().StringVar(&storeS3Opts.CAFile, "ca-bundle", "", "CA bundle of a private endpoint, stored in the RCLIP so mounts trust it too")
+	StoreS3Cmd.Flags().BoolVar(&storeS3ContentAddressed, "content-addressed", false, "Store the archive as <key>/<sha256>.clip, skipping the upload if it's already there, and print the digest")
+	StoreS3Cmd.Flags().StringArrayVar(&storeS3Replicas, "replica", nil, "Also store the archive at this location, e.g. s3://bucket[/key][?region=&endpoint=], mounts fail over to replicas in order (repeatable)")
+	addS3Flags(StoreS3Cmd.Flags(), storeS3Credentials)
+	addProxyFlags(StoreS3Cmd.Flags(), storeProxy)
+	StoreS3Cmd.Flags().Int64Var(&storeS3Opts.UploadBytesPerSecond, "upload-bytes-per-sec", 0, "Limit upload bandwidth to this many bytes per second (0 = unlimited)")
 
 	StoreS3Cmd.MarkFlagRequired("input")
 	StoreS3Cmd.MarkFlagRequired("output")
 	StoreS3Cmd.MarkFlagRequired("bucket")
+
+	StoreCmd.AddCommand(StoreSFTPCmd)
+
+	StoreSFTPCmd.Flags().StringVarP(&storeSFTPOpts.ArchivePath, "input", "i", "", "Input CLIP archive path")
+	StoreSFTPCmd.Flags().StringVarP(&storeSFTPOpts.OutputFile, "output", "o", "", "Output RCLIP archive path")
+	StoreSFTPCmd.Flags().StringVar(&storeSFTPOpts.Host, "host", "", "SFTP host, as host[:port]")
+	StoreSFTPCmd.Flags().StringVarP(&storeSFTPOpts.User, "user", "u", "", "SFTP user")
+	StoreSFTPCmd.Flags().StringVarP(&storeSFTPOpts.Path, "path", "p", "", "Remote archive path (optional)")
+	StoreSFTPCmd.Flags().StringVar(&sftpCredentials.PrivateKeyPath, "identity", "", "Private key used to authenticate (optional)")
+	StoreSFTPCmd.Flags().StringVar(&sftpCredentials.KnownHostsPath, "known-hosts", "", "known_hosts file used to verify the host (optional)")
+	StoreSFTPCmd.Flags().BoolVar(&sftpCredentials.InsecureIgnoreHostKey, "insecure-ignore-host-key", false, "Skip host key verification")
+	StoreSFTPCmd.Flags().Int64Var(&storeSFTPOpts.UploadBytesPerSecond, "upload-bytes-per-sec", 0, "Limit upload bandwidth to this many bytes per second (0 = unlimited)")
+
+	StoreSFTPCmd.MarkFlagRequired("input")
+	StoreSFTPCmd.MarkFlagRequired("output")
+	StoreSFTPCmd.MarkFlagRequired("host")
+	StoreSFTPCmd.MarkFlagRequired("user")
+
+	StoreCmd.AddCommand(StoreIPFSCmd)
+
+	StoreIPFSCmd.Flags().StringVarP(&storeIPFSOpts.ArchivePath, "input", "i", "", "Input CLIP archive path")
+	StoreIPFSCmd.Flags().StringVarP(&storeIPFSOpts.OutputFile, "output", "o", "", "Output RCLIP archive path")
+	StoreIPFSCmd.Flags().StringVar(&storeIPFSOpts.APIURL, "api", "http://127.0.0.1:5001", "RPC API of the IPFS daemon to publish to")
+	StoreIPFSCmd.Flags().StringVar(&storeIPFSOpts.GatewayURL, "gateway", "", "Gateway used to read the content when mounted (optional, defaults to the daemon API)")
+	addProxyFlags(StoreIPFSCmd.Flags(), storeProxy)
+	StoreIPFSCmd.Flags().Int64Var(&storeIPFSOpts.UploadBytesPerSecond, "upload-bytes-per-sec", 0, "Limit upload bandwidth to this many bytes per second (0 = unlimited)")
+
+	StoreIPFSCmd.MarkFlagRequired("input")
+	StoreIPFSCmd.MarkFlagRequired("output")
+
+	StoreCmd.AddCommand(StoreHTTPCmd)
+
+	StoreHTTPCmd.Flags().StringVarP(&storeHTTPOpts.ArchivePath, "input", "i", "", "Input CLIP archive path")
+	StoreHTTPCmd.Flags().StringVarP(&storeHTTPOpts.OutputFile, "output", "o", "", "Output RCLIP archive path")
+	StoreHTTPCmd.Flags().StringVarP(&storeHTTPOpts.URL, "url", "u", "", "URL the archive is uploaded to and served from")
+	addTLSFlags(StoreHTTPCmd.Flags(), storeHTTPTLS)
+	addProxyFlags(StoreHTTPCmd.Flags(), storeProxy)
+	StoreHTTPCmd.Flags().Int64Var(&storeHTTPOpts.UploadBytesPerSecond, "upload-bytes-per-sec", 0, "Limit upload bandwidth to this many bytes per second (0 = unlimited)")
+
+	StoreHTTPCmd.MarkFlagRequired("input")
+	StoreHTTPCmd.MarkFlagRequired("output")
+	StoreHTTPCmd.MarkFlagRequired("url")
+}
+
+// addS3Flags registers the flags picking how S3 credentials are resolved
+func addS3Flags(flags *pflag.FlagSet, creds *storage.S3ClipStorageCredentials) {
+	flags.StringVar(&creds.Profile, "s3-profile", "", "Shared config profile to load S3 credentials from (defaults to AWS_PROFILE)")
+	flags.StringVar(&creds.RoleARN, "s3-role-arn", "", "Role to assume for S3 access")
+	flags.StringVar(&creds.ExternalID, "s3-external-id", "", "External ID to assume --s3-role-arn with")
+	flags.StringVar(&creds.RoleSessionName, "s3-role-session-name", "", "Session name to assume --s3-role-arn with")
+	flags.StringVar(&creds.WebIdentityTokenFile, "s3-web-identity-token-file", "", "OIDC token file to assume --s3-role-arn with, as with IRSA")
+
+	creds.TLS = &common.TLSFiles{}
+	flags.StringVar(&creds.TLS.CertFile, "s3-tls-cert", "", "Client certificate presented to the S3 endpoint")
+	flags.StringVar(&creds.TLS.KeyFile, "s3-tls-key", "", "Private key of --s3-tls-cert")
+	flags.StringVar(&creds.TLS.CAFile, "s3-tls-ca", "", "CA bundle trusted for the S3 endpoint, on top of the system's")
+	flags.BoolVar(&creds.InsecureSkipVerify, "s3-insecure-skip-verify", false, "Don't verify the S3 endpoint's certificate")
+}
+
+// addProxyFlags registers the flags overriding the proxy settings of the environment
+func addProxyFlags(flags *pflag.FlagSet, proxy *storage.ProxyConfig) {
+	flags.StringVar(&proxy.URL, "proxy", "", "Proxy for remote storage requests, instead of HTTP_PROXY and HTTPS_PROXY")
+	flags.StringVar(&proxy.NoProxy, "no-proxy", "", "Hosts reached without the proxy, comma separated, instead of NO_PROXY")
+}
+
+// proxyConfig returns nil when no proxy flags were set, leaving the choice to the environment
+func proxyConfig(proxy *storage.ProxyConfig) *storage.ProxyConfig {
+	if *proxy == (storage.ProxyConfig{}) {
+		return nil
+	}
+	return proxy
+}
+
+// s3Credentials returns nil when no S3 flags were set
+func s3Credentials(creds *storage.S3ClipStorageCredentials) *storage.S3ClipStorageCredentials {
+	creds.TLS = tlsFiles(creds.TLS)
+	if *creds == (storage.S3ClipStorageCredentials{}) {
+		return nil
+	}
+	return creds
+}
+
+// parseReplica parses the location of a replica given to --replica, see storage.ParseLocation. The
+// key of replicas in S3 defaults to the key the archive is stored at.
+func parseReplica(location string, key string) (common.ClipStorageInfo, error) {
+	info, _, err := storage.ParseLocation(location)
+	if err != nil {
+		return nil, err
+	}
+	if info == nil {
+		return nil, fmt.Errorf("replica %q isn't in remote storage", location)
+	}
+	if s3Info, ok := info.(*common.S3StorageInfo); ok && s3Info.Key == "" {
+		s3Info.Key = key
+	}
+	return info, nil
 }
 
 func runStoreS3(cmd *cobra.Command, args []string) error {
-	return clip.StoreS3(*storeS3Opts)
+	storeS3Opts.Credentials.S3 = s3Credentials(storeS3Credentials)
+	storeS3Opts.Credentials.Proxy = proxyConfig(storeProxy)
+
+	key := storeS3Opts.Key
+	if key == "" && !storeS3ContentAddressed {
+		key = filepath.Base(storeS3Opts.ArchivePath)
+	}
+	for _, uri := range storeS3Replicas {
+		replica, err := parseReplica(uri, key)
+		if err != nil {
+			return err
+		}
+		storeS3Opts.Replicas = append(storeS3Opts.Replicas, replica)
+	}
+
+	start := time.Now()
+	if storeS3ContentAddressed {
+		digest, err := clip.StoreS3ContentAddressed(*storeS3Opts)
+		if err != nil {
+			return err
+		}
+		if !outputJSON {
+			fmt.Println(digest)
+			return nil
+		}
+		return printStoreResult(storeS3Opts.ArchivePath, storeS3Opts.OutputFile, "s3", start)
+	}
+
+	if err := clip.StoreS3(*storeS3Opts); err != nil {
+		return err
+	}
+	return printStoreResult(storeS3Opts.ArchivePath, storeS3Opts.OutputFile, "s3", start)
+}
+
+func runStoreSFTP(cmd *cobra.Command, args []string) error {
+	sftpCredentials.Password = os.Getenv("SFTP_PASSWORD")
+	storeSFTPOpts.Credentials.SFTP = sftpCredentials
+
+	start := time.Now()
+	if err := clip.StoreSFTP(*storeSFTPOpts); err != nil {
+		return err
+	}
+	return printStoreResult(storeSFTPOpts.ArchivePath, storeSFTPOpts.OutputFile, "sftp", start)
+}
+
+func runStoreIPFS(cmd *cobra.Command, args []string) error {
+	storeIPFSOpts.Credentials.Proxy = proxyConfig(storeProxy)
+
+	start := time.Now()
+	if err := clip.StoreIPFS(*storeIPFSOpts); err != nil {
+		return err
+	}
+	return printStoreResult(storeIPFSOpts.ArchivePath, storeIPFSOpts.OutputFile, "ipfs", start)
+}
+
+func runStoreHTTP(cmd *cobra.Command, args []string) error {
+	storeHTTPOpts.Credentials.HTTP = httpCredentials(storeHTTPTLS)
+	storeHTTPOpts.Credentials.Proxy = proxyConfig(storeProxy)
+
+	start := time.Now()
+	if err := clip.StoreHTTP(*storeHTTPOpts); err != nil {
+		return err
+	}
+	return printStoreResult(storeHTTPOpts.ArchivePath, storeHTTPOpts.OutputFile, "http", start)
+}
+
+// printStoreResult prints the result of storing an archive with --json
+func printStoreResult(archivePath string, rclipPath string, storageType string, start time.Time) error {
+	if !outputJSON {
+		return nil
+	}
+	size, digest, err := archiveDigest(archivePath)
+	if err != nil {
+		return err
+	}
+	return printJSON(storeResult{
+		Archive:    archivePath,
+		RCLIP:      rclipPath,
+		Storage:    storageType,
+		Digest:     digest,
+		Size:       size,
+		DurationMs: since(start),
+	})
 }
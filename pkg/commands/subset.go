@@ -0,0 +1,26 @@
+package commands
+
+import (
+	"github.com/NilayYadav/clip/pkg/clip"
+	"github.com/spf13/cobra"
+)
+
+var subsetOpts = &clip.SubsetOptions{}
+
+var SubsetCmd = &cobra.Command{
+	Use:   "subset <in.clip> <out.clip>",
+	Short: "Create an archive holding only some paths of an existing archive",
+	Args:  cobra.ExactArgs(2),
+	RunE:  runSubset,
+}
+
+func init() {
+	SubsetCmd.Flags().StringArrayVarP(&subsetOpts.Paths, "path", "p", nil, "Path or glob pattern to keep, like /usr/lib/** or *.so, directories are kept with everything in them (repeatable)")
+	SubsetCmd.Flags().BoolVarP(&subsetOpts.Verbose, "verbose", "v", false, "Verbose output")
+	SubsetCmd.MarkFlagRequired("path")
+}
+
+func runSubset(cmd *cobra.Command, args []string) error {
+	subsetOpts.InputFile, subsetOpts.OutputFile = args[0], args[1]
+	return clip.SubsetArchive(*subsetOpts)
+}
@@ -0,0 +1,31 @@
+package commands
+
+import (
+	"context"
+
+	"github.com/NilayYadav/clip/pkg/clip"
+	"github.com/spf13/cobra"
+)
+
+var syncOpts = &clip.SyncOptions{}
+var syncStorage = &storageFlags{}
+
+var SyncCmd = &cobra.Command{
+	Use:   "sync <source> <destination>",
+	Short: "Copy an archive between storage locations, e.g. s3://us/app.clip s3://eu/app.clip, checking it on the way",
+	Args:  cobra.ExactArgs(2),
+	RunE:  runSync,
+}
+
+func init() {
+	SyncCmd.Flags().StringVarP(&syncOpts.OutputFile, "output", "o", "", "Also write an RCLIP pointing at the destination here")
+	SyncCmd.Flags().StringVar(&syncOpts.StagingDir, "staging-dir", "", "Directory holding the partial copy an interrupted sync resumes from (defaults to the temp dir)")
+	addStorageFlags(SyncCmd.Flags(), syncStorage)
+	SyncCmd.Flags().Int64Var(&syncOpts.UploadBytesPerSecond, "upload-bytes-per-sec", 0, "Limit upload bandwidth to this many bytes per second (0 = unlimited)")
+}
+
+func runSync(cmd *cobra.Command, args []string) error {
+	syncOpts.Source, syncOpts.Destination = args[0], args[1]
+	syncOpts.Credentials = syncStorage.credentials()
+	return clip.Sync(context.Background(), *syncOpts)
+}
@@ -0,0 +1,193 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             v4.25.1
+// source: contentcache.proto
+
+package contentcache
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	ContentCache_GetContent_FullMethodName   = "/clip.contentcache.v1.ContentCache/GetContent"
+	ContentCache_StoreContent_FullMethodName = "/clip.contentcache.v1.ContentCache/StoreContent"
+)
+
+// ContentCacheClient is the client API for ContentCache service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type ContentCacheClient interface {
+	// GetContent returns up to length bytes of content starting at offset.
+	// Reads past the end of the content return fewer bytes, or none at all.
+	GetContent(ctx context.Context, in *GetContentRequest, opts ...grpc.CallOption) (*GetContentResponse, error)
+	// StoreContent receives content as a stream of chunks, in order, and replies
+	// with the hash it was stored under once the stream is closed by the client.
+	// If the first message sets a key the content is stored under that key instead,
+	// and later GetContent calls use it in place of the hash.
+	StoreContent(ctx context.Context, opts ...grpc.CallOption) (ContentCache_StoreContentClient, error)
+}
+
+type contentCacheClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewContentCacheClient(cc grpc.ClientConnInterface) ContentCacheClient {
+	return &contentCacheClient{cc}
+}
+
+func (c *contentCacheClient) GetContent(ctx context.Context, in *GetContentRequest, opts ...grpc.CallOption) (*GetContentResponse, error) {
+	out := new(GetContentResponse)
+	err := c.cc.Invoke(ctx, ContentCache_GetContent_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *contentCacheClient) StoreContent(ctx context.Context, opts ...grpc.CallOption) (ContentCache_StoreContentClient, error) {
+	stream, err := c.cc.NewStream(ctx, &ContentCache_ServiceDesc.Streams[0], ContentCache_StoreContent_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &contentCacheStoreContentClient{stream}
+	return x, nil
+}
+
+type ContentCache_StoreContentClient interface {
+	Send(*StoreContentRequest) error
+	CloseAndRecv() (*StoreContentResponse, error)
+	grpc.ClientStream
+}
+
+type contentCacheStoreContentClient struct {
+	grpc.ClientStream
+}
+
+func (x *contentCacheStoreContentClient) Send(m *StoreContentRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *contentCacheStoreContentClient) CloseAndRecv() (*StoreContentResponse, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(StoreContentResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ContentCacheServer is the server API for ContentCache service.
+// All implementations must embed UnimplementedContentCacheServer
+// for forward compatibility
+type ContentCacheServer interface {
+	// GetContent returns up to length bytes of content starting at offset.
+	// Reads past the end of the content return fewer bytes, or none at all.
+	GetContent(context.Context, *GetContentRequest) (*GetContentResponse, error)
+	// StoreContent receives content as a stream of chunks, in order, and replies
+	// with the hash it was stored under once the stream is closed by the client.
+	// If the first message sets a key the content is stored under that key instead,
+	// and later GetContent calls use it in place of the hash.
+	StoreContent(ContentCache_StoreContentServer) error
+	mustEmbedUnimplementedContentCacheServer()
+}
+
+// UnimplementedContentCacheServer must be embedded to have forward compatible implementations.
+type UnimplementedContentCacheServer struct {
+}
+
+func (UnimplementedContentCacheServer) GetContent(context.Context, *GetContentRequest) (*GetContentResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetContent not implemented")
+}
+func (UnimplementedContentCacheServer) StoreContent(ContentCache_StoreContentServer) error {
+	return status.Errorf(codes.Unimplemented, "method StoreContent not implemented")
+}
+func (UnimplementedContentCacheServer) mustEmbedUnimplementedContentCacheServer() {}
+
+// UnsafeContentCacheServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ContentCacheServer will
+// result in compilation errors.
+type UnsafeContentCacheServer interface {
+	mustEmbedUnimplementedContentCacheServer()
+}
+
+func RegisterContentCacheServer(s grpc.ServiceRegistrar, srv ContentCacheServer) {
+	s.RegisterService(&ContentCache_ServiceDesc, srv)
+}
+
+func _ContentCache_GetContent_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetContentRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ContentCacheServer).GetContent(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ContentCache_GetContent_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ContentCacheServer).GetContent(ctx, req.(*GetContentRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ContentCache_StoreContent_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(ContentCacheServer).StoreContent(&contentCacheStoreContentServer{stream})
+}
+
+type ContentCache_StoreContentServer interface {
+	SendAndClose(*StoreContentResponse) error
+	Recv() (*StoreContentRequest, error)
+	grpc.ServerStream
+}
+
+type contentCacheStoreContentServer struct {
+	grpc.ServerStream
+}
+
+func (x *contentCacheStoreContentServer) SendAndClose(m *StoreContentResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *contentCacheStoreContentServer) Recv() (*StoreContentRequest, error) {
+	m := new(StoreContentRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ContentCache_ServiceDesc is the grpc.ServiceDesc for ContentCache service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var ContentCache_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "clip.contentcache.v1.ContentCache",
+	HandlerType: (*ContentCacheServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetContent",
+			Handler:    _ContentCache_GetContent_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StoreContent",
+			Handler:       _ContentCache_StoreContent_Handler,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "contentcache.proto",
+}
@@ -0,0 +1,66 @@
+package common
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+)
+
+const EncryptionKeyLength = 32 // AES-256
+
+// LoadEncryptionKey reads a key file holding either the raw 32 key bytes or their hex encoding
+func LoadEncryptionKey(name string) ([]byte, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) == EncryptionKeyLength {
+		return data, nil
+	}
+
+	key, err := hex.DecodeString(string(bytes.TrimSpace(data)))
+	if err != nil || len(key) != EncryptionKeyLength {
+		return nil, fmt.Errorf("invalid key file %s: want %d bytes, raw or hex encoded", name, EncryptionKeyLength)
+	}
+	return key, nil
+}
+
+// EncryptionKeyID identifies a key without revealing it, so a wrong key is caught before any file is read
+func EncryptionKeyID(key []byte) []byte {
+	id := sha256.Sum256(append([]byte("clip-key-id:"), key...))
+	return id[:8]
+}
+
+// NewContentCipher returns the AES-CTR keystream of a file positioned at off. CTR lets files be
+// decrypted at any offset, which reads through fuse need.
+func NewContentCipher(key []byte, iv []byte, off int64) (cipher.Stream, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != block.BlockSize() {
+		return nil, fmt.Errorf("invalid iv length %d", len(iv))
+	}
+
+	// Advance the big endian counter to the block holding off, then skip into that block
+	counter := make([]byte, len(iv))
+	copy(counter, iv)
+	carry := uint64(off / int64(block.BlockSize()))
+	for i := len(counter) - 1; i >= 0 && carry > 0; i-- {
+		sum := uint64(counter[i]) + carry&0xff
+		counter[i] = byte(sum)
+		carry = carry>>8 + sum>>8
+	}
+
+	stream := cipher.NewCTR(block, counter)
+	if skip := off % int64(block.BlockSize()); skip > 0 {
+		discard := make([]byte, skip)
+		stream.XORKeyStream(discard, discard)
+	}
+	return stream, nil
+}
@@ -2,8 +2,39 @@ package common
 
 import "errors"
 
+// Kinds of failure callers can tell apart with errors.Is, the errors returned by clip wrap one of them
 var (
-	ErrFileHeaderMismatch = errors.New("unexpected file header")
-	ErrCrcMismatch        = errors.New("crc64 mismatch")
-	ErrMissingArchiveRoot = errors.New("no root node found")
+	ErrNotFound           = errors.New("not found")                          // A file of an archive, or an archive in remote storage
+	ErrCorruptArchive     = errors.New("corrupt archive")                    // Archive bytes that can't be decoded
+	ErrUnsupportedVersion = errors.New("unsupported archive format version") // Made by a newer or much older clip
+	ErrRemoteUnavailable  = errors.New("remote storage unavailable")         // Still failing after retries
+	ErrChecksumMismatch   = errors.New("checksum mismatch")                  // Content that isn't what was stored
 )
+
+var (
+	ErrFileHeaderMismatch = NewError("unexpected file header", ErrCorruptArchive)
+	ErrCrcMismatch        = NewError("crc64 mismatch", ErrChecksumMismatch)
+	ErrMissingArchiveRoot = NewError("no root node found", ErrCorruptArchive)
+	ErrArchiveChanged     = errors.New("remote archive changed")
+	ErrStorageOffline     = NewError("storage unreachable and content not cached", ErrRemoteUnavailable)
+	ErrMissingKey         = errors.New("file is encrypted and no key was given")
+)
+
+// NewError returns an error with its own message that errors.Is and errors.As also match to each of
+// kinds, like ErrNotFound, without their messages being added to it
+func NewError(message string, kinds ...error) error {
+	return &kindError{message: message, kinds: kinds}
+}
+
+type kindError struct {
+	message string
+	kinds   []error
+}
+
+func (e *kindError) Error() string {
+	return e.message
+}
+
+func (e *kindError) Unwrap() []error {
+	return e.kinds
+}
@@ -8,8 +8,15 @@ import (
 var ClipFileStartBytes []byte = []byte{0x89, 0x43, 0x4C, 0x49, 0x50, 0x0D, 0x0A, 0x1A, 0x0A}
 
 const (
-	ClipHeaderLength            = 54
-	ClipFileFormatVersion uint8 = 0x01
+	ClipHeaderLength               = 54
+	ClipFileFormatVersion    uint8 = 0x02 // Archives with a compressed index, which older clip can't read
+	ClipFileFormatVersionMin uint8 = 0x01 // Oldest version read, archives from before the index was compressed
+)
+
+const (
+	ClipHeaderFlagCompressedIndex uint8 = 1 << iota // The index section is zstd compressed
+
+	ClipHeaderKnownFlags = ClipHeaderFlagCompressedIndex
 )
 
 type ClipArchiveHeader struct {
@@ -19,7 +26,8 @@ type ClipArchiveHeader struct {
 	IndexPos              int64
 	StorageInfoLength     int64
 	StorageInfoPos        int64
-	StorageInfoType       [12]byte
+	StorageInfoType       [11]byte
+	Flags                 uint8 // Was the last byte of StorageInfoType, which type names never reach, so older archives have no flags set
 }
 
 /*
@@ -56,6 +64,7 @@ type S3StorageInfo struct {
 	Key            string
 	Endpoint       string
 	ForcePathStyle bool
+	CABundle       []byte // PEM encoded CAs the endpoint's certificate may also be issued by, for private CAs
 }
 
 func (ssi S3StorageInfo) Type() string {
@@ -71,3 +80,95 @@ func (ssi S3StorageInfo) Encode() ([]byte, error) {
 
 	return buf.Bytes(), nil
 }
+
+type SFTPStorageInfo struct {
+	Host string // host:port, port defaults to 22
+	User string
+	Path string
+}
+
+func (ssi SFTPStorageInfo) Type() string {
+	return "sftp"
+}
+
+func (ssi SFTPStorageInfo) Encode() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	if err := enc.Encode(ssi); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+type IPFSStorageInfo struct {
+	GatewayURL string            // Used for reads if set, otherwise content is read through APIURL
+	APIURL     string            // RPC API of the daemon the content was published to
+	CIDs       map[string]string // ContentHash -> CID of the file content
+}
+
+func (isi IPFSStorageInfo) Type() string {
+	return "ipfs"
+}
+
+func (isi IPFSStorageInfo) Encode() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	if err := enc.Encode(isi); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+type HTTPStorageInfo struct {
+	URL  string
+	ETag string // Pins the archive version, if empty the first ETag seen when mounting is used
+}
+
+func (hsi HTTPStorageInfo) Type() string {
+	return "http"
+}
+
+func (hsi HTTPStorageInfo) Encode() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	if err := enc.Encode(hsi); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// MirrorStorageInfo describes an archive stored in several places. Mounts read from the first
+// replica that works and fail over to the next ones in order.
+type MirrorStorageInfo struct {
+	Replicas []StorageInfoWrapper // Storage info of each replica, wrapped as in an rclip
+}
+
+// NewMirrorStorageInfo returns the storage info of an archive stored at each of replicas
+func NewMirrorStorageInfo(replicas ...ClipStorageInfo) (*MirrorStorageInfo, error) {
+	info := &MirrorStorageInfo{}
+	for _, replica := range replicas {
+		data, err := replica.Encode()
+		if err != nil {
+			return nil, err
+		}
+		info.Replicas = append(info.Replicas, StorageInfoWrapper{Type: replica.Type(), Data: data})
+	}
+	return info, nil
+}
+
+func (msi MirrorStorageInfo) Type() string {
+	return "mirror"
+}
+
+func (msi MirrorStorageInfo) Encode() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	if err := enc.Encode(msi); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,191 @@
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+)
+
+// SearchBinaryPeek is how close to their start text files have no NUL byte, as for git grep
+const SearchBinaryPeek = 8000
+
+// SearchIndex maps the trigrams in the text files of an archive, case folded, to the files holding
+// them, so content searches only read files that may match. Files in neither Paths nor Binary, like
+// encrypted files, aren't indexed.
+type SearchIndex struct {
+	Paths    []string // Text files
+	Binary   []string // Files with a NUL byte in their first SearchBinaryPeek bytes
+	Trigrams []uint32 // Sorted
+	Postings [][]byte // Positions in Paths of the files holding each trigram, as varint deltas
+}
+
+// Trigram returns the trigram of three bytes, ASCII letters folded to lower case
+func Trigram(a, b, c byte) uint32 {
+	return uint32(foldByte(a))<<16 | uint32(foldByte(b))<<8 | uint32(foldByte(c))
+}
+
+func foldByte(b byte) byte {
+	if 'A' <= b && b <= 'Z' {
+		return b + 'a' - 'A'
+	}
+	return b
+}
+
+// Lookup returns the text files holding all of trigrams
+func (s *SearchIndex) Lookup(trigrams []uint32) []string {
+	var files []uint32
+	for i, trigram := range trigrams {
+		j := sort.Search(len(s.Trigrams), func(k int) bool { return s.Trigrams[k] >= trigram })
+		if j == len(s.Trigrams) || s.Trigrams[j] != trigram {
+			return nil
+		}
+
+		posting := decodePosting(s.Postings[j])
+		if i == 0 {
+			files = posting
+			continue
+		}
+		files = intersect(files, posting)
+		if len(files) == 0 {
+			return nil
+		}
+	}
+
+	if len(trigrams) == 0 {
+		return s.Paths
+	}
+	paths := make([]string, len(files))
+	for i, f := range files {
+		paths[i] = s.Paths[f]
+	}
+	return paths
+}
+
+func decodePosting(b []byte) []uint32 {
+	var files []uint32
+	var f uint64
+	for len(b) > 0 {
+		delta, n := binary.Uvarint(b)
+		if n <= 0 {
+			break
+		}
+		f += delta
+		files = append(files, uint32(f))
+		b = b[n:]
+	}
+	return files
+}
+
+func intersect(a, b []uint32) []uint32 {
+	var both []uint32
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			both = append(both, a[i])
+			i, j = i+1, j+1
+		}
+	}
+	return both
+}
+
+// SearchIndexBuilder collects the trigrams of files as they're written to it
+type SearchIndexBuilder struct {
+	paths    []string
+	binary   []string
+	postings map[uint32][]uint32
+}
+
+func NewSearchIndexBuilder() *SearchIndexBuilder {
+	return &SearchIndexBuilder{postings: make(map[uint32][]uint32)}
+}
+
+// File returns a writer taking the content of the file at p, added once it's committed
+func (b *SearchIndexBuilder) File(p string) *SearchIndexFile {
+	return &SearchIndexFile{b: b, path: p, trigrams: make(map[uint32]struct{})}
+}
+
+// Build returns the index of the files added
+func (b *SearchIndexBuilder) Build() *SearchIndex {
+	s := &SearchIndex{Paths: b.paths, Binary: b.binary}
+	for trigram := range b.postings {
+		s.Trigrams = append(s.Trigrams, trigram)
+	}
+	sort.Slice(s.Trigrams, func(i, j int) bool { return s.Trigrams[i] < s.Trigrams[j] })
+
+	for _, trigram := range s.Trigrams {
+		var posting []byte
+		last := uint32(0)
+		for _, f := range b.postings[trigram] {
+			posting = binary.AppendUvarint(posting, uint64(f-last))
+			last = f
+		}
+		s.Postings = append(s.Postings, posting)
+	}
+	return s
+}
+
+// SearchIndexFile is the content of a file being added to a SearchIndexBuilder
+type SearchIndexFile struct {
+	b        *SearchIndexBuilder
+	path     string
+	trigrams map[uint32]struct{}
+	last     []byte // The two bytes before the next write
+	n        int64
+	binary   bool
+}
+
+func (f *SearchIndexFile) Write(p []byte) (int, error) {
+	if f.binary {
+		return len(p), nil
+	}
+	if f.n < SearchBinaryPeek {
+		peek := p
+		if left := SearchBinaryPeek - f.n; int64(len(peek)) > left {
+			peek = peek[:left]
+		}
+		if bytes.IndexByte(peek, 0) >= 0 {
+			f.binary, f.trigrams = true, nil
+			return len(p), nil
+		}
+	}
+	f.n += int64(len(p))
+
+	// Trigrams spanning the previous write, then those within this one
+	head := p
+	if len(head) > 2 {
+		head = head[:2]
+	}
+	f.add(append(f.last, head...))
+	f.add(p)
+
+	f.last = append(f.last, head...)
+	if len(p) >= 2 {
+		f.last = append(f.last[:0], p[len(p)-2:]...)
+	} else if len(f.last) > 2 {
+		f.last = f.last[len(f.last)-2:]
+	}
+	return len(p), nil
+}
+
+func (f *SearchIndexFile) add(b []byte) {
+	for i := 0; i+2 < len(b); i++ {
+		f.trigrams[Trigram(b[i], b[i+1], b[i+2])] = struct{}{}
+	}
+}
+
+// Commit adds the file to the index
+func (f *SearchIndexFile) Commit() {
+	if f.binary {
+		f.b.binary = append(f.b.binary, f.path)
+		return
+	}
+	id := uint32(len(f.b.paths))
+	f.b.paths = append(f.b.paths, f.path)
+	for trigram := range f.trigrams {
+		f.b.postings[trigram] = append(f.b.postings[trigram], id)
+	}
+}
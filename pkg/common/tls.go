@@ -0,0 +1,208 @@
+package common
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// TLSFiles locates the PEM files used for mutual TLS. They are reloaded when they change on
+// disk, so certificates and CAs can be rotated without restarting.
+type TLSFiles struct {
+	CertFile string
+	KeyFile  string
+	CAFile   string // Peers must present a certificate issued by one of these CAs
+}
+
+// How often the files are checked for changes at most
+const tlsReloadInterval = time.Second * 10
+
+type tlsReloader struct {
+	files    TLSFiles
+	mu       sync.Mutex
+	checked  time.Time
+	modTimes [3]time.Time
+	cert     *tls.Certificate
+	pool     *x509.CertPool
+}
+
+func newTLSReloader(files TLSFiles) (*tlsReloader, error) {
+	if files.CertFile == "" || files.KeyFile == "" || files.CAFile == "" {
+		return nil, fmt.Errorf("a certificate, a key and a CA are required for mutual TLS")
+	}
+
+	r := &tlsReloader{files: files}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *tlsReloader) load() error {
+	cert, err := tls.LoadX509KeyPair(r.files.CertFile, r.files.KeyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate: %v", err)
+	}
+
+	caPEM, err := os.ReadFile(r.files.CAFile)
+	if err != nil {
+		return fmt.Errorf("failed to read CA bundle: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return fmt.Errorf("no certificates found in CA bundle %s", r.files.CAFile)
+	}
+
+	r.cert = &cert
+	r.pool = pool
+	r.modTimes = r.currentModTimes()
+	return nil
+}
+
+func (r *tlsReloader) currentModTimes() [3]time.Time {
+	var modTimes [3]time.Time
+	for i, name := range []string{r.files.CertFile, r.files.KeyFile, r.files.CAFile} {
+		if fi, err := os.Stat(name); err == nil {
+			modTimes[i] = fi.ModTime()
+		}
+	}
+	return modTimes
+}
+
+// current returns the latest certificate and CA pool. If reloading changed files fails, e.g. because
+// only the certificate has been replaced so far, the previous ones keep being used.
+func (r *tlsReloader) current() (*tls.Certificate, *x509.CertPool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if time.Since(r.checked) >= tlsReloadInterval {
+		r.checked = time.Now()
+		if r.currentModTimes() != r.modTimes {
+			if err := r.load(); err != nil {
+				log.Printf("err reloading tls files, keeping the previous ones: %v", err)
+			}
+		}
+	}
+
+	return r.cert, r.pool
+}
+
+// ServerTLSConfig requires clients to present a certificate issued by files.CAFile
+func ServerTLSConfig(files TLSFiles) (*tls.Config, error) {
+	r, err := newTLSReloader(files)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, pool := r.current()
+			return &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*cert},
+				ClientCAs:    pool,
+				ClientAuth:   tls.RequireAndVerifyClientCert,
+			}, nil
+		},
+	}, nil
+}
+
+// ClientTLSConfig presents the certificate in files and verifies the server against files.CAFile
+func ClientTLSConfig(files TLSFiles, serverName string) (*tls.Config, error) {
+	r, err := newTLSReloader(files)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: serverName,
+		// Verification is done below so the CA pool can change between connections
+		InsecureSkipVerify: true,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, _ := r.current()
+			return cert, nil
+		},
+		VerifyConnection: func(state tls.ConnectionState) error {
+			_, pool := r.current()
+			opts := x509.VerifyOptions{
+				Roots:         pool,
+				DNSName:       serverName,
+				Intermediates: x509.NewCertPool(),
+			}
+			for _, cert := range state.PeerCertificates[1:] {
+				opts.Intermediates.AddCert(cert)
+			}
+			_, err := state.PeerCertificates[0].Verify(opts)
+			return err
+		},
+	}, nil
+}
+
+// PeerIdentities returns the names a verified client certificate identifies its holder by:
+// its common name and DNS names
+func PeerIdentities(state *tls.ConnectionState) []string {
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return nil
+	}
+
+	cert := state.PeerCertificates[0]
+	identities := append([]string{}, cert.DNSNames...)
+	if cert.Subject.CommonName != "" {
+		identities = append(identities, cert.Subject.CommonName)
+	}
+	return identities
+}
+
+// ArchiveAuthorization lists the archives each client identity may access, as path.Match patterns.
+// The identity "*" applies to every authenticated client.
+type ArchiveAuthorization map[string][]string
+
+// LoadArchiveAuthorization reads an authorization file, a JSON object mapping identities to patterns
+func LoadArchiveAuthorization(name string) (ArchiveAuthorization, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var authz ArchiveAuthorization
+	if err := json.Unmarshal(data, &authz); err != nil {
+		return nil, fmt.Errorf("invalid authorization file %s: %v", name, err)
+	}
+
+	for identity, patterns := range authz {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("invalid pattern %q for %s: %v", pattern, identity, err)
+			}
+		}
+	}
+
+	return authz, nil
+}
+
+// Allowed reports whether any of the identities may access archive
+func (a ArchiveAuthorization) Allowed(identities []string, archive string) bool {
+	matches := func(identity string) bool {
+		for _, pattern := range a[identity] {
+			if ok, _ := path.Match(pattern, archive); ok {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, identity := range identities {
+		if matches(identity) {
+			return true
+		}
+	}
+	return matches("*")
+}
@@ -0,0 +1,48 @@
+package common
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// TraceEntry is a single read recorded while tracing a mount, used to build prefetch profiles.
+// Traces are text files with one read per line, as offset, length and the path inside the archive.
+type TraceEntry struct {
+	Path   string
+	Offset int64
+	Length int64
+}
+
+func (e TraceEntry) String() string {
+	return fmt.Sprintf("%d %d %s", e.Offset, e.Length, e.Path)
+}
+
+// ReadTrace parses a trace in the order the reads happened
+func ReadTrace(r io.Reader) ([]TraceEntry, error) {
+	var entries []TraceEntry
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.SplitN(scanner.Text(), " ", 3)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("invalid trace entry on line %d", line)
+		}
+
+		offset, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid offset on line %d: %v", line, err)
+		}
+
+		length, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid length on line %d: %v", line, err)
+		}
+
+		entries = append(entries, TraceEntry{Path: fields[2], Offset: offset, Length: length})
+	}
+
+	return entries, scanner.Err()
+}
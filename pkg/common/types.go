@@ -3,7 +3,6 @@ package common
 import (
 	"strings"
 
-	"github.com/hanwen/go-fuse/v2/fuse"
 	"github.com/tidwall/btree"
 )
 
@@ -13,16 +12,46 @@ const (
 	DirNode     ClipNodeType = "dir"
 	FileNode    ClipNodeType = "file"
 	SymLinkNode ClipNodeType = "symlink"
+	SpecialNode ClipNodeType = "special" // Device node, fifo or socket, the type is in Attr.Mode and the device in Attr.Rdev
 )
 
+// Attr holds the attributes of a node. Its fields are named like the ones of fuse.Attr, which it
+// replaces in the index, so archives written before decode the same way.
+type Attr struct {
+	Ino       uint64
+	Size      uint64
+	Blocks    uint64 // Number of 512-byte blocks the file occupies
+	Atime     uint64
+	Mtime     uint64
+	Ctime     uint64
+	Atimensec uint32
+	Mtimensec uint32
+	Ctimensec uint32
+	Mode      uint32
+	Nlink     uint32
+	Owner
+	Rdev    uint32
+	Blksize uint32 // Preferred size for file system operations
+	Padding uint32
+}
+
+type Owner struct {
+	Uid uint32
+	Gid uint32
+}
+
 type ClipNode struct {
 	NodeType    ClipNodeType
 	Path        string
-	Attr        fuse.Attr
+	Attr        Attr
 	Target      string
-	ContentHash string
-	DataPos     int64 // Position of the nodes data in the final binary
-	DataLen     int64 // Length of the nodes data
+	ContentHash string // Hex encoded sha256 of the content, empty if the file wasn't hashed or is encrypted
+	DataPos     int64  // Position of the nodes data in the final binary
+	DataLen     int64  // Length of the nodes data
+	IV          []byte // Set if the nodes data is encrypted with AES-CTR, starting from this counter
+	ContentType string // MIME type sniffed from the content, empty unless the archive was created detecting them
+
+	Xattrs map[string][]byte // Extended attributes, like security.capability, kept by root filesystem imports
 }
 
 // IsDir returns true if the ClipNode represents a directory.
@@ -30,6 +59,11 @@ func (n *ClipNode) IsDir() bool {
 	return n.NodeType == DirNode
 }
 
+// IsEncrypted returns true if the data of the ClipNode is encrypted.
+func (n *ClipNode) IsEncrypted() bool {
+	return n.IV != nil
+}
+
 // IsSymlink returns true if the ClipNode represents a symlink.
 func (n *ClipNode) IsSymlink() bool {
 	return n.NodeType == SymLinkNode
@@ -39,6 +73,19 @@ type ClipArchiveMetadata struct {
 	Header      ClipArchiveHeader
 	Index       *btree.BTree
 	StorageInfo ClipStorageInfo
+	Attributes  ClipArchiveAttributes
+}
+
+// ClipArchiveAttributes holds archive wide settings. They are encoded in the index section right after
+// the nodes, so readers that don't know about them still decode the index as before.
+type ClipArchiveAttributes struct {
+	PrefetchPaths   []string // Files read as soon as the archive is mounted
+	EncryptionKeyID []byte   // Identifies the key encrypted files were written with, empty if there are none
+	ArchiveDigest   string   // Of the archive an rclip was stored from, see archive.Digest. Set in rclips only.
+
+	Labels map[string]string // Like the entrypoint of a container root filesystem, see archive.ImageConfig
+
+	SearchIndex *SearchIndex // Trigram index of the content of text files, if the archive was created with one
 }
 
 func (m *ClipArchiveMetadata) Insert(node *ClipNode) {
@@ -53,8 +100,9 @@ func (m *ClipArchiveMetadata) Get(path string) *ClipNode {
 	return item.(*ClipNode)
 }
 
-func (m *ClipArchiveMetadata) ListDirectory(path string) []fuse.DirEntry {
-	var entries []fuse.DirEntry
+// ListDirectory returns the nodes directly inside a directory
+func (m *ClipArchiveMetadata) ListDirectory(path string) []*ClipNode {
+	var entries []*ClipNode
 
 	// Append '/' if not present at the end of the path
 	if !strings.HasSuffix(path, "/") {
@@ -88,10 +136,7 @@ func (m *ClipArchiveMetadata) ListDirectory(path string) []fuse.DirEntry {
 		// Node is an immediate child, so we append it to entries
 		relativePath := nodePath[pathLen:]
 		if relativePath != "" {
-			entries = append(entries, fuse.DirEntry{
-				Mode: node.Attr.Mode,
-				Name: relativePath,
-			})
+			entries = append(entries, node)
 		}
 
 		return true
@@ -0,0 +1,347 @@
+//go:build !windows
+
+// Package sidecar mounts archives into a volume shared by the containers of a Kubernetes pod, from a
+// sidecar or a native sidecar init container. The pod is ready once every archive is mounted and warm,
+// and the archives are unmounted when the pod terminates.
+package sidecar
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/NilayYadav/clip/pkg/clip"
+	"github.com/NilayYadav/clip/pkg/storage"
+	"golang.org/x/sys/unix"
+)
+
+const DefaultWarmConcurrency = 8
+
+const unmountTimeout = time.Second * 10
+
+type Options struct {
+	Root   string              // Volume shared with the other containers, like an emptyDir mounted with Bidirectional propagation
+	Mounts []clip.ArchiveMount // Each archive is mounted at its prefix under Root
+	Mount  clip.MountOptions   // Settings of every mount, which share a content cache. The archive and mount point are set per mount.
+
+	Warm            []string // Files or directories under Root, read in full through the mounts before the pod is ready
+	WarmConcurrency int      // Files read at once while warming, defaults to DefaultWarmConcurrency
+
+	ReadyAddr string // Answer /readyz and /healthz probes on this address, or unix:<path> for a socket
+	ReadyFile string // Created once the pod is ready and removed when the archives are unmounted, for containers that wait on it
+}
+
+type mounted struct {
+	mountPoint string
+	mount      *clip.Mount
+	done       chan struct{}
+	err        error // Why the mount went away, set before done is closed
+}
+
+type sidecar struct {
+	opts   Options
+	mounts []*mounted
+	ready  int32
+	failed chan *mounted // Mounts that went away while the pod was running
+}
+
+// Run mounts the archives, warms them and marks the pod ready, then keeps them mounted until ctx is
+// done. The archives are unmounted before it returns, lazily if they are still in use. It fails if a
+// mount goes away on its own, so the container is restarted.
+func Run(ctx context.Context, opts Options) error {
+	if opts.Root == "" || len(opts.Mounts) == 0 {
+		return fmt.Errorf("a root directory and at least one archive are required")
+	}
+	if opts.Mount.Passthrough {
+		return fmt.Errorf("passthrough isn't supported by sidecar mounts, which share their content cache")
+	}
+	if opts.WarmConcurrency <= 0 {
+		opts.WarmConcurrency = DefaultWarmConcurrency
+	}
+
+	s := &sidecar{opts: opts, failed: make(chan *mounted, len(opts.Mounts))}
+
+	// Probes answer while mounting, so the pod is only not ready rather than failing
+	if opts.ReadyAddr != "" {
+		server, err := s.serveProbes(opts.ReadyAddr)
+		if err != nil {
+			return err
+		}
+		defer server.Close()
+	}
+
+	var debug *clip.DebugServer
+	if opts.Mount.DebugAddr != "" {
+		var err error
+		if debug, err = clip.StartDebugServer(opts.Mount.DebugAddr, opts.Mount.Pprof); err != nil {
+			return err
+		}
+		defer debug.Close()
+	}
+
+	defer s.unmount()
+	if err := s.mount(); err != nil {
+		return err
+	}
+	if err := s.warm(ctx); err != nil {
+		return err
+	}
+
+	if opts.ReadyFile != "" {
+		if err := os.WriteFile(opts.ReadyFile, nil, 0644); err != nil {
+			return fmt.Errorf("failed to create ready file: %v", err)
+		}
+	}
+	atomic.StoreInt32(&s.ready, 1)
+	log.Printf("Ready, %d archives mounted under %s\n", len(s.mounts), opts.Root)
+
+	select {
+	case <-ctx.Done():
+		log.Println("Terminating, unmounting archives")
+		return nil
+	case m := <-s.failed:
+		return fmt.Errorf("%s went away: %v", m.mountPoint, m.err)
+	}
+}
+
+// mount mounts every archive under Root, with a content cache shared between them
+func (s *sidecar) mount() error {
+	template := s.opts.Mount
+	template.AllowOther = true
+	template.HealthAddr, template.ControlSocket, template.DebugAddr = "", "", ""
+	if s.opts.Mount.DebugAddr != "" && template.ReadLimits.Shared == nil {
+		template.ReadLimits.Shared = storage.NewSharedReadLimiter(0)
+	}
+
+	contentCache, err := clip.NewContentCache(template)
+	if err != nil {
+		return err
+	}
+	if contentCache != nil {
+		template.ContentCache, template.ContentCacheAvailable = contentCache, true
+		template.MemoryCacheSize, template.DiskCacheDir = 0, ""
+	}
+
+	seen := make(map[string]bool, len(s.opts.Mounts))
+	for _, am := range s.opts.Mounts {
+		prefix := am.MountPrefix()
+		if !filepath.IsLocal(prefix) {
+			return fmt.Errorf("archive %s would be mounted outside of %s, at %s", am.ArchivePath, s.opts.Root, prefix)
+		}
+		if seen[prefix] {
+			return fmt.Errorf("more than one archive mounted at %s", prefix)
+		}
+		seen[prefix] = true
+
+		options := template
+		options.ArchivePath, options.StorageInfo = am.ArchivePath, am.StorageInfo
+		options.CachePath, options.Subpath = am.CachePath, am.Subpath
+		options.MountPoint = filepath.Join(s.opts.Root, prefix)
+		if err := s.mountArchive(options); err != nil {
+			return fmt.Errorf("failed to mount %s: %v", am.ArchivePath, err)
+		}
+	}
+	return nil
+}
+
+func (s *sidecar) mountArchive(options clip.MountOptions) error {
+	if err := os.MkdirAll(options.MountPoint, 0755); err != nil {
+		return err
+	}
+
+	mount, err := clip.NewMount(options)
+	if err != nil {
+		return err
+	}
+	if err := mount.Start(context.Background()); err != nil {
+		return err
+	}
+
+	m := &mounted{mountPoint: options.MountPoint, mount: mount, done: make(chan struct{})}
+	s.mounts = append(s.mounts, m)
+
+	go func() {
+		if m.err = <-mount.Done(); m.err == nil {
+			m.err = fmt.Errorf("unmounted")
+		}
+		close(m.done)
+		s.failed <- m
+	}()
+
+	log.Printf("Mounted %s to %s\n", options.ArchivePath, options.MountPoint)
+	return nil
+}
+
+// unmount unmounts every archive and waits for them to go away. Archives still in use by other
+// containers are detached, and go away once the last file is closed.
+func (s *sidecar) unmount() {
+	atomic.StoreInt32(&s.ready, 0)
+	if s.opts.ReadyFile != "" {
+		os.Remove(s.opts.ReadyFile)
+	}
+
+	for _, m := range s.mounts {
+		select {
+		case <-m.done:
+			continue // Went away already
+		default:
+		}
+
+		if err := m.mount.Close(); err != nil {
+			log.Printf("Detaching %s, it's still in use: %v\n", m.mountPoint, err)
+			if err := unix.Unmount(m.mountPoint, unix.MNT_DETACH); err != nil {
+				log.Printf("Failed to unmount %s: %v\n", m.mountPoint, err)
+				continue
+			}
+		}
+
+		select {
+		case <-m.done:
+			log.Printf("Unmounted %s\n", m.mountPoint)
+		case <-time.After(unmountTimeout):
+			log.Printf("%s didn't go away after %v\n", m.mountPoint, unmountTimeout)
+		}
+	}
+}
+
+// warm reads the files under the Warm paths through the mounts, so they are cached and the first
+// reads of the pod's containers don't wait for storage
+func (s *sidecar) warm(ctx context.Context) error {
+	if len(s.opts.Warm) == 0 {
+		return nil
+	}
+
+	var files []string
+	for _, p := range s.opts.Warm {
+		if !filepath.IsLocal(p) {
+			return fmt.Errorf("can't warm %s, it isn't under %s", p, s.opts.Root)
+		}
+		err := filepath.Walk(filepath.Join(s.opts.Root, p), func(name string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.Mode().IsRegular() {
+				files = append(files, name)
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to warm %s: %v", p, err)
+		}
+	}
+
+	start := time.Now()
+	var warmed int64
+	var wg sync.WaitGroup
+	var firstErr error
+	var errOnce sync.Once
+	names := make(chan string)
+
+	for i := 0; i < s.opts.WarmConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range names {
+				n, err := readFile(name)
+				if err != nil {
+					errOnce.Do(func() { firstErr = fmt.Errorf("failed to warm %s: %v", name, err) })
+					continue
+				}
+				atomic.AddInt64(&warmed, n)
+			}
+		}()
+	}
+
+feed:
+	for _, name := range files {
+		select {
+		case names <- name:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(names)
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	log.Printf("Warmed %d files, %d bytes, in %v\n", len(files), warmed, time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+func readFile(name string) (int64, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return io.Copy(io.Discard, f)
+}
+
+// serveProbes answers /readyz, which fails until every archive is mounted and warm, and /healthz,
+// which fails once a mount went away
+func (s *sidecar) serveProbes(addr string) (*http.Server, error) {
+	var listener net.Listener
+	var err error
+	if socketPath, ok := strings.CutPrefix(addr, "unix:"); ok {
+		os.Remove(socketPath)
+		listener, err = net.Listen("unix", socketPath)
+	} else {
+		listener, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for probes on %s: %v", addr, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&s.ready) == 0 {
+			respond(w, http.StatusServiceUnavailable, "not ready")
+			return
+		}
+		s.respondHealth(w)
+	})
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		s.respondHealth(w)
+	})
+	server := &http.Server{Handler: mux}
+
+	go server.Serve(listener)
+	return server, nil
+}
+
+// respondHealth fails if a mount went away. Mounts are only added before the pod is ready, while the
+// probes only read them once it is.
+func (s *sidecar) respondHealth(w http.ResponseWriter) {
+	if atomic.LoadInt32(&s.ready) == 1 {
+		for _, m := range s.mounts {
+			select {
+			case <-m.done:
+				respond(w, http.StatusServiceUnavailable, fmt.Sprintf("%s went away: %v", m.mountPoint, m.err))
+				return
+			default:
+			}
+		}
+	}
+	respond(w, http.StatusOK, "ok")
+}
+
+func respond(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"status": message})
+}
@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/NilayYadav/clip/pkg/common"
+)
+
+// StorageBackend is a remote storage provider that archives can be uploaded to and mounted from.
+// Backends are registered by the storage info type they handle, which doubles as their URI scheme.
+type StorageBackend interface {
+	// Type returns the storage info type handled by this backend, e.g. "s3"
+	Type() string
+
+	// DecodeStorageInfo decodes the storage info persisted in an rclip, which records where the archive lives
+	DecodeStorageInfo(data []byte) (common.ClipStorageInfo, error)
+
+	// Open connects to the archive described by info
+	Open(ctx context.Context, info common.ClipStorageInfo, opts ClipStorageOpts) (RemoteArchive, error)
+
+	// Upload stores a local archive at the location described by info
+	Upload(ctx context.Context, info common.ClipStorageInfo, archivePath string, opts UploadOpts) error
+}
+
+// RemoteArchive provides ranged reads over an archive held in remote storage
+type RemoteArchive interface {
+	ReadRange(ctx context.Context, dest []byte, off int64) (int, error)
+	Close() error
+}
+
+// ClipStorageOpener can be implemented by backends that provide their own storage implementation
+// (e.g. one with local caching) instead of the generic one built on top of RemoteArchive
+type ClipStorageOpener interface {
+	NewClipStorage(metadata *common.ClipArchiveMetadata, opts ClipStorageOpts) (ClipStorageInterface, error)
+}
+
+// ContentUploader can be implemented by backends that store archive content per file rather than as a single object.
+// It is called instead of Upload, before the rclip is written, and returns the storage info to record in the rclip.
+type ContentUploader interface {
+	UploadContent(ctx context.Context, info common.ClipStorageInfo, metadata *common.ClipArchiveMetadata, archivePath string, opts UploadOpts) (common.ClipStorageInfo, error)
+}
+
+// UploadVerifier can be implemented by backends that can check an upload against the local archive
+// from what the store reports about it, without reading the archive back. It returns false if the
+// store couldn't tell, and an error if the stored archive doesn't match.
+type UploadVerifier interface {
+	VerifyUpload(ctx context.Context, info common.ClipStorageInfo, archivePath string, opts UploadOpts) (bool, error)
+}
+
+var (
+	backendsMu sync.RWMutex
+	backends   = make(map[string]StorageBackend)
+)
+
+// RegisterBackend makes a storage backend available to archives whose storage info has its type.
+// It panics if a backend for the same type is already registered, or if the type is too long for
+// the header of archives.
+func RegisterBackend(backend StorageBackend) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+
+	if maxLength := len(common.ClipArchiveHeader{}.StorageInfoType); len(backend.Type()) > maxLength {
+		panic(fmt.Sprintf("storage backend type %s is longer than %d bytes", backend.Type(), maxLength))
+	}
+	if _, exists := backends[backend.Type()]; exists {
+		panic(fmt.Sprintf("storage backend already registered: %s", backend.Type()))
+	}
+	backends[backend.Type()] = backend
+}
+
+// GetBackend returns the registered backend for a storage info type
+func GetBackend(storageType string) (StorageBackend, error) {
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+
+	backend, ok := backends[storageType]
+	if !ok {
+		return nil, fmt.Errorf("unsupported storage type: %s", storageType)
+	}
+	return backend, nil
+}
+
+// remoteClipStorage serves archive reads through a backend's RemoteArchive
+type remoteClipStorage struct {
+	remote    RemoteArchive
+	metadata  *common.ClipArchiveMetadata
+	coalescer *readCoalescer
+}
+
+func (s *remoteClipStorage) ReadFile(node *common.ClipNode, dest []byte, off int64) (int, error) {
+	if s.coalescer != nil {
+		return s.coalescer.ReadAt(dest, node.DataPos+off)
+	}
+	return s.remote.ReadRange(context.Background(), dest, node.DataPos+off)
+}
+
+func (s *remoteClipStorage) Metadata() *common.ClipArchiveMetadata {
+	return s.metadata
+}
+
+func (s *remoteClipStorage) CachedLocally() bool {
+	return false
+}
+
+// CheckHealth reads the first byte of the archive
+func (s *remoteClipStorage) CheckHealth(ctx context.Context) error {
+	_, err := s.remote.ReadRange(ctx, make([]byte, 1), 0)
+	return err
+}
+
+func (s *remoteClipStorage) ReloadCredentials() error {
+	return ReloadCredentials(s.remote)
+}
+
+func (s *remoteClipStorage) Cleanup() error {
+	return s.remote.Close()
+}
@@ -0,0 +1,113 @@
+package storage
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	coalesceMaxGap  = 1 << 16 // 64Kb, reads further apart than this are fetched separately
+	coalesceMaxSize = 1 << 22 // 4Mb, larger batches aren't worth the extra bytes fetched
+)
+
+// readCoalescer batches small reads arriving within a short window that land close to each other
+// into a single range request, so reading files in small chunks doesn't cost a request per chunk
+type readCoalescer struct {
+	fetch   func(dest []byte, off int64) (int, error)
+	window  time.Duration
+	mu      sync.Mutex
+	batches []*readBatch
+}
+
+type readBatch struct {
+	start int64
+	end   int64 // Exclusive
+	reads []*coalescedRead
+}
+
+type coalescedRead struct {
+	dest []byte
+	off  int64
+	n    int
+	err  error
+	done chan struct{}
+}
+
+// newReadCoalescer returns nil if window is 0, which disables coalescing
+func newReadCoalescer(window time.Duration, fetch func(dest []byte, off int64) (int, error)) *readCoalescer {
+	if window <= 0 {
+		return nil
+	}
+	return &readCoalescer{fetch: fetch, window: window}
+}
+
+// ReadAt reads len(dest) bytes at off, possibly as part of a larger request
+func (c *readCoalescer) ReadAt(dest []byte, off int64) (int, error) {
+	if len(dest) >= coalesceMaxSize {
+		return c.fetch(dest, off)
+	}
+
+	read := &coalescedRead{dest: dest, off: off, done: make(chan struct{})}
+	end := off + int64(len(dest))
+
+	c.mu.Lock()
+	joined := false
+	for _, batch := range c.batches {
+		start, batchEnd := batch.start, batch.end
+		if off < start {
+			start = off
+		}
+		if end > batchEnd {
+			batchEnd = end
+		}
+
+		if off <= batch.end+coalesceMaxGap && end >= batch.start-coalesceMaxGap && batchEnd-start <= coalesceMaxSize {
+			batch.start, batch.end = start, batchEnd
+			batch.reads = append(batch.reads, read)
+			joined = true
+			break
+		}
+	}
+
+	if !joined {
+		batch := &readBatch{start: off, end: end, reads: []*coalescedRead{read}}
+		c.batches = append(c.batches, batch)
+		time.AfterFunc(c.window, func() { c.flush(batch) })
+	}
+	c.mu.Unlock()
+
+	<-read.done
+	return read.n, read.err
+}
+
+// flush fetches a batch once its window has passed and hands every read its part of the result
+func (c *readCoalescer) flush(batch *readBatch) {
+	c.mu.Lock()
+	for i, b := range c.batches {
+		if b == batch {
+			c.batches = append(c.batches[:i], c.batches[i+1:]...)
+			break
+		}
+	}
+	c.mu.Unlock()
+
+	// A lone read doesn't need a separate buffer
+	if len(batch.reads) == 1 {
+		read := batch.reads[0]
+		read.n, read.err = c.fetch(read.dest, read.off)
+		close(read.done)
+		return
+	}
+
+	buf := make([]byte, batch.end-batch.start)
+	n, err := c.fetch(buf, batch.start)
+
+	for _, read := range batch.reads {
+		if err != nil {
+			read.err = err
+		} else if pos := read.off - batch.start; pos < int64(n) {
+			read.n = copy(read.dest, buf[pos:n])
+		}
+		close(read.done)
+	}
+}
@@ -0,0 +1,323 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NilayYadav/clip/pkg/common"
+	"golang.org/x/sync/singleflight"
+)
+
+// How long a validated ETag is trusted when the server doesn't send a max-age
+const defaultHTTPFreshness = time.Second * 60
+
+type HTTPClipStorageCredentials struct {
+	BearerToken string           // Sent in the Authorization header of every request, e.g. to archives published by clip serve
+	TLS         *common.TLSFiles // Client certificate for servers requiring mutual TLS
+}
+
+// client returns an HTTP client going through the proxy and presenting the client certificate, if
+// any, to the host of rawURL
+func (c *HTTPClipStorageCredentials) client(rawURL string, proxy *ProxyConfig) (*http.Client, error) {
+	transport := newHTTPTransport(proxy)
+	if c == nil || c.TLS == nil {
+		return &http.Client{Transport: transport}, nil
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig, err := common.ClientTLSConfig(*c.TLS, u.Hostname())
+	if err != nil {
+		return nil, err
+	}
+
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{Transport: transport}, nil
+}
+
+// setAuthorization adds the bearer token, if any, to a request
+func (c *HTTPClipStorageCredentials) setAuthorization(req *http.Request) {
+	if c != nil && c.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+c.BearerToken)
+	}
+}
+
+// httpRemoteArchive reads an archive served over HTTP(S) with range requests. Range reads are
+// left unconditional so CDN edges can cache them; instead the archive's ETag is revalidated with
+// a conditional request whenever the server's Cache-Control says it may have gone stale.
+type httpRemoteArchive struct {
+	url        string
+	client     *http.Client
+	creds      *HTTPClipStorageCredentials
+	limiter    *readLimiter
+	mu         sync.Mutex
+	etag       string
+	freshUntil time.Time
+
+	revalidations singleflight.Group
+}
+
+func (ra *httpRemoteArchive) ReadRange(ctx context.Context, dest []byte, off int64) (int, error) {
+	if err := ra.revalidate(ctx); err != nil {
+		return 0, err
+	}
+
+	release, err := ra.limiter.Acquire(ctx, len(dest))
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
+	end := off + int64(len(dest)) - 1
+	data, _, err := withReadRetries(ctx, fmt.Sprintf("range %d-%d of %s", off, end, ra.url), func() ([]byte, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, ra.url, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, end))
+		ra.creds.setAuthorization(req)
+
+		resp, err := ra.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusPartialContent {
+			return nil, &httpStatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+		}
+
+		if err := ra.checkETag(resp.Header.Get("ETag")); err != nil {
+			return nil, err
+		}
+
+		return io.ReadAll(resp.Body)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return copy(dest, data), nil
+}
+
+// revalidate checks the archive hasn't changed once the last validation is no longer fresh. Reads
+// needing it at once share a single request, which is sent without holding ra.mu so reads in flight
+// can still check their ETag.
+func (ra *httpRemoteArchive) revalidate(ctx context.Context) error {
+	ra.mu.Lock()
+	fresh := time.Now().Before(ra.freshUntil)
+	ra.mu.Unlock()
+	if fresh {
+		return nil
+	}
+
+	_, err, _ := ra.revalidations.Do("", func() (interface{}, error) {
+		return nil, ra.sendRevalidation(ctx)
+	})
+	return err
+}
+
+func (ra *httpRemoteArchive) sendRevalidation(ctx context.Context) error {
+	ra.mu.Lock()
+	known, fresh := ra.etag, time.Now().Before(ra.freshUntil)
+	ra.mu.Unlock()
+	if fresh {
+		return nil // Revalidated by the request just before
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, ra.url, nil)
+	if err != nil {
+		return err
+	}
+	if known != "" {
+		req.Header.Set("If-None-Match", known)
+	}
+	ra.creds.setAuthorization(req)
+
+	resp, err := ra.client.Do(req)
+	if err != nil {
+		return remoteError(err)
+	}
+	resp.Body.Close()
+
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+	case http.StatusOK:
+		etag := resp.Header.Get("ETag")
+		if ra.etag != "" && !etagsMatch(etag, ra.etag) {
+			return fmt.Errorf("%w: etag changed from %s to %s", common.ErrArchiveChanged, ra.etag, etag)
+		}
+		ra.etag = etag
+	default:
+		return remoteError(&httpStatusError{StatusCode: resp.StatusCode, Status: resp.Status})
+	}
+
+	ra.freshUntil = time.Now().Add(freshness(resp.Header.Get("Cache-Control")))
+	return nil
+}
+
+func (ra *httpRemoteArchive) checkETag(etag string) error {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+
+	if etag != "" && ra.etag != "" && !etagsMatch(etag, ra.etag) {
+		return fmt.Errorf("%w: etag changed from %s to %s", common.ErrArchiveChanged, ra.etag, etag)
+	}
+	return nil
+}
+
+func (ra *httpRemoteArchive) Close() error {
+	ra.client.CloseIdleConnections()
+	return nil
+}
+
+// etagsMatch compares ETags weakly, since CDNs commonly weaken the origin's ETag
+func etagsMatch(a, b string) bool {
+	return strings.TrimPrefix(a, "W/") == strings.TrimPrefix(b, "W/")
+}
+
+// freshness returns how long a response may be used without revalidation according to its Cache-Control
+func freshness(cacheControl string) time.Duration {
+	maxAge := time.Duration(-1)
+	for _, directive := range strings.Split(cacheControl, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(strings.ToLower(directive)), "=")
+		switch name {
+		case "no-cache", "no-store":
+			return 0
+		case "max-age", "s-maxage":
+			seconds, err := strconv.Atoi(strings.Trim(value, `"`))
+			if err != nil {
+				continue
+			}
+			// s-maxage applies to shared caches and takes precedence over max-age
+			if name == "s-maxage" || maxAge < 0 {
+				maxAge = time.Duration(seconds) * time.Second
+			}
+		}
+	}
+
+	if maxAge < 0 {
+		return defaultHTTPFreshness
+	}
+	return maxAge
+}
+
+func init() {
+	RegisterBackend(httpBackend{})
+}
+
+type httpBackend struct{}
+
+func (b httpBackend) Type() string {
+	return "http"
+}
+
+func (b httpBackend) DecodeStorageInfo(data []byte) (common.ClipStorageInfo, error) {
+	var info common.HTTPStorageInfo
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&info); err != nil {
+		return nil, fmt.Errorf("error decoding http storage info: %v", err)
+	}
+	return info, nil
+}
+
+func (b httpBackend) Open(ctx context.Context, info common.ClipStorageInfo, opts ClipStorageOpts) (RemoteArchive, error) {
+	storageInfo, err := httpStorageInfo(info)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := opts.Credentials.HTTP.client(storageInfo.URL, opts.Credentials.Proxy)
+	if err != nil {
+		return nil, err
+	}
+
+	ra := &httpRemoteArchive{
+		url:     storageInfo.URL,
+		client:  client,
+		creds:   opts.Credentials.HTTP,
+		limiter: newReadLimiter(opts.ReadLimits),
+		etag:    storageInfo.ETag,
+	}
+
+	// Make sure the archive is reachable and is still the version the rclip was made for
+	if err := ra.revalidate(ctx); err != nil {
+		return nil, fmt.Errorf("cannot access archive <%s>: %v", storageInfo.URL, err)
+	}
+
+	return ra, nil
+}
+
+func (b httpBackend) Upload(ctx context.Context, info common.ClipStorageInfo, archivePath string, opts UploadOpts) error {
+	storageInfo, err := httpStorageInfo(info)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return fmt.Errorf("failed to open archive <%s>: %v", archivePath, err)
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	pr := &progressReader{
+		r:    newThrottledReader(ctx, f, opts.BytesPerSecond),
+		size: fi.Size(),
+		ch:   opts.ProgressChan,
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, storageInfo.URL, pr)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = fi.Size()
+	opts.Credentials.HTTP.setAuthorization(req)
+
+	client, err := opts.Credentials.HTTP.client(storageInfo.URL, opts.Credentials.Proxy)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to upload archive: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("failed to upload archive: %s", resp.Status)
+	}
+
+	return nil
+}
+
+func httpStorageInfo(info common.ClipStorageInfo) (common.HTTPStorageInfo, error) {
+	switch si := info.(type) {
+	case common.HTTPStorageInfo:
+		return si, nil
+	case *common.HTTPStorageInfo:
+		return *si, nil
+	default:
+		return common.HTTPStorageInfo{}, fmt.Errorf("unexpected storage info for http backend: %T", info)
+	}
+}
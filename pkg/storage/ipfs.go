@@ -0,0 +1,296 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/NilayYadav/clip/pkg/common"
+)
+
+const ipfsUploadConcurrency = 8
+
+// IPFSClipStorage reads file content from IPFS. Every file is published as its own object,
+// so identical files resolve to the same CID no matter which archive they came from.
+type IPFSClipStorage struct {
+	gatewayURL string
+	apiURL     string
+	cids       map[string]string
+	metadata   *common.ClipArchiveMetadata
+	client     *http.Client
+	limiter    *readLimiter
+}
+
+func (s *IPFSClipStorage) ReadFile(node *common.ClipNode, dest []byte, off int64) (int, error) {
+	cid, ok := s.cids[node.ContentHash]
+	if !ok {
+		return 0, fmt.Errorf("no ipfs object for content hash <%s>", node.ContentHash)
+	}
+
+	release, err := s.limiter.Acquire(context.Background(), len(dest))
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
+	var req *http.Request
+	if s.gatewayURL != "" {
+		req, err = http.NewRequest(http.MethodGet, fmt.Sprintf("%s/ipfs/%s", s.gatewayURL, cid), nil)
+		if err != nil {
+			return 0, err
+		}
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+int64(len(dest))-1))
+	} else {
+		// No gateway configured, so read through the daemon's RPC API instead
+		query := url.Values{"arg": {cid}, "offset": {fmt.Sprint(off)}, "length": {fmt.Sprint(len(dest))}}
+		req, err = http.NewRequest(http.MethodPost, fmt.Sprintf("%s/api/v0/cat?%s", s.apiURL, query.Encode()), nil)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// Gateways that ignore Range return the whole object
+		if s.gatewayURL != "" {
+			if _, err := io.CopyN(io.Discard, resp.Body, off); err != nil {
+				return 0, err
+			}
+		}
+	default:
+		return 0, fmt.Errorf("unexpected status reading ipfs object <%s>: %s", cid, resp.Status)
+	}
+
+	n, err := io.ReadFull(resp.Body, dest)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return n, err
+	}
+
+	return n, nil
+}
+
+func (s *IPFSClipStorage) Metadata() *common.ClipArchiveMetadata {
+	return s.metadata
+}
+
+func (s *IPFSClipStorage) CachedLocally() bool {
+	return false
+}
+
+// CheckHealth checks the gateway, or the daemon if there is no gateway, is answering
+func (s *IPFSClipStorage) CheckHealth(ctx context.Context) error {
+	var req *http.Request
+	var err error
+	if s.gatewayURL != "" {
+		req, err = http.NewRequestWithContext(ctx, http.MethodHead, s.gatewayURL+"/ipfs/bafkqaaa", nil) // The empty identity CID
+	} else {
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, s.apiURL+"/api/v0/version", nil)
+	}
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status checking ipfs: %s", resp.Status)
+	}
+	return nil
+}
+
+func (s *IPFSClipStorage) Cleanup() error {
+	return nil
+}
+
+func init() {
+	RegisterBackend(ipfsBackend{})
+}
+
+type ipfsBackend struct{}
+
+func (b ipfsBackend) Type() string {
+	return "ipfs"
+}
+
+func (b ipfsBackend) DecodeStorageInfo(data []byte) (common.ClipStorageInfo, error) {
+	var info common.IPFSStorageInfo
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&info); err != nil {
+		return nil, fmt.Errorf("error decoding ipfs storage info: %v", err)
+	}
+	return info, nil
+}
+
+func (b ipfsBackend) NewClipStorage(metadata *common.ClipArchiveMetadata, opts ClipStorageOpts) (ClipStorageInterface, error) {
+	storageInfo, err := ipfsStorageInfo(metadata.StorageInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	// Allow pointing mounts at a local gateway rather than the one the archive was published with
+	gatewayURL := storageInfo.GatewayURL
+	if gateway := os.Getenv("IPFS_GATEWAY"); gateway != "" {
+		gatewayURL = gateway
+	}
+
+	return &IPFSClipStorage{
+		gatewayURL: strings.TrimSuffix(gatewayURL, "/"),
+		apiURL:     strings.TrimSuffix(storageInfo.APIURL, "/"),
+		cids:       storageInfo.CIDs,
+		metadata:   metadata,
+		client:     &http.Client{Transport: newHTTPTransport(opts.Credentials.Proxy)},
+		limiter:    newReadLimiter(opts.ReadLimits),
+	}, nil
+}
+
+func (b ipfsBackend) Open(ctx context.Context, info common.ClipStorageInfo, opts ClipStorageOpts) (RemoteArchive, error) {
+	return nil, errors.New("ipfs archives are stored per file and cannot be read as a single object")
+}
+
+func (b ipfsBackend) Upload(ctx context.Context, info common.ClipStorageInfo, archivePath string, opts UploadOpts) error {
+	return errors.New("ipfs archives must be uploaded with UploadContent")
+}
+
+// UploadContent publishes every distinct file in the archive to the IPFS daemon
+func (b ipfsBackend) UploadContent(ctx context.Context, info common.ClipStorageInfo, metadata *common.ClipArchiveMetadata, archivePath string, opts UploadOpts) (common.ClipStorageInfo, error) {
+	storageInfo, err := ipfsStorageInfo(info)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open archive <%s>: %v", archivePath, err)
+	}
+	defer f.Close()
+
+	// Only publish each piece of content once
+	nodes := make(map[string]*common.ClipNode)
+	metadata.Index.Ascend(metadata.Index.Min(), func(a interface{}) bool {
+		node := a.(*common.ClipNode)
+		if node.NodeType == common.FileNode && node.DataLen > 0 {
+			nodes[node.ContentHash] = node
+		}
+		return true
+	})
+
+	if _, missing := nodes[""]; missing {
+		return nil, errors.New("archive has files without content hashes, which can't be stored on ipfs")
+	}
+
+	work := make(chan *common.ClipNode)
+	var mu sync.Mutex
+	var firstErr error
+	cids := make(map[string]string, len(nodes))
+	client := &http.Client{Transport: newHTTPTransport(opts.Credentials.Proxy)}
+
+	var wg sync.WaitGroup
+	for i := 0; i < ipfsUploadConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for node := range work {
+				content := newThrottledReader(ctx, io.NewSectionReader(f, node.DataPos, node.DataLen), opts.BytesPerSecond)
+				cid, err := ipfsAdd(ctx, client, storageInfo.APIURL, content)
+
+				mu.Lock()
+				if err != nil && firstErr == nil {
+					firstErr = fmt.Errorf("failed to publish %s: %v", node.Path, err)
+				}
+				cids[node.ContentHash] = cid
+				if opts.ProgressChan != nil {
+					opts.ProgressChan <- len(cids) * 100 / len(nodes)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for _, node := range nodes {
+		work <- node
+	}
+	close(work)
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	storageInfo.CIDs = cids
+	return storageInfo, nil
+}
+
+// ipfsAdd adds content through the daemon's RPC API and returns its CID
+func ipfsAdd(ctx context.Context, client *http.Client, apiURL string, content io.Reader) (string, error) {
+	body, w := io.Pipe()
+	mw := multipart.NewWriter(w)
+
+	go func() {
+		part, err := mw.CreateFormFile("file", "content")
+		if err == nil {
+			_, err = io.Copy(part, content)
+		}
+		if err == nil {
+			err = mw.Close()
+		}
+		w.CloseWithError(err)
+	}()
+
+	// CIDv1 with raw leaves keeps CIDs stable for identical content
+	query := url.Values{"cid-version": {"1"}, "raw-leaves": {"true"}, "pin": {"true"}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s/api/v0/add?%s", strings.TrimSuffix(apiURL, "/"), query.Encode()), body)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status from ipfs add: %s", resp.Status)
+	}
+
+	var result struct {
+		Hash string
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+
+	return result.Hash, nil
+}
+
+func ipfsStorageInfo(info common.ClipStorageInfo) (common.IPFSStorageInfo, error) {
+	switch si := info.(type) {
+	case common.IPFSStorageInfo:
+		return si, nil
+	case *common.IPFSStorageInfo:
+		return *si, nil
+	default:
+		return common.IPFSStorageInfo{}, fmt.Errorf("unexpected storage info for ipfs backend: %T", info)
+	}
+}
@@ -0,0 +1,421 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/time/rate"
+)
+
+// ReadLimits caps how fast a storage implementation may read from its remote source
+type ReadLimits struct {
+	BytesPerSecond    int64
+	RequestsPerSecond float64
+	MaxConcurrent     int                // Requests in flight at once, 0 = unlimited
+	Shared            *SharedReadLimiter // Also applied, together with every other storage it's passed to
+	Mount             string             // Storages of the same mount share its turns at the process cap, see SetMaxConcurrentRequests
+}
+
+// Caps the requests in flight across every storage created in this process
+var processRequests *fairSemaphore
+
+// SetMaxConcurrentRequests caps the remote requests in flight at once across every storage created
+// afterwards, however many archives are mounted, and those of each mount, see ReadLimits.Mount. Once
+// the process cap is reached mounts take turns at the requests that finish, so a mount starting many
+// reads at once can't hold up the others. 0 removes a cap.
+func SetMaxConcurrentRequests(total int, perMount int) {
+	processRequests = newFairSemaphore(total, perMount)
+}
+
+// requestSemaphore holds a slot for each request in flight, nil if unlimited
+type requestSemaphore chan struct{}
+
+func newRequestSemaphore(n int) requestSemaphore {
+	if n <= 0 {
+		return nil
+	}
+	return make(requestSemaphore, n)
+}
+
+func (s requestSemaphore) acquire(ctx context.Context) error {
+	if s == nil {
+		return nil
+	}
+	select {
+	case s <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s requestSemaphore) release() {
+	if s != nil {
+		<-s
+	}
+}
+
+// fairSemaphore holds a slot for each request in flight like requestSemaphore, but hands slots that
+// free up to the mounts waiting for them in turn rather than to whichever request asked first
+type fairSemaphore struct {
+	total    int // 0 = unlimited
+	perMount int // 0 = unlimited
+	mu       sync.Mutex
+	inFlight int
+	mounts   map[string]*mountRequests // Mounts with requests in flight or waiting
+	turns    []string                  // Mounts with requests waiting, in the order they get the next free slot
+}
+
+type mountRequests struct {
+	inFlight int
+	waiting  []chan struct{}
+}
+
+// newFairSemaphore returns nil if unlimited
+func newFairSemaphore(total int, perMount int) *fairSemaphore {
+	if total <= 0 && perMount <= 0 {
+		return nil
+	}
+	if total < 0 {
+		total = 0
+	}
+	if perMount < 0 {
+		perMount = 0
+	}
+	return &fairSemaphore{total: total, perMount: perMount, mounts: make(map[string]*mountRequests)}
+}
+
+func (s *fairSemaphore) acquire(ctx context.Context, mount string) error {
+	if s == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	m, ok := s.mounts[mount]
+	if !ok {
+		m = &mountRequests{}
+		s.mounts[mount] = m
+	}
+	if len(m.waiting) == 0 && s.free(m) {
+		m.inFlight++
+		s.inFlight++
+		s.mu.Unlock()
+		return nil
+	}
+
+	granted := make(chan struct{}, 1)
+	m.waiting = append(m.waiting, granted)
+	if len(m.waiting) == 1 {
+		s.turns = append(s.turns, mount)
+	}
+	s.mu.Unlock()
+
+	select {
+	case <-granted:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		for i, ch := range m.waiting {
+			if ch == granted {
+				m.waiting = append(m.waiting[:i], m.waiting[i+1:]...)
+				if len(m.waiting) == 0 {
+					s.dropTurn(mount)
+				}
+				s.forget(mount, m)
+				s.mu.Unlock()
+				return ctx.Err()
+			}
+		}
+		s.mu.Unlock()
+
+		// The slot was handed over while giving up on it
+		s.release(mount)
+		return ctx.Err()
+	}
+}
+
+func (s *fairSemaphore) release(mount string) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := s.mounts[mount]
+	m.inFlight--
+	s.inFlight--
+
+	for i := 0; i < len(s.turns) && (s.total == 0 || s.inFlight < s.total); {
+		name := s.turns[i]
+		next := s.mounts[name]
+		if !s.free(next) {
+			i++
+			continue
+		}
+
+		granted := next.waiting[0]
+		next.waiting = next.waiting[1:]
+		next.inFlight++
+		s.inFlight++
+		granted <- struct{}{}
+
+		// To the back of the line
+		s.turns = append(s.turns[:i], s.turns[i+1:]...)
+		if len(next.waiting) > 0 {
+			s.turns = append(s.turns, name)
+		}
+	}
+	s.forget(mount, m)
+}
+
+// free reports whether a request of m may start now
+func (s *fairSemaphore) free(m *mountRequests) bool {
+	return (s.total == 0 || s.inFlight < s.total) && (s.perMount == 0 || m.inFlight < s.perMount)
+}
+
+func (s *fairSemaphore) dropTurn(mount string) {
+	for i, name := range s.turns {
+		if name == mount {
+			s.turns = append(s.turns[:i], s.turns[i+1:]...)
+			return
+		}
+	}
+}
+
+// forget drops a mount once it has nothing in flight or waiting
+func (s *fairSemaphore) forget(mount string, m *mountRequests) {
+	if m.inFlight == 0 && len(m.waiting) == 0 {
+		delete(s.mounts, mount)
+	}
+}
+
+// max returns the most requests a single mount may have in flight at once, 0 if unlimited
+func (s *fairSemaphore) max() int {
+	if s == nil {
+		return 0
+	}
+	if s.perMount > 0 && (s.total == 0 || s.perMount < s.total) {
+		return s.perMount
+	}
+	return s.total
+}
+
+// SharedReadLimiter caps the combined bandwidth of several storages and counts the bytes they read
+type SharedReadLimiter struct {
+	bytes     *rate.Limiter
+	bytesRead int64
+	requests  int64
+	inFlight  int64
+}
+
+// NewSharedReadLimiter only counts reads if bytesPerSecond is 0
+func NewSharedReadLimiter(bytesPerSecond int64) *SharedReadLimiter {
+	l := &SharedReadLimiter{}
+	if bytesPerSecond > 0 {
+		l.bytes = rate.NewLimiter(rate.Limit(bytesPerSecond), int(bytesPerSecond))
+	}
+	return l
+}
+
+// BytesRead returns the number of bytes read from remote sources so far
+func (l *SharedReadLimiter) BytesRead() int64 {
+	return atomic.LoadInt64(&l.bytesRead)
+}
+
+// Requests returns the number of requests made to remote sources so far
+func (l *SharedReadLimiter) Requests() int64 {
+	return atomic.LoadInt64(&l.requests)
+}
+
+// InFlight returns the number of requests to remote sources being made right now
+func (l *SharedReadLimiter) InFlight() int64 {
+	return atomic.LoadInt64(&l.inFlight)
+}
+
+func (l *SharedReadLimiter) wait(ctx context.Context, n int) error {
+	atomic.AddInt64(&l.bytesRead, int64(n))
+	if l.bytes == nil {
+		return nil
+	}
+	return waitBytes(ctx, l.bytes, n)
+}
+
+type readLimiter struct {
+	bytes      *rate.Limiter
+	requests   *rate.Limiter
+	shared     *SharedReadLimiter
+	concurrent requestSemaphore
+	process    *fairSemaphore
+	mount      string
+}
+
+// newReadLimiter returns nil if no limits are configured
+func newReadLimiter(limits ReadLimits) *readLimiter {
+	if limits.BytesPerSecond <= 0 && limits.RequestsPerSecond <= 0 && limits.MaxConcurrent <= 0 && limits.Shared == nil && processRequests == nil {
+		return nil
+	}
+
+	l := &readLimiter{
+		shared:     limits.Shared,
+		concurrent: newRequestSemaphore(limits.MaxConcurrent),
+		process:    processRequests,
+		mount:      limits.Mount,
+	}
+	if limits.BytesPerSecond > 0 {
+		l.bytes = rate.NewLimiter(rate.Limit(limits.BytesPerSecond), int(limits.BytesPerSecond))
+	}
+
+	if limits.RequestsPerSecond > 0 {
+		burst := int(limits.RequestsPerSecond)
+		if burst < 1 {
+			burst = 1
+		}
+		l.requests = rate.NewLimiter(rate.Limit(limits.RequestsPerSecond), burst)
+	}
+
+	return l
+}
+
+// Wait blocks until a single request reading n bytes is allowed
+func (l *readLimiter) Wait(ctx context.Context, n int) error {
+	if l == nil {
+		return nil
+	}
+
+	if l.shared != nil {
+		atomic.AddInt64(&l.shared.requests, 1)
+	}
+
+	if l.requests != nil {
+		if err := l.requests.Wait(ctx); err != nil {
+			return err
+		}
+	}
+
+	return l.waitBytes(ctx, n)
+}
+
+// Acquire waits like Wait, then for a free slot to make the request in. The slot must be given back
+// by calling release once the request is done.
+func (l *readLimiter) Acquire(ctx context.Context, n int) (release func(), err error) {
+	if err := l.Wait(ctx, n); err != nil {
+		return nil, err
+	}
+	if l == nil {
+		return func() {}, nil
+	}
+
+	if err := l.concurrent.acquire(ctx); err != nil {
+		return nil, err
+	}
+	if err := l.process.acquire(ctx, l.mount); err != nil {
+		l.concurrent.release()
+		return nil, err
+	}
+
+	if l.shared != nil {
+		atomic.AddInt64(&l.shared.inFlight, 1)
+	}
+	return func() {
+		if l.shared != nil {
+			atomic.AddInt64(&l.shared.inFlight, -1)
+		}
+		l.process.release(l.mount)
+		l.concurrent.release()
+	}, nil
+}
+
+// maxConcurrent returns the most requests that may be in flight at once for this storage, 0 if unlimited
+func (l *readLimiter) maxConcurrent() int {
+	if l == nil {
+		return 0
+	}
+	n := cap(l.concurrent)
+	if p := l.process.max(); p > 0 && (n == 0 || p < n) {
+		n = p
+	}
+	return n
+}
+
+// waitBytes applies only the byte limits, own and shared
+func (l *readLimiter) waitBytes(ctx context.Context, n int) error {
+	if l.bytes != nil {
+		if err := waitBytes(ctx, l.bytes, n); err != nil {
+			return err
+		}
+	}
+
+	if l.shared != nil {
+		return l.shared.wait(ctx, n)
+	}
+
+	return nil
+}
+
+// limitsBytes reports whether reads have to go through waitBytes
+func (l *readLimiter) limitsBytes() bool {
+	return l != nil && (l.bytes != nil || l.shared != nil)
+}
+
+// waitBytes consumes n tokens from a limiter, in burst sized steps so large reads don't fail outright
+func waitBytes(ctx context.Context, limiter *rate.Limiter, n int) error {
+	burst := limiter.Burst()
+	for n > 0 {
+		step := n
+		if step > burst {
+			step = burst
+		}
+
+		if err := limiter.WaitN(ctx, step); err != nil {
+			return err
+		}
+
+		n -= step
+	}
+
+	return nil
+}
+
+// throttledWriterAt applies the byte limit of a readLimiter to downloads written through it
+type throttledWriterAt struct {
+	w       io.WriterAt
+	limiter *readLimiter
+}
+
+func (t *throttledWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	if err := t.limiter.waitBytes(context.Background(), len(p)); err != nil {
+		return 0, err
+	}
+	return t.w.WriteAt(p, off)
+}
+
+// throttledReader caps the rate at which data can be read from r
+type throttledReader struct {
+	r       io.Reader
+	ctx     context.Context
+	limiter *rate.Limiter
+}
+
+func newThrottledReader(ctx context.Context, r io.Reader, bytesPerSecond int64) io.Reader {
+	if bytesPerSecond <= 0 {
+		return r
+	}
+	return &throttledReader{r: r, ctx: ctx, limiter: rate.NewLimiter(rate.Limit(bytesPerSecond), int(bytesPerSecond))}
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	// Never read more than one burst at a time so the limiter can always satisfy the wait
+	if len(p) > t.limiter.Burst() {
+		p = p[:t.limiter.Burst()]
+	}
+
+	n, err := t.r.Read(p)
+	if n > 0 {
+		if waitErr := t.limiter.WaitN(t.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
@@ -2,6 +2,8 @@ package storage
 
 import (
 	"fmt"
+	"io"
+	"log"
 	"os"
 
 	"github.com/NilayYadav/clip/pkg/common"
@@ -11,10 +13,12 @@ type LocalClipStorage struct {
 	archivePath string
 	metadata    *common.ClipArchiveMetadata
 	fileHandle  *os.File
+	mapping     []byte // The whole archive, nil unless mapped
 }
 
 type LocalClipStorageOpts struct {
 	ArchivePath string
+	Mmap        bool // Map the archive into memory and read from the mapping, see LocalClipStorage.Mapped
 }
 
 func NewLocalClipStorage(metadata *common.ClipArchiveMetadata, opts LocalClipStorageOpts) (*LocalClipStorage, error) {
@@ -23,14 +27,43 @@ func NewLocalClipStorage(metadata *common.ClipArchiveMetadata, opts LocalClipSto
 		return nil, err
 	}
 
-	return &LocalClipStorage{
+	s := &LocalClipStorage{
 		metadata:    metadata,
 		archivePath: opts.ArchivePath,
 		fileHandle:  fileHandle,
-	}, nil
+	}
+
+	if opts.Mmap {
+		if s.mapping, err = mapFile(fileHandle); err != nil {
+			log.Printf("Reading %s without mapping it: %v\n", opts.ArchivePath, err)
+		}
+	}
+	return s, nil
+}
+
+// Mapped returns the content of node at off straight from the mapping of the archive, without copying
+// it, cut short at the end of the archive. It fails unless the archive is mapped.
+func (s *LocalClipStorage) Mapped(node *common.ClipNode, off int64, length int) ([]byte, bool) {
+	start := node.DataPos + off
+	if s.mapping == nil || start < 0 || start >= int64(len(s.mapping)) {
+		return nil, false
+	}
+	end := start + int64(length)
+	if end > int64(len(s.mapping)) {
+		end = int64(len(s.mapping))
+	}
+	return s.mapping[start:end], true
 }
 
 func (s *LocalClipStorage) ReadFile(node *common.ClipNode, dest []byte, off int64) (int, error) {
+	if data, ok := s.Mapped(node, off, len(dest)); ok {
+		n := copy(dest, data)
+		if n < len(dest) {
+			return n, fmt.Errorf("unable to read data from file: %w", io.EOF)
+		}
+		return n, nil
+	}
+
 	n, err := s.fileHandle.ReadAt(dest, node.DataPos+off)
 	if err != nil {
 		return n, fmt.Errorf("unable to read data from file: %w", err)
@@ -38,6 +71,10 @@ func (s *LocalClipStorage) ReadFile(node *common.ClipNode, dest []byte, off int6
 	return n, nil
 }
 
+func (s *LocalClipStorage) Fd(node *common.ClipNode, off int64) (uintptr, int64, bool) {
+	return s.fileHandle.Fd(), node.DataPos + off, true
+}
+
 func (s *LocalClipStorage) CachedLocally() bool {
 	return true
 }
@@ -47,5 +84,10 @@ func (s *LocalClipStorage) Metadata() *common.ClipArchiveMetadata {
 }
 
 func (s *LocalClipStorage) Cleanup() error {
-	return nil
+	if s.mapping == nil {
+		return nil
+	}
+	mapping := s.mapping
+	s.mapping = nil
+	return unmapFile(mapping)
 }
@@ -0,0 +1,74 @@
+package storage
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/NilayYadav/clip/pkg/common"
+)
+
+// Cloud Storage endpoint speaking the S3 API
+const gcsEndpoint = "https://storage.googleapis.com"
+
+// ParseLocation parses where an archive is stored:
+//
+//	s3://bucket/key[?region=&endpoint=&force-path-style=true]
+//	gs://bucket/key, through the S3 compatible API of Cloud Storage with HMAC keys
+//	sftp://user@host[:port]/absolute/path
+//	http://... or https://...
+//	file:///path, or just a path, for local archives
+//
+// Local archives give nil storage info and their path.
+func ParseLocation(location string) (common.ClipStorageInfo, string, error) {
+	u, err := url.Parse(location)
+	if err != nil || u.Scheme == "" || len(u.Scheme) == 1 {
+		// Not a URI, or a Windows drive letter
+		return nil, location, nil
+	}
+
+	switch u.Scheme {
+	case "file":
+		return nil, u.Host + u.Path, nil
+
+	case "s3", "gs":
+		if u.Host == "" {
+			return nil, "", fmt.Errorf("invalid location %q, expected %s://bucket/key", location, u.Scheme)
+		}
+		query := u.Query()
+		info := &common.S3StorageInfo{
+			Bucket:   u.Host,
+			Key:      strings.TrimPrefix(u.Path, "/"),
+			Region:   query.Get("region"),
+			Endpoint: query.Get("endpoint"),
+		}
+		if u.Scheme == "gs" && info.Endpoint == "" {
+			info.Endpoint = gcsEndpoint
+		}
+		if info.Region == "" && u.Scheme == "gs" {
+			info.Region = "auto"
+		}
+		if info.Region == "" {
+			info.Region = os.Getenv("AWS_REGION")
+		}
+		if v := query.Get("force-path-style"); v != "" {
+			if info.ForcePathStyle, err = strconv.ParseBool(v); err != nil {
+				return nil, "", fmt.Errorf("invalid location %q: %v", location, err)
+			}
+		}
+		return info, "", nil
+
+	case "sftp":
+		if u.Host == "" || u.User == nil || u.Path == "" {
+			return nil, "", fmt.Errorf("invalid location %q, expected sftp://user@host/path", location)
+		}
+		return &common.SFTPStorageInfo{Host: u.Host, User: u.User.Username(), Path: u.Path}, "", nil
+
+	case "http", "https":
+		return &common.HTTPStorageInfo{URL: location}, "", nil
+	}
+
+	return nil, "", fmt.Errorf("unsupported location %q", location)
+}
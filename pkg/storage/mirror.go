@@ -0,0 +1,247 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+
+	"github.com/NilayYadav/clip/pkg/common"
+)
+
+func init() {
+	RegisterBackend(mirrorBackend{})
+}
+
+// mirrorBackend stores an archive at several replicas, each handled by its own backend
+type mirrorBackend struct{}
+
+func (b mirrorBackend) Type() string {
+	return "mirror"
+}
+
+func (b mirrorBackend) DecodeStorageInfo(data []byte) (common.ClipStorageInfo, error) {
+	var info common.MirrorStorageInfo
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&info); err != nil {
+		return nil, fmt.Errorf("error decoding mirror storage info: %v", err)
+	}
+	return info, nil
+}
+
+// Replicas returns the storage info of every place an archive is stored at, in the order mounts try
+// them: the replicas of a mirrored archive, or info itself otherwise
+func Replicas(info common.ClipStorageInfo) ([]common.ClipStorageInfo, error) {
+	var mirror common.MirrorStorageInfo
+	switch si := info.(type) {
+	case common.MirrorStorageInfo:
+		mirror = si
+	case *common.MirrorStorageInfo:
+		mirror = *si
+	default:
+		return []common.ClipStorageInfo{info}, nil
+	}
+
+	replicas := make([]common.ClipStorageInfo, 0, len(mirror.Replicas))
+	for _, wrapper := range mirror.Replicas {
+		backend, err := GetBackend(wrapper.Type)
+		if err != nil {
+			return nil, err
+		}
+		if _, nested := backend.(mirrorBackend); nested {
+			return nil, fmt.Errorf("mirrored archives can't be replicas of another")
+		}
+
+		replica, err := backend.DecodeStorageInfo(wrapper.Data)
+		if err != nil {
+			return nil, err
+		}
+		replicas = append(replicas, replica)
+	}
+	if len(replicas) == 0 {
+		return nil, fmt.Errorf("mirrored archive has no replicas")
+	}
+	return replicas, nil
+}
+
+// Open connects to the first replica that can be reached. The others are connected to when reads
+// from the current one fail.
+func (b mirrorBackend) Open(ctx context.Context, info common.ClipStorageInfo, opts ClipStorageOpts) (RemoteArchive, error) {
+	replicas, err := Replicas(info)
+	if err != nil {
+		return nil, err
+	}
+
+	ra := &mirrorRemoteArchive{
+		replicas: replicas,
+		remotes:  make([]RemoteArchive, len(replicas)),
+		opts:     opts,
+	}
+	var lastErr error
+	for i := range replicas {
+		if _, lastErr = ra.connect(ctx, i); lastErr == nil {
+			ra.current = i
+			return ra, nil
+		}
+	}
+	return nil, fmt.Errorf("no replica of the archive can be reached, last error: %v", lastErr)
+}
+
+// Upload stores the archive at every replica concurrently. Progress is reported for the first
+// replica only.
+func (b mirrorBackend) Upload(ctx context.Context, info common.ClipStorageInfo, archivePath string, opts UploadOpts) error {
+	replicas, err := Replicas(info)
+	if err != nil {
+		return err
+	}
+
+	errs := make([]error, len(replicas))
+	var wg sync.WaitGroup
+	for i, replica := range replicas {
+		backend, err := GetBackend(replica.Type())
+		if err != nil {
+			return err
+		}
+
+		replicaOpts := opts
+		if i > 0 {
+			replicaOpts.ProgressChan = nil
+		}
+
+		wg.Add(1)
+		go func(i int, backend StorageBackend, replica common.ClipStorageInfo) {
+			defer wg.Done()
+			errs[i] = backend.Upload(ctx, replica, archivePath, replicaOpts)
+		}(i, backend, replica)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			return fmt.Errorf("failed to upload replica %d (%s): %v", i+1, replicas[i].Type(), err)
+		}
+	}
+	return nil
+}
+
+// mirrorRemoteArchive reads from one replica at a time, moving on to the next when a read fails
+type mirrorRemoteArchive struct {
+	replicas []common.ClipStorageInfo
+	opts     ClipStorageOpts
+
+	mu      sync.Mutex
+	remotes []RemoteArchive // Connected lazily, nil until then
+	current int             // Replica reads start from
+	closed  bool
+}
+
+// connect returns the replica at i, connecting to it if it hasn't been yet. Connecting happens
+// without holding the lock, so a replica that's slow to reach doesn't hold up reads from the others.
+func (ra *mirrorRemoteArchive) connect(ctx context.Context, i int) (RemoteArchive, error) {
+	ra.mu.Lock()
+	remote := ra.remotes[i]
+	ra.mu.Unlock()
+	if remote != nil {
+		return remote, nil
+	}
+
+	backend, err := GetBackend(ra.replicas[i].Type())
+	if err != nil {
+		return nil, err
+	}
+	remote, err = backend.Open(ctx, ra.replicas[i], ra.opts)
+	if err != nil {
+		log.Printf("Unable to reach replica %d (%s): %v", i+1, ra.replicas[i].Type(), err)
+		return nil, err
+	}
+
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	if ra.closed {
+		remote.Close()
+		return nil, fmt.Errorf("archive is closed")
+	}
+	if ra.remotes[i] != nil {
+		// Another read connected first
+		remote.Close()
+		return ra.remotes[i], nil
+	}
+	ra.remotes[i] = remote
+	return remote, nil
+}
+
+// use makes the replica at i the one reads start from
+func (ra *mirrorRemoteArchive) use(i int) {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+
+	if i != ra.current {
+		log.Printf("Reading from replica %d (%s)", i+1, ra.replicas[i].Type())
+		ra.current = i
+	}
+}
+
+// ReadRange reads from the current replica, failing over to the following ones in turn
+func (ra *mirrorRemoteArchive) ReadRange(ctx context.Context, dest []byte, off int64) (int, error) {
+	ra.mu.Lock()
+	start := ra.current
+	ra.mu.Unlock()
+
+	var lastErr error
+	for k := 0; k < len(ra.replicas); k++ {
+		i := (start + k) % len(ra.replicas)
+		remote, err := ra.connect(ctx, i)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		n, err := remote.ReadRange(ctx, dest, off)
+		if ctx.Err() != nil {
+			return n, err
+		}
+		if err == nil || err == io.EOF {
+			ra.use(i)
+			return n, err
+		}
+		log.Printf("Read from replica %d (%s) failed: %v", i+1, ra.replicas[i].Type(), err)
+		lastErr = err
+	}
+	return 0, fmt.Errorf("every replica failed, last error: %w", lastErr)
+}
+
+// ReloadCredentials reloads the credentials of the replicas connected to so far
+func (ra *mirrorRemoteArchive) ReloadCredentials() error {
+	ra.mu.Lock()
+	remotes := append([]RemoteArchive(nil), ra.remotes...)
+	ra.mu.Unlock()
+
+	for _, remote := range remotes {
+		if remote == nil {
+			continue
+		}
+		if err := ReloadCredentials(remote); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ra *mirrorRemoteArchive) Close() error {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	ra.closed = true
+
+	var firstErr error
+	for _, remote := range ra.remotes {
+		if remote == nil {
+			continue
+		}
+		if err := remote.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,34 @@
+//go:build !windows
+
+package storage
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// mapFile maps a whole file read only. Archives never change while they're read, one that is truncated
+// anyway faults reads of the pages that are gone.
+func mapFile(f *os.File) ([]byte, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() == 0 || int64(int(info.Size())) != info.Size() {
+		return nil, fmt.Errorf("can't map %d bytes", info.Size())
+	}
+
+	mapping, err := unix.Mmap(int(f.Fd()), 0, int(info.Size()), unix.PROT_READ, unix.MAP_SHARED)
+	if err != nil {
+		return nil, fmt.Errorf("mmap failed: %v", err)
+	}
+	// Reads jump around the archive, read ahead would mostly fetch pages nobody asked for
+	unix.Madvise(mapping, unix.MADV_RANDOM)
+	return mapping, nil
+}
+
+func unmapFile(mapping []byte) error {
+	return unix.Munmap(mapping)
+}
@@ -0,0 +1,15 @@
+package storage
+
+import (
+	"errors"
+	"os"
+)
+
+// mapFile fails on Windows, archives are read from the file there
+func mapFile(f *os.File) ([]byte, error) {
+	return nil, errors.New("mapping archives isn't supported on windows")
+}
+
+func unmapFile(mapping []byte) error {
+	return nil
+}
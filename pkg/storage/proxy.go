@@ -0,0 +1,42 @@
+package storage
+
+import (
+	"net/http"
+	"net/url"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+// ProxyConfig sends the requests remote storages make over HTTP(S) through a proxy. Fields left
+// empty fall back to HTTP_PROXY, HTTPS_PROXY and NO_PROXY.
+type ProxyConfig struct {
+	URL     string // Proxy for every request, http://, https:// or socks5://
+	NoProxy string // Hosts, domains, IPs and CIDRs reached directly, comma separated as in NO_PROXY
+}
+
+// proxyFunc picks the proxy of each request, from the environment only if p is nil
+func (p *ProxyConfig) proxyFunc() func(*http.Request) (*url.URL, error) {
+	if p == nil {
+		return http.ProxyFromEnvironment
+	}
+
+	cfg := httpproxy.FromEnvironment()
+	if p.URL != "" {
+		cfg.HTTPProxy, cfg.HTTPSProxy = p.URL, p.URL
+	}
+	if p.NoProxy != "" {
+		cfg.NoProxy = p.NoProxy
+	}
+
+	proxy := cfg.ProxyFunc()
+	return func(req *http.Request) (*url.URL, error) {
+		return proxy(req.URL)
+	}
+}
+
+// newHTTPTransport returns a transport with the defaults of http.DefaultTransport, going through the proxy
+func newHTTPTransport(proxy *ProxyConfig) *http.Transport {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.Proxy = proxy.proxyFunc()
+	return tr
+}
@@ -0,0 +1,112 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	"github.com/NilayYadav/clip/pkg/common"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+)
+
+const (
+	maxReadAttempts    = 5
+	readRetryBaseDelay = time.Millisecond * 100
+)
+
+// withReadRetries retries transient failures with exponential backoff instead of surfacing them to the
+// reader, until ctx is done. It returns the number of attempts made.
+func withReadRetries(ctx context.Context, description string, read func() ([]byte, error)) ([]byte, int, error) {
+	delay := readRetryBaseDelay
+	for attempt := 1; ; attempt++ {
+		data, err := read()
+		if err == nil {
+			return data, attempt, nil
+		}
+
+		if attempt >= maxReadAttempts || !isRetryableReadError(err) {
+			return nil, attempt, remoteError(err)
+		}
+
+		log.Printf("Retrying read of %s (attempt %d/%d): %v", description, attempt, maxReadAttempts, err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, attempt, remoteError(err)
+		}
+		delay *= 2
+	}
+}
+
+// isRetryableReadError reports whether a failed read is likely to succeed if attempted again,
+// i.e. timeouts, throttling, 5xx responses and dropped connections
+func isRetryableReadError(err error) bool {
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	var statusErr *httpStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= 500 || statusErr.StatusCode == http.StatusTooManyRequests
+	}
+
+	var respErr *awshttp.ResponseError
+	if errors.As(err, &respErr) {
+		status := respErr.HTTPStatusCode()
+		return status >= 500 || status == http.StatusTooManyRequests
+	}
+
+	return retry.IsErrorRetryables(retry.DefaultRetryables).IsErrorRetryable(err) == aws.TrueTernary
+}
+
+// remoteError lets callers tell errors.Is a remote request failed because the object is missing,
+// common.ErrNotFound, or because storage couldn't be reached, common.ErrRemoteUnavailable
+func remoteError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if responseStatus(err) == http.StatusNotFound {
+		return common.NewError(err.Error(), err, common.ErrNotFound)
+	}
+
+	var opErr *net.OpError
+	if isRetryableReadError(err) || errors.As(err, &opErr) {
+		return common.NewError(err.Error(), err, common.ErrRemoteUnavailable)
+	}
+	return err
+}
+
+// responseStatus returns the status code of a failed HTTP or S3 request, 0 if there was no response
+func responseStatus(err error) int {
+	var statusErr *httpStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode
+	}
+	var respErr interface{ HTTPStatusCode() int }
+	if errors.As(err, &respErr) {
+		return respErr.HTTPStatusCode()
+	}
+	return 0
+}
+
+// httpStatusError is returned by plain HTTP backends for unexpected response codes
+type httpStatusError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *httpStatusError) Error() string {
+	return "unexpected response status: " + e.Status
+}
@@ -3,19 +3,31 @@ package storage
 import (
 	"bytes"
 	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/NilayYadav/clip/pkg/common"
 	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
 	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
 	"github.com/gofrs/flock"
 	"github.com/google/uuid"
 )
@@ -23,6 +35,16 @@ import (
 type S3ClipStorageCredentials struct {
 	AccessKey string
 	SecretKey string
+
+	Profile              string // Shared config profile to load, instead of AWS_PROFILE
+	RoleARN              string // Role assumed with the credentials resolved otherwise
+	ExternalID           string // Required by the role's trust policy, if any
+	RoleSessionName      string
+	WebIdentityTokenFile string // Assume RoleARN with this OIDC token, as with IRSA, instead of with other credentials
+	Endpoint             string // Reach S3 here instead of at the archive's endpoint
+
+	TLS                *common.TLSFiles // Client certificate, and CAs trusted on top of the archive's
+	InsecureSkipVerify bool             // Don't verify the endpoint's certificate at all
 }
 
 type S3ClipStorage struct {
@@ -35,6 +57,10 @@ type S3ClipStorage struct {
 	localCachePath string
 	cachedLocally  bool
 	cacheFile      *os.File
+	limiter        *readLimiter
+	coalescer      *readCoalescer
+	opts           S3ClipStorageOpts
+	credentials    *reloadableCredentials // Nil for anonymous access
 }
 
 type S3ClipStorageOpts struct {
@@ -46,24 +72,39 @@ type S3ClipStorageOpts struct {
 	AccessKey      string
 	SecretKey      string
 	ForcePathStyle bool
+	ReadLimits     ReadLimits
+	CoalesceWindow time.Duration
+
+	Profile              string
+	RoleARN              string
+	ExternalID           string
+	RoleSessionName      string
+	WebIdentityTokenFile string
+
+	CABundle           []byte
+	TLS                *common.TLSFiles
+	InsecureSkipVerify bool
+	Proxy              *ProxyConfig
 }
 
 const backgroundDownloadStartupDelay = time.Second * 30
 
-func NewS3ClipStorage(metadata *common.ClipArchiveMetadata, opts S3ClipStorageOpts) (*S3ClipStorage, error) {
-	accessKey := os.Getenv("AWS_ACCESS_KEY_ID")
-	secretKey := os.Getenv("AWS_SECRET_ACCESS_KEY")
+// Archives are uploaded in parts of this size, which the ETag of a multipart upload depends on
+const s3UploadPartSize = manager.DefaultUploadPartSize
 
-	if opts.AccessKey != "" && opts.SecretKey != "" {
-		accessKey = opts.AccessKey
-		secretKey = opts.SecretKey
-	}
-
-	cfg, err := getAWSConfig(accessKey, secretKey, opts.Region, opts.Endpoint)
+func NewS3ClipStorage(metadata *common.ClipArchiveMetadata, opts S3ClipStorageOpts) (*S3ClipStorage, error) {
+	accessKey, secretKey := s3Keys(opts)
+	cfg, err := getAWSConfig(accessKey, secretKey, opts)
 	if err != nil {
 		return nil, err
 	}
 
+	var creds *reloadableCredentials
+	if cfg.Credentials != nil {
+		creds = &reloadableCredentials{provider: cfg.Credentials}
+		cfg.Credentials = creds
+	}
+
 	svc := s3.NewFromConfig(cfg, func(o *s3.Options) {
 		if opts.ForcePathStyle {
 			o.UsePathStyle = true
@@ -89,7 +130,13 @@ func NewS3ClipStorage(metadata *common.ClipArchiveMetadata, opts S3ClipStorageOp
 		localCachePath: opts.CachePath,
 		cachedLocally:  false,
 		cacheFile:      nil,
+		limiter:        newReadLimiter(opts.ReadLimits),
+		opts:           opts,
+		credentials:    creds,
 	}
+	c.coalescer = newReadCoalescer(opts.CoalesceWindow, func(dest []byte, off int64) (int, error) {
+		return c.readSource(context.Background(), dest, off)
+	})
 
 	if opts.CachePath != "" {
 		cacheFile, err := os.OpenFile(opts.CachePath, os.O_RDWR|os.O_CREATE, 0644)
@@ -103,61 +150,187 @@ func NewS3ClipStorage(metadata *common.ClipArchiveMetadata, opts S3ClipStorageOp
 	return c, nil
 }
 
-func getAWSConfig(accessKey string, secretKey string, region string, endpoint string) (aws.Config, error) {
-	var cfg aws.Config
-	var err error
-	var endpointResolver aws.EndpointResolverWithOptions
+// s3Keys returns the keys given in opts, or those in the environment
+func s3Keys(opts S3ClipStorageOpts) (string, string) {
+	if opts.AccessKey != "" && opts.SecretKey != "" {
+		return opts.AccessKey, opts.SecretKey
+	}
+	return os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+}
+
+// reloadableCredentials lets the credentials of a client be replaced once it's created, requests
+// already signed keep the credentials they were signed with
+type reloadableCredentials struct {
+	mu       sync.RWMutex
+	provider aws.CredentialsProvider
+}
+
+func (c *reloadableCredentials) Retrieve(ctx context.Context) (aws.Credentials, error) {
+	c.mu.RLock()
+	provider := c.provider
+	c.mu.RUnlock()
+	return provider.Retrieve(ctx)
+}
+
+// ReloadCredentials resolves credentials again, picking up changes to the shared credentials and
+// config files and to web identity tokens
+func (s3c *S3ClipStorage) ReloadCredentials() error {
+	if s3c.credentials == nil {
+		return nil
+	}
+
+	accessKey, secretKey := s3Keys(s3c.opts)
+	cfg, err := getAWSConfig(accessKey, secretKey, s3c.opts)
+	if err != nil {
+		return fmt.Errorf("failed to reload s3 credentials: %v", err)
+	}
+	if cfg.Credentials == nil {
+		return fmt.Errorf("failed to reload s3 credentials: none found")
+	}
+
+	s3c.credentials.mu.Lock()
+	s3c.credentials.provider = cfg.Credentials
+	s3c.credentials.mu.Unlock()
+	return nil
+}
+
+func getAWSConfig(accessKey string, secretKey string, opts S3ClipStorageOpts) (aws.Config, error) {
 	var useDualStack aws.DualStackEndpointState
 
-	if endpoint != "" {
-		endpointResolver = aws.EndpointResolverWithOptionsFunc(func(service, region string, options ...interface{}) (aws.Endpoint, error) {
+	tlsConfig, err := s3TLSConfig(opts)
+	if err != nil {
+		return aws.Config{}, err
+	}
+
+	// Buildable so AWS_CA_BUNDLE can still be added to the trusted CAs
+	ipv6 := common.IsIPv6Available()
+	httpClient := awshttp.NewBuildableClient().WithTransportOptions(func(tr *http.Transport) {
+		tr.Proxy = opts.Proxy.proxyFunc()
+		if ipv6 {
+			tr.DialContext = common.DialContextIPv6
+		}
+		if tlsConfig != nil {
+			tr.TLSClientConfig = tlsConfig
+		}
+	})
+	if ipv6 {
+		useDualStack = aws.DualStackEndpointStateEnabled
+	} else {
+		useDualStack = aws.DualStackEndpointStateDisabled
+	}
+
+	loadOpts := []func(*config.LoadOptions) error{
+		config.WithRegion(opts.Region),
+		config.WithUseDualStackEndpoint(useDualStack),
+		config.WithHTTPClient(httpClient),
+	}
+
+	if opts.Endpoint != "" {
+		// Only S3 lives at the custom endpoint, STS is still needed to assume roles
+		endpointResolver := aws.EndpointResolverWithOptionsFunc(func(service, region string, options ...interface{}) (aws.Endpoint, error) {
+			if service != s3.ServiceID {
+				return aws.Endpoint{}, &aws.EndpointNotFoundError{}
+			}
 			return aws.Endpoint{
-				URL: endpoint,
+				URL: opts.Endpoint,
 			}, nil
 		})
+		loadOpts = append(loadOpts, config.WithEndpointResolverWithOptions(endpointResolver))
 	}
 
-	httpClient := &http.Client{}
-	if common.IsIPv6Available() {
-		useDualStack = aws.DualStackEndpointStateEnabled
-		ipv6Transport := &http.Transport{
-			Proxy:               http.ProxyFromEnvironment,
-			DialContext:         common.DialContextIPv6,
-			TLSHandshakeTimeout: 10 * time.Second,
+	if opts.Profile != "" {
+		loadOpts = append(loadOpts, config.WithSharedConfigProfile(opts.Profile))
+	}
+
+	if accessKey != "" && secretKey != "" {
+		loadOpts = append(loadOpts, config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(accessKey, secretKey, "")))
+	}
+
+	cfg, err := config.LoadDefaultConfig(context.TODO(), loadOpts...)
+	if err != nil {
+		return cfg, err
+	}
+
+	if opts.WebIdentityTokenFile != "" {
+		if opts.RoleARN == "" {
+			return cfg, fmt.Errorf("a web identity token needs a role to assume")
 		}
-		httpClient.Transport = ipv6Transport
-	} else {
-		useDualStack = aws.DualStackEndpointStateDisabled
+
+		provider := stscreds.NewWebIdentityRoleProvider(sts.NewFromConfig(cfg), opts.RoleARN, stscreds.IdentityTokenFile(opts.WebIdentityTokenFile), func(o *stscreds.WebIdentityRoleOptions) {
+			o.RoleSessionName = opts.RoleSessionName
+		})
+		cfg.Credentials = aws.NewCredentialsCache(provider)
+	} else if opts.RoleARN != "" {
+		// Assumed with whatever the chain above resolved
+		provider := stscreds.NewAssumeRoleProvider(sts.NewFromConfig(cfg), opts.RoleARN, func(o *stscreds.AssumeRoleOptions) {
+			o.RoleSessionName = opts.RoleSessionName
+			if opts.ExternalID != "" {
+				o.ExternalID = aws.String(opts.ExternalID)
+			}
+		})
+		cfg.Credentials = aws.NewCredentialsCache(provider)
+	}
+
+	return cfg, nil
+}
+
+// s3TLSConfig returns nil if the default TLS settings do
+func s3TLSConfig(opts S3ClipStorageOpts) (*tls.Config, error) {
+	if len(opts.CABundle) == 0 && opts.TLS == nil && !opts.InsecureSkipVerify {
+		return nil, nil
 	}
 
-	if accessKey == "" || secretKey == "" {
-		if endpointResolver != nil {
-			cfg, err = config.LoadDefaultConfig(context.TODO(), config.WithRegion(region), config.WithEndpointResolverWithOptions(endpointResolver), config.WithUseDualStackEndpoint(useDualStack), config.WithHTTPClient(httpClient))
-		} else {
-			cfg, err = config.LoadDefaultConfig(context.TODO(), config.WithRegion(region), config.WithUseDualStackEndpoint(useDualStack), config.WithHTTPClient(httpClient))
+	cfg := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: opts.InsecureSkipVerify,
+	}
+
+	var bundles [][]byte
+	if len(opts.CABundle) > 0 {
+		bundles = append(bundles, opts.CABundle)
+	}
+	if opts.TLS != nil && opts.TLS.CAFile != "" {
+		data, err := os.ReadFile(opts.TLS.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle: %v", err)
 		}
-	} else {
-		credentials := credentials.NewStaticCredentialsProvider(accessKey, secretKey, "")
+		bundles = append(bundles, data)
+	}
 
-		if endpointResolver != nil {
-			cfg, err = config.LoadDefaultConfig(context.TODO(), config.WithRegion(region), config.WithCredentialsProvider(credentials), config.WithEndpointResolverWithOptions(endpointResolver), config.WithUseDualStackEndpoint(useDualStack), config.WithHTTPClient(httpClient))
-		} else {
-			cfg, err = config.LoadDefaultConfig(context.TODO(), config.WithRegion(region), config.WithCredentialsProvider(credentials), config.WithUseDualStackEndpoint(useDualStack), config.WithHTTPClient(httpClient))
+	if len(bundles) > 0 {
+		// Private CAs are trusted alongside the system's, not instead of them
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		for _, bundle := range bundles {
+			if !pool.AppendCertsFromPEM(bundle) {
+				return nil, fmt.Errorf("no certificates found in CA bundle")
+			}
+		}
+		cfg.RootCAs = pool
+	}
+
+	if opts.TLS != nil && (opts.TLS.CertFile != "" || opts.TLS.KeyFile != "") {
+		cert, err := tls.LoadX509KeyPair(opts.TLS.CertFile, opts.TLS.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %v", err)
 		}
+		cfg.Certificates = []tls.Certificate{cert}
 	}
 
-	return cfg, err
+	return cfg, nil
 }
 
 type progressReader struct {
-	file *os.File
+	r    io.Reader
 	size int64
 	read int64
 	ch   chan<- int
 }
 
 func (pr *progressReader) Read(p []byte) (int, error) {
-	n, err := pr.file.Read(p)
+	n, err := pr.r.Read(p)
 	if n > 0 {
 		pr.read += int64(n)
 		progress := int(float64(pr.read) / float64(pr.size) * 100)
@@ -169,7 +342,7 @@ func (pr *progressReader) Read(p []byte) (int, error) {
 	return n, err
 }
 
-func (s3c *S3ClipStorage) Upload(ctx context.Context, archivePath string, progressChan chan<- int) error {
+func (s3c *S3ClipStorage) Upload(ctx context.Context, archivePath string, opts UploadOpts) error {
 	f, err := os.Open(archivePath)
 	if err != nil {
 		return fmt.Errorf("failed to open archive <%s>: %v", archivePath, err)
@@ -183,15 +356,23 @@ func (s3c *S3ClipStorage) Upload(ctx context.Context, archivePath string, progre
 
 	length := fi.Size()
 
+	if opts.SkipExisting {
+		if size, err := s3c.getFileSize(); err == nil && size == length {
+			log.Printf("<%s> is already stored, skipping the upload", s3c.key)
+			return nil
+		}
+	}
+
 	pr := &progressReader{
-		file: f,
+		r:    newThrottledReader(ctx, f, opts.BytesPerSecond),
 		size: length,
-		ch:   progressChan,
+		ch:   opts.ProgressChan,
 	}
 
 	// Create an uploader with the S3 client
 	uploader := manager.NewUploader(s3c.svc, func(u *manager.Uploader) {
 		u.Concurrency = 128
+		u.PartSize = s3UploadPartSize
 	})
 
 	_, err = uploader.Upload(ctx, &s3.PutObjectInput{
@@ -201,9 +382,90 @@ func (s3c *S3ClipStorage) Upload(ctx context.Context, archivePath string, progre
 		ContentLength: &length,
 	})
 	if err != nil {
-		return fmt.Errorf("failed to upload archive: %v", err)
+		return fmt.Errorf("failed to upload archive: %w", s3c.requestError("Upload", "", 1, remoteError(err)))
+	}
+
+	return nil
+}
+
+// verifyETag reports whether the object's ETag is the one S3 gives an upload of archivePath, see
+// expectedETag. Objects encrypted with KMS or customer keys have other ETags, so a mismatch only
+// means the ETag can't tell. A size mismatch is an error.
+func (s3c *S3ClipStorage) verifyETag(ctx context.Context, archivePath string) (bool, error) {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := s3c.svc.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s3c.bucket),
+		Key:    aws.String(s3c.key),
+	})
+	if err != nil {
+		return false, err
+	}
+	if size := aws.ToInt64(resp.ContentLength); size != fi.Size() {
+		return false, fmt.Errorf("stored archive <%s> is %d bytes, expected %d", s3c.key, size, fi.Size())
+	}
+
+	expected, err := expectedETag(f, fi.Size(), s3UploadPartSize)
+	if err != nil {
+		return false, err
+	}
+	return strings.Trim(aws.ToString(resp.ETag), `"`) == expected, nil
+}
+
+// expectedETag returns the ETag of an upload of r in parts of partSize: the md5 of the content if it
+// fits in one part, else the md5 of the md5s of the parts followed by the number of parts
+func expectedETag(r io.ReaderAt, size int64, partSize int64) (string, error) {
+	if size < partSize {
+		hash := md5.New()
+		if _, err := io.Copy(hash, io.NewSectionReader(r, 0, size)); err != nil {
+			return "", err
+		}
+		return hex.EncodeToString(hash.Sum(nil)), nil
+	}
+
+	var sums []byte
+	parts := 0
+	for off := int64(0); off < size; off += partSize {
+		hash := md5.New()
+		if _, err := io.Copy(hash, io.NewSectionReader(r, off, partSize)); err != nil {
+			return "", err
+		}
+		sums = hash.Sum(sums)
+		parts++
+	}
+
+	hash := md5.Sum(sums)
+	return fmt.Sprintf("%s-%d", hex.EncodeToString(hash[:]), parts), nil
+}
+
+// verifyCache checks a downloaded archive against the digest recorded in the rclip, if there is one
+func (s3c *S3ClipStorage) verifyCache(cachePath string) error {
+	if s3c.metadata == nil || s3c.metadata.Attributes.ArchiveDigest == "" {
+		return nil
+	}
+
+	f, err := os.Open(cachePath)
+	if err != nil {
+		return err
 	}
+	defer f.Close()
 
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return err
+	}
+	if digest := hex.EncodeToString(hash.Sum(nil)); digest != s3c.metadata.Attributes.ArchiveDigest {
+		return fmt.Errorf("digest is %s, expected %s", digest, s3c.metadata.Attributes.ArchiveDigest)
+	}
 	return nil
 }
 
@@ -217,9 +479,13 @@ func (s3c *S3ClipStorage) startBackgroundDownload() {
 	cacheFileInfo, err := s3c.cacheFile.Stat()
 	if err == nil {
 		if cacheFileInfo.Size() == totalSize {
-			log.Printf("Cache file <%s> exists.\n", s3c.localCachePath)
-			s3c.cachedLocally = true
-			return
+			if err := s3c.verifyCache(s3c.localCachePath); err != nil {
+				log.Printf("Cache file <%s> doesn't match the rclip, downloading again: %v", s3c.localCachePath, err)
+			} else {
+				log.Printf("Cache file <%s> exists.\n", s3c.localCachePath)
+				s3c.cachedLocally = true
+				return
+			}
 		}
 	}
 
@@ -250,6 +516,9 @@ func (s3c *S3ClipStorage) startBackgroundDownload() {
 	startTime := time.Now()
 	downloader := manager.NewDownloader(s3c.svc)
 	downloader.Concurrency = 32
+	if n := s3c.limiter.maxConcurrent(); n > 0 && n < downloader.Concurrency {
+		downloader.Concurrency = n
+	}
 
 	f, err := os.Create(tmpCacheFile)
 	if err != nil {
@@ -258,12 +527,23 @@ func (s3c *S3ClipStorage) startBackgroundDownload() {
 	}
 	defer f.Close()
 
-	_, err = downloader.Download(context.TODO(), f, &s3.GetObjectInput{
+	var w io.WriterAt = f
+	if s3c.limiter.limitsBytes() {
+		w = &throttledWriterAt{w: f, limiter: s3c.limiter}
+	}
+
+	_, err = downloader.Download(context.TODO(), w, &s3.GetObjectInput{
 		Bucket: aws.String(s3c.bucket),
 		Key:    aws.String(s3c.key),
 	})
 	if err != nil {
-		log.Printf("Failed to download object: %v", err)
+		s3c.requestError("Download", "", 1, err)
+		os.Remove(tmpCacheFile)
+		return
+	}
+
+	if err := s3c.verifyCache(tmpCacheFile); err != nil {
+		log.Printf("Downloaded archive doesn't match the rclip, not caching it: %v", err)
 		os.Remove(tmpCacheFile)
 		return
 	}
@@ -289,10 +569,34 @@ func (s3c *S3ClipStorage) startBackgroundDownload() {
 	s3c.cachedLocally = true
 }
 
+// Fd returns the local cache file once the whole archive has been downloaded to it
+func (s3c *S3ClipStorage) Fd(node *common.ClipNode, off int64) (uintptr, int64, bool) {
+	if !s3c.cachedLocally {
+		return 0, 0, false
+	}
+	return s3c.cacheFile.Fd(), node.DataPos + off, true
+}
+
 func (s3c *S3ClipStorage) CachedLocally() bool {
 	return s3c.cachedLocally
 }
 
+// CheckHealth checks the archive object is still there, unless it has been downloaded completely
+func (s3c *S3ClipStorage) CheckHealth(ctx context.Context) error {
+	if s3c.cachedLocally {
+		return nil
+	}
+
+	_, err := s3c.svc.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s3c.bucket),
+		Key:    aws.String(s3c.key),
+	})
+	if err != nil {
+		return s3c.requestError("HeadObject", "", 1, remoteError(err))
+	}
+	return nil
+}
+
 func (s3c *S3ClipStorage) getFileSize() (int64, error) {
 	input := &s3.HeadObjectInput{
 		Bucket: aws.String(s3c.bucket),
@@ -301,14 +605,23 @@ func (s3c *S3ClipStorage) getFileSize() (int64, error) {
 
 	resp, err := s3c.svc.HeadObject(context.TODO(), input)
 	if err != nil {
-		return 0, err
+		return 0, remoteError(err)
 	}
 
 	return *resp.ContentLength, nil
 }
 
-func (s3c *S3ClipStorage) getContentFromSource(dest []byte, start, end int64) (int, error) {
-	data, err := s3c.downloadChunk(start, end)
+// getContentFromSource reads from the archive object. Coalesced reads are shared by several readers,
+// they aren't stopped by the ctx of one of them.
+func (s3c *S3ClipStorage) getContentFromSource(ctx context.Context, dest []byte, start, end int64) (int, error) {
+	if s3c.coalescer != nil {
+		return s3c.coalescer.ReadAt(dest[:end-start+1], start)
+	}
+	return s3c.readSource(ctx, dest[:end-start+1], start)
+}
+
+func (s3c *S3ClipStorage) readSource(ctx context.Context, dest []byte, off int64) (int, error) {
+	data, err := s3c.downloadChunk(ctx, off, off+int64(len(dest))-1)
 	if err != nil {
 		return 0, err
 	}
@@ -323,29 +636,48 @@ func (s3c *S3ClipStorage) ReadFile(node *common.ClipNode, dest []byte, off int64
 	end := start + int64(len(dest)) - 1
 
 	if !s3c.cachedLocally {
-		return s3c.getContentFromSource(dest, start, end)
+		return s3c.getContentFromSource(context.Background(), dest, start, end)
 	}
 
 	// Read from local cache
 	n, err := s3c.cacheFile.ReadAt(dest, start)
 	if err != nil {
 		// Fall back to remote source if local cache file fails for some reason
-		return s3c.getContentFromSource(dest, start, end)
+		return s3c.getContentFromSource(context.Background(), dest, start, end)
 	}
 
 	return n, nil
 }
 
-func (s3c *S3ClipStorage) downloadChunk(start int64, end int64) ([]byte, error) {
+func (s3c *S3ClipStorage) downloadChunk(ctx context.Context, start int64, end int64) ([]byte, error) {
+	release, err := s3c.limiter.Acquire(ctx, int(end-start+1))
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
 	rangeHeader := fmt.Sprintf("bytes=%d-%d", start, end)
+	data, attempts, err := withReadRetries(ctx, fmt.Sprintf("range %d-%d of s3://%s/%s", start, end, s3c.bucket, s3c.key), func() ([]byte, error) {
+		return s3c.fetchRange(ctx, rangeHeader)
+	})
+	if err != nil {
+		return nil, s3c.requestError("GetObject", rangeHeader, attempts, err)
+	}
+	return data, nil
+}
+
+func (s3c *S3ClipStorage) fetchRange(ctx context.Context, rangeHeader string) ([]byte, error) {
 	getObjectInput := &s3.GetObjectInput{
 		Bucket: aws.String(s3c.bucket),
 		Key:    aws.String(s3c.key),
 		Range:  aws.String(rangeHeader),
 	}
 
-	// Attempt to download chunk from S3
-	resp, err := s3c.svc.GetObject(context.Background(), getObjectInput)
+	// Attempt to download chunk from S3. withReadRetries retries, the SDK retrying the same errors
+	// as well would multiply the requests of a read.
+	resp, err := s3c.svc.GetObject(ctx, getObjectInput, func(o *s3.Options) {
+		o.Retryer = aws.NopRetryer{}
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -360,10 +692,79 @@ func (s3c *S3ClipStorage) downloadChunk(start int64, end int64) ([]byte, error)
 	return buf.Bytes()[:buf.Len()], nil
 }
 
+// S3Error is a failed S3 request, with what's needed to find it in the bucket's server access logs
+// or to raise it with AWS support
+type S3Error struct {
+	Operation string // GetObject, HeadObject or Upload
+	Bucket    string
+	Key       string
+	Range     string // Of reads, as in the Range header
+	Attempts  int
+	RequestID string // x-amz-request-id, empty if S3 never answered
+	HostID    string // x-amz-id-2
+	Err       error
+}
+
+func (e *S3Error) Error() string {
+	msg := fmt.Sprintf("s3 %s of s3://%s/%s", e.Operation, e.Bucket, e.Key)
+	if e.Range != "" {
+		msg += " " + e.Range
+	}
+	if e.Attempts > 1 {
+		msg += fmt.Sprintf(" failed after %d attempts", e.Attempts)
+	}
+	if e.RequestID != "" {
+		msg += " (request id " + e.RequestID
+		if e.HostID != "" {
+			msg += ", host id " + e.HostID
+		}
+		msg += ")"
+	}
+	return msg + ": " + e.Err.Error()
+}
+
+func (e *S3Error) Unwrap() error {
+	return e.Err
+}
+
+// requestError wraps the error of a request to the archive object, and logs it: reads that fail end up
+// as EIO in applications, which says nothing of what went wrong
+func (s3c *S3ClipStorage) requestError(operation string, rangeHeader string, attempts int, err error) error {
+	s3Err := &S3Error{
+		Operation: operation,
+		Bucket:    s3c.bucket,
+		Key:       s3c.key,
+		Range:     rangeHeader,
+		Attempts:  attempts,
+		Err:       err,
+	}
+
+	var reqErr interface{ ServiceRequestID() string }
+	if errors.As(err, &reqErr) {
+		s3Err.RequestID = reqErr.ServiceRequestID()
+	}
+	var hostErr interface{ ServiceHostID() string }
+	if errors.As(err, &hostErr) {
+		s3Err.HostID = hostErr.ServiceHostID()
+	}
+
+	log.Println(s3Err)
+	return s3Err
+}
+
 func (s3c *S3ClipStorage) Metadata() *common.ClipArchiveMetadata {
 	return s3c.metadata
 }
 
+// ReadRange reads directly from the archive object, bypassing the local cache
+func (s3c *S3ClipStorage) ReadRange(ctx context.Context, dest []byte, off int64) (int, error) {
+	return s3c.getContentFromSource(ctx, dest, off, off+int64(len(dest))-1)
+}
+
+func (s3c *S3ClipStorage) Close() error {
+	return s3c.Cleanup()
+}
+
 func (s3c *S3ClipStorage) Cleanup() error {
 	if s3c.cacheFile != nil {
 		s3c.cacheFile.Close()
@@ -371,3 +772,93 @@ func (s3c *S3ClipStorage) Cleanup() error {
 
 	return nil
 }
+
+func init() {
+	RegisterBackend(s3Backend{})
+}
+
+type s3Backend struct{}
+
+func (b s3Backend) Type() string {
+	return "s3"
+}
+
+func (b s3Backend) DecodeStorageInfo(data []byte) (common.ClipStorageInfo, error) {
+	var info common.S3StorageInfo
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&info); err != nil {
+		return nil, fmt.Errorf("error decoding s3 storage info: %v", err)
+	}
+	return info, nil
+}
+
+func (b s3Backend) Open(ctx context.Context, info common.ClipStorageInfo, opts ClipStorageOpts) (RemoteArchive, error) {
+	// Ranged reads only, so don't start a background download of the archive
+	opts.CachePath = ""
+	return b.newStorage(nil, info, opts)
+}
+
+func (b s3Backend) NewClipStorage(metadata *common.ClipArchiveMetadata, opts ClipStorageOpts) (ClipStorageInterface, error) {
+	return b.newStorage(metadata, metadata.StorageInfo, opts)
+}
+
+func (b s3Backend) Upload(ctx context.Context, info common.ClipStorageInfo, archivePath string, opts UploadOpts) error {
+	s3c, err := b.newStorage(nil, info, ClipStorageOpts{Credentials: opts.Credentials})
+	if err != nil {
+		return err
+	}
+	defer s3c.Cleanup()
+
+	return s3c.Upload(ctx, archivePath, opts)
+}
+
+// VerifyUpload compares the ETag of the stored archive with the one expected for the local archive
+func (b s3Backend) VerifyUpload(ctx context.Context, info common.ClipStorageInfo, archivePath string, opts UploadOpts) (bool, error) {
+	s3c, err := b.newStorage(nil, info, ClipStorageOpts{Credentials: opts.Credentials})
+	if err != nil {
+		return false, err
+	}
+	defer s3c.Cleanup()
+
+	return s3c.verifyETag(ctx, archivePath)
+}
+
+func (b s3Backend) newStorage(metadata *common.ClipArchiveMetadata, info common.ClipStorageInfo, opts ClipStorageOpts) (*S3ClipStorage, error) {
+	var storageInfo common.S3StorageInfo
+	switch si := info.(type) {
+	case common.S3StorageInfo:
+		storageInfo = si
+	case *common.S3StorageInfo:
+		storageInfo = *si
+	default:
+		return nil, fmt.Errorf("unexpected storage info for s3 backend: %T", info)
+	}
+
+	s3Opts := S3ClipStorageOpts{
+		Bucket:         storageInfo.Bucket,
+		Region:         storageInfo.Region,
+		Key:            storageInfo.Key,
+		Endpoint:       storageInfo.Endpoint,
+		ForcePathStyle: storageInfo.ForcePathStyle,
+		CABundle:       storageInfo.CABundle,
+		CachePath:      opts.CachePath,
+		ReadLimits:     opts.ReadLimits,
+		CoalesceWindow: opts.CoalesceWindow,
+		Proxy:          opts.Credentials.Proxy,
+	}
+	if creds := opts.Credentials.S3; creds != nil {
+		s3Opts.AccessKey = creds.AccessKey
+		s3Opts.SecretKey = creds.SecretKey
+		s3Opts.Profile = creds.Profile
+		s3Opts.RoleARN = creds.RoleARN
+		s3Opts.ExternalID = creds.ExternalID
+		s3Opts.RoleSessionName = creds.RoleSessionName
+		s3Opts.WebIdentityTokenFile = creds.WebIdentityTokenFile
+		if creds.Endpoint != "" {
+			s3Opts.Endpoint = creds.Endpoint
+		}
+		s3Opts.TLS = creds.TLS
+		s3Opts.InsecureSkipVerify = creds.InsecureSkipVerify
+	}
+
+	return NewS3ClipStorage(metadata, s3Opts)
+}
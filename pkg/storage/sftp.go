@@ -0,0 +1,234 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/NilayYadav/clip/pkg/common"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+type SFTPClipStorageCredentials struct {
+	Password              string
+	PrivateKeyPath        string // Defaults to ~/.ssh/id_ed25519 or ~/.ssh/id_rsa
+	PrivateKeyPassphrase  string
+	KnownHostsPath        string // Defaults to ~/.ssh/known_hosts
+	InsecureIgnoreHostKey bool
+}
+
+type sftpRemoteArchive struct {
+	conn   *ssh.Client
+	client *sftp.Client
+	file   *sftp.File
+}
+
+func (ra *sftpRemoteArchive) ReadRange(ctx context.Context, dest []byte, off int64) (int, error) {
+	n, err := ra.file.ReadAt(dest, off)
+	if err != nil {
+		return n, fmt.Errorf("unable to read data from sftp: %w", err)
+	}
+	return n, nil
+}
+
+func (ra *sftpRemoteArchive) Close() error {
+	if ra.file != nil {
+		ra.file.Close()
+	}
+	ra.client.Close()
+	return ra.conn.Close()
+}
+
+func init() {
+	RegisterBackend(sftpBackend{})
+}
+
+type sftpBackend struct{}
+
+func (b sftpBackend) Type() string {
+	return "sftp"
+}
+
+func (b sftpBackend) DecodeStorageInfo(data []byte) (common.ClipStorageInfo, error) {
+	var info common.SFTPStorageInfo
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&info); err != nil {
+		return nil, fmt.Errorf("error decoding sftp storage info: %v", err)
+	}
+	return info, nil
+}
+
+func (b sftpBackend) Open(ctx context.Context, info common.ClipStorageInfo, opts ClipStorageOpts) (RemoteArchive, error) {
+	ra, storageInfo, err := b.connect(info, opts.Credentials.SFTP)
+	if err != nil {
+		return nil, remoteError(err)
+	}
+
+	ra.file, err = ra.client.Open(storageInfo.Path)
+	if err != nil {
+		ra.Close()
+		if errors.Is(err, os.ErrNotExist) {
+			err = common.NewError(err.Error(), err, common.ErrNotFound)
+		}
+		return nil, fmt.Errorf("failed to open remote archive <%s>: %w", storageInfo.Path, err)
+	}
+
+	return ra, nil
+}
+
+func (b sftpBackend) Upload(ctx context.Context, info common.ClipStorageInfo, archivePath string, opts UploadOpts) error {
+	ra, storageInfo, err := b.connect(info, opts.Credentials.SFTP)
+	if err != nil {
+		return err
+	}
+	defer ra.Close()
+
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return fmt.Errorf("failed to open archive <%s>: %v", archivePath, err)
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if err := ra.client.MkdirAll(path.Dir(storageInfo.Path)); err != nil {
+		return fmt.Errorf("failed to create remote directory: %v", err)
+	}
+
+	// Upload to a temporary name first so readers never see a partial archive
+	tmpPath := storageInfo.Path + ".upload"
+	remoteFile, err := ra.client.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("failed to create remote archive <%s>: %v", tmpPath, err)
+	}
+
+	pr := &progressReader{
+		r:    newThrottledReader(ctx, f, opts.BytesPerSecond),
+		size: fi.Size(),
+		ch:   opts.ProgressChan,
+	}
+
+	_, err = remoteFile.ReadFrom(pr)
+	remoteFile.Close()
+	if err != nil {
+		ra.client.Remove(tmpPath)
+		return fmt.Errorf("failed to upload archive: %v", err)
+	}
+
+	if err := ra.client.PosixRename(tmpPath, storageInfo.Path); err != nil {
+		ra.client.Remove(tmpPath)
+		return fmt.Errorf("failed to move uploaded archive into place: %v", err)
+	}
+
+	return nil
+}
+
+func (b sftpBackend) connect(info common.ClipStorageInfo, credentials *SFTPClipStorageCredentials) (*sftpRemoteArchive, common.SFTPStorageInfo, error) {
+	var storageInfo common.SFTPStorageInfo
+	switch si := info.(type) {
+	case common.SFTPStorageInfo:
+		storageInfo = si
+	case *common.SFTPStorageInfo:
+		storageInfo = *si
+	default:
+		return nil, storageInfo, fmt.Errorf("unexpected storage info for sftp backend: %T", info)
+	}
+
+	if credentials == nil {
+		credentials = &SFTPClipStorageCredentials{}
+	}
+
+	config, err := sshClientConfig(storageInfo.User, credentials)
+	if err != nil {
+		return nil, storageInfo, err
+	}
+
+	addr := storageInfo.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "22")
+	}
+
+	conn, err := ssh.Dial("tcp", addr, config)
+	if err != nil {
+		return nil, storageInfo, fmt.Errorf("cannot connect to sftp host <%s>: %v", addr, err)
+	}
+
+	client, err := sftp.NewClient(conn, sftp.UseConcurrentReads(true), sftp.UseConcurrentWrites(true))
+	if err != nil {
+		conn.Close()
+		return nil, storageInfo, fmt.Errorf("cannot start sftp session: %v", err)
+	}
+
+	return &sftpRemoteArchive{conn: conn, client: client}, storageInfo, nil
+}
+
+func sshClientConfig(user string, credentials *SFTPClipStorageCredentials) (*ssh.ClientConfig, error) {
+	home, _ := os.UserHomeDir()
+
+	var authMethods []ssh.AuthMethod
+	keyPaths := []string{credentials.PrivateKeyPath}
+	if credentials.PrivateKeyPath == "" {
+		keyPaths = []string{filepath.Join(home, ".ssh", "id_ed25519"), filepath.Join(home, ".ssh", "id_rsa")}
+	}
+
+	for _, keyPath := range keyPaths {
+		key, err := os.ReadFile(keyPath)
+		if err != nil {
+			if credentials.PrivateKeyPath != "" {
+				return nil, fmt.Errorf("failed to read private key <%s>: %v", keyPath, err)
+			}
+			continue
+		}
+
+		var signer ssh.Signer
+		if credentials.PrivateKeyPassphrase != "" {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(key, []byte(credentials.PrivateKeyPassphrase))
+		} else {
+			signer, err = ssh.ParsePrivateKey(key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse private key <%s>: %v", keyPath, err)
+		}
+
+		authMethods = append(authMethods, ssh.PublicKeys(signer))
+		break
+	}
+
+	if credentials.Password != "" {
+		authMethods = append(authMethods, ssh.Password(credentials.Password))
+	}
+
+	if len(authMethods) == 0 {
+		return nil, fmt.Errorf("no sftp credentials available")
+	}
+
+	hostKeyCallback := ssh.InsecureIgnoreHostKey()
+	if !credentials.InsecureIgnoreHostKey {
+		knownHostsPath := credentials.KnownHostsPath
+		if knownHostsPath == "" {
+			knownHostsPath = filepath.Join(home, ".ssh", "known_hosts")
+		}
+
+		var err error
+		hostKeyCallback, err = knownhosts.New(knownHostsPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load known hosts <%s>: %v", knownHostsPath, err)
+		}
+	}
+
+	return &ssh.ClientConfig{
+		User:            user,
+		Auth:            authMethods,
+		HostKeyCallback: hostKeyCallback,
+	}, nil
+}
@@ -1,7 +1,8 @@
 package storage
 
 import (
-	"errors"
+	"context"
+	"time"
 
 	"github.com/NilayYadav/clip/pkg/common"
 )
@@ -13,50 +14,101 @@ type ClipStorageInterface interface {
 	Cleanup() error
 }
 
+// FdReader can be implemented by storages that hold archive content in a local file, so reads can be
+// spliced straight from that file into the kernel instead of being copied through a buffer
+type FdReader interface {
+	// Fd returns the file holding the content of node at off, and the position of that content in it
+	Fd(node *common.ClipNode, off int64) (fd uintptr, pos int64, ok bool)
+}
+
+// MappedReader can be implemented by storages that map archives into memory, so reads can be served
+// from slices of the mapping instead of being read into a buffer, leaving caching to the page cache
+type MappedReader interface {
+	// Mapped returns up to length bytes of the content of node at off
+	Mapped(node *common.ClipNode, off int64, length int) ([]byte, bool)
+}
+
+// HealthChecker can be implemented by storages reading from a remote source, to check it can still be reached
+type HealthChecker interface {
+	CheckHealth(ctx context.Context) error
+}
+
+// CheckHealth checks that a storage can still read its archive, storages without a remote source always can
+func CheckHealth(ctx context.Context, s ClipStorageInterface) error {
+	if checker, ok := s.(HealthChecker); ok {
+		return checker.CheckHealth(ctx)
+	}
+	return nil
+}
+
+// CredentialsReloader can be implemented by storages that resolve credentials from files, like the
+// AWS shared credentials file, to resolve them again after the files changed
+type CredentialsReloader interface {
+	ReloadCredentials() error
+}
+
+// ReloadCredentials has a storage resolve its credentials again, if it resolved them from files
+func ReloadCredentials(s interface{}) error {
+	if reloader, ok := s.(CredentialsReloader); ok {
+		return reloader.ReloadCredentials()
+	}
+	return nil
+}
+
 type ClipStorageCredentials struct {
-	S3 *S3ClipStorageCredentials
+	S3   *S3ClipStorageCredentials
+	SFTP *SFTPClipStorageCredentials
+	HTTP *HTTPClipStorageCredentials
+
+	Proxy *ProxyConfig // Used by every backend reaching its storage over HTTP(S)
 }
 
-func NewClipStorage(archivePath string, cachePath string, metadata *common.ClipArchiveMetadata, credentials ClipStorageCredentials) (ClipStorageInterface, error) {
-	var storage ClipStorageInterface = nil
-	var storageType string
-	var err error = nil
+type ClipStorageOpts struct {
+	ArchivePath string
+	CachePath   string
+	Credentials ClipStorageCredentials
+	ReadLimits  ReadLimits
+	Mmap        bool // Map local archives into memory, see LocalClipStorageOpts
 
-	header := metadata.Header
+	// How long to wait for nearby small reads to batch into a single remote request, 0 disables batching
+	CoalesceWindow time.Duration
+}
+
+type UploadOpts struct {
+	Credentials    ClipStorageCredentials
+	ProgressChan   chan<- int
+	BytesPerSecond int64 // Caps upload bandwidth, 0 means unlimited
+	SkipExisting   bool  // Don't upload if the destination already exists, for content addressed names
+}
+
+func NewClipStorage(metadata *common.ClipArchiveMetadata, opts ClipStorageOpts) (ClipStorageInterface, error) {
+	// This is a local archive, so read straight from the file
+	if metadata.StorageInfo == nil {
+		return NewLocalClipStorage(metadata, LocalClipStorageOpts{
+			ArchivePath: opts.ArchivePath,
+			Mmap:        opts.Mmap,
+		})
+	}
 
 	// This a remote archive, so we have to load that particular storage implementation
-	if header.StorageInfoLength > 0 {
-		storageType = metadata.StorageInfo.Type()
-	} else {
-		storageType = "local"
+	backend, err := GetBackend(metadata.StorageInfo.Type())
+	if err != nil {
+		return nil, err
 	}
 
-	switch storageType {
-	case "s3":
-		storageInfo := metadata.StorageInfo.(common.S3StorageInfo)
-		opts := S3ClipStorageOpts{
-			Bucket:         storageInfo.Bucket,
-			Region:         storageInfo.Region,
-			Key:            storageInfo.Key,
-			Endpoint:       storageInfo.Endpoint,
-			ForcePathStyle: storageInfo.ForcePathStyle,
-			CachePath:      cachePath,
-			AccessKey:      credentials.S3.AccessKey,
-			SecretKey:      credentials.S3.SecretKey,
-		}
-		storage, err = NewS3ClipStorage(metadata, opts)
-	case "local":
-		opts := LocalClipStorageOpts{
-			ArchivePath: archivePath,
-		}
-		storage, err = NewLocalClipStorage(metadata, opts)
-	default:
-		err = errors.New("unsupported storage type")
+	if opener, ok := backend.(ClipStorageOpener); ok {
+		return opener.NewClipStorage(metadata, opts)
 	}
 
+	remote, err := backend.Open(context.TODO(), metadata.StorageInfo, opts)
 	if err != nil {
 		return nil, err
 	}
 
-	return storage, nil
+	s := &remoteClipStorage{remote: remote, metadata: metadata}
+	s.coalescer = newReadCoalescer(opts.CoalesceWindow, func(dest []byte, off int64) (int, error) {
+		return remote.ReadRange(context.Background(), dest, off)
+	})
+
+	return s, nil
 }
@@ -0,0 +1,50 @@
+// Package vfs defines how archives are served to filesystem frontends, independent of any fuse library.
+// Frontends only need this interface, so the same archives and caching can be exposed through go-fuse,
+// cgofuse/WinFSP or anything else that can answer path based requests.
+package vfs
+
+import (
+	"errors"
+	"time"
+
+	"github.com/NilayYadav/clip/pkg/common"
+)
+
+var (
+	ErrNotExist    = common.NewError("no such file or directory", common.ErrNotFound)
+	ErrNotDir      = errors.New("not a directory")
+	ErrIsDir       = errors.New("is a directory")
+	ErrNotSymlink  = errors.New("not a symlink")
+	ErrReadOnly    = errors.New("read-only file system")
+	ErrUnavailable = common.NewError("content unavailable", common.ErrRemoteUnavailable)
+)
+
+// Attr describes a node the way stat(2) does
+type Attr struct {
+	Ino    uint64
+	Size   uint64
+	Blocks uint64
+	Mode   uint32 // File type and permission bits
+	Nlink  uint32
+	Uid    uint32
+	Gid    uint32
+	Rdev   uint32
+	Atime  time.Time
+	Mtime  time.Time
+	Ctime  time.Time
+}
+
+type DirEntry struct {
+	Name string
+	Mode uint32
+	Ino  uint64
+}
+
+// FileSystem is a read-only filesystem. Paths are slash separated and relative to the filesystem root,
+// which is "/" or "".
+type FileSystem interface {
+	Stat(path string) (Attr, error)
+	ReadDir(path string) ([]DirEntry, error)
+	Readlink(path string) (string, error)
+	ReadFile(path string, dest []byte, off int64) (int, error)
+}
@@ -0,0 +1,220 @@
+//go:build windows
+
+// Package winfsp mounts archives on Windows through WinFSP, using cgofuse. It only depends on
+// vfs.FileSystem, so it works without cgo and without go-fuse.
+package winfsp
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"path"
+
+	"github.com/NilayYadav/clip/pkg/vfs"
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+type MountOptions struct {
+	Verbose    bool
+	VolumeName string   // Label shown by Explorer
+	Options    []string // Extra WinFSP options, e.g. -o uid=-1
+}
+
+// FileSystem adapts a vfs.FileSystem to cgofuse. Anything that would write to it fails with EROFS.
+type FileSystem struct {
+	fuse.FileSystemBase
+	fs      vfs.FileSystem
+	verbose bool
+}
+
+func NewFileSystem(fs vfs.FileSystem, verbose bool) *FileSystem {
+	return &FileSystem{fs: fs, verbose: verbose}
+}
+
+// Mount serves fs at mountPoint, a drive letter like "X:" or a directory that doesn't exist yet.
+// It blocks until the filesystem is unmounted.
+func Mount(fs vfs.FileSystem, mountPoint string, opts MountOptions) error {
+	host := fuse.NewFileSystemHost(NewFileSystem(fs, opts.Verbose))
+	host.SetCapReaddirPlus(true)
+
+	options := opts.Options
+	if opts.VolumeName != "" {
+		options = append(options, "-o", fmt.Sprintf("volname=%s", opts.VolumeName))
+	}
+	options = append(options, "-o", "ro")
+
+	if !host.Mount(mountPoint, options) {
+		return fmt.Errorf("failed to mount at %s", mountPoint)
+	}
+
+	return nil
+}
+
+func (f *FileSystem) log(format string, v ...interface{}) {
+	if f.verbose {
+		log.Printf(fmt.Sprintf("[WINFSP] %s", format), v...)
+	}
+}
+
+// errno maps vfs errors to the negated error numbers cgofuse expects
+func errno(err error) int {
+	switch {
+	case errors.Is(err, vfs.ErrNotExist):
+		return -fuse.ENOENT
+	case errors.Is(err, vfs.ErrNotDir):
+		return -fuse.ENOTDIR
+	case errors.Is(err, vfs.ErrIsDir):
+		return -fuse.EISDIR
+	case errors.Is(err, vfs.ErrNotSymlink):
+		return -fuse.EINVAL
+	case errors.Is(err, vfs.ErrReadOnly):
+		return -fuse.EROFS
+	default:
+		return -fuse.EIO
+	}
+}
+
+func fillStat(attr vfs.Attr, stat *fuse.Stat_t) {
+	stat.Ino = attr.Ino
+	stat.Mode = attr.Mode
+	stat.Nlink = attr.Nlink
+	stat.Uid = attr.Uid
+	stat.Gid = attr.Gid
+	stat.Rdev = uint64(attr.Rdev)
+	stat.Size = int64(attr.Size)
+	stat.Blocks = int64(attr.Blocks)
+	stat.Atim = fuse.NewTimespec(attr.Atime)
+	stat.Mtim = fuse.NewTimespec(attr.Mtime)
+	stat.Ctim = fuse.NewTimespec(attr.Ctime)
+	stat.Birthtim = stat.Ctim
+}
+
+func (f *FileSystem) Getattr(p string, stat *fuse.Stat_t, fh uint64) int {
+	attr, err := f.fs.Stat(p)
+	if err != nil {
+		return errno(err)
+	}
+
+	fillStat(attr, stat)
+	return 0
+}
+
+func (f *FileSystem) Open(p string, flags int) (int, uint64) {
+	f.log("Open called for %s with flags: %v", p, flags)
+	if flags&fuse.O_ACCMODE != fuse.O_RDONLY {
+		return -fuse.EROFS, ^uint64(0)
+	}
+
+	if _, err := f.fs.Stat(p); err != nil {
+		return errno(err), ^uint64(0)
+	}
+	return 0, 0
+}
+
+func (f *FileSystem) Read(p string, buff []byte, off int64, fh uint64) int {
+	n, err := f.fs.ReadFile(p, buff, off)
+	if err != nil {
+		return errno(err)
+	}
+	return n
+}
+
+func (f *FileSystem) Readlink(p string) (int, string) {
+	target, err := f.fs.Readlink(p)
+	if err != nil {
+		return errno(err), ""
+	}
+	return 0, target
+}
+
+func (f *FileSystem) Opendir(p string) (int, uint64) {
+	attr, err := f.fs.Stat(p)
+	if err != nil {
+		return errno(err), ^uint64(0)
+	}
+	if attr.Mode&fuse.S_IFMT != fuse.S_IFDIR {
+		return -fuse.ENOTDIR, ^uint64(0)
+	}
+	return 0, 0
+}
+
+func (f *FileSystem) Readdir(p string, fill func(name string, stat *fuse.Stat_t, ofst int64) bool, ofst int64, fh uint64) int {
+	entries, err := f.fs.ReadDir(p)
+	if err != nil {
+		return errno(err)
+	}
+
+	fill(".", nil, 0)
+	fill("..", nil, 0)
+	for _, entry := range entries {
+		var stat *fuse.Stat_t
+		if attr, err := f.fs.Stat(path.Join(p, entry.Name)); err == nil {
+			stat = &fuse.Stat_t{}
+			fillStat(attr, stat)
+		}
+		if !fill(entry.Name, stat, 0) {
+			break
+		}
+	}
+
+	return 0
+}
+
+func (f *FileSystem) Statfs(p string, stat *fuse.Statfs_t) int {
+	stat.Bsize = 4096
+	stat.Frsize = 4096
+	stat.Namemax = 255
+	return 0
+}
+
+func (f *FileSystem) Create(p string, flags int, mode uint32) (int, uint64) {
+	return -fuse.EROFS, ^uint64(0)
+}
+
+func (f *FileSystem) Mknod(p string, mode uint32, dev uint64) int {
+	return -fuse.EROFS
+}
+
+func (f *FileSystem) Mkdir(p string, mode uint32) int {
+	return -fuse.EROFS
+}
+
+func (f *FileSystem) Unlink(p string) int {
+	return -fuse.EROFS
+}
+
+func (f *FileSystem) Rmdir(p string) int {
+	return -fuse.EROFS
+}
+
+func (f *FileSystem) Link(oldpath string, newpath string) int {
+	return -fuse.EROFS
+}
+
+func (f *FileSystem) Symlink(target string, newpath string) int {
+	return -fuse.EROFS
+}
+
+func (f *FileSystem) Rename(oldpath string, newpath string) int {
+	return -fuse.EROFS
+}
+
+func (f *FileSystem) Chmod(p string, mode uint32) int {
+	return -fuse.EROFS
+}
+
+func (f *FileSystem) Chown(p string, uid uint32, gid uint32) int {
+	return -fuse.EROFS
+}
+
+func (f *FileSystem) Utimens(p string, tmsp []fuse.Timespec) int {
+	return -fuse.EROFS
+}
+
+func (f *FileSystem) Truncate(p string, size int64, fh uint64) int {
+	return -fuse.EROFS
+}
+
+func (f *FileSystem) Write(p string, buff []byte, off int64, fh uint64) int {
+	return -fuse.EROFS
+}